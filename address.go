@@ -2,6 +2,10 @@ package dsn
 
 import (
 	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
 
 	"golang.org/x/net/idna"
 	"golang.org/x/text/unicode/norm"
@@ -33,6 +37,10 @@ func toASCII(addr string) (string, error) {
 	if err != nil {
 		return addr, err
 	}
+	if aDomain == domain && len(addr) == len(mbox)+1+len(domain) {
+		// Already in the A-label form.
+		return addr, nil
+	}
 
 	return mbox + "@" + aDomain, nil
 }
@@ -68,6 +76,78 @@ func addrSelectIDNA(ulabel bool, addr string) (string, error) {
 	return toASCII(addr)
 }
 
+// addressField returns the type and the value of an address field such as
+// Final-Recipient. Without utf8, addresses with a Unicode local-part cannot
+// be converted to the ACE form and are downgraded as described by RFC 6857
+// instead: they are written with the "utf-8" type in the utf-8-addr-xtext
+// form of RFC 6533.
+func addressField(utf8 bool, addr string) (string, string, error) {
+	converted, err := addrSelectIDNA(utf8, addr)
+	if err == ErrUnicodeMailbox {
+		uAddr, err := toUnicode(addr)
+		if err != nil {
+			return "", addr, err
+		}
+		return "utf-8", encodeAddrXtext(uAddr), nil
+	}
+	return addressType(utf8), converted, err
+}
+
+// encodeAddrXtext encodes addr as utf-8-addr-xtext, RFC 6533 section 3.
+// Non-ASCII characters, controls, space, '+', '=' and '\' are written as
+// "\x{HEX}".
+func encodeAddrXtext(addr string) string {
+	var b strings.Builder
+	for _, r := range addr {
+		if r > 0x20 && r < 0x7f && r != '+' && r != '=' && r != '\\' {
+			b.WriteRune(r)
+			continue
+		}
+		fmt.Fprintf(&b, "\\x{%02X}", r)
+	}
+	return b.String()
+}
+
+// decodeAddrXtext decodes utf-8-addr-xtext, see encodeAddrXtext. Malformed
+// escapes are kept as is.
+func decodeAddrXtext(s string) string {
+	if !strings.Contains(s, "\\x{") {
+		return s
+	}
+	var b strings.Builder
+	for {
+		i := strings.Index(s, "\\x{")
+		if i == -1 {
+			break
+		}
+		j := strings.IndexByte(s[i:], '}')
+		if j == -1 {
+			break
+		}
+		r, err := strconv.ParseUint(s[i+3:i+j], 16, 32)
+		if err != nil || j == 3 || j > 9 {
+			b.WriteString(s[:i+3])
+			s = s[i+3:]
+			continue
+		}
+		b.WriteString(s[:i])
+		b.WriteRune(rune(r))
+		s = s[i+j+1:]
+	}
+	b.WriteString(s)
+	return b.String()
+}
+
+// splitAddress returns the address of an address field, decoding the
+// utf-8-addr-xtext form of the "utf-8" type.
+func splitAddress(v string) string {
+	typ, addr := splitTyped(v)
+	if typ == "utf-8" {
+		return decodeAddrXtext(addr)
+	}
+	return addr
+}
+
 // dnsSelectIDNA is a convenience function for encoding to/from Punycode.
 //
 // If ulabel is true, it returns U-label encoded domain in the Unicode NFC
@@ -80,3 +160,32 @@ func dnsSelectIDNA(ulabel bool, domain string) (string, error) {
 	}
 	return idna.ToASCII(domain)
 }
+
+// mtaName returns the type and the value of an MTA name field. Names of type
+// "dns", the default, are converted with dnsSelectIDNA unless they are
+// address literals such as "[192.0.2.1]", which are written as is.
+func mtaName(ulabel bool, typ, name string) (string, string, error) {
+	if typ == "" || strings.EqualFold(typ, "dns") {
+		if isAddressLiteral(name) {
+			return "dns", name, nil
+		}
+		name, err := dnsSelectIDNA(ulabel, name)
+		return "dns", name, err
+	}
+	return typ, name, nil
+}
+
+// isAddressLiteral reports whether name is an IPv4 or IPv6 address literal
+// as defined by RFC 5321 section 4.1.3, e.g. "[IPv6:2001:db8::1]".
+func isAddressLiteral(name string) bool {
+	if len(name) < 2 || name[0] != '[' || name[len(name)-1] != ']' {
+		return false
+	}
+	addr := name[1 : len(name)-1]
+	if len(addr) > 5 && strings.EqualFold(addr[:5], "IPv6:") {
+		ip := net.ParseIP(addr[5:])
+		return ip != nil && strings.Contains(addr[5:], ":")
+	}
+	ip := net.ParseIP(addr)
+	return ip != nil && ip.To4() != nil && !strings.Contains(addr, ":")
+}
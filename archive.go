@@ -0,0 +1,73 @@
+package dsn
+
+import (
+	"bytes"
+	"io"
+)
+
+// ArchiveTransport is a Transport keeping a copy of every DSN, alongside or
+// instead of sending it, e.g. in an IMAP folder for an audit trail. With
+// github.com/emersion/go-imap:
+//
+//	t := &dsn.ArchiveTransport{
+//		Transport: relay,
+//		Archive: func(msg []byte) error {
+//			return c.Append("Bounces/Sent", []string{imap.SeenFlag}, time.Now(), bytes.NewBuffer(msg))
+//		},
+//	}
+type ArchiveTransport struct {
+	// Transport sends the DSNs, if nil they are only archived.
+	Transport Transport
+	// Archive is called with the complete message once it was sent, with
+	// CRLF line endings.
+	Archive func(msg []byte) error
+}
+
+// ArchiveError is returned by ArchiveTransport if a DSN was sent but could
+// not be archived. The DSN must not be sent again, Sender does not retry
+// it.
+type ArchiveError struct {
+	Err error
+}
+
+func (err *ArchiveError) Error() string {
+	return "dsn: sent but not archived: " + err.Err.Error()
+}
+
+// Send implements Transport.
+func (t *ArchiveTransport) Send(from string, to []string, write func(w io.Writer) error) error {
+	var buf bytes.Buffer
+	if err := write(&buf); err != nil {
+		return err
+	}
+	// Use the line endings of the SMTP transaction, IMAP servers may
+	// reject bare LF.
+	msg := toCRLF(buf.Bytes())
+
+	if t.Transport == nil {
+		return t.Archive(msg)
+	}
+	err := t.Transport.Send(from, to, func(w io.Writer) error {
+		_, err := w.Write(msg)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if err := t.Archive(msg); err != nil {
+		return &ArchiveError{Err: err}
+	}
+	return nil
+}
+
+// toCRLF replaces bare LF line endings in b with CRLF.
+func toCRLF(b []byte) []byte {
+	out := make([]byte, 0, len(b)+bytes.Count(b, []byte{'\n'}))
+	for i, c := range b {
+		if c == '\n' && (i == 0 || b[i-1] != '\r') {
+			out = append(out, '\r')
+		}
+		out = append(out, c)
+	}
+	return out
+}
@@ -0,0 +1,137 @@
+package dsn
+
+import (
+	"io"
+	"mime"
+	"mime/quotedprintable"
+	"net/mail"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/emersion/go-message/textproto"
+)
+
+// replaceNonASCII replaces all non-ASCII characters of s with '?'.
+func replaceNonASCII(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= utf8.RuneSelf {
+			return '?'
+		}
+		return r
+	}, s)
+}
+
+// isASCII reports whether s only contains ASCII characters.
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+// needsUTF8 reports whether the envelope or an address of a DSN contains
+// non-ASCII characters, see Generator.AutoDetectUTF8.
+func needsUTF8(envelope Envelope, mtaInfo ReportingMTAInfo, rcptsInfo []RecipientInfo) bool {
+	if !isASCII(envelope.From) || !isASCII(envelope.To) || !isASCII(mtaInfo.XSender) {
+		return true
+	}
+	for _, rcpt := range rcptsInfo {
+		if !isASCII(rcpt.FinalRecipient) || !isASCII(rcpt.OriginalRecipient) {
+			return true
+		}
+	}
+	return false
+}
+
+// headerNeedsUTF8 reports whether a field of h contains non-ASCII
+// characters.
+func headerNeedsUTF8(h textproto.Header) bool {
+	for f := h.Fields(); f.Next(); {
+		if !isASCII(f.Key()) || !isASCII(f.Value()) {
+			return true
+		}
+	}
+	return false
+}
+
+// encodeSubject encodes a non-ASCII subject as RFC 2047 encoded-words.
+func encodeSubject(subject string) string {
+	return mime.QEncoding.Encode("utf-8", subject)
+}
+
+// encodeAddressList encodes the non-ASCII display names of the From or To
+// field value v as RFC 2047 encoded-words. Values that are ASCII already or
+// cannot be parsed are returned as is.
+func encodeAddressList(v string) string {
+	if isASCII(v) {
+		return v
+	}
+	addrs, err := mail.ParseAddressList(v)
+	if err != nil {
+		return v
+	}
+	out := make([]string, len(addrs))
+	for i, addr := range addrs {
+		// String encodes non-ASCII names.
+		out[i] = addr.String()
+	}
+	return strings.Join(out, ", ")
+}
+
+// asciiHeader returns a copy of h with all non-ASCII characters of the
+// values replaced with '?'.
+func asciiHeader(h textproto.Header) textproto.Header {
+	out := textproto.Header{}
+	forEachField(h, func(k, v string) {
+		out.Add(k, replaceNonASCII(v))
+	})
+	return out
+}
+
+// asciiWriter replaces every non-ASCII character written to it with '?'.
+//
+// An incomplete UTF-8 sequence at the end of a Write is kept until the next
+// one, a trailing incomplete sequence at the end of the output is dropped.
+type asciiWriter struct {
+	w       io.Writer
+	pending []byte
+	buf     []byte
+}
+
+func (aw *asciiWriter) Write(b []byte) (int, error) {
+	p := append(aw.pending, b...)
+	aw.pending = aw.pending[:0]
+	out := aw.buf[:0]
+	for len(p) > 0 {
+		if p[0] < utf8.RuneSelf {
+			out = append(out, p[0])
+			p = p[1:]
+			continue
+		}
+		if !utf8.FullRune(p) {
+			aw.pending = append(aw.pending, p...)
+			break
+		}
+		_, size := utf8.DecodeRune(p)
+		out = append(out, '?')
+		p = p[size:]
+	}
+	aw.buf = out
+	if _, err := aw.w.Write(out); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// textBodyWriter returns the writer for the body of a text part and a
+// function finishing it. The body is quoted-printable encoded for
+// Generator.SevenBit.
+func textBodyWriter(p *Profile, w io.Writer) (io.Writer, func() error) {
+	if !p.sevenBit {
+		return w, func() error { return nil }
+	}
+	qp := quotedprintable.NewWriter(w)
+	return qp, qp.Close
+}
@@ -0,0 +1,87 @@
+package dsn
+
+import (
+	"bytes"
+	"context"
+	"sync"
+
+	"github.com/emersion/go-message/textproto"
+)
+
+// Job is a DSN to be generated by GenerateDSNs or sent by Sender.
+type Job struct {
+	// ID is copied to the Result and names the files of DeadLetterDir.
+	ID string
+	// Priority is used by PriorityQueue.
+	Priority Priority
+
+	UTF8         bool
+	Envelope     Envelope
+	MTAInfo      ReportingMTAInfo
+	Recipients   []RecipientInfo
+	FailedHeader textproto.Header
+}
+
+// Result is the outcome of a Job.
+type Result struct {
+	Job    Job
+	Header textproto.Header
+	Body   []byte
+	// Err is set if the DSN could not be generated, Header and Body are
+	// empty then.
+	Err error
+}
+
+// GenerateDSNs generates the DSNs for all jobs received from jobs using the
+// given number of workers and sends the results to results, e.g. to bounce
+// all messages of a stuck queue at once. Results are sent in no particular
+// order, a slow consumer blocks the workers.
+//
+// It returns when jobs is closed and all results were sent or when ctx is
+// done, in which case ctx.Err() is returned. results is not closed.
+func GenerateDSNs(ctx context.Context, jobs <-chan Job, results chan<- Result, workers int) error {
+	return (&Generator{}).GenerateDSNs(ctx, jobs, results, workers)
+}
+
+// GenerateDSNs is like the GenerateDSNs function but uses the configuration
+// of g. g.Rand must be safe for concurrent use if workers is larger than 1.
+func (g *Generator) GenerateDSNs(ctx context.Context, jobs <-chan Job, results chan<- Result, workers int) error {
+	if workers < 1 {
+		workers = 1
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for {
+				var job Job
+				var ok bool
+				select {
+				case <-ctx.Done():
+					return
+				case job, ok = <-jobs:
+					if !ok {
+						return
+					}
+				}
+
+				res := Result{Job: job}
+				var body bytes.Buffer
+				res.Header, res.Err = g.Generate(job.UTF8, job.Envelope, job.MTAInfo, job.Recipients, job.FailedHeader, &body)
+				if res.Err == nil {
+					res.Body = body.Bytes()
+				}
+
+				select {
+				case <-ctx.Done():
+					return
+				case results <- res:
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	return ctx.Err()
+}
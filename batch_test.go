@@ -0,0 +1,77 @@
+package dsn
+
+import (
+	"context"
+	"strconv"
+	"testing"
+
+	"github.com/emersion/go-smtp"
+)
+
+func TestGenerateDSNs(t *testing.T) {
+	jobs := make(chan Job)
+	results := make(chan Result)
+	done := make(chan error, 1)
+	go func() {
+		done <- GenerateDSNs(context.Background(), jobs, results, 4)
+		close(results)
+	}()
+
+	const n = 50
+	go func() {
+		for i := 0; i < n; i++ {
+			job := Job{
+				ID:      strconv.Itoa(i),
+				MTAInfo: ReportingMTAInfo{ReportingMTA: "mx.example.org"},
+				Recipients: []RecipientInfo{{
+					FinalRecipient: "rcpt@example.com",
+					Action:         ActionFailed,
+					Status:         smtp.EnhancedCode{5, 1, 1},
+				}},
+			}
+			if i%10 == 0 {
+				// Invalid, the Reporting-MTA is missing.
+				job.MTAInfo = ReportingMTAInfo{}
+			}
+			jobs <- job
+		}
+		close(jobs)
+	}()
+
+	seen := map[string]bool{}
+	failed := 0
+	for res := range results {
+		seen[res.Job.ID] = true
+		if res.Err != nil {
+			failed++
+			continue
+		}
+		if len(res.Body) == 0 || res.Header.Get("Content-Type") == "" {
+			t.Errorf("job %s: empty result", res.Job.ID)
+		}
+	}
+	if err := <-done; err != nil {
+		t.Errorf("GenerateDSNs() = %v", err)
+	}
+	if len(seen) != n {
+		t.Errorf("got results for %d jobs, want %d", len(seen), n)
+	}
+	if failed != n/10 {
+		t.Errorf("%d jobs failed, want %d", failed, n/10)
+	}
+}
+
+func TestGenerateDSNsCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	jobs := make(chan Job, 1)
+	jobs <- Job{MTAInfo: ReportingMTAInfo{ReportingMTA: "mx.example.org"}}
+
+	// Nobody reads the results, the worker blocks until ctx is canceled.
+	results := make(chan Result)
+	done := make(chan error, 1)
+	go func() { done <- GenerateDSNs(ctx, jobs, results, 2) }()
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Errorf("GenerateDSNs() = %v, want %v", err, context.Canceled)
+	}
+}
@@ -0,0 +1,158 @@
+package dsn
+
+import (
+	"errors"
+	"io"
+
+	"github.com/emersion/go-message/textproto"
+)
+
+// Builder assembles a DSN step by step, as an alternative to the positional
+// arguments of GenerateDSN:
+//
+//	h, err := dsn.New().
+//		From("MAILER-DAEMON@mx.example.org").
+//		To("sender@example.org").
+//		ReportingMTA("mx.example.org").
+//		AddRecipient(rcpt).
+//		Header(failedHeader).
+//		Build(w)
+//
+// The header fields are validated as they are set. The first error is kept,
+// later steps are ignored and Build returns it without writing anything.
+// The per-message and per-recipient fields are validated by Build, with the
+// final UTF8 setting and the defaults of the Generator applied.
+type Builder struct {
+	g        *Generator
+	utf8     bool
+	envelope Envelope
+	mtaInfo  ReportingMTAInfo
+	rcpts    []RecipientInfo
+	header   textproto.Header
+	err      error
+}
+
+// New returns a Builder using the zero Generator.
+func New() *Builder {
+	return &Builder{g: &Generator{}}
+}
+
+// Generator sets the Generator used by Build, e.g. to select a Profile.
+func (b *Builder) Generator(g *Generator) *Builder {
+	if b.err == nil && g == nil {
+		b.err = errors.New("dsn: Generator is nil")
+	}
+	if b.err == nil {
+		b.g = g
+	}
+	return b
+}
+
+// UTF8 enables the internationalized DSN format of RFC 6533.
+func (b *Builder) UTF8(utf8 bool) *Builder {
+	b.utf8 = utf8
+	return b
+}
+
+// From sets the From field of the DSN.
+func (b *Builder) From(from string) *Builder {
+	if b.err == nil {
+		b.err = checkHeaderValue("From", from)
+	}
+	if b.err == nil {
+		b.envelope.From = from
+	}
+	return b
+}
+
+// To sets the To field of the DSN, usually the sender of the failed message.
+func (b *Builder) To(to string) *Builder {
+	if b.err == nil {
+		b.err = checkHeaderValue("To", to)
+	}
+	if b.err == nil {
+		b.envelope.To = to
+	}
+	return b
+}
+
+// MessageID sets the Message-Id field of the DSN.
+func (b *Builder) MessageID(msgID string) *Builder {
+	if b.err == nil {
+		b.err = checkHeaderValue("Message-Id", msgID)
+	}
+	if b.err == nil {
+		b.envelope.MsgID = msgID
+	}
+	return b
+}
+
+// Language sets the language of the DSN, see Envelope.Language.
+func (b *Builder) Language(lang string) *Builder {
+	b.envelope.Language = lang
+	return b
+}
+
+// AddField adds a field to the message header of the DSN, see
+// Envelope.Header.
+func (b *Builder) AddField(key, value string) *Builder {
+	h := textproto.Header{}
+	h.Add(key, value)
+	if b.err == nil {
+		b.err = checkExtraFields(h)
+	}
+	if b.err == nil {
+		b.err = checkHeaderValue(canonicalKey(key), value)
+	}
+	if b.err == nil {
+		b.envelope.Header.Add(key, value)
+	}
+	return b
+}
+
+// ReportingMTA sets the name of the MTA generating the DSN. Other fields of
+// the per-message block set with MTAInfo are kept.
+func (b *Builder) ReportingMTA(name string) *Builder {
+	info := b.mtaInfo
+	info.ReportingMTA = name
+	return b.MTAInfo(info)
+}
+
+// MTAInfo sets all fields of the per-message block.
+func (b *Builder) MTAInfo(info ReportingMTAInfo) *Builder {
+	b.mtaInfo = info
+	return b
+}
+
+// AddRecipient adds a per-recipient block.
+func (b *Builder) AddRecipient(rcpt RecipientInfo) *Builder {
+	b.rcpts = append(b.rcpts, rcpt)
+	return b
+}
+
+// Header sets the header of the failed message returned in the DSN.
+func (b *Builder) Header(h textproto.Header) *Builder {
+	b.header = h
+	return b
+}
+
+// Err returns the first error of the previous steps. Errors of the
+// per-message and per-recipient fields are only returned by Build.
+func (b *Builder) Err() error {
+	return b.err
+}
+
+// Build generates the DSN like Generator.Generate, writing the body to w and
+// returning the header.
+func (b *Builder) Build(w io.Writer) (textproto.Header, error) {
+	if b.err != nil {
+		return textproto.Header{}, b.err
+	}
+	if len(b.rcpts) == 0 {
+		return textproto.Header{}, errors.New("dsn: at least one recipient is required")
+	}
+	if err := b.g.checkStatus(b.utf8, b.envelope, b.mtaInfo, b.rcpts, b.header); err != nil {
+		return textproto.Header{}, err
+	}
+	return b.g.Generate(b.utf8, b.envelope, b.mtaInfo, b.rcpts, b.header, w)
+}
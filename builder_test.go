@@ -0,0 +1,115 @@
+package dsn_test
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-smtp"
+	dsn "schneider.vip/go-dsn"
+)
+
+func TestBuilder(t *testing.T) {
+	rcpt := dsn.RecipientInfo{FinalRecipient: "rcpt@example.com", Action: dsn.ActionFailed, Status: smtp.EnhancedCode{5, 1, 1}}
+	failedHeader := textproto.Header{}
+	failedHeader.Add("Subject", "Hello")
+
+	var body bytes.Buffer
+	h, err := dsn.New().
+		From("MAILER-DAEMON@mx.example.org").
+		To("sender@example.org").
+		MessageID("<dsn@mx.example.org>").
+		ReportingMTA("mx.example.org").
+		AddRecipient(rcpt).
+		Header(failedHeader).
+		Build(&body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := h.Get("To"); got != "sender@example.org" {
+		t.Errorf("To = %q", got)
+	}
+	for _, want := range []string{"Reporting-Mta: dns; mx.example.org", "Final-Recipient: rfc822; rcpt@example.com", "Subject: Hello"} {
+		if !strings.Contains(body.String(), want) {
+			t.Errorf("body does not contain %q:\n%s", want, body.String())
+		}
+	}
+}
+
+func TestBuilderErrors(t *testing.T) {
+	rcpt := dsn.RecipientInfo{FinalRecipient: "rcpt@example.com", Action: dsn.ActionFailed, Status: smtp.EnhancedCode{5, 1, 1}}
+
+	b := dsn.New().To("a@example.org\r\nBcc: b@example.org").ReportingMTA("mx.example.org").AddRecipient(rcpt)
+	var valueErr *dsn.HeaderValueError
+	if !errors.As(b.Err(), &valueErr) {
+		t.Errorf("Err() = %v, want a HeaderValueError", b.Err())
+	}
+	var body bytes.Buffer
+	if _, err := b.Build(&body); err != b.Err() || body.Len() != 0 {
+		t.Errorf("Build() = %v and wrote %d bytes, want the first error and no output", err, body.Len())
+	}
+
+	for name, b := range map[string]*dsn.Builder{
+		"no Reporting-MTA": dsn.New().AddRecipient(rcpt),
+		"no recipients":    dsn.New().ReportingMTA("mx.example.org"),
+		"no Status":        dsn.New().ReportingMTA("mx.example.org").AddRecipient(dsn.RecipientInfo{FinalRecipient: "rcpt@example.com", Action: dsn.ActionFailed}),
+	} {
+		if _, err := b.Build(&bytes.Buffer{}); err == nil {
+			t.Errorf("%s: Build() succeeded", name)
+		}
+	}
+}
+
+func TestBuilderValidatesOnBuild(t *testing.T) {
+	rcpt := dsn.RecipientInfo{FinalRecipient: "jörg@bücher.example", Action: dsn.ActionFailed, Status: smtp.EnhancedCode{5, 1, 1}}
+
+	// The per-message block is complete only after ReportingMTA, UTF8 is
+	// set last.
+	b := dsn.New().
+		MTAInfo(dsn.ReportingMTAInfo{XSender: "sender@example.org"}).
+		AddRecipient(rcpt).
+		ReportingMTA("mx.example.org").
+		UTF8(true)
+	if err := b.Err(); err != nil {
+		t.Fatalf("Err() = %v before Build", err)
+	}
+	var body bytes.Buffer
+	if _, err := b.Build(&body); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"message/global-delivery-status", "Final-Recipient: utf8; jörg@bücher.example", "X-Godsn-Sender: utf8; sender@example.org"} {
+		if !strings.Contains(body.String(), want) {
+			t.Errorf("body does not contain %q:\n%s", want, body.String())
+		}
+	}
+}
+
+func TestExtraHeaderFields(t *testing.T) {
+	rcpt := dsn.RecipientInfo{FinalRecipient: "rcpt@example.com", Action: dsn.ActionFailed, Status: smtp.EnhancedCode{5, 1, 1}}
+
+	h, err := dsn.New().
+		ReportingMTA("mx.example.org").
+		AddRecipient(rcpt).
+		AddField("X-Queue-Id", "q1").
+		AddField("Organization", "Example").
+		Build(&bytes.Buffer{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.Get("X-Queue-Id") != "q1" || h.Get("Organization") != "Example" {
+		t.Errorf("extra fields missing: X-Queue-Id = %q, Organization = %q", h.Get("X-Queue-Id"), h.Get("Organization"))
+	}
+
+	extra := textproto.Header{}
+	extra.Add("Content-Type", "text/plain")
+	_, err = dsn.GenerateDSN(false, dsn.Envelope{Header: extra}, dsn.ReportingMTAInfo{ReportingMTA: "mx.example.org"}, []dsn.RecipientInfo{rcpt}, textproto.Header{}, &bytes.Buffer{})
+	var reservedErr *dsn.ReservedFieldError
+	if !errors.As(err, &reservedErr) || reservedErr.Field != "Content-Type" {
+		t.Errorf("GenerateDSN() = %v, want a ReservedFieldError for Content-Type", err)
+	}
+	if err := dsn.New().AddField("subject", "x").Err(); !errors.As(err, &reservedErr) {
+		t.Errorf("AddField(subject) = %v, want a ReservedFieldError", err)
+	}
+}
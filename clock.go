@@ -0,0 +1,62 @@
+package dsn
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"time"
+)
+
+// Clock is the source of the current time. Everything in this package that
+// needs the time takes a Clock so that tests can fix it.
+type Clock interface {
+	Now() time.Time
+}
+
+// ClockFunc adapts an ordinary function to the Clock interface.
+type ClockFunc func() time.Time
+
+func (f ClockFunc) Now() time.Time {
+	return f()
+}
+
+// FixedClock returns a Clock that always reports t.
+func FixedClock(t time.Time) Clock {
+	return ClockFunc(func() time.Time { return t })
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+// SystemClock reports the current wall clock time. It is used when no Clock
+// is set.
+var SystemClock Clock = systemClock{}
+
+func clockOrDefault(c Clock) Clock {
+	if c == nil {
+		return SystemClock
+	}
+	return c
+}
+
+// Random data (MIME boundaries, identifiers) is read from an io.Reader which
+// defaults to crypto/rand.Reader. A seeded math/rand.Rand can be used instead
+// to get reproducible output in tests.
+func randOrDefault(r io.Reader) io.Reader {
+	if r == nil {
+		return rand.Reader
+	}
+	return r
+}
+
+// randomHex reads n bytes from r and returns them hex-encoded.
+func randomHex(r io.Reader, n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := io.ReadFull(randOrDefault(r), b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
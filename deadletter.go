@@ -0,0 +1,104 @@
+package dsn
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// DeadLetterSink receives the DSNs Sender gave up on, together with the
+// error of the last attempt. msg is the message as handed to the Transport,
+// nil if no DSN could be generated for job.
+type DeadLetterSink interface {
+	DeadLetter(job Job, msg []byte, reason error) error
+}
+
+// DeadLetterFunc adapts a function to DeadLetterSink.
+type DeadLetterFunc func(job Job, msg []byte, reason error) error
+
+// DeadLetter implements DeadLetterSink.
+func (f DeadLetterFunc) DeadLetter(job Job, msg []byte, reason error) error {
+	return f(job, msg, reason)
+}
+
+// DeadLetterDir is a DeadLetterSink writing each DSN to a file in Dir, as it
+// was handed to the Transport. The file is named after Job.ID, or a random
+// name if it is empty, with the ".eml" extension. The reason is added in an
+// X-Dead-Letter-Reason field before the message header.
+//
+// Files are synced before they are renamed into place, so a crash leaves
+// either the complete message or none. Dir is synced after the rename, so
+// a DSN is on disk once DeadLetter returns.
+type DeadLetterDir struct {
+	Dir string
+}
+
+// DeadLetter implements DeadLetterSink. It fails if no DSN was generated.
+func (d DeadLetterDir) DeadLetter(job Job, msg []byte, reason error) error {
+	if msg == nil {
+		return errors.New("dsn: no DSN was generated")
+	}
+	name := deadLetterName(job.ID)
+	if name == "" {
+		var err error
+		if name, err = randomHex(nil, 16); err != nil {
+			return err
+		}
+	}
+
+	// Write to a temporary file first so that readers of Dir never see a
+	// partial message.
+	f, err := ioutil.TempFile(d.Dir, ".tmp-"+name)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	field := "X-Dead-Letter-Reason: " + strings.Join(strings.Fields(reason.Error()), " ") + "\r\n"
+	if _, err := io.WriteString(f, field); err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := f.Write(msg); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(f.Name(), filepath.Join(d.Dir, name+".eml")); err != nil {
+		return err
+	}
+	return syncDir(d.Dir)
+}
+
+// syncDir syncs the directory dir so that renames into it are durable.
+func syncDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// deadLetterName returns id with all characters not safe in file names
+// replaced with '_'.
+func deadLetterName(id string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_', r == '.':
+			return r
+		}
+		return '_'
+	}, strings.TrimLeft(id, "."))
+}
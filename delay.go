@@ -0,0 +1,38 @@
+package dsn
+
+import (
+	"io"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-smtp"
+)
+
+// GenerateDelayWarning generates a delayed DSN, a warning that delivery to
+// rcptsInfo is still being retried until retryUntil, with DelayedProfile.
+//
+// Action is set to ActionDelayed for all recipients. Status is set to 4.0.0
+// unless it already is a 4.x.x code and WillRetryUntil is set to retryUntil
+// unless it is already set.
+func GenerateDelayWarning(utf8 bool, envelope Envelope, mtaInfo ReportingMTAInfo, rcptsInfo []RecipientInfo, retryUntil time.Time, failedHeader textproto.Header, outWriter io.Writer) (textproto.Header, error) {
+	return (&Generator{}).GenerateDelayWarning(utf8, envelope, mtaInfo, rcptsInfo, retryUntil, failedHeader, outWriter)
+}
+
+// GenerateDelayWarning is like the GenerateDelayWarning function but uses
+// the configuration of g. g.Profile is used instead of DelayedProfile if it
+// is set.
+func (g *Generator) GenerateDelayWarning(utf8 bool, envelope Envelope, mtaInfo ReportingMTAInfo, rcptsInfo []RecipientInfo, retryUntil time.Time, failedHeader textproto.Header, outWriter io.Writer) (textproto.Header, error) {
+	delayed := make([]RecipientInfo, len(rcptsInfo))
+	for i, rcpt := range rcptsInfo {
+		rcpt.Action = ActionDelayed
+		if rcpt.Status[0] != 4 {
+			rcpt.Status = smtp.EnhancedCode{4, 0, 0}
+		}
+		if rcpt.WillRetryUntil.IsZero() {
+			rcpt.WillRetryUntil = retryUntil
+		}
+		delayed[i] = rcpt
+	}
+
+	return g.withDefaultProfile(DelayedProfile).Generate(utf8, envelope, mtaInfo, delayed, failedHeader, outWriter)
+}
@@ -0,0 +1,94 @@
+package dsn_test
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-smtp"
+	dsn "schneider.vip/go-dsn"
+)
+
+func TestGenerateDelayWarning(t *testing.T) {
+	until := time.Date(2020, 4, 19, 10, 0, 0, 0, time.UTC)
+	failedHeader := textproto.Header{}
+	failedHeader.Add("Subject", "Quarterly report")
+
+	var body bytes.Buffer
+	hdr, err := dsn.GenerateDelayWarning(false, dsn.Envelope{
+		MsgID: "<warning@example.org>",
+		From:  "MAILER-DAEMON@example.org",
+		To:    "sender@example.org",
+	}, dsn.ReportingMTAInfo{ReportingMTA: "mx.example.org"}, []dsn.RecipientInfo{
+		{FinalRecipient: "a@example.net"},
+		{
+			FinalRecipient: "b@example.net",
+			Status:         smtp.EnhancedCode{4, 4, 1},
+			DiagnosticCode: errors.New("connection timed out"),
+		},
+		{FinalRecipient: "c@example.net", Status: smtp.EnhancedCode{5, 1, 1}},
+	}, until, failedHeader, &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := hdr.Get("Subject"); got != dsn.DefaultDelayedSubject {
+		t.Errorf("Subject = %q", got)
+	}
+	if !strings.Contains(body.String(), "THIS IS A WARNING ONLY") {
+		t.Errorf("body does not contain the delay wording:\n%s", body.String())
+	}
+
+	var msg bytes.Buffer
+	if err := textproto.WriteHeader(&msg, hdr); err != nil {
+		t.Fatal(err)
+	}
+	msg.Write(body.Bytes())
+	report, err := dsn.ParseDSN(&msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []smtp.EnhancedCode{{4, 0, 0}, {4, 4, 1}, {4, 0, 0}}
+	for i, rcpt := range report.Recipients {
+		if rcpt.Action != dsn.ActionDelayed || rcpt.Status != want[i] || !rcpt.WillRetryUntil.Equal(until) {
+			t.Errorf("recipient %d: Action %v, Status %v, Will-Retry-Until %v", i, rcpt.Action, rcpt.Status, rcpt.WillRetryUntil)
+		}
+	}
+}
+
+func TestGenerateDSNDelayed(t *testing.T) {
+	until := time.Date(2020, 4, 19, 10, 0, 0, 0, time.UTC)
+	delayed := dsn.RecipientInfo{
+		FinalRecipient: "a@example.net",
+		Action:         dsn.ActionDelayed,
+		Status:         smtp.EnhancedCode{4, 4, 1},
+		WillRetryUntil: until,
+	}
+	failed := dsn.RecipientInfo{
+		FinalRecipient: "b@example.net",
+		Action:         dsn.ActionFailed,
+		Status:         smtp.EnhancedCode{5, 1, 1},
+	}
+
+	for _, test := range []struct {
+		rcpts   []dsn.RecipientInfo
+		subject string
+	}{
+		{[]dsn.RecipientInfo{delayed}, dsn.DefaultDelayedSubject},
+		{[]dsn.RecipientInfo{delayed, failed}, dsn.DefaultProfile.Subject},
+	} {
+		var body bytes.Buffer
+		hdr, err := dsn.GenerateDSN(false, dsn.Envelope{}, dsn.ReportingMTAInfo{ReportingMTA: "mx.example.org"}, test.rcpts, textproto.Header{}, &body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := hdr.Get("Subject"); got != test.subject {
+			t.Errorf("%d recipients: Subject = %q, want %q", len(test.rcpts), got, test.subject)
+		}
+		if !strings.Contains(body.String(), "Will-Retry-Until: Sun, 19 Apr 2020 10:00:00 +0000\r\n") {
+			t.Errorf("%d recipients: Will-Retry-Until is missing:\n%s", len(test.rcpts), body.String())
+		}
+	}
+}
@@ -1,6 +1,7 @@
 // Package dsn contains the utilities used for dsn message (DSN) generation.
 //
 // It implements RFC 3464 and RFC 3462.
+// Message disposition notifications (RFC 8098) are generated by GenerateMDN.
 package dsn
 
 import (
@@ -8,13 +9,15 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"mime"
 	"strings"
 	"text/template"
 	"time"
 
 	"github.com/emersion/go-message/textproto"
 	"github.com/emersion/go-smtp"
-	"github.com/mschneider82/go-smtp/smtpclient"
+	"golang.org/x/text/language"
 )
 
 const xMTADefaultName = "Godsn"
@@ -23,6 +26,12 @@ type ReportingMTAInfo struct {
 	ReportingMTA    string
 	ReceivedFromMTA string
 
+	// ReportingMTAType and ReceivedFromMTAType are the MTA name types of
+	// ReportingMTA and ReceivedFromMTA, "dns" if empty. Only dns names are
+	// converted to A- or U-labels, others are written as is.
+	ReportingMTAType    string
+	ReceivedFromMTAType string
+
 	// XMTAName if empty it defaults to Godsn, and is used as MTA name in
 	// the X-HeaderKey (e.g. X-Godsn-Sender) - rfc3464 section 2.4
 	XMTAName string
@@ -38,23 +47,41 @@ type ReportingMTAInfo struct {
 
 	// Time when message delivery was attempted last time.
 	LastAttemptDate time.Time
+
+	// ExtensionFields are written to the end of the per-message block as
+	// is, e.g. DSN-Gateway or vendor fields. ParseDSN returns the fields it
+	// does not know here.
+	ExtensionFields textproto.Header
+
+	// dateLayout is used by FormatDate, set from the Generator.
+	dateLayout string
+
+	// xMsgIDField is the name of the XMessageID field after the X-MTA
+	// prefix, set from the Profile.
+	xMsgIDField string
 }
 
 func (info ReportingMTAInfo) WriteTo(utf8 bool, w io.Writer) error {
-	// DSN format uses structure similar to MIME header, so we reuse
-	// MIME generator here.
-	h := textproto.Header{}
+	// DSN format uses structure similar to MIME header, fieldWriter
+	// produces the same output as the MIME generator.
+	fw := getFieldWriter()
+	defer putFieldWriter(fw)
 
 	if info.ReportingMTA == "" {
 		return errors.New("dsn: Reporting-MTA field is mandatory")
 	}
+	if err := writeExtensionFields(fw, info.ExtensionFields); err != nil {
+		return err
+	}
 
-	reportingMTA, err := dnsSelectIDNA(utf8, info.ReportingMTA)
+	typ, reportingMTA, err := mtaName(utf8, info.ReportingMTAType, info.ReportingMTA)
 	if err != nil {
 		return fmt.Errorf("dsn: cannot convert Reporting-MTA to a suitable representation: %w", err)
 	}
 
-	h.Add("Reporting-MTA", "dns; "+reportingMTA)
+	if err := fw.typed("Reporting-Mta", typ, reportingMTA); err != nil {
+		return err
+	}
 
 	if info.XMTAName == "" {
 		info.XMTAName = xMTADefaultName
@@ -62,38 +89,59 @@ func (info ReportingMTAInfo) WriteTo(utf8 bool, w io.Writer) error {
 	xHeaderPrefix := "X-" + strings.TrimSpace(info.XMTAName)
 
 	if info.ReceivedFromMTA != "" {
-		receivedFromMTA, err := dnsSelectIDNA(utf8, info.ReceivedFromMTA)
+		typ, receivedFromMTA, err := mtaName(utf8, info.ReceivedFromMTAType, info.ReceivedFromMTA)
 		if err != nil {
 			return fmt.Errorf("dsn: cannot convert Received-From-MTA to a suitable representation: %w", err)
 		}
 
-		h.Add("Received-From-MTA", "dns; "+receivedFromMTA)
+		if err := fw.typed("Received-From-Mta", typ, receivedFromMTA); err != nil {
+			return err
+		}
 	}
 
 	if info.XSender != "" {
-		sender, err := addrSelectIDNA(utf8, info.XSender)
+		typ, sender, err := addressField(utf8, info.XSender)
 		if err != nil {
 			return fmt.Errorf("dsn: cannot convert %s-Sender to a suitable representation: %w", xHeaderPrefix, err)
 		}
 
-		if utf8 {
-			h.Add(xHeaderPrefix+"-Sender", "utf8; "+sender)
-		} else {
-			h.Add(xHeaderPrefix+"-Sender", "rfc822; "+sender)
+		if err := fw.typed(canonicalKey(xHeaderPrefix+"-Sender"), typ, sender); err != nil {
+			return err
 		}
 	}
 	if info.XMessageID != "" {
-		h.Add(xHeaderPrefix+"-MsgID", info.XMessageID)
+		if info.xMsgIDField == "" {
+			info.xMsgIDField = DefaultProfile.MessageIDField
+		}
+		if err := fw.field(canonicalKey(xHeaderPrefix+"-"+info.xMsgIDField), info.XMessageID); err != nil {
+			return err
+		}
 	}
 
 	if !info.ArrivalDate.IsZero() {
-		h.Add("Arrival-Date", info.ArrivalDate.Format(timeLayout))
+		fw.begin("Arrival-Date")
+		fw.buf = info.ArrivalDate.AppendFormat(fw.buf, timeLayout)
+		if err := fw.end(); err != nil {
+			return err
+		}
 	}
-	if !info.ArrivalDate.IsZero() {
-		h.Add("Last-Attempt-Date", info.LastAttemptDate.Format(timeLayout))
+	if !info.LastAttemptDate.IsZero() {
+		fw.begin("Last-Attempt-Date")
+		fw.buf = info.LastAttemptDate.AppendFormat(fw.buf, timeLayout)
+		if err := fw.end(); err != nil {
+			return err
+		}
 	}
 
-	return textproto.WriteHeader(w, h)
+	return fw.flush(w)
+}
+
+// addressType returns the address type of Final-Recipient and X-*-Sender.
+func addressType(utf8 bool) string {
+	if utf8 {
+		return "utf8"
+	}
+	return "rfc822"
 }
 
 const timeLayout = "Mon, 2 Jan 2006 15:04:05 -0700"
@@ -111,190 +159,391 @@ const (
 type RecipientInfo struct {
 	FinalRecipient string
 	RemoteMTA      string
+	// RemoteMTAType is the MTA name type of RemoteMTA, see
+	// ReportingMTAInfo.ReportingMTAType.
+	RemoteMTAType string
+
+	// OriginalRecipient is the address of the ORCPT parameter (RFC 3461)
+	// the recipient was received with, if any, after xtext decoding. It is
+	// written as is. OriginalRecipientType is its address type, "rfc822"
+	// if empty.
+	OriginalRecipient     string
+	OriginalRecipientType string
 
 	Action Action
 	Status smtp.EnhancedCode
 
 	// DiagnosticCode is the error that will be returned to the sender.
+	// *smtp.SMTPError and *DiagnosticError are written with their type,
+	// see Profile.DiagnosticType for other errors.
 	DiagnosticCode error
-	xMTAName       string
+
+	// WillRetryUntil is the time the Reporting MTA gives up, it is only
+	// written for ActionDelayed.
+	WillRetryUntil time.Time
+
+	// ExpandedTo are the addresses an alias or mailing list was expanded
+	// to, for ActionExpanded. They are only shown in the human-readable
+	// part.
+	ExpandedTo []string
+
+	// ExtensionFields are written to the end of the recipient block as
+	// is, e.g. site-specific X- fields or fields of newer RFCs. ParseDSN
+	// returns the fields it does not know here.
+	ExtensionFields textproto.Header
+
+	// Metadata is opaque data of the caller, e.g. a campaign or tenant ID,
+	// to correlate the recipient. It is never written to the DSN but is
+	// available to templates and NotifyPolicy.
+	Metadata map[string]string
+
+	// lastAttemptDate is the LastAttemptDate of the message, set while
+	// the human-readable part is generated.
+	lastAttemptDate time.Time
+	xMTAName        string
+	// asciiDiagType is the type of non-SMTP diagnostic codes if utf8 is not
+	// used, set from the Profile.
+	asciiDiagType string
+	// encodeDiag writes non-ASCII diagnostic texts as RFC 2047
+	// encoded-words, set for Generator.SevenBit.
+	encodeDiag bool
+}
+
+// DiagnosticError is a Diagnostic-Code of another type than "smtp", e.g.
+// an "X-Unix" error of a local delivery agent or an "X-LMTP" reply. It is
+// written as "<Type>; <Text>", non-ASCII characters of Text are replaced
+// with '?' if utf8 is not used.
+type DiagnosticError struct {
+	Type string
+	Text string
+}
+
+func (err *DiagnosticError) Error() string {
+	return err.Text
 }
 
 var newLineReplacer = strings.NewReplacer("\n", " ", "\r", " ")
 
 func (info RecipientInfo) WriteTo(utf8 bool, w io.Writer) error {
-	// DSN format uses structure similar to MIME header, so we reuse
-	// MIME generator here.
-	h := textproto.Header{}
+	// DSN format uses structure similar to MIME header, fieldWriter
+	// produces the same output as the MIME generator.
+	fw := getFieldWriter()
+	defer putFieldWriter(fw)
 
 	if info.FinalRecipient == "" {
 		return errors.New("dsn: Final-Recipient is required")
 	}
-	finalRcpt, err := addrSelectIDNA(utf8, info.FinalRecipient)
+	if err := writeExtensionFields(fw, info.ExtensionFields); err != nil {
+		return err
+	}
+	typ, finalRcpt, err := addressField(utf8, info.FinalRecipient)
 	if err != nil {
 		return fmt.Errorf("dsn: cannot convert Final-Recipient to a suitable representation: %w", err)
 	}
-	if utf8 {
-		h.Add("Final-Recipient", "utf8; "+finalRcpt)
-	} else {
-		h.Add("Final-Recipient", "rfc822; "+finalRcpt)
+	if err := fw.typed("Final-Recipient", typ, finalRcpt); err != nil {
+		return err
+	}
+	if info.OriginalRecipient != "" {
+		typ := info.OriginalRecipientType
+		if typ == "" {
+			typ = "rfc822"
+		}
+		if err := fw.typed("Original-Recipient", typ, info.OriginalRecipient); err != nil {
+			return err
+		}
 	}
 
 	if info.Action == "" {
 		return errors.New("dsn: Action is required")
 	}
-	h.Add("Action", string(info.Action))
+	if err := fw.field("Action", string(info.Action)); err != nil {
+		return err
+	}
 	if info.Status[0] == 0 {
 		return errors.New("dsn: Status is required")
 	}
-	h.Add("Status", fmt.Sprintf("%d.%d.%d", info.Status[0], info.Status[1], info.Status[2]))
+	if info.Action == ActionExpanded && info.Status[0] != 2 {
+		return errors.New("dsn: Status of expanded recipients must be 2.x.x")
+	}
+	if info.Action == ActionDelivered && info.Status[0] != 2 {
+		return errors.New("dsn: Status of delivered recipients must be 2.x.x")
+	}
+	fw.begin("Status")
+	fw.code(info.Status)
+	if err := fw.end(); err != nil {
+		return err
+	}
 
-	if smtpErr, ok := info.DiagnosticCode.(*smtp.SMTPError); ok {
+	if diagErr, ok := info.DiagnosticCode.(*DiagnosticError); ok {
+		text := newLineReplacer.Replace(diagErr.Text)
+		if info.encodeDiag {
+			text = mime.QEncoding.Encode("utf-8", text)
+		} else if !utf8 {
+			text = replaceNonASCII(text)
+		}
+		if err := fw.typed("Diagnostic-Code", diagErr.Type, text); err != nil {
+			return err
+		}
+	} else if smtpErr, ok := info.DiagnosticCode.(*smtp.SMTPError); ok {
 		// Error message may contain newlines if it is received from another SMTP server.
 		// But we cannot directly insert CR/LF into Disagnostic-Code so rewrite it.
-		h.Add("Diagnostic-Code", fmt.Sprintf("smtp; %d %d.%d.%d %s",
-			smtpErr.Code, smtpErr.EnhancedCode[0], smtpErr.EnhancedCode[1], smtpErr.EnhancedCode[2],
-			newLineReplacer.Replace(smtpErr.Message)))
-	} else if utf8 {
-		// It might contain Unicode, so don't include it if we are not allowed to.
-		// ... I didn't bother implementing mangling logic to remove Unicode
-		// characters.
+		fw.begin("Diagnostic-Code")
+		fw.str("smtp; ")
+		fw.int(smtpErr.Code)
+		fw.str(" ")
+		if smtpErr.EnhancedCode[0] > 0 {
+			fw.code(smtpErr.EnhancedCode)
+			fw.str(" ")
+		}
+		msg := newLineReplacer.Replace(smtpErr.Message)
+		if info.encodeDiag {
+			msg = mime.QEncoding.Encode("utf-8", msg)
+		}
+		fw.str(msg)
+		if err := fw.end(); err != nil {
+			return err
+		}
+	} else if (utf8 || info.encodeDiag && info.asciiDiagType == "") && info.DiagnosticCode != nil {
 		errorDesc := newLineReplacer.Replace(info.DiagnosticCode.Error())
+		if info.encodeDiag {
+			errorDesc = mime.QEncoding.Encode("utf-8", errorDesc)
+		}
 		if info.xMTAName == "" {
 			info.xMTAName = xMTADefaultName
 		}
-		xHeaderPrefix := "X-" + strings.TrimSpace(info.xMTAName)
-		h.Add("Diagnostic-Code", xHeaderPrefix+"; "+errorDesc)
+		if err := fw.typed("Diagnostic-Code", "X-"+strings.TrimSpace(info.xMTAName), errorDesc); err != nil {
+			return err
+		}
+	} else if info.asciiDiagType != "" && info.DiagnosticCode != nil {
+		// It might contain Unicode, which we are not allowed to include.
+		errorDesc := newLineReplacer.Replace(info.DiagnosticCode.Error())
+		if info.encodeDiag {
+			errorDesc = mime.QEncoding.Encode("utf-8", errorDesc)
+		} else {
+			errorDesc = replaceNonASCII(errorDesc)
+		}
+		if err := fw.typed("Diagnostic-Code", info.asciiDiagType, errorDesc); err != nil {
+			return err
+		}
 	}
 
 	if info.RemoteMTA != "" {
-		remoteMTA, err := dnsSelectIDNA(utf8, info.RemoteMTA)
+		typ, remoteMTA, err := mtaName(utf8, info.RemoteMTAType, info.RemoteMTA)
 		if err != nil {
 			return fmt.Errorf("dsn: cannot convert Remote-MTA to a suitable representation: %w", err)
 		}
 
-		h.Add("Remote-MTA", "dns; "+remoteMTA)
+		if err := fw.typed("Remote-Mta", typ, remoteMTA); err != nil {
+			return err
+		}
 	}
 
-	return textproto.WriteHeader(w, h)
+	if info.Action == ActionDelayed && !info.WillRetryUntil.IsZero() {
+		fw.begin("Will-Retry-Until")
+		fw.buf = info.WillRetryUntil.AppendFormat(fw.buf, timeLayout)
+		if err := fw.end(); err != nil {
+			return err
+		}
+	}
+
+	return fw.flush(w)
 }
 
 type Envelope struct {
 	MsgID string
 	From  string
 	To    string
+
+	// Header lists extra fields of the message header of the DSN, e.g. an
+	// X-Queue-ID or organization-specific field. They are added after the
+	// fields of Profile.Header. The fields generated from the other
+	// arguments and the MIME fields cannot be set, see ReservedFieldError.
+	Header textproto.Header
+
+	// Language, if set, selects the translation of the DSN registered with
+	// RegisterTranslation, as a language tag such as "de" or a list in
+	// Accept-Language format such as "de-CH, fr;q=0.8". The built-in English
+	// profiles are used if no translation matches.
+	Language string
+
+	// inReplyTo and references are taken from the failed message for the
+	// In-Reply-To and References fields, unless Header has either of them.
+	inReplyTo  string
+	references string
+	// headerLanguages are taken from the failed message, see
+	// Generator.DetectLanguage.
+	headerLanguages []language.Tag
 }
 
 // GenerateDSN is a top-level function that should be used for generation of the DSNs.
 //
 // DSN header will be returned, body itself will be written to outWriter.
-func GenerateDSN(utf8 bool, envelope Envelope, mtaInfo ReportingMTAInfo, rcptsInfo []RecipientInfo, failedHeader textproto.Header, outWriter io.Writer) (textproto.Header, error) {
-	partWriter := textproto.NewMultipartWriter(outWriter)
-
-	reportHeader := textproto.Header{}
-	reportHeader.Add("Date", time.Now().Format(timeLayout))
-	reportHeader.Add("Message-Id", envelope.MsgID)
-	reportHeader.Add("Content-Transfer-Encoding", "8bit")
-	reportHeader.Add("Content-Type", "multipart/report; report-type=delivery-status; boundary="+partWriter.Boundary())
-	reportHeader.Add("MIME-Version", "1.0")
-	reportHeader.Add("Auto-Submitted", "auto-replied")
-	reportHeader.Add("To", envelope.To)
-	reportHeader.Add("From", envelope.From)
-	reportHeader.Add("Subject", "Undelivered Mail Returned to Sender")
-
-	defer partWriter.Close()
+// HeaderFromMap converts a net/mail.Header for failedHeader.
+//
+// The wording depends on the recipients, see Generator.Profile.
+//
+// If utf8 is false, non-ASCII display names of the From and To fields and a
+// non-ASCII subject are written as RFC 2047 encoded-words.
+//
+// If failedHeader has a Message-Id, it is referenced with In-Reply-To and
+// References fields so that mail clients show the DSN as a reply, unless
+// Envelope.Header sets either of them.
+//
+// New returns a Builder for the same, which is easier to extend. Further
+// settings are passed as options, see Option.
+func GenerateDSN(utf8 bool, envelope Envelope, mtaInfo ReportingMTAInfo, rcptsInfo []RecipientInfo, failedHeader textproto.Header, outWriter io.Writer, opts ...Option) (textproto.Header, error) {
+	return NewGenerator(opts...).Generate(utf8, envelope, mtaInfo, rcptsInfo, failedHeader, outWriter)
+}
 
-	if err := writeHumanReadablePart(partWriter, mtaInfo, rcptsInfo); err != nil {
-		return textproto.Header{}, err
-	}
-	if err := writeMachineReadablePart(utf8, partWriter, mtaInfo, rcptsInfo); err != nil {
-		return textproto.Header{}, err
-	}
-	return reportHeader, writeHeader(utf8, partWriter, failedHeader)
+// GenerateFullDSN is like GenerateDSN but returns the complete failed
+// message read from msg, see Generator.GenerateFull.
+func GenerateFullDSN(utf8 bool, envelope Envelope, mtaInfo ReportingMTAInfo, rcptsInfo []RecipientInfo, msg io.Reader, outWriter io.Writer, opts ...Option) (textproto.Header, error) {
+	return NewGenerator(opts...).GenerateFull(utf8, envelope, mtaInfo, rcptsInfo, msg, outWriter)
 }
 
 // SendDSN generates and sends DSN via an smtp relay
 // From Addr defaults to <>
-func SendDSN(smtpaddr string, utf8 bool, envelope Envelope, mtaInfo ReportingMTAInfo, rcptsInfo []RecipientInfo, failedHeader textproto.Header) error {
-	bodyBuf := bytes.Buffer{}
+//
+// The DSN is streamed to the relay while it is generated. If generating it
+// fails after the DATA command, the connection is closed without completing
+// the transaction.
+//
+// Generator.LoopGuard is enabled unless WithLoopGuard(false) is passed, so
+// that no DSN is sent for messages refused by ShouldGenerateDSN.
+func SendDSN(smtpaddr string, utf8 bool, envelope Envelope, mtaInfo ReportingMTAInfo, rcptsInfo []RecipientInfo, failedHeader textproto.Header, opts ...Option) error {
+	opts = append([]Option{WithLoopGuard(true)}, opts...)
+	return NewGenerator(opts...).Send(&NetSMTPTransport{Addr: smtpaddr}, utf8, envelope, mtaInfo, rcptsInfo, failedHeader)
+}
+
+// Send generates a DSN and sends it through t with the null reverse-path,
+// see SendDSN.
+func (g *Generator) Send(t Transport, utf8 bool, envelope Envelope, mtaInfo ReportingMTAInfo, rcptsInfo []RecipientInfo, failedHeader textproto.Header) error {
+	if g.LoopGuard {
+		if ok, reason := ShouldGenerateDSN(failedHeader, envelope); !ok {
+			return &SuppressedError{Reason: reason}
+		}
+	}
 	envelope.From = "MAILER-DAEMON (Mail Delivery System)"
-	hdr, err := GenerateDSN(utf8, envelope, mtaInfo, rcptsInfo, failedHeader, &bodyBuf)
-	if err != nil {
-		return err
+	if g.AutoDetectUTF8 {
+		utf8 = needsUTF8(envelope, mtaInfo, rcptsInfo) || headerNeedsUTF8(failedHeader)
 	}
-	c, err := smtpclient.Dial(smtpaddr)
+	envelope.useFailedHeader(failedHeader)
+	hdr, writeBody, err := g.generate(g.profileFor(envelope, rcptsInfo), utf8, envelope, mtaInfo, rcptsInfo, headerContent(failedHeader))
 	if err != nil {
 		return err
 	}
-	defer c.Close()
-	if err := c.Hello("bla"); err != nil {
+	// Catch invalid fields before anything is sent.
+	if err := mtaInfo.WriteTo(utf8, ioutil.Discard); err != nil {
 		return err
 	}
-	if err := c.Mail("<>"); err != nil {
-		return err
-	}
-	for _, r := range rcptsInfo {
-		if err := c.Rcpt(r.FinalRecipient); err != nil {
+	to := make([]string, 0, len(rcptsInfo))
+	for _, rcpt := range rcptsInfo {
+		if err := rcpt.WriteTo(utf8, ioutil.Discard); err != nil {
 			return err
 		}
+		to = append(to, rcpt.FinalRecipient)
 	}
-	wr, err := c.Data()
-	if err != nil {
-		return err
-	}
-	err = textproto.WriteHeader(wr, hdr)
-	if err != nil {
-		wr.Close()
-		return err
-	}
-	_, err = bodyBuf.WriteTo(wr)
-	if err != nil {
-		wr.Close()
-		return err
-	}
-	return wr.Close()
+
+	return t.Send("", to, func(w io.Writer) error {
+		if err := textproto.WriteHeader(w, hdr); err != nil {
+			return err
+		}
+		return writeBody(w)
+	})
 }
 
-func writeHeader(utf8 bool, w *textproto.MultipartWriter, header textproto.Header) error {
+func writeHeader(utf8 bool, p *Profile, w *textproto.MultipartWriter, returned returnedContent) error {
 	partHeader := textproto.Header{}
-	partHeader.Add("Content-Description", "Undelivered message header")
-	if utf8 {
+	description := p.ReturnedDescription
+	if p.returnFull {
+		description = p.ReturnedMessageDescription
+		if description == "" {
+			description = "Undelivered message"
+		}
+	}
+	partHeader.Add("Content-Description", mime.QEncoding.Encode("utf-8", description))
+	switch {
+	case p.returnFull && utf8:
+		partHeader.Add("Content-Type", "message/global")
+	case p.returnFull:
+		partHeader.Add("Content-Type", "message/rfc822")
+	case utf8:
 		partHeader.Add("Content-Type", "message/global-headers")
-	} else {
-		partHeader.Add("Content-Type", "message/rfc822-headers")
+	case p.sevenBit:
+		// Unlike message/rfc822-headers, it can be encoded.
+		partHeader.Add("Content-Type", "text/rfc822-headers")
+		partHeader.Add("Content-Transfer-Encoding", "quoted-printable")
+	default:
+		partHeader.Add("Content-Type", p.ReturnedHeadersType)
+	}
+	// The returned message is copied as is, so it may contain 8bit data
+	// and cannot be left with the implied 7bit. message/rfc822 must not be
+	// encoded (RFC 2046 section 5.2.1).
+	if !p.OmitTransferEncoding || p.returnFull {
+		partHeader.Add("Content-Transfer-Encoding", "8bit")
+	}
+	if p.ReturnedFilename != "" {
+		partHeader.Add("Content-Disposition", attachment(p.ReturnedFilename))
 	}
-	partHeader.Add("Content-Transfer-Encoding", "8bit")
 	headerWriter, err := w.CreatePart(partHeader)
 	if err != nil {
 		return err
 	}
-	return textproto.WriteHeader(headerWriter, header)
+	if p.returnFull {
+		return returned(headerWriter)
+	}
+	bodyWriter, closeBody := textBodyWriter(p, headerWriter)
+	if err := returned(bodyWriter); err != nil {
+		return err
+	}
+	return closeBody()
 }
 
-func writeMachineReadablePart(utf8 bool, w *textproto.MultipartWriter, mtaInfo ReportingMTAInfo, rcptsInfo []RecipientInfo) error {
+func writeMachineReadablePart(utf8 bool, p *Profile, w *textproto.MultipartWriter, mtaInfo ReportingMTAInfo, rcptsInfo []RecipientInfo) error {
 	machineHeader := textproto.Header{}
 	if utf8 {
 		machineHeader.Add("Content-Type", "message/global-delivery-status")
 	} else {
 		machineHeader.Add("Content-Type", "message/delivery-status")
 	}
-	machineHeader.Add("Content-Description", "Delivery report")
+	machineHeader.Add("Content-Description", mime.QEncoding.Encode("utf-8", p.StatusDescription))
+	if p.StatusFilename != "" {
+		machineHeader.Add("Content-Disposition", attachment(p.StatusFilename))
+	}
 	machineWriter, err := w.CreatePart(machineHeader)
 	if err != nil {
 		return err
 	}
 
+	// The fields are collected in buf to write the part in one go.
+	buf := getBuffer()
+	defer putBuffer(buf)
+
+	if err := writeStatusFields(utf8, p, buf, mtaInfo, rcptsInfo); err != nil {
+		return err
+	}
+	_, err = buf.WriteTo(machineWriter)
+	return err
+}
+
+// writeStatusFields writes the per-message and per-recipient fields with the
+// defaults of p applied.
+func writeStatusFields(utf8 bool, p *Profile, w io.Writer, mtaInfo ReportingMTAInfo, rcptsInfo []RecipientInfo) error {
+	if mtaInfo.XMTAName == "" {
+		mtaInfo.XMTAName = p.XMTAName
+	}
+	mtaInfo.xMsgIDField = p.MessageIDField
+
 	// WriteTo will add an empty line after output.
-	if err := mtaInfo.WriteTo(utf8, machineWriter); err != nil {
+	if err := mtaInfo.WriteTo(utf8, w); err != nil {
 		return err
 	}
 
 	for _, rcpt := range rcptsInfo {
-		if mtaInfo.XMTAName == "" {
-			mtaInfo.XMTAName = xMTADefaultName
-		}
 		rcpt.xMTAName = mtaInfo.XMTAName
-		if err := rcpt.WriteTo(utf8, machineWriter); err != nil {
+		rcpt.asciiDiagType = p.DiagnosticType
+		rcpt.encodeDiag = p.sevenBit
+		if err := rcpt.WriteTo(utf8, w); err != nil {
 			return err
 		}
 	}
@@ -312,36 +561,198 @@ recipient address or maintenance at the recipient side.
 Contact the postmaster for further assistance, provide the Message ID (below):
 
 Message ID: {{.XMessageID}}
-Arrival: {{.ArrivalDate}}
-Last delivery attempt: {{.LastAttemptDate}}
+Arrival: {{.FormatDate .ArrivalDate}}
+Last delivery attempt: {{.FormatDate .LastAttemptDate}}
 
 `
 
 // failedText is the text of the human-readable part of DSN.
 var failedText = template.Must(template.New("dsn-text").Parse(FailedTemplateText))
 
-func writeHumanReadablePart(w *textproto.MultipartWriter, mtaInfo ReportingMTAInfo, rcptsInfo []RecipientInfo) error {
-	humanHeader := textproto.Header{}
-	humanHeader.Add("Content-Transfer-Encoding", "8bit")
-	humanHeader.Add("Content-Type", `text/plain; charset="utf-8"`)
-	humanHeader.Add("Content-Description", "Notification")
+func writeHumanReadablePart(p *Profile, altBoundary string, w *textproto.MultipartWriter, mtaInfo ReportingMTAInfo, rcptsInfo []RecipientInfo) error {
+	if p.HTML != nil || len(p.Alternatives) != 0 {
+		return writeHumanAlternative(p, altBoundary, w, mtaInfo, rcptsInfo)
+	}
+
+	humanHeader := textPartHeader(p, "text/plain")
+	humanHeader.Add("Content-Description", mime.QEncoding.Encode("utf-8", p.HumanDescription))
 	humanWriter, err := w.CreatePart(humanHeader)
 	if err != nil {
 		return err
 	}
 
-	mtaInfo.ArrivalDate = mtaInfo.ArrivalDate.Truncate(time.Second)
-	mtaInfo.LastAttemptDate = mtaInfo.LastAttemptDate.Truncate(time.Second)
+	bodyWriter, closeBody := textBodyWriter(p, humanWriter)
+	if err := writeHumanText(p, bodyWriter, mtaInfo, rcptsInfo); err != nil {
+		return err
+	}
+	return closeBody()
+}
 
-	if err := failedText.Execute(humanWriter, mtaInfo); err != nil {
+// writeHumanAlternative writes the human-readable part as a
+// multipart/alternative of the texts of the Alternatives, the text and the
+// HTML version.
+func writeHumanAlternative(p *Profile, boundary string, w *textproto.MultipartWriter, mtaInfo ReportingMTAInfo, rcptsInfo []RecipientInfo) error {
+	altHeader := textproto.Header{}
+	altHeader.Add("Content-Type", "multipart/alternative; boundary="+boundary)
+	altHeader.Add("Content-Description", mime.QEncoding.Encode("utf-8", p.HumanDescription))
+	if p.inlineText {
+		altHeader.Add("Content-Disposition", "inline")
+	}
+	if p.Language != "" && len(p.Alternatives) == 0 {
+		altHeader.Add("Content-Language", p.Language)
+	}
+	altPart, err := w.CreatePart(altHeader)
+	if err != nil {
+		return err
+	}
+	altWriter := textproto.NewMultipartWriter(altPart)
+	if err := altWriter.SetBoundary(boundary); err != nil {
 		return err
 	}
 
-	for _, rcpt := range rcptsInfo {
-		if _, err := fmt.Fprintf(humanWriter, "Delivery to %s failed with error: %v\n", rcpt.FinalRecipient, rcpt.DiagnosticCode); err != nil {
+	for _, alt := range p.Alternatives {
+		if err := writeHumanTextPart(p.alternative(alt), altWriter, mtaInfo, rcptsInfo); err != nil {
 			return err
 		}
 	}
+	if err := writeHumanTextPart(p, altWriter, mtaInfo, rcptsInfo); err != nil {
+		return err
+	}
+	if p.HTML == nil {
+		return altWriter.Close()
+	}
 
-	return nil
+	htmlWriter, err := altWriter.CreatePart(textPartHeader(p, "text/html"))
+	if err != nil {
+		return err
+	}
+	bodyWriter, closeBody := textBodyWriter(p, htmlWriter)
+	mtaInfo, rcptsInfo = humanData(p, mtaInfo, rcptsInfo)
+	if err := p.HTML.Execute(bodyWriter, TemplateData{ReportingMTAInfo: mtaInfo, Recipients: rcptsInfo}); err != nil {
+		return err
+	}
+	if err := closeBody(); err != nil {
+		return err
+	}
+
+	return altWriter.Close()
+}
+
+// writeHumanTextPart writes the text of p as part of a
+// multipart/alternative.
+func writeHumanTextPart(p *Profile, w *textproto.MultipartWriter, mtaInfo ReportingMTAInfo, rcptsInfo []RecipientInfo) error {
+	textWriter, err := w.CreatePart(textPartHeader(p, "text/plain"))
+	if err != nil {
+		return err
+	}
+	bodyWriter, closeBody := textBodyWriter(p, textWriter)
+	if err := writeHumanText(p, bodyWriter, mtaInfo, rcptsInfo); err != nil {
+		return err
+	}
+	return closeBody()
+}
+
+func attachment(filename string) string {
+	return mime.FormatMediaType("attachment", map[string]string{"filename": filename})
+}
+
+func textPartHeader(p *Profile, mediaType string) textproto.Header {
+	h := textproto.Header{}
+	if p.inlineText {
+		h.Add("Content-Disposition", "inline")
+	}
+	if p.sevenBit {
+		h.Add("Content-Transfer-Encoding", "quoted-printable")
+	} else if !p.OmitTransferEncoding {
+		h.Add("Content-Transfer-Encoding", "8bit")
+	}
+	h.Add("Content-Type", mediaType+`; charset="utf-8"`)
+	if p.Language != "" {
+		h.Add("Content-Language", p.Language)
+	}
+	return h
+}
+
+// writeHumanText executes the templates of p.
+func writeHumanText(p *Profile, w io.Writer, mtaInfo ReportingMTAInfo, rcptsInfo []RecipientInfo) error {
+	mtaInfo, rcptsInfo = humanData(p, mtaInfo, rcptsInfo)
+
+	// Templates issue many small writes, collect them in buf.
+	buf := getBuffer()
+	defer putBuffer(buf)
+
+	if err := p.Text.Execute(buf, TemplateData{ReportingMTAInfo: mtaInfo, Recipients: rcptsInfo}); err != nil {
+		return err
+	}
+
+	if p.GroupRecipients > 0 && len(rcptsInfo) >= p.GroupRecipients {
+		if err := writeGroupedRecipients(p, buf, rcptsInfo); err != nil {
+			return err
+		}
+	} else {
+		for _, rcpt := range rcptsInfo {
+			if err := writeRecipientText(p, buf, rcpt); err != nil {
+				return err
+			}
+		}
+	}
+	if p.Trailer != nil {
+		if err := p.Trailer.Execute(buf, rcptsInfo); err != nil {
+			return err
+		}
+	}
+	if p.returnTruncated > 0 {
+		fmt.Fprintf(buf, "\nThe message is larger than %d bytes, only its header is returned.\n", p.returnTruncated)
+	}
+
+	_, err := buf.WriteTo(w)
+	return err
+}
+
+// humanData prepares the data passed to the templates of the
+// human-readable part: the timestamps are truncated to seconds and converted
+// to the location of the profile, and the fields for FormatDate and
+// RetryingFor are set.
+func humanData(p *Profile, mtaInfo ReportingMTAInfo, rcptsInfo []RecipientInfo) (ReportingMTAInfo, []RecipientInfo) {
+	mtaInfo.ArrivalDate = humanTime(p, mtaInfo.ArrivalDate)
+	mtaInfo.LastAttemptDate = humanTime(p, mtaInfo.LastAttemptDate)
+	mtaInfo.dateLayout = p.dateLayout
+
+	if mtaInfo.LastAttemptDate.IsZero() && p.location == nil {
+		return mtaInfo, rcptsInfo
+	}
+	rcpts := make([]RecipientInfo, len(rcptsInfo))
+	for i, rcpt := range rcptsInfo {
+		rcpt.WillRetryUntil = humanTime(p, rcpt.WillRetryUntil)
+		rcpt.lastAttemptDate = mtaInfo.LastAttemptDate
+		rcpts[i] = rcpt
+	}
+	return mtaInfo, rcpts
+}
+
+func humanTime(p *Profile, t time.Time) time.Time {
+	t = t.Truncate(time.Second)
+	if p.location != nil && !t.IsZero() {
+		t = t.In(p.location)
+	}
+	return t
+}
+
+// writeRecipientText executes the RecipientText of p for rcpt.
+func writeRecipientText(p *Profile, buf *bytes.Buffer, rcpt RecipientInfo) error {
+	if p.RecipientText == defaultRecipientText {
+		writeDefaultRecipientText(buf, rcpt)
+		return nil
+	}
+	return p.RecipientText.Execute(buf, rcpt)
+}
+
+// writeDefaultRecipientText writes the same text as defaultRecipientText, it
+// avoids the cost of executing the template for every recipient.
+func writeDefaultRecipientText(buf *bytes.Buffer, rcpt RecipientInfo) {
+	buf.WriteString("Delivery to ")
+	buf.WriteString(rcpt.FinalRecipient)
+	buf.WriteString(" failed with error: ")
+	fmt.Fprint(buf, rcpt.DiagnosticCode)
+	buf.WriteByte('\n')
 }
@@ -5,6 +5,8 @@ package dsn
 
 import (
 	"bytes"
+	"math/rand"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
@@ -78,55 +80,256 @@ func TestGenerateDSN(t *testing.T) {
 	}
 }
 
-func TestSendDSN(t *testing.T) {
-	type args struct {
-		smtpaddr     string
-		utf8         bool
-		envelope     Envelope
-		mtaInfo      ReportingMTAInfo
-		rcptsInfo    []RecipientInfo
-		failedHeader textproto.Header
+func TestGeneratorDeterministic(t *testing.T) {
+	generate := func() []byte {
+		g := Generator{
+			Clock: FixedClock(time.Date(2020, 01, 02, 15, 04, 05, 0, time.UTC)),
+			Rand:  rand.New(rand.NewSource(1)),
+		}
+		body := bytes.Buffer{}
+		hdr, err := g.Generate(false, Envelope{MsgID: "<msgid1@example.com>"}, ReportingMTAInfo{
+			ReportingMTA: "reportingmta.example.com",
+		}, []RecipientInfo{{
+			FinalRecipient: "finalrcpt@example.com",
+			Action:         ActionFailed,
+			Status:         smtp.EnhancedCode{5, 0, 0},
+		}}, textproto.Header{}, &body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out := bytes.Buffer{}
+		if err := textproto.WriteHeader(&out, hdr); err != nil {
+			t.Fatal(err)
+		}
+		body.WriteTo(&out)
+		return out.Bytes()
 	}
-	tests := []struct {
-		name    string
-		args    args
-		wantErr bool
-	}{
-		{
-			name: "t",
-			args: args{
-				smtpaddr: "localhost:25",
-				utf8:     false,
-				envelope: Envelope{
-					MsgID: "<msgid1@example.com>",
-					From:  "from@example.com",
-					To:    "to@example.com",
-				},
-				mtaInfo: ReportingMTAInfo{
-					ReportingMTA:    "reportingmta.example.com",
-					ReceivedFromMTA: "receivedmta.example.com",
-					XSender:         "XSender@example.com",
-					XMessageID:      "XMessageID@example.com",
-					ArrivalDate:     time.Date(2020, 01, 02, 15, 04, 05, 06, time.UTC),
-					LastAttemptDate: time.Date(2020, 01, 02, 15, 04, 05, 07, time.UTC),
-				},
-				rcptsInfo: []RecipientInfo{{
-					FinalRecipient: "test@example.com",
-					RemoteMTA:      "remotemta.example.com",
-					Action:         ActionFailed,
-					Status:         smtp.EnhancedCode{5, 0, 0},
-					DiagnosticCode: nil,
-				}},
-				failedHeader: textproto.Header{},
-			},
-			wantErr: false,
-		},
+
+	first, second := generate(), generate()
+	if !bytes.Equal(first, second) {
+		t.Errorf("output differs between runs:\n%s\n---\n%s", first, second)
 	}
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			if err := SendDSN(tt.args.smtpaddr, tt.args.utf8, tt.args.envelope, tt.args.mtaInfo, tt.args.rcptsInfo, tt.args.failedHeader); (err != nil) != tt.wantErr {
-				t.Errorf("SendDSN() error = %v, wantErr %v", err, tt.wantErr)
+	if !bytes.Contains(first, []byte("Date: Thu, 2 Jan 2020 15:04:05 +0000")) {
+		t.Errorf("Date does not come from the Clock:\n%s", first)
+	}
+}
+
+func BenchmarkGenerateDSN(b *testing.B) {
+	mtaInfo := ReportingMTAInfo{
+		ReportingMTA: "mx.example.org",
+		XSender:      "sender@example.org",
+		XMessageID:   "XMessageID",
+		ArrivalDate:  time.Date(2020, 01, 02, 15, 04, 05, 0, time.UTC),
+	}
+	failedHeader := textproto.Header{}
+	failedHeader.Add("Subject", "test")
+
+	for _, n := range []int{1, 10, 1000} {
+		rcpts := benchmarkRecipients(n)
+
+		b.Run(strconv.Itoa(n), func(b *testing.B) {
+			b.ReportAllocs()
+			var out bytes.Buffer
+			for i := 0; i < b.N; i++ {
+				out.Reset()
+				if _, err := GenerateDSN(false, Envelope{}, mtaInfo, rcpts, failedHeader, &out); err != nil {
+					b.Fatal(err)
+				}
 			}
 		})
 	}
 }
+
+func TestRemoteMTAAddressLiteral(t *testing.T) {
+	for _, remoteMTA := range []string{"[192.0.2.1]", "[IPv6:2001:DB8::1]"} {
+		for _, utf8 := range []bool{false, true} {
+			rcpt := RecipientInfo{FinalRecipient: "rcpt@example.com", Action: ActionFailed, Status: smtp.EnhancedCode{5, 1, 1}, RemoteMTA: remoteMTA}
+			var b bytes.Buffer
+			if err := rcpt.WriteTo(utf8, &b); err != nil {
+				t.Fatal(err)
+			}
+			if want := "Remote-Mta: dns; " + remoteMTA + "\r\n"; !strings.Contains(b.String(), want) {
+				t.Errorf("utf8=%v: recipient block %q does not contain %q", utf8, b.String(), want)
+			}
+		}
+	}
+
+	for _, name := range []string{"[192.0.2]", "[IPv6:192.0.2.1]", "[2001:db8::1]", "192.0.2.1", "[]"} {
+		if isAddressLiteral(name) {
+			t.Errorf("isAddressLiteral(%q) = true", name)
+		}
+	}
+}
+
+func TestAutoDetectUTF8(t *testing.T) {
+	rcpt := RecipientInfo{FinalRecipient: "rcpt@example.com", Action: ActionFailed, Status: smtp.EnhancedCode{5, 1, 1}}
+	unicodeHeader := textproto.Header{}
+	unicodeHeader.Add("Subject", "Grüße")
+
+	for _, test := range []struct {
+		name     string
+		envelope Envelope
+		rcpt     RecipientInfo
+		header   textproto.Header
+		utf8     bool
+	}{
+		{"ascii", Envelope{To: "sender@example.org"}, rcpt, textproto.Header{}, false},
+		{"envelope", Envelope{To: "jörg@example.org"}, rcpt, textproto.Header{}, true},
+		{"recipient", Envelope{}, RecipientInfo{FinalRecipient: "jörg@example.com", Action: ActionFailed, Status: smtp.EnhancedCode{5, 1, 1}}, textproto.Header{}, true},
+		{"header", Envelope{}, rcpt, unicodeHeader, true},
+	} {
+		g := Generator{AutoDetectUTF8: true}
+		var body bytes.Buffer
+		if _, err := g.Generate(!test.utf8, test.envelope, ReportingMTAInfo{ReportingMTA: "mx.example.org"}, []RecipientInfo{test.rcpt}, test.header, &body); err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.Contains(body.String(), "message/global-delivery-status"); got != test.utf8 {
+			t.Errorf("%s: utf8 = %v, want %v", test.name, got, test.utf8)
+		}
+	}
+}
+
+func TestSevenBit(t *testing.T) {
+	rcpt := RecipientInfo{
+		FinalRecipient: "rcpt@example.com",
+		Action:         ActionFailed,
+		Status:         smtp.EnhancedCode{5, 1, 1},
+		DiagnosticCode: &smtp.SMTPError{Code: 550, EnhancedCode: smtp.EnhancedCode{5, 1, 1}, Message: "Empfänger unbekannt"},
+	}
+	header := textproto.Header{}
+	header.Add("Subject", "Grüße")
+
+	g := Generator{SevenBit: true}
+	var body bytes.Buffer
+	if _, err := g.Generate(true, Envelope{}, ReportingMTAInfo{ReportingMTA: "mx.example.org"}, []RecipientInfo{rcpt}, header, &body); err != nil {
+		t.Fatal(err)
+	}
+	out := body.String()
+	if !isASCII(out) {
+		t.Errorf("output contains non-ASCII characters:\n%s", out)
+	}
+	for _, want := range []string{
+		"message/delivery-status",
+		"Content-Transfer-Encoding: quoted-printable",
+		"text/rfc822-headers",
+		"Diagnostic-Code: smtp; 550 5.1.1 =?utf-8?q?Empf=C3=A4nger_unbekannt?=",
+		"Subject: Gr=C3=BC=C3=9Fe",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output does not contain %q:\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, "8bit") {
+		t.Errorf("output declares 8bit:\n%s", out)
+	}
+}
+
+func TestUnicodeLocalPartDowngrade(t *testing.T) {
+	rcpt := RecipientInfo{FinalRecipient: "jörg+x@bücher.example", Action: ActionFailed, Status: smtp.EnhancedCode{5, 1, 1}}
+	var buf bytes.Buffer
+	if err := rcpt.WriteTo(false, &buf); err != nil {
+		t.Fatal(err)
+	}
+	want := `Final-Recipient: utf-8; j\x{F6}rg\x{2B}x@b\x{FC}cher.example`
+	if !strings.Contains(buf.String(), want) {
+		t.Errorf("WriteTo() =\n%s\nwant it to contain %q", buf.String(), want)
+	}
+
+	var msg, body bytes.Buffer
+	h, err := GenerateDSN(false, Envelope{}, ReportingMTAInfo{ReportingMTA: "mx.example.org"}, []RecipientInfo{rcpt}, textproto.Header{}, &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := textproto.WriteHeader(&msg, h); err != nil {
+		t.Fatal(err)
+	}
+	msg.Write(body.Bytes())
+	rep, err := ParseDSN(&msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := rep.Recipients[0].FinalRecipient; got != rcpt.FinalRecipient {
+		t.Errorf("parsed FinalRecipient = %q, want %q", got, rcpt.FinalRecipient)
+	}
+}
+
+func TestEncodedWordHeader(t *testing.T) {
+	envelope := Envelope{From: "Mailer-Daemon <postmaster@example.org>", To: "Jörg Müller <joerg@example.com>"}
+	profile := &Profile{Subject: "Zustellung fehlgeschlagen – Rückmeldung"}
+	rcpts := []RecipientInfo{{FinalRecipient: "rcpt@example.com", Action: ActionFailed, Status: smtp.EnhancedCode{5, 1, 1}}}
+
+	for _, test := range []struct {
+		utf8    bool
+		subject string
+		to      string
+	}{
+		{false, "=?utf-8?q?Zustellung_fehlgeschlagen_=E2=80=93_R=C3=BCckmeldung?=", "=?utf-8?q?J=C3=B6rg_M=C3=BCller?= <joerg@example.com>"},
+		{true, "Zustellung fehlgeschlagen – Rückmeldung", "Jörg Müller <joerg@example.com>"},
+	} {
+		g := Generator{Profile: profile}
+		h, err := g.Generate(test.utf8, envelope, ReportingMTAInfo{ReportingMTA: "mx.example.org"}, rcpts, textproto.Header{}, &bytes.Buffer{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := h.Get("Subject"); got != test.subject {
+			t.Errorf("utf8=%v: Subject = %q, want %q", test.utf8, got, test.subject)
+		}
+		if got := h.Get("To"); got != test.to {
+			t.Errorf("utf8=%v: To = %q, want %q", test.utf8, got, test.to)
+		}
+		if got := h.Get("From"); got != envelope.From {
+			t.Errorf("utf8=%v: From = %q, want %q", test.utf8, got, envelope.From)
+		}
+	}
+}
+
+func TestThreadingFields(t *testing.T) {
+	rcpts := []RecipientInfo{{FinalRecipient: "rcpt@example.com", Action: ActionFailed, Status: smtp.EnhancedCode{5, 1, 1}}}
+	mtaInfo := ReportingMTAInfo{ReportingMTA: "mx.example.org"}
+	failedHeader := textproto.Header{}
+	failedHeader.Add("Message-Id", "<msg@example.org>")
+	failedHeader.Add("References", "<a@example.org>  <b@example.org>")
+
+	h, err := GenerateDSN(false, Envelope{}, mtaInfo, rcpts, failedHeader, &bytes.Buffer{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := h.Get("In-Reply-To"); got != "<msg@example.org>" {
+		t.Errorf("In-Reply-To = %q", got)
+	}
+	if got, want := h.Get("References"), "<a@example.org> <b@example.org> <msg@example.org>"; got != want {
+		t.Errorf("References = %q, want %q", got, want)
+	}
+
+	msg := "Message-Id: <full@example.org>\r\nSubject: Hello\r\n\r\nHello\r\n"
+	var body bytes.Buffer
+	h, err = GenerateFullDSN(false, Envelope{}, mtaInfo, rcpts, strings.NewReader(msg), &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := h.Get("In-Reply-To"); got != "<full@example.org>" {
+		t.Errorf("GenerateFullDSN: In-Reply-To = %q", got)
+	}
+	if !strings.Contains(body.String(), msg) {
+		t.Errorf("GenerateFullDSN: message not returned unchanged:\n%s", body.String())
+	}
+
+	// References set by the caller replace the automatic fields.
+	extra := textproto.Header{}
+	extra.Add("References", "<thread@example.org>")
+	h, err = GenerateDSN(false, Envelope{Header: extra}, mtaInfo, rcpts, failedHeader, &bytes.Buffer{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if refs := h.FieldsByKey("References"); refs.Len() != 1 || h.Get("References") != "<thread@example.org>" || h.Get("In-Reply-To") != "" {
+		t.Errorf("Envelope.Header References: In-Reply-To = %q, %d References fields, References = %q", h.Get("In-Reply-To"), refs.Len(), h.Get("References"))
+	}
+
+	h, err = GenerateDSN(false, Envelope{}, mtaInfo, rcpts, textproto.Header{}, &bytes.Buffer{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.Get("In-Reply-To") != "" || h.Get("References") != "" {
+		t.Errorf("threading fields without Message-Id: In-Reply-To = %q, References = %q", h.Get("In-Reply-To"), h.Get("References"))
+	}
+}
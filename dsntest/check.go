@@ -0,0 +1,214 @@
+package dsntest
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"strings"
+
+	"github.com/emersion/go-message/textproto"
+	dsn "schneider.vip/go-dsn"
+)
+
+// MaxLineLength is the line length limit of RFC 5322 section 2.1.1,
+// excluding the CRLF.
+const MaxLineLength = 998
+
+// Part is a top-level part of a parsed report.
+type Part struct {
+	Header    textproto.Header
+	MediaType string
+	Params    map[string]string
+}
+
+// Parsed is a generated DSN prepared for checking.
+type Parsed struct {
+	Raw []byte
+
+	// Report is nil if dsn.ParseDSN failed, ParseErr holds the error then.
+	Report   *dsn.Report
+	ParseErr error
+
+	Header    textproto.Header
+	MediaType string
+	Params    map[string]string
+	Parts     []Part
+}
+
+// Parse prepares a complete message for checking. It fails only if the
+// message header cannot be read, everything else is left to the checks.
+func Parse(msg []byte) (*Parsed, error) {
+	br := bufio.NewReader(bytes.NewReader(msg))
+	h, err := textproto.ReadHeader(br)
+	if err != nil {
+		return nil, fmt.Errorf("dsntest: cannot read header: %w", err)
+	}
+
+	p := &Parsed{Raw: msg, Header: h}
+	p.Report, p.ParseErr = dsn.ParseDSN(bytes.NewReader(msg))
+	p.MediaType, p.Params, _ = mime.ParseMediaType(h.Get("Content-Type"))
+
+	if !strings.HasPrefix(p.MediaType, "multipart/") {
+		return p, nil
+	}
+	mr := textproto.NewMultipartReader(br, p.Params["boundary"])
+	for {
+		part, err := mr.NextPart()
+		if err != nil {
+			break
+		}
+		mediaType, params, _ := mime.ParseMediaType(part.Header.Get("Content-Type"))
+		p.Parts = append(p.Parts, Part{Header: part.Header, MediaType: mediaType, Params: params})
+	}
+	return p, nil
+}
+
+// Check verifies a single invariant of a parsed DSN.
+type Check func(p *Parsed) error
+
+// Checks is the list of checks run by Validate if none are given.
+var Checks = []Check{RequiredFields, ContentTypes, StatusMatchesAction, LineLength(MaxLineLength)}
+
+// Validate parses msg and runs the given checks (or Checks) on it. All
+// failures are reported in the returned error.
+func Validate(msg []byte, checks ...Check) error {
+	p, err := Parse(msg)
+	if err != nil {
+		return err
+	}
+	if len(checks) == 0 {
+		checks = Checks
+	}
+
+	var msgs []string
+	for _, check := range checks {
+		if err := check(p); err != nil {
+			msgs = append(msgs, err.Error())
+		}
+	}
+	if len(msgs) != 0 {
+		return errors.New(strings.Join(msgs, "\n"))
+	}
+	return nil
+}
+
+// RequiredFields checks that the fields RFC 3464 requires are present: a
+// Reporting-MTA and at least one recipient block with Final-Recipient,
+// Action and Status.
+func RequiredFields(p *Parsed) error {
+	if p.Report == nil {
+		return fmt.Errorf("required fields: %v", p.ParseErr)
+	}
+	if p.Report.MTAInfo.ReportingMTA == "" {
+		return errors.New("required fields: Reporting-MTA is missing")
+	}
+	if len(p.Report.Recipients) == 0 {
+		return errors.New("required fields: no recipient blocks")
+	}
+	for i, rcpt := range p.Report.Recipients {
+		if rcpt.FinalRecipient == "" || rcpt.Action == "" || rcpt.Status[0] == 0 {
+			return fmt.Errorf("required fields: recipient #%d lacks Final-Recipient, Action or Status", i+1)
+		}
+	}
+	return nil
+}
+
+// ContentTypes checks the multipart/report structure of RFC 3462: a
+// human-readable text part followed by the delivery-status part and
+// optionally the returned content, with content types consistent with the
+// use of RFC 6533 (message/global-*) types.
+func ContentTypes(p *Parsed) error {
+	if p.MediaType != "multipart/report" {
+		return fmt.Errorf("content types: top-level type is %q, want multipart/report", p.MediaType)
+	}
+	if p.Params["report-type"] != "delivery-status" {
+		return fmt.Errorf("content types: report-type is %q, want delivery-status", p.Params["report-type"])
+	}
+	if len(p.Parts) < 2 || len(p.Parts) > 3 {
+		return fmt.Errorf("content types: report has %d parts, want 2 or 3", len(p.Parts))
+	}
+	if !strings.HasPrefix(p.Parts[0].MediaType, "text/") && !strings.HasPrefix(p.Parts[0].MediaType, "multipart/") {
+		return fmt.Errorf("content types: first part is %q, want human-readable text", p.Parts[0].MediaType)
+	}
+
+	global := false
+	switch p.Parts[1].MediaType {
+	case "message/delivery-status":
+	case "message/global-delivery-status":
+		global = true
+	default:
+		return fmt.Errorf("content types: second part is %q, want message/delivery-status", p.Parts[1].MediaType)
+	}
+
+	if len(p.Parts) == 3 {
+		switch p.Parts[2].MediaType {
+		case "message/rfc822-headers", "text/rfc822-headers", "message/rfc822":
+		case "message/global-headers", "message/global":
+			if !global {
+				return fmt.Errorf("content types: %s returned with a message/delivery-status part", p.Parts[2].MediaType)
+			}
+		default:
+			return fmt.Errorf("content types: third part is %q, want returned message or headers", p.Parts[2].MediaType)
+		}
+	}
+	return nil
+}
+
+// StatusMatchesAction checks that every Action is one of the values defined
+// in RFC 3464 section 2.3.3 and that the Status class matches it: 5.x.x or
+// 4.x.x for failed, since a temporary error becomes final once the delivery
+// time expires (e.g. 4.4.7), 4.x.x for delayed and 2.x.x otherwise.
+func StatusMatchesAction(p *Parsed) error {
+	if p.Report == nil {
+		return nil
+	}
+	for i, rcpt := range p.Report.Recipients {
+		ok := false
+		switch rcpt.Action {
+		case dsn.ActionFailed:
+			ok = rcpt.Status[0] == 5 || rcpt.Status[0] == 4
+		case dsn.ActionDelayed:
+			ok = rcpt.Status[0] == 4
+		case dsn.ActionDelivered, dsn.ActionRelayed, dsn.ActionExpanded:
+			ok = rcpt.Status[0] == 2
+		default:
+			return fmt.Errorf("status: recipient #%d has unknown Action %q", i+1, rcpt.Action)
+		}
+		if !ok {
+			return fmt.Errorf("status: recipient #%d has Action %s with Status %d.%d.%d",
+				i+1, rcpt.Action, rcpt.Status[0], rcpt.Status[1], rcpt.Status[2])
+		}
+	}
+	return nil
+}
+
+// LineLength returns a check that no line of the message is longer than max
+// octets, excluding the line terminator.
+func LineLength(max int) Check {
+	return func(p *Parsed) error {
+		r := bufio.NewReader(bytes.NewReader(p.Raw))
+		for n := 1; ; n++ {
+			line, err := r.ReadSlice('\n')
+			length := len(bytes.TrimRight(line, "\r\n"))
+			if err == bufio.ErrBufferFull {
+				length = len(line)
+				for err == bufio.ErrBufferFull {
+					line, err = r.ReadSlice('\n')
+					length += len(bytes.TrimRight(line, "\r\n"))
+				}
+			}
+			if length > max {
+				return fmt.Errorf("line length: line %d is %d octets long, limit is %d", n, length, max)
+			}
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
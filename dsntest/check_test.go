@@ -0,0 +1,171 @@
+package dsntest
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-smtp"
+	dsn "schneider.vip/go-dsn"
+)
+
+func TestValidateGolden(t *testing.T) {
+	msg, err := ioutil.ReadFile("testdata/failed.golden")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Validate(msg); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestValidateFailures(t *testing.T) {
+	msg, err := ioutil.ReadFile("testdata/failed.golden")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		msg     string
+		check   Check
+		wantErr string
+	}{
+		{
+			name:    "status",
+			msg:     strings.Replace(string(msg), "Status: 5.1.1", "Status: 2.0.0", 1),
+			check:   StatusMatchesAction,
+			wantErr: "Action failed with Status 2.0.0",
+		},
+		{
+			name:    "content type",
+			msg:     strings.Replace(string(msg), "message/rfc822-headers", "message/global-headers", 1),
+			check:   ContentTypes,
+			wantErr: "message/global-headers returned",
+		},
+		{
+			name:    "line length",
+			msg:     strings.Replace(string(msg), "Subject: Hello", "Subject: "+strings.Repeat("a", 100), 1),
+			check:   LineLength(78),
+			wantErr: "limit is 78",
+		},
+		{
+			name:    "required fields",
+			msg:     strings.Replace(string(msg), "Reporting-Mta", "X-Reporting-Mta", 1),
+			check:   RequiredFields,
+			wantErr: "Reporting-MTA",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := Validate([]byte(tt.msg), tt.check)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Validate() = %v, want error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// TestValidateGenerated checks randomly generated reports against all
+// invariants.
+func TestValidateGenerated(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	actions := []struct {
+		action dsn.Action
+		class  int
+	}{
+		{dsn.ActionFailed, 5},
+		{dsn.ActionDelayed, 4},
+		{dsn.ActionDelivered, 2},
+		{dsn.ActionRelayed, 2},
+		{dsn.ActionExpanded, 2},
+	}
+
+	for i := 0; i < 100; i++ {
+		var rcpts []dsn.RecipientInfo
+		for j := rnd.Intn(5); j >= 0; j-- {
+			a := actions[rnd.Intn(len(actions))]
+			status := smtp.EnhancedCode{a.class, rnd.Intn(8), rnd.Intn(10)}
+			rcpts = append(rcpts, dsn.RecipientInfo{
+				FinalRecipient: fmt.Sprintf("rcpt%d@example.net", j),
+				Action:         a.action,
+				Status:         status,
+				DiagnosticCode: &smtp.SMTPError{
+					Code:         a.class*100 + 50,
+					EnhancedCode: status,
+					Message:      strings.Repeat("x", rnd.Intn(200)),
+				},
+			})
+		}
+
+		body := bytes.Buffer{}
+		hdr, err := dsn.GenerateDSN(rnd.Intn(2) == 0, dsn.Envelope{MsgID: "<dsn@example.com>"}, dsn.ReportingMTAInfo{
+			ReportingMTA: "mx.example.com",
+			ArrivalDate:  time.Unix(rnd.Int63n(1<<32), 0),
+		}, rcpts, textproto.Header{}, &body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg, err := Message(hdr, body.Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := Validate(msg); err != nil {
+			t.Fatalf("generated report #%d is invalid: %v\n%s", i, err, msg)
+		}
+	}
+}
+
+// TestValidateWorkflow checks the delayed and the failed DSN of a Workflow,
+// which reports expired temporary errors as failed with 4.4.7.
+func TestValidateWorkflow(t *testing.T) {
+	start := time.Date(2020, 4, 14, 10, 0, 0, 0, time.UTC)
+	now := start
+	clock := dsn.ClockFunc(func() time.Time { return now })
+	w := &dsn.Workflow{
+		Scheduler: dsn.Scheduler{
+			Backoff:   dsn.Backoff{Initial: time.Hour, Max: time.Hour, Jitter: -1},
+			WarnAfter: 2 * time.Hour,
+			Lifetime:  4 * time.Hour,
+			Clock:     clock,
+		},
+		Generator: dsn.Generator{Clock: clock},
+		MTAInfo:   dsn.ReportingMTAInfo{ReportingMTA: "mx.example.org"},
+	}
+	st := &dsn.MessageState{
+		Sender:     "sender@example.org",
+		Recipients: []dsn.RetryState{{Recipient: "slow@example.net"}},
+	}
+	failedHeader := textproto.Header{}
+	failedHeader.Add("Subject", "test")
+
+	var notes []dsn.Notification
+	for hour := 0; hour <= 4; hour++ {
+		now = start.Add(time.Duration(hour) * time.Hour)
+		n, err := w.Record(st, map[string]error{"slow@example.net": fmt.Errorf("connection timed out")}, failedHeader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		notes = append(notes, n...)
+	}
+	if len(notes) != 2 || notes[1].Action != dsn.ActionFailed {
+		t.Fatalf("got %d notifications, want delayed and failed", len(notes))
+	}
+	for _, n := range notes {
+		var msg bytes.Buffer
+		if _, err := n.WriteTo(&msg); err != nil {
+			t.Fatal(err)
+		}
+		if n.Action == dsn.ActionFailed && !bytes.Contains(msg.Bytes(), []byte("Status: 4.4.7")) {
+			t.Errorf("failed DSN does not report 4.4.7:\n%s", msg.Bytes())
+		}
+		if err := Validate(msg.Bytes()); err != nil {
+			t.Errorf("%s DSN: %v", n.Action, err)
+		}
+	}
+}
@@ -0,0 +1,186 @@
+package dsntest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	dsn "schneider.vip/go-dsn"
+)
+
+// Expectation is the content of the JSON sidecar file of a corpus fixture.
+//
+// Empty fields are not checked. Recipients is checked if it is present,
+// "recipients": [] expects a report without recipients.
+type Expectation struct {
+	// Error is set if parsing the fixture is expected to fail.
+	Error bool `json:"error,omitempty"`
+
+	ReportingMTA string              `json:"reporting_mta,omitempty"`
+	Recipients   []ExpectedRecipient `json:"recipients,omitempty"`
+}
+
+// ExpectedRecipient describes a recipient block of a corpus fixture.
+// Recipients are matched by FinalRecipient.
+type ExpectedRecipient struct {
+	FinalRecipient string `json:"final_recipient"`
+	Action         string `json:"action,omitempty"`
+	Status         string `json:"status,omitempty"`
+	RemoteMTA      string `json:"remote_mta,omitempty"`
+	// Diagnostic must be contained in the text of the Diagnostic-Code.
+	Diagnostic string `json:"diagnostic,omitempty"`
+}
+
+// Corpus runs a parser over a directory of captured bounces.
+//
+// Every file with the extension Ext is a fixture, the expected result is read
+// from the file with the same name and a .json extension (see Expectation).
+// If the DSNTEST_UPDATE environment variable is set, the sidecar files are
+// written from the current parser output instead.
+type Corpus struct {
+	Dir string
+	// Ext defaults to ".eml".
+	Ext string
+	// Parse defaults to dsn.ParseDSN.
+	Parse func(r io.Reader) (*dsn.Report, error)
+}
+
+// RunCorpus runs the fixtures in dir against dsn.ParseDSN.
+func RunCorpus(t *testing.T, dir string) {
+	t.Helper()
+	Corpus{Dir: dir}.Run(t)
+}
+
+// Run runs a subtest for every fixture in the corpus.
+func (c Corpus) Run(t *testing.T) {
+	t.Helper()
+
+	ext := c.Ext
+	if ext == "" {
+		ext = ".eml"
+	}
+	parse := c.Parse
+	if parse == nil {
+		parse = dsn.ParseDSN
+	}
+
+	fixtures, err := filepath.Glob(filepath.Join(c.Dir, "*"+ext))
+	if err != nil {
+		t.Fatalf("dsntest: %v", err)
+	}
+	if len(fixtures) == 0 {
+		t.Fatalf("dsntest: no *%s fixtures in %s", ext, c.Dir)
+	}
+
+	for _, path := range fixtures {
+		path := path
+		name := strings.TrimSuffix(filepath.Base(path), ext)
+		t.Run(name, func(t *testing.T) {
+			runFixture(t, path, strings.TrimSuffix(path, ext)+".json", parse)
+		})
+	}
+}
+
+func runFixture(t *testing.T, path, sidecar string, parse func(io.Reader) (*dsn.Report, error)) {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	rep, parseErr := parse(f)
+
+	if os.Getenv(UpdateEnv) != "" {
+		b, err := json.MarshalIndent(expectationOf(rep, parseErr), "", "  ")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(sidecar, append(b, '\n'), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	b, err := ioutil.ReadFile(sidecar)
+	if err != nil {
+		t.Fatalf("dsntest: cannot read expectations (set %s=1 to create them): %v", UpdateEnv, err)
+	}
+	want := Expectation{}
+	if err := json.Unmarshal(b, &want); err != nil {
+		t.Fatalf("dsntest: malformed %s: %v", sidecar, err)
+	}
+
+	if want.Error {
+		if parseErr == nil {
+			t.Error("parsing succeeded, want error")
+		}
+		return
+	}
+	if parseErr != nil {
+		t.Fatalf("parsing failed: %v", parseErr)
+	}
+
+	for _, diff := range compareExpectation(want, expectationOf(rep, nil)) {
+		t.Error(diff)
+	}
+}
+
+func expectationOf(rep *dsn.Report, err error) Expectation {
+	if err != nil {
+		return Expectation{Error: true}
+	}
+
+	exp := Expectation{ReportingMTA: rep.MTAInfo.ReportingMTA}
+	for _, rcpt := range rep.Recipients {
+		er := ExpectedRecipient{
+			FinalRecipient: rcpt.FinalRecipient,
+			Action:         string(rcpt.Action),
+			Status:         fmt.Sprintf("%d.%d.%d", rcpt.Status[0], rcpt.Status[1], rcpt.Status[2]),
+			RemoteMTA:      rcpt.RemoteMTA,
+		}
+		if rcpt.DiagnosticCode != nil {
+			er.Diagnostic = rcpt.DiagnosticCode.Error()
+		}
+		exp.Recipients = append(exp.Recipients, er)
+	}
+	return exp
+}
+
+func compareExpectation(want, got Expectation) []string {
+	var diffs []string
+	if want.ReportingMTA != "" && want.ReportingMTA != got.ReportingMTA {
+		diffs = append(diffs, fmt.Sprintf("Reporting-MTA is %q, want %q", got.ReportingMTA, want.ReportingMTA))
+	}
+
+	gotRcpts := make(map[string]ExpectedRecipient, len(got.Recipients))
+	for _, r := range got.Recipients {
+		gotRcpts[strings.ToLower(r.FinalRecipient)] = r
+	}
+	if want.Recipients != nil && len(want.Recipients) != len(got.Recipients) {
+		diffs = append(diffs, fmt.Sprintf("got %d recipients, want %d", len(got.Recipients), len(want.Recipients)))
+	}
+
+	for _, w := range want.Recipients {
+		g, ok := gotRcpts[strings.ToLower(w.FinalRecipient)]
+		if !ok {
+			diffs = append(diffs, fmt.Sprintf("recipient %s is missing", w.FinalRecipient))
+			continue
+		}
+		check := func(field, want, got string) {
+			if want != "" && want != got {
+				diffs = append(diffs, fmt.Sprintf("recipient %s: %s is %q, want %q", w.FinalRecipient, field, got, want))
+			}
+		}
+		check("Action", w.Action, g.Action)
+		check("Status", w.Status, g.Status)
+		check("Remote-MTA", w.RemoteMTA, g.RemoteMTA)
+		if w.Diagnostic != "" && !strings.Contains(g.Diagnostic, w.Diagnostic) {
+			diffs = append(diffs, fmt.Sprintf("recipient %s: Diagnostic-Code %q does not contain %q", w.FinalRecipient, g.Diagnostic, w.Diagnostic))
+		}
+	}
+	return diffs
+}
@@ -0,0 +1,17 @@
+package dsntest
+
+import "testing"
+
+func TestCorpus(t *testing.T) {
+	RunCorpus(t, "testdata/corpus")
+}
+
+func TestCompareExpectationOmittedRecipients(t *testing.T) {
+	got := Expectation{ReportingMTA: "mx.example.com", Recipients: []ExpectedRecipient{{FinalRecipient: "rcpt@example.net"}}}
+	if diffs := compareExpectation(Expectation{ReportingMTA: "mx.example.com"}, got); len(diffs) != 0 {
+		t.Errorf("omitted recipients are checked: %v", diffs)
+	}
+	if diffs := compareExpectation(Expectation{Recipients: []ExpectedRecipient{}}, got); len(diffs) != 1 {
+		t.Errorf("an empty recipient list is not checked: %v", diffs)
+	}
+}
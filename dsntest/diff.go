@@ -0,0 +1,321 @@
+package dsntest
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/mail"
+	nettextproto "net/textproto"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+)
+
+// MaxDateSkew is the largest difference between two date fields that Diff
+// still considers equal.
+var MaxDateSkew = 5 * time.Minute
+
+// reportFields are the top-level header fields compared by Diff. Everything
+// else (Date excepted) differs between any two generated messages anyway.
+var reportFields = []string{"From", "To", "Subject", "Auto-Submitted"}
+
+// dateFields are compared with MaxDateSkew tolerance.
+var dateFields = map[string]bool{
+	"Date":              true,
+	"Arrival-Date":      true,
+	"Last-Attempt-Date": true,
+	"Will-Retry-Until":  true,
+}
+
+// typedFields carry a "type; value" pair, the type is case-insensitive.
+var typedFields = map[string]bool{
+	"Reporting-Mta":      true,
+	"Received-From-Mta":  true,
+	"Final-Recipient":    true,
+	"Original-Recipient": true,
+	"Remote-Mta":         true,
+	"Diagnostic-Code":    true,
+}
+
+type diffReport struct {
+	header    textproto.Header
+	mediaType string
+	params    map[string]string
+	parts     []string
+	perMsg    textproto.Header
+	rcpts     []textproto.Header
+	returned  *textproto.Header
+}
+
+// Diff compares two DSN messages at the field level and describes the
+// differences, one per line. An empty string means the reports are
+// equivalent.
+//
+// MIME boundaries, header field order, the Message-Id, extension (X-) fields
+// and the wording of the human-readable part are ignored. Date fields are
+// considered equal if they are at most MaxDateSkew apart. Recipient blocks are
+// matched by their Final-Recipient field.
+func Diff(a, b io.Reader) (string, error) {
+	ra, err := readDiffReport(a)
+	if err != nil {
+		return "", fmt.Errorf("dsntest: cannot read first report: %w", err)
+	}
+	rb, err := readDiffReport(b)
+	if err != nil {
+		return "", fmt.Errorf("dsntest: cannot read second report: %w", err)
+	}
+
+	var diffs []string
+	for _, k := range reportFields {
+		diffs = append(diffs, diffField("header", k, ra.header.Get(k), rb.header.Get(k))...)
+	}
+	diffs = append(diffs, diffField("header", "Date", ra.header.Get("Date"), rb.header.Get("Date"))...)
+	if ra.mediaType != rb.mediaType {
+		diffs = append(diffs, fmt.Sprintf("header: Content-Type %q != %q", ra.mediaType, rb.mediaType))
+	}
+	if ra.params["report-type"] != rb.params["report-type"] {
+		diffs = append(diffs, fmt.Sprintf("header: report-type %q != %q", ra.params["report-type"], rb.params["report-type"]))
+	}
+	if strings.Join(ra.parts, ", ") != strings.Join(rb.parts, ", ") {
+		diffs = append(diffs, fmt.Sprintf("parts: [%s] != [%s]", strings.Join(ra.parts, ", "), strings.Join(rb.parts, ", ")))
+	}
+
+	diffs = append(diffs, diffHeaders("per-message", ra.perMsg, rb.perMsg)...)
+
+	rcptsA, rcptsB := rcptIndex(ra.rcpts), rcptIndex(rb.rcpts)
+	for _, k := range sortedKeys(rcptsA, rcptsB) {
+		ha, okA := rcptsA[k]
+		hb, okB := rcptsB[k]
+		switch {
+		case !okB:
+			diffs = append(diffs, fmt.Sprintf("recipient %s: only in first report", k))
+		case !okA:
+			diffs = append(diffs, fmt.Sprintf("recipient %s: only in second report", k))
+		default:
+			diffs = append(diffs, diffHeaders("recipient "+k, ha, hb)...)
+		}
+	}
+
+	switch {
+	case ra.returned == nil && rb.returned != nil:
+		diffs = append(diffs, "returned content: only in second report")
+	case ra.returned != nil && rb.returned == nil:
+		diffs = append(diffs, "returned content: only in first report")
+	case ra.returned != nil:
+		diffs = append(diffs, diffReturned(*ra.returned, *rb.returned)...)
+	}
+
+	return strings.Join(diffs, "\n"), nil
+}
+
+func readDiffReport(r io.Reader) (*diffReport, error) {
+	br := bufio.NewReader(r)
+	h, err := textproto.ReadHeader(br)
+	if err != nil {
+		return nil, err
+	}
+	rep := &diffReport{header: h}
+
+	rep.mediaType, rep.params, err = mime.ParseMediaType(h.Get("Content-Type"))
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(rep.mediaType, "multipart/") {
+		return nil, errors.New("not a multipart message")
+	}
+
+	mr := textproto.NewMultipartReader(br, rep.params["boundary"])
+	for {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		mediaType, _, err := mime.ParseMediaType(p.Header.Get("Content-Type"))
+		if err != nil {
+			mediaType = "text/plain"
+		}
+		rep.parts = append(rep.parts, mediaType)
+
+		switch mediaType {
+		case "message/delivery-status", "message/global-delivery-status":
+			blocks, err := readBlocks(p)
+			if err != nil {
+				return nil, err
+			}
+			if len(blocks) > 0 {
+				rep.perMsg = blocks[0]
+				rep.rcpts = blocks[1:]
+			}
+		case "message/rfc822-headers", "message/global-headers", "message/rfc822", "message/global":
+			rh, err := textproto.ReadHeader(bufio.NewReader(p))
+			if err != nil {
+				return nil, err
+			}
+			rep.returned = &rh
+		}
+	}
+	return rep, nil
+}
+
+// readBlocks reads the header-like blocks of a delivery-status body.
+func readBlocks(r io.Reader) ([]textproto.Header, error) {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	text := strings.Replace(string(b), "\r\n", "\n", -1)
+
+	var blocks []textproto.Header
+	for _, chunk := range strings.Split(text, "\n\n") {
+		if strings.TrimSpace(chunk) == "" {
+			continue
+		}
+		h, err := textproto.ReadHeader(bufio.NewReader(strings.NewReader(strings.TrimLeft(chunk, "\n") + "\n\n")))
+		if err != nil {
+			return nil, err
+		}
+		blocks = append(blocks, h)
+	}
+	return blocks, nil
+}
+
+func rcptIndex(rcpts []textproto.Header) map[string]textproto.Header {
+	idx := make(map[string]textproto.Header, len(rcpts))
+	for i, h := range rcpts {
+		k := normalizeValue("Final-Recipient", h.Get("Final-Recipient"))
+		if k == "" {
+			k = fmt.Sprintf("#%d", i+1)
+		}
+		idx[k] = h
+	}
+	return idx
+}
+
+func sortedKeys(a, b map[string]textproto.Header) []string {
+	seen := make(map[string]bool)
+	var keys []string
+	for _, m := range []map[string]textproto.Header{a, b} {
+		for k := range m {
+			if !seen[k] {
+				seen[k] = true
+				keys = append(keys, k)
+			}
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func fieldKeys(h textproto.Header) map[string]string {
+	m := make(map[string]string)
+	fields := h.Fields()
+	for fields.Next() {
+		k := nettextproto.CanonicalMIMEHeaderKey(fields.Key())
+		if strings.HasPrefix(k, "X-") {
+			continue
+		}
+		m[k] = fields.Value()
+	}
+	return m
+}
+
+// diffHeaders compares two delivery-status blocks.
+func diffHeaders(scope string, a, b textproto.Header) []string {
+	fa, fb := fieldKeys(a), fieldKeys(b)
+
+	keys := make([]string, 0, len(fa)+len(fb))
+	for k := range fa {
+		keys = append(keys, k)
+	}
+	for k := range fb {
+		if _, ok := fa[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	var diffs []string
+	for _, k := range keys {
+		diffs = append(diffs, diffField(scope, k, fa[k], fb[k])...)
+	}
+	return diffs
+}
+
+// diffReturned compares the returned headers as unordered sets of fields.
+func diffReturned(a, b textproto.Header) []string {
+	count := func(h textproto.Header) map[string]int {
+		m := make(map[string]int)
+		fields := h.Fields()
+		for fields.Next() {
+			m[nettextproto.CanonicalMIMEHeaderKey(fields.Key())+": "+collapseSpace(fields.Value())]++
+		}
+		return m
+	}
+	ca, cb := count(a), count(b)
+
+	var diffs []string
+	for f, n := range ca {
+		if cb[f] < n {
+			diffs = append(diffs, fmt.Sprintf("returned content: %q only in first report", f))
+		}
+	}
+	for f, n := range cb {
+		if ca[f] < n {
+			diffs = append(diffs, fmt.Sprintf("returned content: %q only in second report", f))
+		}
+	}
+	sort.Strings(diffs)
+	return diffs
+}
+
+func diffField(scope, key, a, b string) []string {
+	key = nettextproto.CanonicalMIMEHeaderKey(key)
+	if dateFields[key] && a != "" && b != "" {
+		ta, errA := mail.ParseDate(a)
+		tb, errB := mail.ParseDate(b)
+		if errA == nil && errB == nil {
+			skew := ta.Sub(tb)
+			if skew < 0 {
+				skew = -skew
+			}
+			if skew <= MaxDateSkew {
+				return nil
+			}
+			return []string{fmt.Sprintf("%s: %s %q != %q (off by %v)", scope, key, a, b, skew)}
+		}
+	}
+
+	if normalizeValue(key, a) == normalizeValue(key, b) {
+		return nil
+	}
+	switch {
+	case a == "":
+		return []string{fmt.Sprintf("%s: %s only in second report (%q)", scope, key, b)}
+	case b == "":
+		return []string{fmt.Sprintf("%s: %s only in first report (%q)", scope, key, a)}
+	}
+	return []string{fmt.Sprintf("%s: %s %q != %q", scope, key, a, b)}
+}
+
+func normalizeValue(key, v string) string {
+	v = collapseSpace(v)
+	if typedFields[nettextproto.CanonicalMIMEHeaderKey(key)] {
+		if i := strings.IndexByte(v, ';'); i >= 0 {
+			v = strings.ToLower(strings.TrimSpace(v[:i])) + "; " + strings.TrimSpace(v[i+1:])
+		}
+	}
+	return v
+}
+
+func collapseSpace(v string) string {
+	return strings.Join(strings.Fields(v), " ")
+}
@@ -0,0 +1,104 @@
+package dsntest
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+const diffReportA = "From: MAILER-DAEMON@example.com\r\n" +
+	"To: sender@example.org\r\n" +
+	"Subject: Undelivered Mail Returned to Sender\r\n" +
+	"Date: Thu, 2 Jan 2020 16:04:05 +0000\r\n" +
+	"Message-Id: <a@example.com>\r\n" +
+	"Content-Type: multipart/report; report-type=delivery-status; boundary=aaa\r\n" +
+	"\r\n" +
+	"--aaa\r\n" +
+	"Content-Type: text/plain\r\n" +
+	"\r\n" +
+	"Your message could not be delivered.\r\n" +
+	"--aaa\r\n" +
+	"Content-Type: message/delivery-status\r\n" +
+	"\r\n" +
+	"Reporting-MTA: dns; mx.example.com\r\n" +
+	"X-Godsn-MsgID: msg1\r\n" +
+	"\r\n" +
+	"Final-Recipient: rfc822; one@example.net\r\n" +
+	"Action: failed\r\n" +
+	"Status: 5.1.1\r\n" +
+	"\r\n" +
+	"Final-Recipient: rfc822; two@example.net\r\n" +
+	"Action: failed\r\n" +
+	"Status: 5.2.2\r\n" +
+	"\r\n" +
+	"--aaa\r\n" +
+	"Content-Type: message/rfc822-headers\r\n" +
+	"\r\n" +
+	"From: sender@example.org\r\n" +
+	"Subject: Hello\r\n" +
+	"\r\n" +
+	"--aaa--\r\n"
+
+// diffReportB is equivalent to diffReportA.
+const diffReportB = "Subject: Undelivered Mail Returned to Sender\r\n" +
+	"To: sender@example.org\r\n" +
+	"From: MAILER-DAEMON@example.com\r\n" +
+	"Date: Thu, 2 Jan 2020 16:05:00 +0000\r\n" +
+	"Message-Id: <b@example.com>\r\n" +
+	"Content-Type: multipart/report; boundary=\"bbb\"; report-type=delivery-status\r\n" +
+	"\r\n" +
+	"--bbb\r\n" +
+	"Content-Type: text/plain\r\n" +
+	"\r\n" +
+	"Delivery failed.\r\n" +
+	"--bbb\r\n" +
+	"Content-Type: message/delivery-status\r\n" +
+	"\r\n" +
+	"Reporting-MTA: DNS;mx.example.com\r\n" +
+	"X-Postfix-Queue-ID: 1234\r\n" +
+	"\r\n" +
+	"Final-Recipient: rfc822; two@example.net\r\n" +
+	"Status: 5.2.2\r\n" +
+	"Action: failed\r\n" +
+	"\r\n" +
+	"Final-Recipient: RFC822; one@example.net\r\n" +
+	"Action: failed\r\n" +
+	"Status: 5.1.1\r\n" +
+	"\r\n" +
+	"--bbb\r\n" +
+	"Content-Type: message/rfc822-headers\r\n" +
+	"\r\n" +
+	"Subject: Hello\r\n" +
+	"From: sender@example.org\r\n" +
+	"\r\n" +
+	"--bbb--\r\n"
+
+func TestDiffEqual(t *testing.T) {
+	d, err := Diff(strings.NewReader(diffReportA), strings.NewReader(diffReportB))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d != "" {
+		t.Errorf("Diff() reported differences for equivalent reports:\n%s", d)
+	}
+}
+
+func TestDiffDifferent(t *testing.T) {
+	b := strings.Replace(diffReportB, "Status: 5.2.2", "Status: 4.2.2", 1)
+	b = strings.Replace(b, "16:05:00", "18:05:00", 1)
+	b = strings.Replace(b, "Subject: Hello\r\n", "", 1)
+
+	d, err := Diff(strings.NewReader(diffReportA), bytes.NewReader([]byte(b)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		`recipient rfc822; two@example.net: Status "5.2.2" != "4.2.2"`,
+		"header: Date",
+		`returned content: "Subject: Hello" only in first report`,
+	} {
+		if !strings.Contains(d, want) {
+			t.Errorf("Diff() = %q, want it to contain %q", d, want)
+		}
+	}
+}
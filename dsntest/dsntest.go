@@ -0,0 +1,112 @@
+// Package dsntest contains helpers for testing code that generates DSNs
+// with the dsn package.
+//
+// Generated reports carry values that change on every run (the Date field,
+// the random MIME boundary, the Message-Id), Normalize replaces them with
+// fixed placeholders so the output can be compared against golden files.
+package dsntest
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+
+	"github.com/emersion/go-message/textproto"
+)
+
+const (
+	// NormalizedDate is the value Date fields are replaced with.
+	NormalizedDate = "Thu, 1 Jan 1970 00:00:00 +0000"
+	// NormalizedMessageID is the value Message-Id fields are replaced with.
+	NormalizedMessageID = "<normalized@dsntest>"
+	// NormalizedBoundary is the value MIME boundaries are replaced with.
+	NormalizedBoundary = "BOUNDARY"
+)
+
+// UpdateEnv is the environment variable that makes Golden rewrite the golden
+// files with the current output instead of comparing against them.
+const UpdateEnv = "DSNTEST_UPDATE"
+
+var (
+	dateRe     = regexp.MustCompile(`(?im)^(Date:[ \t]*)[^\r\n]*`)
+	msgIDRe    = regexp.MustCompile(`(?im)^(Message-Id:[ \t]*)[^\r\n]*`)
+	boundaryRe = regexp.MustCompile(`(?i)boundary="?([^";\r\n]+)"?`)
+)
+
+// Normalize replaces run-dependent values in a generated message with fixed
+// placeholders and converts CRLF line endings to LF.
+//
+// msg may be a complete message or just the body written by GenerateDSN. In
+// the latter case the boundary is taken from the first delimiter line. The
+// result is a copy, msg and the header it was serialized from are not
+// modified.
+func Normalize(msg []byte) []byte {
+	out := bytes.Replace(msg, []byte("\r\n"), []byte("\n"), -1)
+
+	var boundaries []string
+	for _, m := range boundaryRe.FindAllSubmatch(out, -1) {
+		boundaries = append(boundaries, string(m[1]))
+	}
+	if bytes.HasPrefix(out, []byte("--")) {
+		line := out[2:]
+		if i := bytes.IndexByte(line, '\n'); i >= 0 {
+			line = line[:i]
+		}
+		boundaries = append(boundaries, string(bytes.TrimSpace(line)))
+	}
+	for _, b := range boundaries {
+		if b == "" || b == NormalizedBoundary {
+			continue
+		}
+		out = bytes.Replace(out, []byte(b), []byte(NormalizedBoundary), -1)
+	}
+
+	out = dateRe.ReplaceAll(out, []byte("${1}"+NormalizedDate))
+	out = msgIDRe.ReplaceAll(out, []byte("${1}"+NormalizedMessageID))
+	return out
+}
+
+// Message serializes the report header returned by GenerateDSN followed by
+// the body written to its outWriter.
+func Message(h textproto.Header, body []byte) ([]byte, error) {
+	buf := bytes.Buffer{}
+	if err := textproto.WriteHeader(&buf, h); err != nil {
+		return nil, err
+	}
+	buf.Write(body)
+	return buf.Bytes(), nil
+}
+
+// Golden compares the normalized form of got against the golden file
+// testdata/<name>.golden and fails the test if they differ.
+//
+// If the DSNTEST_UPDATE environment variable is set to a non-empty value the
+// golden file is (re)written instead.
+func Golden(tb testing.TB, name string, got []byte) {
+	tb.Helper()
+
+	path := filepath.Join("testdata", name+".golden")
+	got = Normalize(got)
+
+	if os.Getenv(UpdateEnv) != "" {
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			tb.Fatalf("dsntest: cannot create golden directory: %v", err)
+		}
+		if err := ioutil.WriteFile(path, got, 0o644); err != nil {
+			tb.Fatalf("dsntest: cannot update golden file: %v", err)
+		}
+		return
+	}
+
+	want, err := ioutil.ReadFile(path)
+	if err != nil {
+		tb.Fatalf("dsntest: cannot read golden file (set %s=1 to create it): %v", UpdateEnv, err)
+	}
+	want = Normalize(want)
+	if !bytes.Equal(got, want) {
+		tb.Errorf("dsntest: output differs from %s:\n--- got\n%s\n--- want\n%s", path, got, want)
+	}
+}
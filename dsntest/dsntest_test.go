@@ -0,0 +1,127 @@
+package dsntest
+
+import (
+	"bytes"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-smtp"
+	dsn "schneider.vip/go-dsn"
+)
+
+func TestNormalize(t *testing.T) {
+	in := "Date: Mon, 2 Jan 2006 15:04:05 -0700\r\n" +
+		"Message-Id: <123@example.org>\r\n" +
+		"Content-Type: multipart/report; boundary=abc123\r\n" +
+		"\r\n" +
+		"--abc123\r\n" +
+		"\r\n" +
+		"text\r\n" +
+		"--abc123--\r\n"
+	want := "Date: " + NormalizedDate + "\n" +
+		"Message-Id: " + NormalizedMessageID + "\n" +
+		"Content-Type: multipart/report; boundary=BOUNDARY\n" +
+		"\n" +
+		"--BOUNDARY\n" +
+		"\n" +
+		"text\n" +
+		"--BOUNDARY--\n"
+
+	if got := Normalize([]byte(in)); string(got) != want {
+		t.Errorf("Normalize() = %q, want %q", got, want)
+	}
+}
+
+func TestNormalizeBodyOnly(t *testing.T) {
+	in := "--abc123\r\n\r\ntext\r\n--abc123--\r\n"
+	want := "--BOUNDARY\n\ntext\n--BOUNDARY--\n"
+
+	if got := Normalize([]byte(in)); string(got) != want {
+		t.Errorf("Normalize() = %q, want %q", got, want)
+	}
+}
+
+func TestNormalizeKeepsInput(t *testing.T) {
+	var body bytes.Buffer
+	rcpts := []dsn.RecipientInfo{{FinalRecipient: "rcpt@example.com", Action: dsn.ActionFailed, Status: smtp.EnhancedCode{5, 1, 1}}}
+	h, err := dsn.GenerateDSN(false, dsn.Envelope{MsgID: "<dsn@example.org>"}, dsn.ReportingMTAInfo{ReportingMTA: "mx.example.org"}, rcpts, textproto.Header{}, &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	date := h.Get("Date")
+	msg, err := Message(h, body.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Without CRLF line endings nothing is converted before the fields are
+	// replaced.
+	msg = bytes.Replace(msg, []byte("\r\n"), []byte("\n"), -1)
+	orig := append([]byte(nil), msg...)
+
+	Normalize(msg)
+	if !bytes.Equal(msg, orig) {
+		t.Error("Normalize() modified its argument")
+	}
+	if h.Get("Date") != date || h.Get("Message-Id") != "<dsn@example.org>" {
+		t.Errorf("Normalize() modified the header: Date = %q, Message-Id = %q", h.Get("Date"), h.Get("Message-Id"))
+	}
+}
+
+func TestGolden(t *testing.T) {
+	body := bytes.Buffer{}
+	failedHeader := textproto.Header{}
+	failedHeader.Add("Subject", "Hello")
+	failedHeader.Add("From", "sender@example.org")
+
+	hdr, err := dsn.GenerateDSN(false, dsn.Envelope{
+		MsgID: "<dsn1@example.com>",
+		From:  "MAILER-DAEMON@example.com",
+		To:    "sender@example.org",
+	}, dsn.ReportingMTAInfo{
+		ReportingMTA:    "mx.example.com",
+		XSender:         "sender@example.org",
+		XMessageID:      "msg1",
+		ArrivalDate:     time.Date(2020, 01, 02, 15, 04, 05, 0, time.UTC),
+		LastAttemptDate: time.Date(2020, 01, 02, 16, 04, 05, 0, time.UTC),
+	}, []dsn.RecipientInfo{{
+		FinalRecipient: "rcpt@example.net",
+		RemoteMTA:      "mx.example.net",
+		Action:         dsn.ActionFailed,
+		Status:         smtp.EnhancedCode{5, 1, 1},
+		DiagnosticCode: &smtp.SMTPError{
+			Code:         550,
+			EnhancedCode: smtp.EnhancedCode{5, 1, 1},
+			Message:      "No such user",
+		},
+	}}, failedHeader, &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err := Message(hdr, body.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	Golden(t, "failed", msg)
+}
+
+func TestGoldenMismatch(t *testing.T) {
+	if os.Getenv(UpdateEnv) != "" {
+		t.Skip("golden files are being updated")
+	}
+
+	ft := &fakeTB{TB: t}
+	Golden(ft, "failed", []byte("something else"))
+	if !ft.failed {
+		t.Error("Golden() did not report a mismatch")
+	}
+}
+
+type fakeTB struct {
+	testing.TB
+	failed bool
+}
+
+func (f *fakeTB) Errorf(format string, args ...interface{}) { f.failed = true }
@@ -0,0 +1,104 @@
+package dsntest
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"text/template"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/emersion/go-smtp"
+	dsn "schneider.vip/go-dsn"
+)
+
+// TemplateLineLength is the line length LintTemplate enforces on rendered
+// text, the limit recommended by RFC 5322 section 2.1.1.
+var TemplateLineLength = 78
+
+// SampleMTAInfo returns representative per-message data for rendering
+// human-readable templates, see SampleTemplateData.
+func SampleMTAInfo() dsn.ReportingMTAInfo {
+	return dsn.ReportingMTAInfo{
+		ReportingMTA:    "mx1.mail.example.com",
+		ReceivedFromMTA: "submission.example.org",
+		XSender:         "sender@example.org",
+		XMessageID:      "<20200102150405.1234567@submission.example.org>",
+		ArrivalDate:     time.Date(2020, 01, 02, 15, 04, 05, 0, time.UTC),
+		LastAttemptDate: time.Date(2020, 01, 05, 15, 04, 05, 0, time.UTC),
+	}
+}
+
+// SampleRecipients returns representative recipients for rendering
+// human-readable templates, a failed and a delayed one.
+func SampleRecipients() []dsn.RecipientInfo {
+	return []dsn.RecipientInfo{{
+		FinalRecipient: "rcpt@example.net",
+		RemoteMTA:      "mx.example.net",
+		Action:         dsn.ActionFailed,
+		Status:         smtp.EnhancedCode{5, 1, 1},
+		DiagnosticCode: &smtp.SMTPError{Code: 550, EnhancedCode: smtp.EnhancedCode{5, 1, 1}, Message: "No such user"},
+	}, {
+		FinalRecipient: "other@example.com",
+		Action:         dsn.ActionDelayed,
+		Status:         smtp.EnhancedCode{4, 4, 1},
+		DiagnosticCode: &smtp.SMTPError{Code: 421, Message: "Try again later"},
+		WillRetryUntil: time.Date(2020, 01, 07, 15, 04, 05, 0, time.UTC),
+	}}
+}
+
+// SampleTemplateData returns the TemplateData the Text, HTML and Subjects
+// templates of a Profile are executed with, built from SampleMTAInfo and
+// SampleRecipients.
+func SampleTemplateData() dsn.TemplateData {
+	return dsn.TemplateData{ReportingMTAInfo: SampleMTAInfo(), Recipients: SampleRecipients()}
+}
+
+// LintTemplate renders tmpl with data (SampleTemplateData if nil) and checks
+// the result: every placeholder must resolve, the output must not contain
+// control characters other than tab and newline or invalid UTF-8, and no
+// line may be longer than TemplateLineLength.
+//
+// All problems are reported in the returned error.
+func LintTemplate(tmpl *template.Template, data interface{}) error {
+	if data == nil {
+		data = SampleTemplateData()
+	}
+
+	t, err := tmpl.Clone()
+	if err != nil {
+		return fmt.Errorf("dsntest: cannot clone template: %w", err)
+	}
+	buf := bytes.Buffer{}
+	if err := t.Option("missingkey=error").Execute(&buf, data); err != nil {
+		return fmt.Errorf("dsntest: template %s: %w", tmpl.Name(), err)
+	}
+
+	var problems []string
+	if !utf8.Valid(buf.Bytes()) {
+		problems = append(problems, "output is not valid UTF-8")
+	}
+
+	// Lines are split at '\n' only, so that a '\r' is reported.
+	for i, line := range strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n") {
+		n := i + 1
+		if strings.Contains(line, "<no value>") || strings.Contains(line, "{{") || strings.Contains(line, "}}") {
+			problems = append(problems, fmt.Sprintf("line %d: unresolved placeholder: %q", n, line))
+		}
+		if l := utf8.RuneCountInString(line); l > TemplateLineLength {
+			problems = append(problems, fmt.Sprintf("line %d: %d characters long, limit is %d", n, l, TemplateLineLength))
+		}
+		for _, r := range line {
+			if unicode.IsControl(r) && r != '\t' {
+				problems = append(problems, fmt.Sprintf("line %d: control character %U", n, r))
+				break
+			}
+		}
+	}
+
+	if len(problems) != 0 {
+		return fmt.Errorf("dsntest: template %s:\n%s", tmpl.Name(), strings.Join(problems, "\n"))
+	}
+	return nil
+}
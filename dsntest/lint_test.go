@@ -0,0 +1,73 @@
+package dsntest
+
+import (
+	"strings"
+	"testing"
+	"text/template"
+
+	dsn "schneider.vip/go-dsn"
+)
+
+func TestLintTemplateDefault(t *testing.T) {
+	tmpl := template.Must(template.New("failed").Parse(dsn.FailedTemplateText))
+	if err := LintTemplate(tmpl, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestLintTemplateRecipients(t *testing.T) {
+	tmpl := template.Must(template.New("list").Parse("{{range .Recipients}}{{.FinalRecipient}}: {{.Action}}\n{{end}}at {{.ReportingMTA}}\n"))
+	if err := LintTemplate(tmpl, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestLintTemplate(t *testing.T) {
+	tests := []struct {
+		name    string
+		text    string
+		data    interface{}
+		wantErr string
+	}{
+		{
+			name:    "unknown field",
+			text:    "Message ID: {{.MessageID}}\n",
+			wantErr: "MessageID",
+		},
+		{
+			name:    "missing map key",
+			text:    "Hello {{.name}}\n",
+			data:    map[string]string{},
+			wantErr: "name",
+		},
+		{
+			name:    "long line",
+			text:    strings.Repeat("word ", 20) + "\n",
+			wantErr: "limit is 78",
+		},
+		{
+			name:    "control character",
+			text:    "Ring \a the bell\n",
+			wantErr: "control character U+0007",
+		},
+		{
+			name:    "carriage return",
+			text:    "Line ending\r\n",
+			wantErr: "control character U+000D",
+		},
+		{
+			name:    "leftover braces",
+			text:    "{{`{{.ReportingMTA}}`}}\n",
+			wantErr: "unresolved placeholder",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpl := template.Must(template.New(tt.name).Parse(tt.text))
+			err := LintTemplate(tmpl, tt.data)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("LintTemplate() = %v, want error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,205 @@
+package dsntest
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-smtp"
+	"golang.org/x/net/idna"
+	dsn "schneider.vip/go-dsn"
+)
+
+// RoundTrip generates a DSN from the arguments, parses it back with
+// dsn.ParseDSN and generates it again from the parsed values.
+//
+// It returns an error describing every field that was lost or changed on the
+// way: between the arguments and the first parse, and between the first and
+// the second generated message.
+func RoundTrip(utf8 bool, envelope dsn.Envelope, mtaInfo dsn.ReportingMTAInfo, rcptsInfo []dsn.RecipientInfo, failedHeader textproto.Header) error {
+	first, err := generate(utf8, envelope, mtaInfo, rcptsInfo, failedHeader)
+	if err != nil {
+		return fmt.Errorf("dsntest: cannot generate DSN: %w", err)
+	}
+	rep1, err := dsn.ParseDSN(bytes.NewReader(first))
+	if err != nil {
+		return fmt.Errorf("dsntest: cannot parse generated DSN: %w", err)
+	}
+
+	want := &dsn.Report{
+		UTF8:         utf8,
+		Envelope:     envelope,
+		MTAInfo:      mtaInfo,
+		Recipients:   rcptsInfo,
+		FailedHeader: failedHeader,
+	}
+	diffs := compareReports("first parse", want, rep1)
+
+	second, err := generate(rep1.UTF8, rep1.Envelope, rep1.MTAInfo, rep1.Recipients, rep1.FailedHeader)
+	if err != nil {
+		return fmt.Errorf("dsntest: cannot regenerate DSN: %w", err)
+	}
+	rep2, err := dsn.ParseDSN(bytes.NewReader(second))
+	if err != nil {
+		return fmt.Errorf("dsntest: cannot parse regenerated DSN: %w", err)
+	}
+	diffs = append(diffs, compareReports("second parse", rep1, rep2)...)
+
+	d, err := Diff(bytes.NewReader(first), bytes.NewReader(second))
+	if err != nil {
+		return err
+	}
+	if d != "" {
+		diffs = append(diffs, strings.Split(d, "\n")...)
+	}
+
+	if len(diffs) != 0 {
+		return errors.New("dsntest: round trip is lossy:\n" + strings.Join(diffs, "\n"))
+	}
+	return nil
+}
+
+func generate(utf8 bool, envelope dsn.Envelope, mtaInfo dsn.ReportingMTAInfo, rcptsInfo []dsn.RecipientInfo, failedHeader textproto.Header) ([]byte, error) {
+	body := bytes.Buffer{}
+	hdr, err := dsn.GenerateDSN(utf8, envelope, mtaInfo, rcptsInfo, failedHeader, &body)
+	if err != nil {
+		return nil, err
+	}
+	return Message(hdr, body.Bytes())
+}
+
+// compareReports reports the differences between the fields of two reports
+// that are carried through generation.
+func compareReports(scope string, want, got *dsn.Report) []string {
+	var diffs []string
+	check := func(field string, equal bool, want, got string) {
+		if !equal {
+			diffs = append(diffs, fmt.Sprintf("%s: %s is %q, want %q", scope, field, got, want))
+		}
+	}
+
+	check("UTF8", want.UTF8 == got.UTF8, fmt.Sprint(want.UTF8), fmt.Sprint(got.UTF8))
+	check("Message-Id", want.Envelope.MsgID == got.Envelope.MsgID, want.Envelope.MsgID, got.Envelope.MsgID)
+	check("From", want.Envelope.From == got.Envelope.From, want.Envelope.From, got.Envelope.From)
+	check("To", want.Envelope.To == got.Envelope.To, want.Envelope.To, got.Envelope.To)
+
+	wm, gm := want.MTAInfo, got.MTAInfo
+	check("Reporting-MTA", sameDomain(wm.ReportingMTA, gm.ReportingMTA), wm.ReportingMTA, gm.ReportingMTA)
+	check("Reporting-MTA type", sameType(wm.ReportingMTAType, gm.ReportingMTAType, "dns"), wm.ReportingMTAType, gm.ReportingMTAType)
+	check("Received-From-MTA", sameDomain(wm.ReceivedFromMTA, gm.ReceivedFromMTA), wm.ReceivedFromMTA, gm.ReceivedFromMTA)
+	if wm.ReceivedFromMTA != "" {
+		check("Received-From-MTA type", sameType(wm.ReceivedFromMTAType, gm.ReceivedFromMTAType, "dns"), wm.ReceivedFromMTAType, gm.ReceivedFromMTAType)
+	}
+	if wm.XMTAName != "" && (wm.XSender != "" || wm.XMessageID != "") {
+		check("XMTAName", strings.EqualFold(strings.TrimSpace(wm.XMTAName), gm.XMTAName), wm.XMTAName, gm.XMTAName)
+	}
+	check("XSender", sameAddr(wm.XSender, gm.XSender), wm.XSender, gm.XSender)
+	check("XMessageID", wm.XMessageID == gm.XMessageID, wm.XMessageID, gm.XMessageID)
+	check("Arrival-Date", sameTime(wm.ArrivalDate, gm.ArrivalDate), wm.ArrivalDate.String(), gm.ArrivalDate.String())
+	check("Last-Attempt-Date", sameTime(wm.LastAttemptDate, gm.LastAttemptDate), wm.LastAttemptDate.String(), gm.LastAttemptDate.String())
+	we, ge := headerFields(wm.ExtensionFields), headerFields(gm.ExtensionFields)
+	check("extension fields", strings.Join(we, "\n") == strings.Join(ge, "\n"), strings.Join(we, ", "), strings.Join(ge, ", "))
+
+	if len(want.Recipients) != len(got.Recipients) {
+		diffs = append(diffs, fmt.Sprintf("%s: got %d recipients, want %d", scope, len(got.Recipients), len(want.Recipients)))
+	} else {
+		for i, w := range want.Recipients {
+			g := got.Recipients[i]
+			prefix := fmt.Sprintf("recipient #%d ", i+1)
+			check(prefix+"Final-Recipient", sameAddr(w.FinalRecipient, g.FinalRecipient), w.FinalRecipient, g.FinalRecipient)
+			check(prefix+"Original-Recipient", sameAddr(w.OriginalRecipient, g.OriginalRecipient), w.OriginalRecipient, g.OriginalRecipient)
+			if w.OriginalRecipient != "" {
+				check(prefix+"Original-Recipient type", sameType(w.OriginalRecipientType, g.OriginalRecipientType, "rfc822"), w.OriginalRecipientType, g.OriginalRecipientType)
+			}
+			check(prefix+"Remote-MTA", sameDomain(w.RemoteMTA, g.RemoteMTA), w.RemoteMTA, g.RemoteMTA)
+			if w.RemoteMTA != "" {
+				check(prefix+"Remote-MTA type", sameType(w.RemoteMTAType, g.RemoteMTAType, "dns"), w.RemoteMTAType, g.RemoteMTAType)
+			}
+			check(prefix+"Action", w.Action == g.Action, string(w.Action), string(g.Action))
+			check(prefix+"Status", w.Status == g.Status, fmt.Sprint(w.Status), fmt.Sprint(g.Status))
+			check(prefix+"Diagnostic-Code", sameError(w.DiagnosticCode, g.DiagnosticCode), fmt.Sprint(w.DiagnosticCode), fmt.Sprint(g.DiagnosticCode))
+			if w.Action == dsn.ActionDelayed {
+				check(prefix+"Will-Retry-Until", sameTime(w.WillRetryUntil, g.WillRetryUntil), w.WillRetryUntil.String(), g.WillRetryUntil.String())
+			}
+			we, ge := headerFields(w.ExtensionFields), headerFields(g.ExtensionFields)
+			check(prefix+"extension fields", strings.Join(we, "\n") == strings.Join(ge, "\n"), strings.Join(we, ", "), strings.Join(ge, ", "))
+		}
+	}
+
+	wh, gh := headerFields(want.FailedHeader), headerFields(got.FailedHeader)
+	check("returned header", strings.Join(wh, "\n") == strings.Join(gh, "\n"), strings.Join(wh, ", "), strings.Join(gh, ", "))
+	return diffs
+}
+
+func sameDomain(a, b string) bool {
+	if a == b {
+		return true
+	}
+	aa, errA := idna.ToASCII(a)
+	ab, errB := idna.ToASCII(b)
+	return errA == nil && errB == nil && strings.EqualFold(aa, ab)
+}
+
+func sameAddr(a, b string) bool {
+	ia, ib := strings.LastIndexByte(a, '@'), strings.LastIndexByte(b, '@')
+	if ia == -1 || ib == -1 {
+		return a == b
+	}
+	return a[:ia] == b[:ib] && sameDomain(a[ia+1:], b[ib+1:])
+}
+
+// sameType compares address or MTA name types, an empty type is def.
+func sameType(a, b, def string) bool {
+	if a == "" {
+		a = def
+	}
+	if b == "" {
+		b = def
+	}
+	return strings.EqualFold(a, b)
+}
+
+func sameTime(a, b time.Time) bool {
+	return a.Truncate(time.Second).Equal(b.Truncate(time.Second))
+}
+
+func sameError(a, b error) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+
+	sa, okA := a.(*smtp.SMTPError)
+	sb, okB := b.(*smtp.SMTPError)
+	if okA != okB {
+		return false
+	}
+	if okA {
+		if sa.EnhancedCode[0] > 0 || sb.EnhancedCode[0] > 0 {
+			if sa.EnhancedCode != sb.EnhancedCode {
+				return false
+			}
+		}
+		return sa.Code == sb.Code && collapseSpace(sa.Message) == collapseSpace(sb.Message)
+	}
+	da, okA := a.(*dsn.DiagnosticError)
+	db, okB := b.(*dsn.DiagnosticError)
+	if okA && okB && !strings.EqualFold(da.Type, db.Type) {
+		return false
+	}
+	return collapseSpace(a.Error()) == collapseSpace(b.Error())
+}
+
+// headerFields returns the sorted "Key: value" lines of h.
+func headerFields(h textproto.Header) []string {
+	var lines []string
+	fields := h.Fields()
+	for fields.Next() {
+		lines = append(lines, strings.ToLower(fields.Key())+": "+collapseSpace(fields.Value()))
+	}
+	sort.Strings(lines)
+	return lines
+}
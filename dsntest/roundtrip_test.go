@@ -0,0 +1,146 @@
+package dsntest
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-smtp"
+	dsn "schneider.vip/go-dsn"
+)
+
+func TestRoundTrip(t *testing.T) {
+	failedHeader := textproto.Header{}
+	failedHeader.Add("Subject", "Hello")
+	failedHeader.Add("From", "sender@example.org")
+
+	mtaInfo := dsn.ReportingMTAInfo{
+		ReportingMTA:    "mx.example.com",
+		ReceivedFromMTA: "relay.example.org",
+		XMTAName:        "Godsn",
+		XSender:         "sender@example.org",
+		XMessageID:      "msg1",
+		ArrivalDate:     time.Date(2020, 01, 02, 15, 04, 05, 0, time.UTC),
+		LastAttemptDate: time.Date(2020, 01, 02, 16, 04, 05, 0, time.UTC),
+	}
+	envelope := dsn.Envelope{
+		MsgID: "<dsn1@example.com>",
+		From:  "MAILER-DAEMON@example.com",
+		To:    "sender@example.org",
+	}
+	rcpts := []dsn.RecipientInfo{{
+		FinalRecipient: "rcpt@example.net",
+		RemoteMTA:      "mx.example.net",
+		Action:         dsn.ActionFailed,
+		Status:         smtp.EnhancedCode{5, 1, 1},
+		DiagnosticCode: &smtp.SMTPError{
+			Code:         550,
+			EnhancedCode: smtp.EnhancedCode{5, 1, 1},
+			Message:      "No such user",
+		},
+	}, {
+		FinalRecipient: "other@bücher.example",
+		Action:         dsn.ActionDelayed,
+		Status:         smtp.EnhancedCode{4, 4, 1},
+		DiagnosticCode: &smtp.SMTPError{Code: 421, Message: "Try again later"},
+	}}
+
+	for _, utf8 := range []bool{false, true} {
+		if err := RoundTrip(utf8, envelope, mtaInfo, rcpts, failedHeader); err != nil {
+			t.Errorf("RoundTrip(utf8=%v): %v", utf8, err)
+		}
+	}
+}
+
+func TestRoundTripAllFields(t *testing.T) {
+	failedHeader := textproto.Header{}
+	failedHeader.Add("Subject", "Hello")
+
+	msgExt := textproto.Header{}
+	msgExt.Add("DSN-Gateway", "dns; gw.example.org")
+	mtaInfo := dsn.ReportingMTAInfo{
+		ReportingMTA:        "mx.example.com",
+		ReportingMTAType:    "x-local",
+		ReceivedFromMTA:     "relay.example.org",
+		ReceivedFromMTAType: "x-local",
+		XMTAName:            "Godsn",
+		XSender:             "sender@example.org",
+		XMessageID:          "msg1",
+		ArrivalDate:         time.Date(2020, 01, 02, 15, 04, 05, 0, time.UTC),
+		LastAttemptDate:     time.Date(2020, 01, 02, 16, 04, 05, 0, time.UTC),
+		ExtensionFields:     msgExt,
+	}
+	rcptExt := textproto.Header{}
+	rcptExt.Add("X-Mailbox-Id", "42")
+	rcpts := []dsn.RecipientInfo{{
+		FinalRecipient:        "rcpt@example.net",
+		OriginalRecipient:     "alias@example.net",
+		OriginalRecipientType: "rfc822",
+		RemoteMTA:             "mx.example.net",
+		RemoteMTAType:         "x-local",
+		Action:                dsn.ActionDelayed,
+		Status:                smtp.EnhancedCode{4, 4, 1},
+		DiagnosticCode:        &dsn.DiagnosticError{Type: "X-Postfix", Text: "connection timed out"},
+		WillRetryUntil:        time.Date(2020, 01, 05, 15, 04, 05, 0, time.UTC),
+		ExtensionFields:       rcptExt,
+	}}
+	envelope := dsn.Envelope{
+		MsgID: "<dsn1@example.com>",
+		From:  "MAILER-DAEMON@example.com",
+		To:    "sender@example.org",
+	}
+
+	for _, utf8 := range []bool{false, true} {
+		if err := RoundTrip(utf8, envelope, mtaInfo, rcpts, failedHeader); err != nil {
+			t.Errorf("RoundTrip(utf8=%v): %v", utf8, err)
+		}
+	}
+}
+
+func TestRoundTripLossy(t *testing.T) {
+	err := RoundTrip(false, dsn.Envelope{MsgID: "<dsn1@example.com>"}, dsn.ReportingMTAInfo{
+		ReportingMTA: "mx.example.com",
+	}, []dsn.RecipientInfo{{
+		FinalRecipient: "rcpt@example.net",
+		Action:         dsn.ActionFailed,
+		Status:         smtp.EnhancedCode{5, 0, 0},
+		// Non-SMTP diagnostics are dropped in ASCII mode.
+		DiagnosticCode: errors.New("mailbox is full"),
+	}}, textproto.Header{})
+	if err == nil || !strings.Contains(err.Error(), "Diagnostic-Code") {
+		t.Errorf("RoundTrip() = %v, want Diagnostic-Code loss", err)
+	}
+}
+
+func TestCompareReportsFields(t *testing.T) {
+	ext := textproto.Header{}
+	ext.Add("X-Mailbox-Id", "42")
+	want := &dsn.Report{
+		MTAInfo: dsn.ReportingMTAInfo{ReportingMTA: "mx.example.com", ReportingMTAType: "x-local", ExtensionFields: ext},
+		Recipients: []dsn.RecipientInfo{{
+			FinalRecipient:    "rcpt@example.net",
+			OriginalRecipient: "alias@example.net",
+			RemoteMTA:         "mx.example.net",
+			RemoteMTAType:     "x-local",
+			DiagnosticCode:    &dsn.DiagnosticError{Type: "X-Postfix", Text: "timeout"},
+			ExtensionFields:   ext,
+		}},
+	}
+	got := &dsn.Report{
+		MTAInfo: dsn.ReportingMTAInfo{ReportingMTA: "mx.example.com"},
+		Recipients: []dsn.RecipientInfo{{
+			FinalRecipient: "rcpt@example.net",
+			RemoteMTA:      "mx.example.net",
+			DiagnosticCode: &dsn.DiagnosticError{Type: "smtp", Text: "timeout"},
+		}},
+	}
+
+	diffs := strings.Join(compareReports("test", want, got), "\n")
+	for _, field := range []string{"Reporting-MTA type", "extension fields", "Original-Recipient", "Remote-MTA type", "Diagnostic-Code", "recipient #1 extension fields"} {
+		if !strings.Contains(diffs, field) {
+			t.Errorf("no difference reported for %s:\n%s", field, diffs)
+		}
+	}
+}
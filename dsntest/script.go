@@ -0,0 +1,167 @@
+package dsntest
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/emersion/go-smtp"
+)
+
+// errDropped is returned to go-smtp after the connection was closed by a
+// Drop rule, the reply is never seen by the client.
+var errDropped = errors.New("dsntest: connection dropped")
+
+// Rule scripts the server reply to a command. Rules are built with On and
+// OnNth and evaluated in order, the first matching rule wins.
+//
+//	s := &dsntest.Server{Script: []dsntest.Rule{
+//		dsntest.OnNth("RCPT", 2).Reject(452, smtp.EnhancedCode{4, 5, 3}, "Too many recipients"),
+//		dsntest.On("DATA").Drop(),
+//	}}
+type Rule struct {
+	// Command is MAIL, RCPT or DATA. DATA rules are applied after the
+	// message body was received.
+	Command string
+	// Occurrence restricts the rule to the nth time Command is seen by the
+	// server, counted across all connections and starting at 1. Zero matches
+	// every occurrence.
+	Occurrence int
+	// Rcpt restricts RCPT rules, and DATA rules in LMTP mode, to a single
+	// recipient.
+	Rcpt string
+
+	// Err is the reply sent to the client. A rule with neither Err nor
+	// DropConn accepts the command, the Reject* fields of the Server are
+	// not applied.
+	Err error
+	// DropConn closes the connection instead of replying.
+	DropConn bool
+}
+
+// On returns a rule matching every occurrence of command.
+func On(command string) Rule {
+	return Rule{Command: strings.ToUpper(command)}
+}
+
+// OnNth returns a rule matching the nth occurrence of command.
+func OnNth(command string, n int) Rule {
+	return Rule{Command: strings.ToUpper(command), Occurrence: n}
+}
+
+// For restricts the rule to the recipient rcpt.
+func (r Rule) For(rcpt string) Rule {
+	r.Rcpt = rcpt
+	return r
+}
+
+// Reject makes the rule reply with the given SMTP error.
+func (r Rule) Reject(code int, enhCode smtp.EnhancedCode, msg string) Rule {
+	r.Err = &smtp.SMTPError{Code: code, EnhancedCode: enhCode, Message: msg}
+	return r
+}
+
+// Drop makes the rule close the connection without replying.
+func (r Rule) Drop() Rule {
+	r.DropConn = true
+	return r
+}
+
+// script evaluates rules and keeps the occurrence counters.
+type script struct {
+	mu     sync.Mutex
+	counts map[string]int
+	conns  map[string]net.Conn
+	total  int
+}
+
+// next counts an occurrence of command and returns its number.
+func (sc *script) next(command string) int {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if sc.counts == nil {
+		sc.counts = make(map[string]int)
+	}
+	sc.counts[command]++
+	return sc.counts[command]
+}
+
+// match returns the first rule in rules for the nth occurrence of command
+// with recipient rcpt.
+func match(rules []Rule, command string, n int, rcpt string) *Rule {
+	for i, r := range rules {
+		if r.Command != command {
+			continue
+		}
+		if r.Occurrence != 0 && r.Occurrence != n {
+			continue
+		}
+		if r.Rcpt != "" && !strings.EqualFold(r.Rcpt, rcpt) {
+			continue
+		}
+		return &rules[i]
+	}
+	return nil
+}
+
+// trackingListener remembers accepted connections by remote address so that
+// sessions can drop them.
+type trackingListener struct {
+	net.Listener
+	sc *script
+}
+
+func (l trackingListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	l.sc.mu.Lock()
+	defer l.sc.mu.Unlock()
+	if l.sc.conns == nil {
+		l.sc.conns = make(map[string]net.Conn)
+	}
+	tc := &trackedConn{Conn: c, sc: l.sc}
+	l.sc.conns[c.RemoteAddr().String()] = tc
+	l.sc.total++
+	return tc, nil
+}
+
+// trackedConn forgets the connection when it is closed.
+type trackedConn struct {
+	net.Conn
+	sc *script
+}
+
+func (c *trackedConn) Close() error {
+	c.sc.forget(c.RemoteAddr().String(), c)
+	return c.Conn.Close()
+}
+
+// forget removes the connection c of remoteAddr.
+func (sc *script) forget(remoteAddr string, c net.Conn) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if sc.conns[remoteAddr] == c {
+		delete(sc.conns, remoteAddr)
+	}
+}
+
+func (sc *script) drop(remoteAddr string) {
+	sc.mu.Lock()
+	c := sc.conns[remoteAddr]
+	delete(sc.conns, remoteAddr)
+	sc.mu.Unlock()
+
+	if c != nil {
+		c.Close()
+	}
+}
+
+func (sc *script) connections() int {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	return sc.total
+}
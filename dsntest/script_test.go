@@ -0,0 +1,186 @@
+package dsntest
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+func TestScriptRejectNthRcpt(t *testing.T) {
+	s := &Server{Script: []Rule{
+		OnNth("RCPT", 2).Reject(452, smtp.EnhancedCode{4, 5, 3}, "Too many recipients"),
+	}}
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	c, err := smtp.Dial(s.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err := c.Mail("", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, rcpt := range []string{"a@example.net", "b@example.net", "c@example.net"} {
+		err := c.Rcpt(rcpt)
+		if i == 1 {
+			if smtpErr, ok := err.(*smtp.SMTPError); !ok || smtpErr.Code != 452 {
+				t.Errorf("second RCPT error = %v, want 452", err)
+			}
+		} else if err != nil {
+			t.Errorf("RCPT %s: %v", rcpt, err)
+		}
+	}
+}
+
+func TestScriptDropAfterData(t *testing.T) {
+	s := &Server{Script: []Rule{OnNth("DATA", 1).Drop()}}
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	send := func() error {
+		c, err := smtp.Dial(s.Addr)
+		if err != nil {
+			return err
+		}
+		defer c.Close()
+		if err := c.Mail("", nil); err != nil {
+			return err
+		}
+		if err := c.Rcpt("rcpt@example.net"); err != nil {
+			return err
+		}
+		wc, err := c.Data()
+		if err != nil {
+			return err
+		}
+		if _, err := wc.Write([]byte("Subject: test\r\n\r\nbody\r\n")); err != nil {
+			return err
+		}
+		return wc.Close()
+	}
+
+	if err := send(); err == nil {
+		t.Error("first delivery succeeded, want dropped connection")
+	}
+	if err := send(); err != nil {
+		t.Errorf("second delivery: %v", err)
+	}
+	if n := len(s.Transactions()); n != 1 {
+		t.Errorf("got %d transactions, want 1", n)
+	}
+	if n := s.Connections(); n != 2 {
+		t.Errorf("got %d connections, want 2", n)
+	}
+}
+
+func TestScriptLMTPPerRecipient(t *testing.T) {
+	s := &Server{LMTP: true, Script: []Rule{
+		On("DATA").For("full@example.net").Reject(452, smtp.EnhancedCode{4, 2, 2}, "Mailbox full"),
+	}}
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	conn, err := net.Dial("tcp", s.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := smtp.NewClientLMTP(conn, "localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if err := c.Mail("", nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, rcpt := range []string{"ok@example.net", "full@example.net"} {
+		if err := c.Rcpt(rcpt); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	statuses := make(map[string]*smtp.SMTPError)
+	wc, err := c.LMTPData(func(rcpt string, status *smtp.SMTPError) {
+		statuses[rcpt] = status
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wc.Write([]byte("Subject: test\r\n\r\nbody\r\n"))
+	wc.Close()
+
+	if statuses["ok@example.net"] != nil {
+		t.Errorf("ok@example.net status = %v, want success", statuses["ok@example.net"])
+	}
+	if st := statuses["full@example.net"]; st == nil || st.Code != 452 {
+		t.Errorf("full@example.net status = %v, want 452", st)
+	}
+	if txs := s.Transactions(); len(txs) != 1 || len(txs[0].To) != 1 || txs[0].To[0] != "ok@example.net" {
+		t.Errorf("unexpected transactions: %+v", txs)
+	}
+}
+
+func TestScriptAccept(t *testing.T) {
+	rejected := &smtp.SMTPError{Code: 550, EnhancedCode: smtp.EnhancedCode{5, 1, 1}, Message: "No such user"}
+	s := &Server{
+		RejectRcpt: map[string]error{"a@example.net": rejected, "b@example.net": rejected},
+		Script:     []Rule{OnNth("RCPT", 1)},
+	}
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	c, err := smtp.Dial(s.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err := c.Mail("", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Rcpt("a@example.net"); err != nil {
+		t.Errorf("first RCPT: %v, want it accepted by the script", err)
+	}
+	if err := c.Rcpt("b@example.net"); err == nil {
+		t.Error("second RCPT accepted, want RejectRcpt applied")
+	}
+}
+
+func TestScriptForgetsClosedConnections(t *testing.T) {
+	s := NewServer(t)
+	for i := 0; i < 3; i++ {
+		c, err := smtp.Dial(s.Addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := c.Quit(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	open := func() int {
+		s.sc.mu.Lock()
+		defer s.sc.mu.Unlock()
+		return len(s.sc.conns)
+	}
+	for deadline := time.Now().Add(time.Second); open() != 0 && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	if n := open(); n != 0 {
+		t.Errorf("%d closed connections are still tracked", n)
+	}
+	if n := s.Connections(); n != 3 {
+		t.Errorf("Connections() = %d, want 3", n)
+	}
+}
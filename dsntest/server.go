@@ -0,0 +1,302 @@
+package dsntest
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+// Transaction is a mail transaction accepted by Server.
+type Transaction struct {
+	// From is the reverse-path without angle brackets, empty for <>.
+	From     string
+	MailOpts smtp.MailOptions
+	// To lists the accepted recipients, rejected ones are not included.
+	To   []string
+	Data []byte
+	// Username is the authenticated user, empty for anonymous sessions.
+	Username string
+}
+
+// Server is a fake SMTP server listening on the loopback interface that
+// records all transactions it receives.
+//
+// The exported fields configure its behavior and must be set before Start is
+// called.
+type Server struct {
+	// RejectMail, if set, is returned for every MAIL command.
+	RejectMail error
+	// RejectRcpt maps recipient addresses to the error returned for them.
+	RejectRcpt map[string]error
+	// RejectData, if set, is returned after the message body was received.
+	RejectData error
+
+	// Username and Password enable AUTH PLAIN. If Username is set, anonymous
+	// sessions are rejected.
+	Username string
+	Password string
+
+	// StartTLS makes the server advertise STARTTLS using a self-signed
+	// certificate, see ClientTLSConfig.
+	StartTLS bool
+
+	// LMTP makes the server speak LMTP (RFC 2033) instead of SMTP.
+	LMTP bool
+
+	// Script lists rules applied before the Reject* fields.
+	Script []Rule
+
+	// Addr is the address the server listens on. It is set by Start.
+	Addr string
+
+	srv       *smtp.Server
+	clientTLS *tls.Config
+	sc        script
+
+	mu   sync.Mutex
+	msgs []Transaction
+}
+
+// NewServer starts a Server with the default configuration and stops it
+// when the test completes.
+func NewServer(tb testing.TB) *Server {
+	tb.Helper()
+
+	s := &Server{}
+	if err := s.Start(); err != nil {
+		tb.Fatalf("dsntest: cannot start server: %v", err)
+	}
+	tb.Cleanup(func() { s.Close() })
+	return s
+}
+
+// Start starts listening on a random loopback port.
+func (s *Server) Start() error {
+	if s.srv != nil {
+		return errors.New("dsntest: server already started")
+	}
+
+	srv := smtp.NewServer(backend{s})
+	srv.Domain = "dsntest.localhost"
+	srv.ErrorLog = log.New(ioutil.Discard, "", 0)
+	srv.EnableSMTPUTF8 = true
+	srv.AllowInsecureAuth = !s.StartTLS
+	srv.AuthDisabled = s.Username == ""
+	srv.LMTP = s.LMTP
+
+	if s.StartTLS {
+		cert, err := selfSigned()
+		if err != nil {
+			return err
+		}
+		srv.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+
+		pool := x509.NewCertPool()
+		pool.AddCert(cert.Leaf)
+		s.clientTLS = &tls.Config{RootCAs: pool, ServerName: "localhost"}
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	s.Addr = l.Addr().String()
+	s.srv = srv
+
+	go srv.Serve(trackingListener{Listener: l, sc: &s.sc})
+	return nil
+}
+
+// Close stops the server.
+func (s *Server) Close() error {
+	if s.srv == nil {
+		return nil
+	}
+	return s.srv.Close()
+}
+
+// ClientTLSConfig returns a TLS configuration that trusts the server
+// certificate. It is nil unless StartTLS is set.
+func (s *Server) ClientTLSConfig() *tls.Config {
+	return s.clientTLS
+}
+
+// Connections returns the number of connections accepted so far.
+func (s *Server) Connections() int {
+	return s.sc.connections()
+}
+
+// Transactions returns the transactions accepted so far.
+func (s *Server) Transactions() []Transaction {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Transaction(nil), s.msgs...)
+}
+
+func (s *Server) record(msg Transaction) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.msgs = append(s.msgs, msg)
+}
+
+type backend struct {
+	s *Server
+}
+
+func (be backend) Login(state *smtp.ConnectionState, username, password string) (smtp.Session, error) {
+	if be.s.Username == "" || username != be.s.Username || password != be.s.Password {
+		return nil, &smtp.SMTPError{
+			Code:         535,
+			EnhancedCode: smtp.EnhancedCode{5, 7, 8},
+			Message:      "Invalid credentials",
+		}
+	}
+	return &session{s: be.s, username: username, remoteAddr: state.RemoteAddr.String()}, nil
+}
+
+func (be backend) AnonymousLogin(state *smtp.ConnectionState) (smtp.Session, error) {
+	if be.s.Username != "" {
+		return nil, smtp.ErrAuthRequired
+	}
+	return &session{s: be.s, remoteAddr: state.RemoteAddr.String()}, nil
+}
+
+type session struct {
+	s          *Server
+	username   string
+	remoteAddr string
+	msg        Transaction
+}
+
+// scripted applies the first matching rule of the script, if any. matched
+// reports whether a rule decided the reply, err is the reply.
+func (sess *session) scripted(command, rcpt string) (matched bool, err error) {
+	r := match(sess.s.Script, command, sess.s.sc.next(command), rcpt)
+	if r == nil {
+		return false, nil
+	}
+	if r.DropConn {
+		sess.s.sc.drop(sess.remoteAddr)
+		return true, errDropped
+	}
+	return true, r.Err
+}
+
+func (sess *session) Reset() {
+	sess.msg = Transaction{}
+}
+
+func (sess *session) Logout() error {
+	return nil
+}
+
+func (sess *session) Mail(from string, opts smtp.MailOptions) error {
+	if matched, err := sess.scripted("MAIL", ""); err != nil {
+		return err
+	} else if !matched && sess.s.RejectMail != nil {
+		return sess.s.RejectMail
+	}
+	sess.msg = Transaction{From: from, MailOpts: opts, Username: sess.username}
+	return nil
+}
+
+func (sess *session) Rcpt(to string) error {
+	if matched, err := sess.scripted("RCPT", to); err != nil {
+		return err
+	} else if !matched && sess.s.RejectRcpt[to] != nil {
+		return sess.s.RejectRcpt[to]
+	}
+	sess.msg.To = append(sess.msg.To, to)
+	return nil
+}
+
+func (sess *session) Data(r io.Reader) error {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if matched, err := sess.scripted("DATA", ""); err != nil {
+		return err
+	} else if !matched && sess.s.RejectData != nil {
+		return sess.s.RejectData
+	}
+	sess.msg.Data = b
+	sess.s.record(sess.msg)
+	return nil
+}
+
+// LMTPData is used in LMTP mode, DATA rules with Rcpt set are applied to the
+// status of the matching recipient only.
+func (sess *session) LMTPData(r io.Reader, status smtp.StatusCollector) error {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	n := sess.s.sc.next("DATA")
+	var accepted []string
+	for _, rcpt := range sess.msg.To {
+		rule := match(sess.s.Script, "DATA", n, rcpt)
+		switch {
+		case rule != nil && rule.DropConn:
+			sess.s.sc.drop(sess.remoteAddr)
+			return errDropped
+		case rule != nil && rule.Err != nil:
+			status.SetStatus(rcpt, rule.Err)
+		case rule == nil && sess.s.RejectData != nil:
+			status.SetStatus(rcpt, sess.s.RejectData)
+		default:
+			status.SetStatus(rcpt, nil)
+			accepted = append(accepted, rcpt)
+		}
+	}
+
+	if len(accepted) != 0 {
+		msg := sess.msg
+		msg.To = accepted
+		msg.Data = b
+		sess.s.record(msg)
+	}
+	return nil
+}
+
+// selfSigned generates a short-lived certificate for localhost.
+func selfSigned() (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "dsntest"},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, nil
+}
@@ -0,0 +1,93 @@
+package dsntest
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-sasl"
+	"github.com/emersion/go-smtp"
+)
+
+func TestServerStartTLSAuth(t *testing.T) {
+	s := &Server{Username: "user", Password: "secret", StartTLS: true}
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	c, err := smtp.Dial(s.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if err := c.Mail("sender@example.org", nil); err == nil {
+		t.Fatal("anonymous MAIL accepted")
+	}
+	if err := c.StartTLS(s.ClientTLSConfig()); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Auth(sasl.NewPlainClient("", "user", "secret")); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Mail("sender@example.org", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Rcpt("rcpt@example.net"); err != nil {
+		t.Fatal(err)
+	}
+	wc, err := c.Data()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := wc.Write([]byte("Subject: test\r\n\r\nbody\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err := wc.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	msgs := s.Transactions()
+	if len(msgs) != 1 {
+		t.Fatalf("got %d messages, want 1", len(msgs))
+	}
+	if msgs[0].Username != "user" || msgs[0].From != "sender@example.org" ||
+		len(msgs[0].To) != 1 || !strings.Contains(string(msgs[0].Data), "Subject: test") {
+		t.Errorf("unexpected message recorded: %+v", msgs[0])
+	}
+}
+
+func TestServerReject(t *testing.T) {
+	s := &Server{
+		RejectData: &smtp.SMTPError{Code: 554, EnhancedCode: smtp.EnhancedCode{5, 6, 0}, Message: "Rejected"},
+	}
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	c, err := smtp.Dial(s.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if err := c.Mail("", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Rcpt("rcpt@example.net"); err != nil {
+		t.Fatal(err)
+	}
+	wc, err := c.Data()
+	if err != nil {
+		t.Fatal(err)
+	}
+	wc.Write([]byte("Subject: test\r\n\r\nbody\r\n"))
+	err = wc.Close()
+	if smtpErr, ok := err.(*smtp.SMTPError); !ok || smtpErr.Code != 554 {
+		t.Errorf("Data() error = %v, want 554", err)
+	}
+	if len(s.Transactions()) != 0 {
+		t.Error("rejected message was recorded")
+	}
+}
@@ -0,0 +1,156 @@
+package dsntest
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	nettextproto "net/textproto"
+	"sort"
+	"strings"
+
+	"github.com/emersion/go-message/textproto"
+)
+
+// traceFields are added in transit or on delivery and are not part of the
+// report structure.
+var traceFields = map[string]bool{
+	"return-path":   true,
+	"received":      true,
+	"delivered-to":  true,
+	"x-original-to": true,
+}
+
+// Skeleton describes the structure of a DSN message: the top-level media
+// type and field names, the media type, description and field names of every
+// part, and for every delivery-status block its field names along with the
+// type token of typed fields ("dns", "rfc822", "smtp", ...).
+//
+// Values, boundaries and the human-readable text are not included, so two
+// reports with the same skeleton look the same to tools that parse them by
+// structure. It is meant for comparing generated output with a captured
+// bounce of another MTA.
+func Skeleton(r io.Reader) (string, error) {
+	br := bufio.NewReader(r)
+	h, err := textproto.ReadHeader(br)
+	if err != nil {
+		return "", fmt.Errorf("dsntest: cannot read header: %w", err)
+	}
+
+	sb := strings.Builder{}
+	if err := writeSkeleton(&sb, "", h, br); err != nil {
+		return "", err
+	}
+	return sb.String(), nil
+}
+
+// SameStructure compares the skeletons of two messages and returns an error
+// listing the differing lines.
+func SameStructure(a, b io.Reader) error {
+	sa, err := Skeleton(a)
+	if err != nil {
+		return err
+	}
+	sb, err := Skeleton(b)
+	if err != nil {
+		return err
+	}
+	if sa == sb {
+		return nil
+	}
+
+	la, lb := strings.Split(sa, "\n"), strings.Split(sb, "\n")
+	var diffs []string
+	for i := 0; i < len(la) || i < len(lb); i++ {
+		var x, y string
+		if i < len(la) {
+			x = la[i]
+		}
+		if i < len(lb) {
+			y = lb[i]
+		}
+		if x != y {
+			diffs = append(diffs, fmt.Sprintf("- %s\n+ %s", x, y))
+		}
+	}
+	return fmt.Errorf("dsntest: structure differs:\n%s", strings.Join(diffs, "\n"))
+}
+
+func writeSkeleton(sb *strings.Builder, indent string, h textproto.Header, r io.Reader) error {
+	mediaType, params, err := mime.ParseMediaType(h.Get("Content-Type"))
+	if err != nil {
+		mediaType = "text/plain"
+	}
+	typ := mediaType
+	if rt := params["report-type"]; rt != "" {
+		typ += "; report-type=" + rt
+	}
+	fmt.Fprintf(sb, "%s%s\n", indent, typ)
+	if desc := h.Get("Content-Description"); desc != "" {
+		fmt.Fprintf(sb, "%s  description: %s\n", indent, desc)
+	}
+	fmt.Fprintf(sb, "%s  fields: %s\n", indent, strings.Join(fieldNames(h, true), ", "))
+
+	switch {
+	case strings.HasPrefix(mediaType, "multipart/"):
+		mr := textproto.NewMultipartReader(r, params["boundary"])
+		for {
+			p, err := mr.NextPart()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if err := writeSkeleton(sb, indent+"  ", p.Header, p); err != nil {
+				return err
+			}
+		}
+	case mediaType == "message/delivery-status" || mediaType == "message/global-delivery-status":
+		blocks, err := readBlocks(r)
+		if err != nil {
+			return err
+		}
+		for i, b := range blocks {
+			var fields []string
+			for _, k := range fieldNames(b, false) {
+				if typedFields[k] {
+					if t := strings.SplitN(b.Get(k), ";", 2); len(t) == 2 {
+						k += " (" + strings.ToLower(strings.TrimSpace(t[0])) + ")"
+					}
+				}
+				fields = append(fields, k)
+			}
+			name := "recipient"
+			if i == 0 {
+				name = "per-message"
+			}
+			fmt.Fprintf(sb, "%s  %s: %s\n", indent, name, strings.Join(fields, ", "))
+		}
+	case strings.HasSuffix(mediaType, "-headers") || mediaType == "message/rfc822" || mediaType == "message/global":
+		// The returned content is the original message and says nothing
+		// about the report structure.
+		_, err := io.Copy(ioutil.Discard, r)
+		return err
+	}
+	return nil
+}
+
+// fieldNames returns the sorted, canonicalized and deduplicated field names
+// of h, without trace fields if skipTrace is true.
+func fieldNames(h textproto.Header, skipTrace bool) []string {
+	seen := make(map[string]bool)
+	var names []string
+	fields := h.Fields()
+	for fields.Next() {
+		k := nettextproto.CanonicalMIMEHeaderKey(fields.Key())
+		if seen[k] || (skipTrace && traceFields[strings.ToLower(k)]) {
+			continue
+		}
+		seen[k] = true
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return names
+}
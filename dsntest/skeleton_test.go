@@ -0,0 +1,59 @@
+package dsntest
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestSameStructure(t *testing.T) {
+	ref, err := ioutil.ReadFile("testdata/corpus/postfix.eml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Same structure with other values and field order.
+	other := strings.Replace(string(ref), "nobody@example.net", "someone@example.com", -1)
+	other = strings.Replace(other, "Status: 5.1.1\r\n", "", 1)
+	other = strings.Replace(other, "Action: failed\r\n", "Action: failed\r\nStatus: 5.2.2\r\n", 1)
+	other = strings.Replace(other, "8B2E41A0311.1586852467/mail.example.com", "other-boundary", -1)
+	if err := SameStructure(bytes.NewReader(ref), strings.NewReader(other)); err != nil {
+		t.Error(err)
+	}
+
+	changed := strings.Replace(string(ref), "Remote-MTA: dns;", "Remote-MTA: x-local-hostname;", 1)
+	err = SameStructure(bytes.NewReader(ref), strings.NewReader(changed))
+	if err == nil || !strings.Contains(err.Error(), "Remote-Mta (x-local-hostname)") {
+		t.Errorf("SameStructure() = %v, want Remote-MTA type difference", err)
+	}
+}
+
+func TestSkeleton(t *testing.T) {
+	ref, err := ioutil.ReadFile("testdata/corpus/postfix.eml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := Skeleton(bytes.NewReader(ref))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := `multipart/report; report-type=delivery-status
+  fields: Auto-Submitted, Content-Type, Date, From, Message-Id, Mime-Version, Subject, To
+  text/plain
+    description: Notification
+    fields: Content-Description, Content-Type
+  message/delivery-status
+    description: Delivery report
+    fields: Content-Description, Content-Type
+    per-message: Arrival-Date, Reporting-Mta (dns), X-Postfix-Queue-Id, X-Postfix-Sender
+    recipient: Action, Diagnostic-Code (smtp), Final-Recipient (rfc822), Original-Recipient (rfc822), Remote-Mta (dns), Status
+  text/rfc822-headers
+    description: Undelivered Message Headers
+    fields: Content-Description, Content-Type
+`
+	if got != want {
+		t.Errorf("Skeleton() =\n%s\nwant\n%s", got, want)
+	}
+}
@@ -0,0 +1,62 @@
+package dsn
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+
+	"github.com/emersion/go-message/textproto"
+)
+
+// Encoder generates DSNs with the configuration of a Generator and keeps
+// state between calls to make repeated generation cheaper: the profile is
+// resolved once, the random source for boundaries is buffered and the
+// output buffer is reused.
+//
+// An Encoder is not safe for concurrent use, use one per goroutine.
+type Encoder struct {
+	g   Generator
+	p   *Profile
+	buf bytes.Buffer
+}
+
+// NewEncoder returns an Encoder using a copy of the configuration of g,
+// later changes of g have no effect on it.
+func (g *Generator) NewEncoder() *Encoder {
+	e := &Encoder{g: *g}
+	if e.g.Rand == nil {
+		e.g.Rand = bufio.NewReaderSize(rand.Reader, 1024)
+	}
+	e.p = e.g.profile()
+	return e
+}
+
+// Encode generates a DSN and returns the complete message including its
+// header. The returned slice is only valid until the next call to Encode.
+func (e *Encoder) Encode(utf8 bool, envelope Envelope, mtaInfo ReportingMTAInfo, rcptsInfo []RecipientInfo, failedHeader textproto.Header) ([]byte, error) {
+	e.buf.Reset()
+	if e.buf.Cap() > maxPooledBuffer {
+		// Do not keep the memory of a single large DSN.
+		e.buf = bytes.Buffer{}
+	}
+
+	if e.g.AutoDetectUTF8 {
+		utf8 = needsUTF8(envelope, mtaInfo, rcptsInfo) || headerNeedsUTF8(failedHeader)
+	}
+	envelope.useFailedHeader(failedHeader)
+	p := e.p
+	if dp := e.g.defaultProfile(envelope, rcptsInfo); dp != nil && dp != DefaultProfile {
+		p = e.g.profileFor(envelope, rcptsInfo)
+	}
+	hdr, writeBody, err := e.g.generate(p, utf8, envelope, mtaInfo, rcptsInfo, headerContent(failedHeader))
+	if err != nil {
+		return nil, err
+	}
+	if err := textproto.WriteHeader(&e.buf, hdr); err != nil {
+		return nil, err
+	}
+	if err := writeBody(&e.buf); err != nil {
+		return nil, err
+	}
+	return e.buf.Bytes(), nil
+}
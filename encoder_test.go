@@ -0,0 +1,61 @@
+package dsn
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+)
+
+func TestEncoder(t *testing.T) {
+	newGenerator := func() *Generator {
+		return &Generator{
+			Clock:   FixedClock(time.Date(2020, 4, 14, 10, 21, 7, 0, time.UTC)),
+			Rand:    rand.New(rand.NewSource(1)),
+			Profile: PostfixProfile,
+		}
+	}
+	mtaInfo := ReportingMTAInfo{ReportingMTA: "mx.example.org"}
+	rcpts := benchmarkRecipients(3)
+
+	g := newGenerator()
+	e := newGenerator().NewEncoder()
+	for i := 0; i < 3; i++ {
+		var body bytes.Buffer
+		h, err := g.Generate(false, Envelope{}, mtaInfo, rcpts, textproto.Header{}, &body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var want bytes.Buffer
+		if err := textproto.WriteHeader(&want, h); err != nil {
+			t.Fatal(err)
+		}
+		want.Write(body.Bytes())
+
+		got, err := e.Encode(false, Envelope{}, mtaInfo, rcpts, textproto.Header{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want.Bytes()) {
+			t.Errorf("Encode() #%d output\n%s\nwant\n%s", i, got, want.Bytes())
+		}
+	}
+
+	if _, err := e.Encode(false, Envelope{}, ReportingMTAInfo{}, rcpts, textproto.Header{}); err == nil {
+		t.Error("Encode() succeeded without Reporting-MTA")
+	}
+}
+
+func BenchmarkEncoder(b *testing.B) {
+	e := (&Generator{}).NewEncoder()
+	mtaInfo := ReportingMTAInfo{ReportingMTA: "mx.example.org"}
+	rcpts := benchmarkRecipients(10)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := e.Encode(false, Envelope{}, mtaInfo, rcpts, textproto.Header{}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package dsn
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-message/textproto"
+)
+
+// GenerateDSNEntity is like GenerateDSN but returns the DSN as a
+// github.com/emersion/go-message entity tree, e.g. to sign it or to add
+// parts before it is written with Entity.WriteTo.
+func GenerateDSNEntity(utf8 bool, envelope Envelope, mtaInfo ReportingMTAInfo, rcptsInfo []RecipientInfo, failedHeader textproto.Header, opts ...Option) (*message.Entity, error) {
+	return NewGenerator(opts...).GenerateEntity(utf8, envelope, mtaInfo, rcptsInfo, failedHeader)
+}
+
+// GenerateEntity generates a DSN as an entity tree, see GenerateDSNEntity.
+//
+// Every multipart entity is made with message.NewMultipart, so its parts
+// are returned by MultipartReader and can be replaced. The bodies of the
+// other entities are decoded, Entity.WriteTo encodes them again according
+// to their Content-Transfer-Encoding.
+func (g *Generator) GenerateEntity(utf8 bool, envelope Envelope, mtaInfo ReportingMTAInfo, rcptsInfo []RecipientInfo, failedHeader textproto.Header) (*message.Entity, error) {
+	var body bytes.Buffer
+	h, err := g.Generate(utf8, envelope, mtaInfo, rcptsInfo, failedHeader, &body)
+	if err != nil {
+		return nil, err
+	}
+	return newEntity(h, body.Bytes())
+}
+
+// newEntity returns the entity tree of a generated entity. Parts of the
+// message/* types are not split further.
+func newEntity(h textproto.Header, body []byte) (*message.Entity, error) {
+	mh := message.Header{Header: h}
+	mediaType, params, err := mh.ContentType()
+	if err != nil || !strings.HasPrefix(mediaType, "multipart/") {
+		return message.New(mh, bytes.NewReader(body))
+	}
+
+	var parts []*message.Entity
+	mr := textproto.NewMultipartReader(bytes.NewReader(body), params["boundary"])
+	for {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		b, err := ioutil.ReadAll(p)
+		if err != nil {
+			return nil, err
+		}
+		part, err := newEntity(p.Header, b)
+		if err != nil {
+			return nil, err
+		}
+		parts = append(parts, part)
+	}
+	return message.NewMultipart(mh, parts)
+}
@@ -0,0 +1,69 @@
+package dsn_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-smtp"
+	dsn "schneider.vip/go-dsn"
+)
+
+func TestGenerateDSNEntity(t *testing.T) {
+	rcpts := []dsn.RecipientInfo{{FinalRecipient: "rcpt@example.com", Action: dsn.ActionFailed, Status: smtp.EnhancedCode{5, 1, 1}}}
+	failedHeader := textproto.Header{}
+	failedHeader.Add("Subject", "Hello")
+
+	e, err := dsn.GenerateDSNEntity(false, dsn.Envelope{To: "sender@example.org"}, dsn.ReportingMTAInfo{ReportingMTA: "mx.example.org"}, rcpts, failedHeader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := e.Header.Get("To"); got != "sender@example.org" {
+		t.Errorf("To = %q", got)
+	}
+
+	mr := e.MultipartReader()
+	if mr == nil {
+		t.Fatal("entity is not multipart")
+	}
+	var types []string
+	for {
+		p, err := mr.NextPart()
+		if err != nil {
+			break
+		}
+		typ, _, _ := p.Header.ContentType()
+		types = append(types, typ)
+		if typ == "message/delivery-status" {
+			b, err := ioutil.ReadAll(p.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(string(b), "Final-Recipient: rfc822; rcpt@example.com") {
+				t.Errorf("delivery-status part:\n%s", b)
+			}
+		}
+	}
+	if got, want := strings.Join(types, " "), "text/plain message/delivery-status message/rfc822-headers"; got != want {
+		t.Errorf("parts = %q, want %q", got, want)
+	}
+
+	// The entity can be written and parsed again.
+	e, err = dsn.GenerateDSNEntity(false, dsn.Envelope{To: "sender@example.org"}, dsn.ReportingMTAInfo{ReportingMTA: "mx.example.org"}, rcpts, failedHeader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := e.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	rep, err := dsn.ParseDSN(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rep.Recipients) != 1 || rep.FailedHeader.Get("Subject") != "Hello" {
+		t.Errorf("ParseDSN() = %+v", rep)
+	}
+}
@@ -0,0 +1,34 @@
+package dsn
+
+import (
+	"io"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-smtp"
+)
+
+// GenerateExpandedDSN generates a DSN reporting that rcptsInfo were aliases
+// or mailing lists that were expanded to the addresses in their ExpandedTo
+// field (RFC 3464 section 2.3.3), with ExpandedProfile.
+//
+// Action is set to ActionExpanded for all recipients and Status to 2.0.0
+// if it is not set. Other statuses than 2.x.x are rejected.
+func GenerateExpandedDSN(utf8 bool, envelope Envelope, mtaInfo ReportingMTAInfo, rcptsInfo []RecipientInfo, failedHeader textproto.Header, outWriter io.Writer) (textproto.Header, error) {
+	return (&Generator{}).GenerateExpandedDSN(utf8, envelope, mtaInfo, rcptsInfo, failedHeader, outWriter)
+}
+
+// GenerateExpandedDSN is like the GenerateExpandedDSN function but uses the
+// configuration of g. g.Profile is used instead of ExpandedProfile if it is
+// set.
+func (g *Generator) GenerateExpandedDSN(utf8 bool, envelope Envelope, mtaInfo ReportingMTAInfo, rcptsInfo []RecipientInfo, failedHeader textproto.Header, outWriter io.Writer) (textproto.Header, error) {
+	expanded := make([]RecipientInfo, len(rcptsInfo))
+	for i, rcpt := range rcptsInfo {
+		rcpt.Action = ActionExpanded
+		if rcpt.Status[0] == 0 {
+			rcpt.Status = smtp.EnhancedCode{2, 0, 0}
+		}
+		expanded[i] = rcpt
+	}
+
+	return g.withDefaultProfile(ExpandedProfile).Generate(utf8, envelope, mtaInfo, expanded, failedHeader, outWriter)
+}
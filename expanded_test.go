@@ -0,0 +1,40 @@
+package dsn_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-smtp"
+	dsn "schneider.vip/go-dsn"
+)
+
+func TestGenerateExpandedDSN(t *testing.T) {
+	var body bytes.Buffer
+	hdr, err := dsn.GenerateExpandedDSN(false, dsn.Envelope{MsgID: "<expanded@example.org>"}, dsn.ReportingMTAInfo{ReportingMTA: "mx.example.org"}, []dsn.RecipientInfo{
+		{FinalRecipient: "team@example.net", ExpandedTo: []string{"alice@example.net", "bob@example.net"}},
+	}, textproto.Header{}, &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := hdr.Get("Subject"); got != dsn.ExpandedProfile.Subject {
+		t.Errorf("Subject = %q", got)
+	}
+	for _, want := range []string{
+		"team@example.net was expanded to 2 address(es):\n    alice@example.net\n    bob@example.net\n",
+		"Action: expanded\r\n",
+		"Status: 2.0.0\r\n",
+	} {
+		if !strings.Contains(body.String(), want) {
+			t.Errorf("body does not contain %q:\n%s", want, body.String())
+		}
+	}
+
+	_, err = dsn.GenerateExpandedDSN(false, dsn.Envelope{}, dsn.ReportingMTAInfo{ReportingMTA: "mx.example.org"}, []dsn.RecipientInfo{
+		{FinalRecipient: "team@example.net", Status: smtp.EnhancedCode{5, 1, 1}},
+	}, textproto.Header{}, &body)
+	if err == nil {
+		t.Error("GenerateExpandedDSN() succeeded with a 5.x.x status")
+	}
+}
@@ -0,0 +1,220 @@
+package dsn
+
+import (
+	"bytes"
+	"io"
+	nettextproto "net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-smtp"
+)
+
+// fieldLineLen is the line length up to which fields are written without
+// folding, it matches the preferred length of textproto.WriteHeader.
+const fieldLineLen = 76
+
+// fieldWriter formats the fields of a delivery-status block into a single
+// buffer, avoiding the textproto.Header and string concatenations per field.
+//
+// The output is identical to adding the fields to a textproto.Header and
+// writing it with textproto.WriteHeader: the fields are written in reverse
+// order and long or invalid fields are formatted by textproto.
+type fieldWriter struct {
+	buf    []byte
+	starts []int
+	key    string
+}
+
+// begin starts a field, key must be in canonical form.
+func (fw *fieldWriter) begin(key string) {
+	fw.starts = append(fw.starts, len(fw.buf))
+	fw.key = key
+	fw.buf = append(fw.buf, key...)
+	fw.buf = append(fw.buf, ": "...)
+}
+
+func (fw *fieldWriter) str(s string) {
+	fw.buf = append(fw.buf, s...)
+}
+
+func (fw *fieldWriter) int(n int) {
+	fw.buf = strconv.AppendInt(fw.buf, int64(n), 10)
+}
+
+func (fw *fieldWriter) code(code smtp.EnhancedCode) {
+	fw.int(code[0])
+	fw.buf = append(fw.buf, '.')
+	fw.int(code[1])
+	fw.buf = append(fw.buf, '.')
+	fw.int(code[2])
+}
+
+// end finishes the current field.
+func (fw *fieldWriter) end() error {
+	start := fw.starts[len(fw.starts)-1]
+	line := fw.buf[start:]
+	value := line[len(fw.key)+2:]
+	if bytes.IndexAny(value, "\r\n") != -1 {
+		return &HeaderValueError{Field: fw.key}
+	}
+	if len(line) <= fieldLineLen && len(value) != 0 && validFieldKey(fw.key) {
+		fw.buf = append(fw.buf, '\r', '\n')
+		return nil
+	}
+
+	// Leave folding and validation to textproto.
+	h := textproto.Header{}
+	h.Add(fw.key, string(value))
+	var b bytes.Buffer
+	if err := textproto.WriteHeader(&b, h); err != nil {
+		return err
+	}
+	fw.buf = append(fw.buf[:start], b.Bytes()[:b.Len()-2]...)
+	return nil
+}
+
+// HeaderValueError is returned if the value of a header or delivery-status
+// field contains a CR or LF character, which could inject additional fields.
+// Line breaks in diagnostic texts are replaced instead.
+type HeaderValueError struct {
+	// Field is the name of the field.
+	Field string
+}
+
+func (err *HeaderValueError) Error() string {
+	return "dsn: " + err.Field + " contains a line break"
+}
+
+// ReservedFieldError is returned if Envelope.Header contains a field that
+// is generated, such as Subject or Content-Type.
+type ReservedFieldError struct {
+	Field string
+}
+
+func (err *ReservedFieldError) Error() string {
+	return "dsn: " + err.Field + " is generated and cannot be set in Envelope.Header"
+}
+
+// reservedFields are the fields of the message header of a DSN that are
+// generated and occur only once.
+var reservedFields = map[string]bool{
+	"Date":                      true,
+	"Message-Id":                true,
+	"From":                      true,
+	"To":                        true,
+	"Subject":                   true,
+	"Mime-Version":              true,
+	"Content-Type":              true,
+	"Content-Transfer-Encoding": true,
+}
+
+// checkExtraFields returns a ReservedFieldError for the first reserved field
+// of h.
+func checkExtraFields(h textproto.Header) error {
+	for f := h.Fields(); f.Next(); {
+		if k := canonicalKey(f.Key()); reservedFields[k] {
+			return &ReservedFieldError{Field: k}
+		}
+	}
+	return nil
+}
+
+// checkHeaderValue returns a HeaderValueError if v contains CR or LF.
+func checkHeaderValue(key, v string) error {
+	if strings.ContainsAny(v, "\r\n") {
+		return &HeaderValueError{Field: key}
+	}
+	return nil
+}
+
+// checkHeaderValues checks the values of all fields of h, see
+// checkHeaderValue.
+func checkHeaderValues(h textproto.Header) error {
+	for f := h.Fields(); f.Next(); {
+		if err := checkHeaderValue(f.Key(), f.Value()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// field writes a field with a single value.
+func (fw *fieldWriter) field(key, value string) error {
+	fw.begin(key)
+	fw.str(value)
+	return fw.end()
+}
+
+// typed writes a "type; value" field.
+func (fw *fieldWriter) typed(key, typ, value string) error {
+	fw.begin(key)
+	fw.str(typ)
+	fw.str("; ")
+	fw.str(value)
+	return fw.end()
+}
+
+// writeExtensionFields writes the fields of h, which end up after the
+// fields written later since flush reverses the order.
+func writeExtensionFields(fw *fieldWriter, h textproto.Header) error {
+	// Fields returns the fields in message order, the reverse order of Add.
+	for f := h.Fields(); f.Next(); {
+		if err := fw.field(canonicalKey(f.Key()), f.Value()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// flush writes the fields in reverse order followed by an empty line.
+func (fw *fieldWriter) flush(w io.Writer) error {
+	end := len(fw.buf)
+	for i := len(fw.starts) - 1; i >= 0; i-- {
+		if _, err := w.Write(fw.buf[fw.starts[i]:end]); err != nil {
+			return err
+		}
+		end = fw.starts[i]
+	}
+	_, err := w.Write(crlf)
+	return err
+}
+
+var crlf = []byte{'\r', '\n'}
+
+var fieldWriterPool = sync.Pool{
+	New: func() interface{} { return new(fieldWriter) },
+}
+
+func getFieldWriter() *fieldWriter {
+	return fieldWriterPool.Get().(*fieldWriter)
+}
+
+func putFieldWriter(fw *fieldWriter) {
+	if cap(fw.buf) > maxPooledBuffer {
+		return
+	}
+	fw.buf = fw.buf[:0]
+	fw.starts = fw.starts[:0]
+	fieldWriterPool.Put(fw)
+}
+
+// validFieldKey reports whether key only contains printable US-ASCII
+// characters except ':'.
+func validFieldKey(key string) bool {
+	for i := 0; i < len(key); i++ {
+		ch := key[i]
+		if !(ch >= '!' && ch < ':' || ch > ':' && ch <= '~') {
+			return false
+		}
+	}
+	return true
+}
+
+// canonicalKey returns the canonical form of a field name as used by
+// textproto.Header.
+func canonicalKey(key string) string {
+	return nettextproto.CanonicalMIMEHeaderKey(key)
+}
@@ -0,0 +1,127 @@
+package dsn
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-smtp"
+)
+
+func TestFieldWriterMatchesTextproto(t *testing.T) {
+	fields := []struct{ key, value string }{
+		{"Reporting-Mta", "dns; mx.example.org"},
+		{"Action", "failed"},
+		{"X-Godsn-Msgid", ""},
+		{"Diagnostic-Code", "smtp; 550 5.1.1 " + strings.Repeat("very long message ", 10)},
+		{"Diagnostic-Code", "smtp; 550 " + strings.Repeat("x", 100)},
+		{"Final-Recipient", "rfc822; " + strings.Repeat("a", 60) + "@example.com"},
+	}
+
+	fw := &fieldWriter{}
+	h := textproto.Header{}
+	for _, f := range fields {
+		if err := fw.field(f.key, f.value); err != nil {
+			t.Fatal(err)
+		}
+		h.Add(f.key, f.value)
+	}
+	var got, want bytes.Buffer
+	if err := fw.flush(&got); err != nil {
+		t.Fatal(err)
+	}
+	if err := textproto.WriteHeader(&want, h); err != nil {
+		t.Fatal(err)
+	}
+	if got.String() != want.String() {
+		t.Errorf("fieldWriter output\n%q\nwant\n%q", got.String(), want.String())
+	}
+
+	if err := (&fieldWriter{}).field("X-Bad Name-Sender", "x"); err == nil {
+		t.Error("invalid field name accepted")
+	}
+	if err := (&fieldWriter{}).field("Action", "a\r\nb"); err == nil {
+		t.Error("CRLF in field value accepted")
+	}
+}
+
+func TestHeaderInjection(t *testing.T) {
+	mtaInfo := ReportingMTAInfo{ReportingMTA: "mx.example.org"}
+	rcpt := RecipientInfo{FinalRecipient: "rcpt@example.com", Action: ActionFailed, Status: smtp.EnhancedCode{5, 1, 1}}
+
+	tests := []struct {
+		name     string
+		g        Generator
+		envelope Envelope
+		mtaInfo  ReportingMTAInfo
+		rcpt     RecipientInfo
+		field    string
+	}{
+		{"To", Generator{}, Envelope{To: "a@example.org\r\nBcc: b@example.org"}, mtaInfo, rcpt, "To"},
+		{"From", Generator{}, Envelope{From: "a@example.org\nX-Injected: 1"}, mtaInfo, rcpt, "From"},
+		{"Message-Id", Generator{}, Envelope{MsgID: "<id@example.org>\r\nX-Injected: 1"}, mtaInfo, rcpt, "Message-Id"},
+		{"Subject", Generator{Profile: &Profile{Subject: "Grüße\r\nX-Injected: 1"}}, Envelope{}, mtaInfo, rcpt, "Subject"},
+		{"Reporting-MTA", Generator{}, Envelope{}, ReportingMTAInfo{ReportingMTA: "mx.example.org\r\nX-Injected: 1"}, rcpt, "Reporting-Mta"},
+		{"X-Message-ID", Generator{}, Envelope{}, ReportingMTAInfo{ReportingMTA: "mx.example.org", XMessageID: "q1\r\nX-Injected: 1"}, rcpt, "X-Godsn-Msgid"},
+	}
+	for _, test := range tests {
+		_, err := test.g.Generate(false, test.envelope, test.mtaInfo, []RecipientInfo{test.rcpt}, textproto.Header{}, &bytes.Buffer{})
+		var valueErr *HeaderValueError
+		if !errors.As(err, &valueErr) {
+			t.Errorf("%s: Generate() = %v, want a HeaderValueError", test.name, err)
+			continue
+		}
+		if valueErr.Field != test.field {
+			t.Errorf("%s: Field = %q, want %q", test.name, valueErr.Field, test.field)
+		}
+	}
+}
+
+func benchmarkRecipients(n int) []RecipientInfo {
+	rcpts := make([]RecipientInfo, n)
+	for i := range rcpts {
+		rcpts[i] = RecipientInfo{
+			FinalRecipient: "rcpt@example.com",
+			RemoteMTA:      "mx.example.com",
+			Action:         ActionFailed,
+			Status:         smtp.EnhancedCode{5, 1, 1},
+			DiagnosticCode: &smtp.SMTPError{Code: 550, EnhancedCode: smtp.EnhancedCode{5, 1, 1}, Message: "User unknown"},
+		}
+	}
+	return rcpts
+}
+
+func BenchmarkRecipientInfoWriteTo(b *testing.B) {
+	rcpts := benchmarkRecipients(500)
+	var out bytes.Buffer
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		out.Reset()
+		for _, rcpt := range rcpts {
+			if err := rcpt.WriteTo(false, &out); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func TestWriteDefaultRecipientText(t *testing.T) {
+	var nilSMTPErr *smtp.SMTPError
+	for _, rcpt := range []RecipientInfo{
+		{FinalRecipient: "rcpt@example.com"},
+		{FinalRecipient: "rcpt@example.com", DiagnosticCode: &smtp.SMTPError{Code: 550, EnhancedCode: smtp.EnhancedCode{5, 1, 1}, Message: "User unknown"}},
+		{FinalRecipient: "rcpt@example.com", DiagnosticCode: errors.New("connection refused")},
+		{FinalRecipient: "rcpt@example.com", DiagnosticCode: nilSMTPErr},
+	} {
+		var got, want bytes.Buffer
+		writeDefaultRecipientText(&got, rcpt)
+		if err := defaultRecipientText.Execute(&want, rcpt); err != nil {
+			t.Fatal(err)
+		}
+		if got.String() != want.String() {
+			t.Errorf("writeDefaultRecipientText() = %q, template output %q", got.String(), want.String())
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package dsn
+
+import (
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"io/fs"
+	"path"
+	"text/template"
+)
+
+// Template file names read by ProfileFromFS.
+const (
+	TextTemplateFile      = "text.tmpl"
+	RecipientTemplateFile = "recipient.tmpl"
+	TrailerTemplateFile   = "trailer.tmpl"
+	HTMLTemplateFile      = "html.tmpl"
+)
+
+// ProfileFromFS returns a copy of base, DefaultProfile if nil, with the
+// templates of the human-readable part read from fsys, e.g. an embed.FS or
+// os.DirFS holding branded texts: TextTemplateFile replaces Text,
+// RecipientTemplateFile RecipientText, TrailerTemplateFile Trailer and
+// HTMLTemplateFile HTML. Missing files keep the templates of base.
+//
+// The profile can be set per Generator, unlike FailedTemplateText which
+// applies to the whole process.
+func ProfileFromFS(fsys fs.FS, base *Profile) (*Profile, error) {
+	if base == nil {
+		base = DefaultProfile
+	}
+	p := *base
+
+	for _, t := range []struct {
+		name string
+		dst  **template.Template
+	}{
+		{TextTemplateFile, &p.Text},
+		{RecipientTemplateFile, &p.RecipientText},
+		{TrailerTemplateFile, &p.Trailer},
+	} {
+		text, ok, err := readTemplateFile(fsys, t.name)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+		if *t.dst, err = template.New(t.name).Funcs(templateFuncs).Parse(text); err != nil {
+			return nil, fmt.Errorf("dsn: cannot parse template %s: %w", t.name, err)
+		}
+	}
+
+	text, ok, err := readTemplateFile(fsys, HTMLTemplateFile)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		if p.HTML, err = htmltemplate.New(HTMLTemplateFile).Funcs(htmltemplate.FuncMap(templateFuncs)).Parse(text); err != nil {
+			return nil, fmt.Errorf("dsn: cannot parse template %s: %w", HTMLTemplateFile, err)
+		}
+	}
+	return &p, nil
+}
+
+// readTemplateFile reads name from fsys, ok is false if it does not exist.
+func readTemplateFile(fsys fs.FS, name string) (text string, ok bool, err error) {
+	b, err := fs.ReadFile(fsys, name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return "", false, nil
+	} else if err != nil {
+		return "", false, fmt.Errorf("dsn: cannot read template %s: %w", name, err)
+	}
+	return string(b), true, nil
+}
+
+// FSTemplateLoader returns a TemplateSet.Load function reading the template
+// for lang and action from "<lang>/<action>.tmpl" in fsys, falling back to
+// "<action>.tmpl" if there is none for lang.
+func FSTemplateLoader(fsys fs.FS) func(lang string, action Action) (string, error) {
+	return func(lang string, action Action) (string, error) {
+		name := string(action) + ".tmpl"
+		if lang != "" {
+			text, ok, err := readTemplateFile(fsys, path.Join(lang, name))
+			if err != nil || ok {
+				return text, err
+			}
+		}
+		b, err := fs.ReadFile(fsys, name)
+		return string(b), err
+	}
+}
@@ -0,0 +1,68 @@
+package dsn
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestProfileFromFS(t *testing.T) {
+	fsys := fstest.MapFS{
+		"text.tmpl":      {Data: []byte("Your message could not be delivered by {{.ReportingMTA}}.\n")},
+		"recipient.tmpl": {Data: []byte("  {{.FinalRecipient}}\n")},
+		"html.tmpl":      {Data: []byte("<p>{{.ReportingMTA}}</p>")},
+	}
+	p, err := ProfileFromFS(fsys, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Trailer != DefaultProfile.Trailer {
+		t.Error("ProfileFromFS() replaced Trailer without trailer.tmpl")
+	}
+	if p.Text == DefaultProfile.Text || p.HTML == nil {
+		t.Fatal("ProfileFromFS() did not load the templates")
+	}
+
+	var b bytes.Buffer
+	if err := p.Text.Execute(&b, ReportingMTAInfo{ReportingMTA: "mx.example.org"}); err != nil {
+		t.Fatal(err)
+	}
+	if want := "Your message could not be delivered by mx.example.org.\n"; b.String() != want {
+		t.Errorf("text template output %q, want %q", b.String(), want)
+	}
+
+	fsys["trailer.tmpl"] = &fstest.MapFile{Data: []byte("{{.Unclosed")}
+	if _, err := ProfileFromFS(fsys, nil); err == nil || !strings.Contains(err.Error(), "trailer.tmpl") {
+		t.Errorf("ProfileFromFS() error %v, want a parse error for trailer.tmpl", err)
+	}
+}
+
+func TestFSTemplateLoader(t *testing.T) {
+	s := &TemplateSet{Load: FSTemplateLoader(fstest.MapFS{
+		"failed.tmpl":    {Data: []byte("Delivery to {{.FinalRecipient}} failed")},
+		"de/failed.tmpl": {Data: []byte("Zustellung an {{.FinalRecipient}} fehlgeschlagen")},
+	})}
+
+	for lang, want := range map[string]string{
+		"de": "Zustellung an rcpt@example.com fehlgeschlagen",
+		"fr": "Delivery to rcpt@example.com failed",
+		"":   "Delivery to rcpt@example.com failed",
+	} {
+		tmpl, err := s.Get(lang, ActionFailed)
+		if err != nil {
+			t.Fatalf("Get(%q): %v", lang, err)
+		}
+		var b bytes.Buffer
+		if err := tmpl.Execute(&b, RecipientInfo{FinalRecipient: "rcpt@example.com"}); err != nil {
+			t.Fatal(err)
+		}
+		if b.String() != want {
+			t.Errorf("Get(%q) output %q, want %q", lang, b.String(), want)
+		}
+	}
+
+	if _, err := s.Get("de", ActionDelayed); err == nil {
+		t.Error("Get() succeeded for an action without template")
+	}
+}
@@ -0,0 +1,581 @@
+package dsn
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+)
+
+// Generator generates DSNs with a fixed configuration. The zero value is
+// ready to use and behaves like GenerateDSN.
+type Generator struct {
+	// Clock is used for the Date field, it defaults to SystemClock.
+	Clock Clock
+
+	// Rand is the source of the MIME boundary, it defaults to
+	// crypto/rand.Reader.
+	Rand io.Reader
+
+	// Boundary, if set, returns the MIME boundaries instead of Rand: n is 0
+	// for the boundary of the report and 1 for the one of the HTML
+	// alternative. Together with Clock and MessageID it makes the output
+	// reproducible, e.g. for golden files, see WithDeterministicOutput.
+	Boundary func(n int) string
+
+	// MessageID, if set, returns the Message-Id of DSNs whose
+	// Envelope.MsgID is empty.
+	MessageID func() string
+
+	// Profile controls the wording and layout. It defaults to
+	// DelayedProfile if all recipients have ActionDelayed, to
+	// RelayedProfile if all have ActionRelayed, to ExpandedProfile if all
+	// have ActionExpanded, to DeliveredProfile if all have ActionDelivered
+	// or ActionRelayed and to DefaultProfile otherwise.
+	Profile *Profile
+
+	// OutlookCompat adjusts the part headers of the profile so that the
+	// report is displayed correctly in Outlook and OWA: the human-readable
+	// part is marked inline, the delivery-status and returned header parts
+	// become named text attachments and a plain-text preamble is added.
+	OutlookCompat bool
+
+	// LegacyRFC1894 restricts the output for old gateways: utf8 is ignored so
+	// that only RFC 1894 types are used, the returned headers are sent as
+	// message/rfc822-headers and no HTML alternative is added. The subject
+	// and the display names of From and To are written as RFC 2047
+	// encoded-words, all other non-ASCII characters are replaced with '?'.
+	LegacyRFC1894 bool
+
+	// SevenBit generates a DSN consisting of 7-bit data only, for relays
+	// without 8BITMIME: utf8 is ignored, the text parts and the returned
+	// header are quoted-printable encoded and non-ASCII diagnostic texts are
+	// written as RFC 2047 encoded-words instead of being replaced or left
+	// out. The message passed to GenerateFull is returned as is.
+	SevenBit bool
+
+	// MachineOnly omits the human-readable part for notifications that are
+	// only processed by software, the report consists of the
+	// delivery-status and the returned header part. Note that RFC 6522
+	// requires the human-readable part, strict parsers may reject such
+	// reports. QSBMF and HTML of the profile are ignored.
+	MachineOnly bool
+
+	// AutoDetectUTF8 ignores the utf8 argument and generates an
+	// internationalized DSN if the envelope, the recipient addresses,
+	// ReportingMTAInfo.XSender or the returned header contain non-ASCII
+	// characters. The message passed to GenerateFull is not scanned.
+	AutoDetectUTF8 bool
+
+	// LoopGuard makes Send return a SuppressedError instead of sending a
+	// DSN refused by ShouldGenerateDSN. It is enabled by SendDSN.
+	LoopGuard bool
+
+	// Return selects the returned content, e.g. to honor the RET parameter
+	// of RFC 3461.
+	Return ReturnPolicy
+
+	// MaxReturnSize, if positive, is the maximum size of the message
+	// returned by GenerateFull. Only the header of larger messages is
+	// returned and a note is added to the human-readable text.
+	MaxReturnSize int64
+
+	// Location, if set, is the time zone of the timestamps in the
+	// human-readable part, and of the Date field if LocalDateField is set.
+	Location *time.Location
+	// LocalDateField writes the Date field in Location.
+	LocalDateField bool
+	// DateLayout, if set, is the layout of the timestamps in the
+	// human-readable part of the built-in profiles, see
+	// ReportingMTAInfo.FormatDate.
+	DateLayout string
+
+	// DetectLanguage selects the translation of the DSN, see
+	// RegisterTranslation, by the Accept-Language, X-Accept-Language and
+	// Content-Language fields of the failed message if Envelope.Language is
+	// empty.
+	DetectLanguage bool
+
+	// AlternativeLanguages, if set, adds the human-readable text in these
+	// languages as Profile.Alternatives, using the translations registered
+	// with RegisterTranslation or the built-in English profiles. Languages
+	// of the profile itself or of a previous alternative are skipped.
+	AlternativeLanguages []string
+
+	// Templates, if set, supplies the RecipientText of the profile and of
+	// its Alternatives, selected by their Language and the Action of the
+	// report, see Profile.Subjects. The templates are compiled once and
+	// kept until TemplateSet.Invalidate is called.
+	Templates *TemplateSet
+
+	// Funcs, if set, are added to the templates of the human-readable part
+	// and the Subjects of the profile when rendering, replacing built-in
+	// functions of the same name, e.g. "status" to translate the
+	// descriptions of the actions. Templates calling other functions must
+	// be parsed with them. The HTML template is left as is, since
+	// html/template cannot clone a template once executed.
+	Funcs template.FuncMap
+
+	// profileOptions are applied to the profile, see WithSubject.
+	profileOptions []func(p *Profile)
+}
+
+// Generate generates a DSN, see GenerateDSN.
+func (g *Generator) Generate(utf8 bool, envelope Envelope, mtaInfo ReportingMTAInfo, rcptsInfo []RecipientInfo, failedHeader textproto.Header, outWriter io.Writer) (textproto.Header, error) {
+	if g.AutoDetectUTF8 {
+		utf8 = needsUTF8(envelope, mtaInfo, rcptsInfo) || headerNeedsUTF8(failedHeader)
+	}
+	envelope.useFailedHeader(failedHeader)
+	return g.generateTo(utf8, envelope, mtaInfo, rcptsInfo, headerContent(failedHeader), outWriter)
+}
+
+// checkStatus returns the error Generate would return for the per-message
+// and per-recipient fields, without generating the DSN.
+func (g *Generator) checkStatus(utf8 bool, envelope Envelope, mtaInfo ReportingMTAInfo, rcptsInfo []RecipientInfo, failedHeader textproto.Header) error {
+	if g.AutoDetectUTF8 {
+		utf8 = needsUTF8(envelope, mtaInfo, rcptsInfo) || headerNeedsUTF8(failedHeader)
+	}
+	envelope.useFailedHeader(failedHeader)
+	p := g.profileFor(envelope, rcptsInfo)
+	if g.LegacyRFC1894 || p.sevenBit {
+		utf8 = false
+	}
+	return writeStatusFields(utf8, p, ioutil.Discard, mtaInfo, rcptsInfo)
+}
+
+// GenerateRawHeader is like Generate but takes the header of the failed
+// message as raw bytes, e.g. as read from the queue, which are copied into
+// the DSN as is instead of being parsed and formatted again.
+//
+// The header is only checked to consist of CRLF terminated field and
+// continuation lines of at most 998 characters. Anything after the first
+// empty line is ignored.
+func (g *Generator) GenerateRawHeader(utf8 bool, envelope Envelope, mtaInfo ReportingMTAInfo, rcptsInfo []RecipientInfo, failedHeader []byte, outWriter io.Writer) (textproto.Header, error) {
+	n, err := checkRawHeader(failedHeader)
+	if err != nil {
+		return textproto.Header{}, err
+	}
+	if g.AutoDetectUTF8 {
+		utf8 = needsUTF8(envelope, mtaInfo, rcptsInfo) || !isASCII(string(failedHeader[:n]))
+	}
+	if h, err := textproto.ReadHeader(bufio.NewReader(bytes.NewReader(failedHeader[:n]))); err == nil {
+		envelope.useFailedHeader(h)
+	}
+	return g.generateTo(utf8, envelope, mtaInfo, rcptsInfo, rawHeaderContent(failedHeader[:n]), outWriter)
+}
+
+// GenerateFull is like Generate but returns the complete failed message,
+// read from msg, as requested with RET=FULL (RFC 3461). The message is
+// streamed into a message/rfc822 part, or a message/global part if utf8 is
+// set, instead of the returned header part. It is copied as is and should
+// use CRLF line endings. If the message is larger than g.MaxReturnSize, only
+// its header is returned.
+func (g *Generator) GenerateFull(utf8 bool, envelope Envelope, mtaInfo ReportingMTAInfo, rcptsInfo []RecipientInfo, msg io.Reader, outWriter io.Writer) (textproto.Header, error) {
+	if g.AutoDetectUTF8 {
+		utf8 = needsUTF8(envelope, mtaInfo, rcptsInfo)
+	}
+	// Read the header for the threading fields and languages, the message
+	// is returned unchanged even if it cannot be parsed.
+	var consumed bytes.Buffer
+	if h, err := textproto.ReadHeader(bufio.NewReader(io.TeeReader(msg, &consumed))); err == nil {
+		envelope.useFailedHeader(h)
+	}
+	msg = io.MultiReader(&consumed, msg)
+
+	p := *g.profileFor(envelope, rcptsInfo)
+	p.returnFull = true
+	returned := messageContent(msg)
+	if g.Return == ReturnHeaders {
+		h, err := textproto.ReadHeader(bufio.NewReader(msg))
+		if err != nil {
+			return textproto.Header{}, fmt.Errorf("dsn: cannot read header of the returned message: %w", err)
+		}
+		p.returnFull = false
+		returned = headerContent(h)
+	} else if g.MaxReturnSize > 0 {
+		head, err := ioutil.ReadAll(io.LimitReader(msg, g.MaxReturnSize+1))
+		if err != nil {
+			return textproto.Header{}, err
+		}
+		if int64(len(head)) > g.MaxReturnSize {
+			h, err := textproto.ReadHeader(bufio.NewReader(io.MultiReader(bytes.NewReader(head), msg)))
+			if err != nil {
+				return textproto.Header{}, fmt.Errorf("dsn: cannot read header of the returned message: %w", err)
+			}
+			p.returnFull = false
+			p.returnTruncated = g.MaxReturnSize
+			returned = headerContent(h)
+		} else {
+			returned = messageContent(bytes.NewReader(head))
+		}
+	}
+	reportHeader, writeBody, err := g.generate(&p, utf8, envelope, mtaInfo, rcptsInfo, returned)
+	if err != nil {
+		return textproto.Header{}, err
+	}
+	if err := writeBody(outWriter); err != nil {
+		return textproto.Header{}, err
+	}
+	return reportHeader, nil
+}
+
+func (g *Generator) generateTo(utf8 bool, envelope Envelope, mtaInfo ReportingMTAInfo, rcptsInfo []RecipientInfo, returned returnedContent, outWriter io.Writer) (textproto.Header, error) {
+	reportHeader, writeBody, err := g.generate(g.profileFor(envelope, rcptsInfo), utf8, envelope, mtaInfo, rcptsInfo, returned)
+	if err != nil {
+		return textproto.Header{}, err
+	}
+	if err := writeBody(outWriter); err != nil {
+		return textproto.Header{}, err
+	}
+	return reportHeader, nil
+}
+
+// profile returns the profile with the Generator options applied.
+func (g *Generator) profile() *Profile {
+	p := g.Profile.withDefaults()
+	if len(g.profileOptions) != 0 {
+		out := *p
+		for _, opt := range g.profileOptions {
+			opt(&out)
+		}
+		p = &out
+	}
+	if len(g.Funcs) != 0 {
+		p = p.withFuncs(g.Funcs)
+	}
+	if g.OutlookCompat {
+		p = p.outlook()
+	}
+	if p.Dispositions {
+		p = p.dispositions()
+	}
+	if g.LegacyRFC1894 {
+		p = p.legacy()
+	}
+	if g.MachineOnly {
+		out := *p
+		out.machineOnly = true
+		out.QSBMF = false
+		out.HTML = nil
+		p = &out
+	}
+	if g.SevenBit {
+		out := *p
+		out.sevenBit = true
+		out.OmitTransferEncoding = true
+		p = &out
+	}
+	if g.Return == ReturnNone {
+		out := *p
+		out.returnNone = true
+		p = &out
+	}
+	if g.Location != nil || g.DateLayout != "" {
+		out := *p
+		out.location = g.Location
+		out.dateLayout = g.DateLayout
+		p = &out
+	}
+	return p
+}
+
+// actionProfiles are the profiles used instead of DefaultProfile if all
+// recipients of a DSN have the same Action, see Generator.Profile.
+var actionProfiles = map[Action]*Profile{
+	ActionDelayed:   DelayedProfile,
+	ActionDelivered: DeliveredProfile,
+	ActionRelayed:   RelayedProfile,
+	ActionExpanded:  ExpandedProfile,
+}
+
+// actionProfile returns the default profile for rcptsInfo: the profile of
+// their Action if it is the same for all of them, DeliveredProfile for
+// delivered and relayed recipients.
+func actionProfile(rcptsInfo []RecipientInfo) *Profile {
+	var p *Profile
+	for _, rcpt := range rcptsInfo {
+		rp, ok := actionProfiles[rcpt.Action]
+		switch {
+		case !ok:
+			return DefaultProfile
+		case p == nil || p == rp:
+			p = rp
+		case isSuccessProfile(p) && isSuccessProfile(rp):
+			p = DeliveredProfile
+		default:
+			return DefaultProfile
+		}
+	}
+	if p == nil {
+		return DefaultProfile
+	}
+	return p
+}
+
+func isSuccessProfile(p *Profile) bool {
+	return p == DeliveredProfile || p == RelayedProfile
+}
+
+// profileFor returns the profile with the Generator options applied for a
+// DSN to envelope reporting rcptsInfo.
+func (g *Generator) profileFor(envelope Envelope, rcptsInfo []RecipientInfo) *Profile {
+	return g.withDefaultProfile(g.defaultProfile(envelope, rcptsInfo)).profile()
+}
+
+// withAlternativeLanguages returns a copy of p with the profiles for
+// AlternativeLanguages added to its Alternatives.
+func (g *Generator) withAlternativeLanguages(p *Profile, rcptsInfo []RecipientInfo) *Profile {
+	out := *p
+	out.Alternatives = append([]*Profile(nil), p.Alternatives...)
+	seen := map[string]bool{p.Language: true}
+	for _, alt := range p.Alternatives {
+		seen[alt.Language] = true
+	}
+	for _, lang := range g.AlternativeLanguages {
+		alt := lookupTranslation(parseLanguages(lang), rcptsInfo)
+		if alt == nil {
+			alt = actionProfile(rcptsInfo)
+		}
+		if seen[alt.Language] {
+			continue
+		}
+		seen[alt.Language] = true
+		if len(g.Funcs) != 0 {
+			alt = alt.withFuncs(g.Funcs)
+		}
+		out.Alternatives = append(out.Alternatives, alt)
+	}
+	return &out
+}
+
+// defaultProfile returns the profile used if Generator.Profile is not set,
+// nil otherwise: the translation for the languages of envelope, or the
+// profile for the Action of rcptsInfo.
+func (g *Generator) defaultProfile(envelope Envelope, rcptsInfo []RecipientInfo) *Profile {
+	if g.Profile != nil {
+		return nil
+	}
+	if p := lookupTranslation(envelope.languages(g.DetectLanguage), rcptsInfo); p != nil {
+		return p
+	}
+	return actionProfile(rcptsInfo)
+}
+
+// withDefaultProfile returns g with p as profile if g has none.
+func (g *Generator) withDefaultProfile(p *Profile) *Generator {
+	if g.Profile != nil {
+		return g
+	}
+	withProfile := *g
+	withProfile.Profile = p
+	return &withProfile
+}
+
+// generate returns the header of the DSN and a function writing its body, so
+// that the header can be written before the body is generated.
+func (g *Generator) generate(p *Profile, utf8 bool, envelope Envelope, mtaInfo ReportingMTAInfo, rcptsInfo []RecipientInfo, returned returnedContent) (textproto.Header, func(io.Writer) error, error) {
+	if g.LegacyRFC1894 || p.sevenBit {
+		utf8 = false
+	}
+	if len(g.AlternativeLanguages) != 0 {
+		p = g.withAlternativeLanguages(p, rcptsInfo)
+	}
+	if g.Templates != nil {
+		var err error
+		if p, err = g.Templates.apply(p, reportAction(rcptsInfo)); err != nil {
+			return textproto.Header{}, nil, err
+		}
+	}
+
+	boundary, err := g.boundary(0)
+	if err != nil {
+		return textproto.Header{}, nil, err
+	}
+	var altBoundary string
+	if p.HTML != nil || len(p.Alternatives) != 0 {
+		if altBoundary, err = g.boundary(1); err != nil {
+			return textproto.Header{}, nil, err
+		}
+	}
+	if envelope.MsgID == "" && g.MessageID != nil {
+		envelope.MsgID = g.MessageID()
+	}
+
+	reportHeader := textproto.Header{}
+	now := clockOrDefault(g.Clock).Now()
+	if g.LocalDateField && g.Location != nil {
+		now = now.In(g.Location)
+	}
+	reportHeader.Add("Date", now.Format(timeLayout))
+	reportHeader.Add("Message-Id", envelope.MsgID)
+	if !p.OmitTransferEncoding {
+		reportHeader.Add("Content-Transfer-Encoding", "8bit")
+	}
+	if p.sevenBit && p.QSBMF {
+		reportHeader.Add("Content-Transfer-Encoding", "quoted-printable")
+	}
+	if p.QSBMF {
+		reportHeader.Add("Content-Type", `text/plain; charset="utf-8"`)
+	} else {
+		reportHeader.Add("Content-Type", "multipart/report; report-type=delivery-status; boundary="+boundary)
+	}
+	reportHeader.Add("MIME-Version", "1.0")
+	reportHeader.Add("Auto-Submitted", p.AutoSubmitted)
+	if p.SuppressAutoResponses {
+		reportHeader.Add("Precedence", "bulk")
+		reportHeader.Add("X-Auto-Response-Suppress", "All")
+	}
+	subject, err := p.subject(mtaInfo, rcptsInfo)
+	if err != nil {
+		return textproto.Header{}, nil, err
+	}
+	to, from := envelope.To, envelope.From
+	// Encoding would hide line breaks.
+	for _, f := range [][2]string{{"To", to}, {"From", from}, {"Subject", subject}} {
+		if err := checkHeaderValue(f[0], f[1]); err != nil {
+			return textproto.Header{}, nil, err
+		}
+	}
+	if !utf8 {
+		to, from, subject = encodeAddressList(to), encodeAddressList(from), encodeSubject(subject)
+	}
+	reportHeader.Add("To", to)
+	reportHeader.Add("From", from)
+	reportHeader.Add("Subject", subject)
+	if p.Language != "" {
+		reportHeader.Add("Content-Language", p.Language)
+	}
+	if p.FailedRecipientsField {
+		if failed := failedRecipients(rcptsInfo); len(failed) != 0 {
+			reportHeader.Add("X-Failed-Recipients", strings.Join(failed, ", "))
+		}
+	}
+
+	forEachField(p.Header, reportHeader.Add)
+	if envelope.inReplyTo != "" && !envelope.Header.Has("In-Reply-To") && !envelope.Header.Has("References") {
+		references := envelope.inReplyTo
+		if envelope.references != "" {
+			references = envelope.references + " " + references
+		}
+		reportHeader.Add("In-Reply-To", envelope.inReplyTo)
+		reportHeader.Add("References", references)
+	}
+	if err := checkExtraFields(envelope.Header); err != nil {
+		return textproto.Header{}, nil, err
+	}
+	forEachField(envelope.Header, reportHeader.Add)
+	if err := checkHeaderValues(reportHeader); err != nil {
+		return textproto.Header{}, nil, err
+	}
+
+	if g.LegacyRFC1894 {
+		reportHeader = asciiHeader(reportHeader)
+	}
+
+	writeBody := func(outWriter io.Writer) error {
+		if g.LegacyRFC1894 {
+			outWriter = &asciiWriter{w: outWriter}
+		}
+
+		if p.QSBMF {
+			bodyWriter, closeBody := textBodyWriter(p, outWriter)
+			if err := writeQSBMF(p, bodyWriter, mtaInfo, rcptsInfo, returned); err != nil {
+				return err
+			}
+			return closeBody()
+		}
+
+		if p.Preamble != "" {
+			if _, err := io.WriteString(outWriter, p.Preamble+"\r\n"); err != nil {
+				return err
+			}
+		}
+
+		partWriter := textproto.NewMultipartWriter(outWriter)
+		if err := partWriter.SetBoundary(boundary); err != nil {
+			return err
+		}
+		defer partWriter.Close()
+
+		if !p.machineOnly {
+			if err := writeHumanReadablePart(p, altBoundary, partWriter, mtaInfo, rcptsInfo); err != nil {
+				return err
+			}
+		}
+		if err := writeMachineReadablePart(utf8, p, partWriter, mtaInfo, rcptsInfo); err != nil {
+			return err
+		}
+		if p.returnNone {
+			return nil
+		}
+		return writeHeader(utf8, p, partWriter, returned)
+	}
+	return reportHeader, writeBody, nil
+}
+
+// failedRecipients returns the addresses of the recipients with ActionFailed.
+func failedRecipients(rcptsInfo []RecipientInfo) []string {
+	var failed []string
+	for _, rcpt := range rcptsInfo {
+		if rcpt.Action == ActionFailed {
+			failed = append(failed, rcpt.FinalRecipient)
+		}
+	}
+	return failed
+}
+
+// qsbmfSeparator separates the recipient paragraphs from the returned
+// message in QSBMF.
+const qsbmfSeparator = "--- Below this line is a copy of the message.\n\n"
+
+// writeQSBMF writes a plain text bounce in the qmail-send bounce message
+// format.
+func writeQSBMF(p *Profile, w io.Writer, mtaInfo ReportingMTAInfo, rcptsInfo []RecipientInfo, returned returnedContent) error {
+	if err := writeHumanText(p, w, mtaInfo, rcptsInfo); err != nil {
+		return err
+	}
+	if p.returnNone {
+		return nil
+	}
+	if _, err := io.WriteString(w, qsbmfSeparator); err != nil {
+		return err
+	}
+	return returned(w)
+}
+
+// useFailedHeader sets the threading fields of the DSN from the header of
+// the failed message, so that the DSN is shown as a reply to it, and keeps
+// the languages of its sender.
+func (e *Envelope) useFailedHeader(failedHeader textproto.Header) {
+	e.inReplyTo = strings.TrimSpace(failedHeader.Get("Message-Id"))
+	e.references = strings.Join(strings.Fields(failedHeader.Get("References")), " ")
+	e.headerLanguages = headerLanguages(failedHeader)
+}
+
+// boundary returns the nth MIME boundary of a DSN, see Generator.Boundary.
+func (g *Generator) boundary(n int) (string, error) {
+	if g.Boundary != nil {
+		return g.Boundary(n), nil
+	}
+	return randomHex(g.Rand, 30)
+}
+
+// forEachField calls fn for every field of h in the order they were added.
+func forEachField(h textproto.Header, fn func(k, v string)) {
+	type field struct{ k, v string }
+	var fields []field
+	for f := h.Fields(); f.Next(); {
+		fields = append(fields, field{f.Key(), f.Value()})
+	}
+
+	// Fields are returned in the reverse order of Add.
+	for i := len(fields) - 1; i >= 0; i-- {
+		fn(fields[i].k, fields[i].v)
+	}
+}
@@ -1,11 +1,11 @@
 module schneider.vip/go-dsn
 
-go 1.15
+go 1.16
 
 require (
 	github.com/emersion/go-message v0.13.0
+	github.com/emersion/go-sasl v0.0.0-20200509203442-7bfe0ed36a21
 	github.com/emersion/go-smtp v0.14.0
-	github.com/mschneider82/go-smtp v1.2.0
 	golang.org/x/net v0.0.0-20201110031124-69a78807bb2b
 	golang.org/x/text v0.3.4
 )
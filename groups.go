@@ -0,0 +1,60 @@
+package dsn
+
+import (
+	"bytes"
+	"strconv"
+)
+
+// actionHeadings are the group headings of GroupRecipients, in the order
+// the groups are written.
+var actionHeadings = []struct {
+	action  Action
+	heading string
+}{
+	{ActionFailed, "Permanently failed"},
+	{ActionDelayed, "Delayed"},
+	{ActionDelivered, "Delivered"},
+	{ActionRelayed, "Relayed"},
+	{ActionExpanded, "Expanded"},
+}
+
+// writeGroupedRecipients writes the recipients grouped by Action, see
+// Profile.GroupRecipients. Recipients with other actions follow in a group
+// per action.
+func writeGroupedRecipients(p *Profile, buf *bytes.Buffer, rcptsInfo []RecipientInfo) error {
+	known := make(map[Action]bool, len(actionHeadings))
+	for _, h := range actionHeadings {
+		known[h.action] = true
+		if err := writeRecipientGroup(p, buf, h.heading, byAction(rcptsInfo, h.action)); err != nil {
+			return err
+		}
+	}
+
+	for _, rcpt := range rcptsInfo {
+		if known[rcpt.Action] {
+			continue
+		}
+		known[rcpt.Action] = true
+		if err := writeRecipientGroup(p, buf, string(rcpt.Action), byAction(rcptsInfo, rcpt.Action)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeRecipientGroup(p *Profile, buf *bytes.Buffer, heading string, rcpts []RecipientInfo) error {
+	if len(rcpts) == 0 {
+		return nil
+	}
+	buf.WriteString(heading)
+	buf.WriteString(" (")
+	buf.WriteString(strconv.Itoa(len(rcpts)))
+	buf.WriteString("):\n")
+	for _, rcpt := range rcpts {
+		if err := writeRecipientText(p, buf, rcpt); err != nil {
+			return err
+		}
+	}
+	buf.WriteByte('\n')
+	return nil
+}
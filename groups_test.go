@@ -0,0 +1,42 @@
+package dsn
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-smtp"
+)
+
+func TestGroupRecipients(t *testing.T) {
+	p := *DefaultProfile
+	p.RecipientText = PostfixProfile.RecipientText
+	p.GroupRecipients = 3
+
+	rcpts := []RecipientInfo{
+		{FinalRecipient: "a@example.net", Action: ActionDelayed, Status: smtp.EnhancedCode{4, 4, 1}},
+		{FinalRecipient: "b@example.net", Action: ActionFailed, Status: smtp.EnhancedCode{5, 1, 1}},
+		{FinalRecipient: "c@example.net", Action: ActionFailed, Status: smtp.EnhancedCode{5, 1, 1}},
+		{FinalRecipient: "d@example.net", Action: "quarantined", Status: smtp.EnhancedCode{5, 7, 1}},
+	}
+	generate := func(rcpts []RecipientInfo) string {
+		var body bytes.Buffer
+		g := &Generator{Profile: &p}
+		if _, err := g.Generate(false, Envelope{MsgID: "<msgid@example.org>"}, ReportingMTAInfo{ReportingMTA: "mx.example.org"}, rcpts, textproto.Header{}, &body); err != nil {
+			t.Fatal(err)
+		}
+		return body.String()
+	}
+
+	want := "Permanently failed (2):\n<b@example.net>: \n<c@example.net>: \n\n" +
+		"Delayed (1):\n<a@example.net>: \n\n" +
+		"quarantined (1):\n<d@example.net>: \n\n"
+	if got := generate(rcpts); !strings.Contains(got, want) {
+		t.Errorf("body does not contain %q:\n%s", want, got)
+	}
+
+	if got := generate(rcpts[:2]); strings.Contains(got, "Delayed (1):") {
+		t.Errorf("recipients grouped below the threshold:\n%s", got)
+	}
+}
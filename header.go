@@ -0,0 +1,45 @@
+package dsn
+
+import (
+	"net/mail"
+	"sort"
+
+	"github.com/emersion/go-message/textproto"
+)
+
+// HeaderFromMap converts a header map, such as a net/mail.Header or a
+// net/textproto.MIMEHeader, to a textproto.Header, e.g. for the failedHeader
+// argument of GenerateDSN.
+//
+// Maps do not keep the order of the fields: they are sorted by key, the
+// values of a key keep their order.
+func HeaderFromMap(m map[string][]string) textproto.Header {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	h := textproto.Header{}
+	// Add prepends, add the fields in reverse order.
+	for i := len(keys) - 1; i >= 0; i-- {
+		values := m[keys[i]]
+		for j := len(values) - 1; j >= 0; j-- {
+			h.Add(keys[i], values[j])
+		}
+	}
+	return h
+}
+
+// MailHeader converts h to a net/mail.Header, e.g. for the header of a
+// parsed report. Keys are canonicalized, the order of the fields with
+// different keys is lost.
+func MailHeader(h textproto.Header) mail.Header {
+	m := mail.Header{}
+	// Fields returns the fields in message order, the reverse order of Add.
+	for f := h.Fields(); f.Next(); {
+		k := canonicalKey(f.Key())
+		m[k] = append(m[k], f.Value())
+	}
+	return m
+}
@@ -0,0 +1,35 @@
+package dsn_test
+
+import (
+	"bytes"
+	"net/mail"
+	"reflect"
+	"testing"
+
+	"github.com/emersion/go-message/textproto"
+	dsn "schneider.vip/go-dsn"
+)
+
+func TestHeaderFromMap(t *testing.T) {
+	h := dsn.HeaderFromMap(mail.Header{
+		"Subject":  {"Hello"},
+		"Received": {"from a by b", "from c by a"},
+		"From":     {"sender@example.org"},
+	})
+	var buf bytes.Buffer
+	if err := textproto.WriteHeader(&buf, h); err != nil {
+		t.Fatal(err)
+	}
+	want := "From: sender@example.org\r\nReceived: from a by b\r\nReceived: from c by a\r\nSubject: Hello\r\n\r\n"
+	if buf.String() != want {
+		t.Errorf("HeaderFromMap() =\n%q\nwant\n%q", buf.String(), want)
+	}
+
+	m := dsn.MailHeader(h)
+	if got := m["Received"]; !reflect.DeepEqual(got, []string{"from a by b", "from c by a"}) {
+		t.Errorf("MailHeader() Received = %q", got)
+	}
+	if got := m.Get("Subject"); got != "Hello" {
+		t.Errorf("MailHeader() Subject = %q", got)
+	}
+}
@@ -0,0 +1,76 @@
+package dsn
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// QueuedFor returns the time between ArrivalDate and LastAttemptDate, 0 if
+// either is unknown.
+func (info ReportingMTAInfo) QueuedFor() time.Duration {
+	if info.ArrivalDate.IsZero() || info.LastAttemptDate.IsZero() {
+		return 0
+	}
+	return info.LastAttemptDate.Sub(info.ArrivalDate)
+}
+
+// FormatDate formats t for the human-readable part with the DateLayout of
+// the Generator, like time.Time.String by default. It is meant to be used in
+// templates, e.g. {{.FormatDate .ArrivalDate}}.
+func (info ReportingMTAInfo) FormatDate(t time.Time) string {
+	if info.dateLayout == "" {
+		return t.String()
+	}
+	return t.Format(info.dateLayout)
+}
+
+// RetryingFor returns how much longer delivery is retried: the time between
+// the LastAttemptDate of the message and WillRetryUntil. It is only known
+// while the human-readable part is generated, i.e. in templates, and 0
+// otherwise.
+func (info RecipientInfo) RetryingFor() time.Duration {
+	if info.WillRetryUntil.IsZero() || info.lastAttemptDate.IsZero() {
+		return 0
+	}
+	return info.WillRetryUntil.Sub(info.lastAttemptDate)
+}
+
+// humanDuration formats d for people with its two most significant units,
+// e.g. "2 days and 4 hours" or "18 hours". It returns "less than a minute"
+// for shorter durations and an empty string for durations <= 0.
+func humanDuration(d time.Duration) string {
+	if d <= 0 {
+		return ""
+	}
+	if d < time.Minute {
+		return "less than a minute"
+	}
+
+	units := []struct {
+		name string
+		n    int64
+	}{
+		{"day", int64(d / (24 * time.Hour))},
+		{"hour", int64(d % (24 * time.Hour) / time.Hour)},
+		{"minute", int64(d % time.Hour / time.Minute)},
+	}
+	var parts []string
+	for _, u := range units {
+		if u.n == 0 {
+			if len(parts) != 0 {
+				break
+			}
+			continue
+		}
+		part := strconv.FormatInt(u.n, 10) + " " + u.name
+		if u.n != 1 {
+			part += "s"
+		}
+		parts = append(parts, part)
+		if len(parts) == 2 {
+			break
+		}
+	}
+	return strings.Join(parts, " and ")
+}
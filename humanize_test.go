@@ -0,0 +1,98 @@
+package dsn
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-smtp"
+)
+
+func TestHumanDuration(t *testing.T) {
+	tests := []struct {
+		d    time.Duration
+		want string
+	}{
+		{0, ""},
+		{-time.Hour, ""},
+		{30 * time.Second, "less than a minute"},
+		{time.Minute, "1 minute"},
+		{18 * time.Hour, "18 hours"},
+		{time.Hour + 5*time.Minute + 10*time.Second, "1 hour and 5 minutes"},
+		{52 * time.Hour, "2 days and 4 hours"},
+		{48*time.Hour + 30*time.Minute, "2 days"},
+		{24*time.Hour + 59*time.Minute, "1 day"},
+	}
+	for _, tt := range tests {
+		if got := humanDuration(tt.d); got != tt.want {
+			t.Errorf("humanDuration(%v) = %q, want %q", tt.d, got, tt.want)
+		}
+	}
+}
+
+func TestDelayedProfileDurations(t *testing.T) {
+	arrival := time.Date(2020, 4, 14, 10, 0, 0, 0, time.UTC)
+	mtaInfo := ReportingMTAInfo{
+		ReportingMTA:    "mx.example.org",
+		ArrivalDate:     arrival,
+		LastAttemptDate: arrival.Add(52 * time.Hour),
+	}
+	rcpts := []RecipientInfo{{FinalRecipient: "a@example.net"}}
+
+	var body bytes.Buffer
+	_, err := GenerateDelayWarning(false, Envelope{MsgID: "<warning@example.org>"}, mtaInfo, rcpts, arrival.Add(70*time.Hour), textproto.Header{}, &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"Your message has been queued for 2 days and 4 hours.",
+		"Delivery to a@example.net delayed, will keep trying for another 18 hours",
+	} {
+		if !strings.Contains(body.String(), want) {
+			t.Errorf("body does not contain %q:\n%s", want, body.String())
+		}
+	}
+	if rcpts[0].RetryingFor() != 0 {
+		t.Error("RetryingFor is known outside of generation")
+	}
+}
+
+func TestGeneratorLocation(t *testing.T) {
+	zone := time.FixedZone("CEST", 2*60*60)
+	arrival := time.Date(2020, 4, 14, 10, 0, 0, 0, time.UTC)
+	g := &Generator{
+		Clock:          FixedClock(arrival.Add(time.Hour)),
+		Location:       zone,
+		LocalDateField: true,
+		DateLayout:     "2 Jan 2006 15:04 MST",
+	}
+
+	var body bytes.Buffer
+	hdr, err := g.Generate(false, Envelope{MsgID: "<msgid@example.org>"}, ReportingMTAInfo{
+		ReportingMTA:    "mx.example.org",
+		ArrivalDate:     arrival,
+		LastAttemptDate: arrival.Add(30 * time.Minute),
+	}, []RecipientInfo{{
+		FinalRecipient: "a@example.net",
+		Action:         ActionFailed,
+		Status:         smtp.EnhancedCode{5, 1, 1},
+	}}, textproto.Header{}, &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := hdr.Get("Date"), "Tue, 14 Apr 2020 13:00:00 +0200"; got != want {
+		t.Errorf("Date = %q, want %q", got, want)
+	}
+	for _, want := range []string{
+		"Arrival: 14 Apr 2020 12:00 CEST\n",
+		"Last delivery attempt: 14 Apr 2020 12:30 CEST\n",
+		// The machine-readable part is not affected.
+		"Arrival-Date: Tue, 14 Apr 2020 10:00:00 +0000",
+	} {
+		if !strings.Contains(body.String(), want) {
+			t.Errorf("body does not contain %q:\n%s", want, body.String())
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package dsn
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+
+	"github.com/emersion/go-message/textproto"
+	"golang.org/x/text/language"
+)
+
+var (
+	translationsMu sync.RWMutex
+	translations   = map[templateKey]*Profile{}
+)
+
+// RegisterTranslation makes p the profile of DSNs reporting action to
+// senders preferring the language lang, a BCP 47 tag such as "de" or
+// "pt-BR", see Envelope.Language and Generator.DetectLanguage. The action of
+// a report is the Action of all its recipients, or the most severe one of a
+// mix, as for Profile.Subjects.
+//
+// Translations replace the built-in profiles, which are English, and are
+// not used if Generator.Profile is set. Empty fields of p are taken from
+// DefaultProfile, except that its Subject is used for all actions if
+// Subjects is nil, and its Language defaults to lang.
+//
+// It returns an error if lang is not a valid tag or a translation for lang
+// and action is already registered.
+func RegisterTranslation(lang string, action Action, p *Profile) error {
+	if p == nil {
+		return errors.New("dsn: translation profile is nil")
+	}
+	tag, err := language.Parse(lang)
+	if err != nil {
+		return fmt.Errorf("dsn: invalid language tag %q: %w", lang, err)
+	}
+	key := templateKey{tag.String(), action}
+
+	out := *p
+	if out.Language == "" {
+		out.Language = key.lang
+	}
+	if out.Subjects == nil && out.Subject != "" {
+		out.Subjects = map[Action]*template.Template{}
+	}
+
+	translationsMu.Lock()
+	defer translationsMu.Unlock()
+	if _, ok := translations[key]; ok {
+		return fmt.Errorf("dsn: translation for %q/%s is already registered", key.lang, action)
+	}
+	translations[key] = &out
+	return nil
+}
+
+// lookupTranslation returns the translation of a report of rcptsInfo in the
+// language best matching languages, which are in order of preference. It
+// returns nil if English or none of them matches.
+func lookupTranslation(languages []language.Tag, rcptsInfo []RecipientInfo) *Profile {
+	if len(languages) == 0 {
+		return nil
+	}
+	action := reportAction(rcptsInfo)
+
+	translationsMu.RLock()
+	defer translationsMu.RUnlock()
+	var keys []templateKey
+	for key := range translations {
+		if key.action == action {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].lang < keys[j].lang
+	})
+
+	// The built-in profiles are offered last as English, so that senders
+	// preferring English get them unless an English translation is
+	// registered.
+	supported := make([]language.Tag, 0, len(keys)+1)
+	for _, key := range keys {
+		supported = append(supported, language.Make(key.lang))
+	}
+	supported = append(supported, language.English)
+
+	_, i, confidence := language.NewMatcher(supported).Match(languages...)
+	if confidence == language.No || i == len(keys) {
+		return nil
+	}
+	return translations[keys[i]]
+}
+
+// parseLanguages returns the language tags of a Content-Language or
+// Accept-Language field in order of preference, invalid values are ignored.
+func parseLanguages(v string) []language.Tag {
+	if strings.TrimSpace(v) == "" {
+		return nil
+	}
+	tags, _, err := language.ParseAcceptLanguage(v)
+	if err != nil {
+		return nil
+	}
+	return tags
+}
+
+// headerLanguages returns the languages understood by the sender of a
+// message with header h, from its Accept-Language (RFC 3282),
+// X-Accept-Language and Content-Language fields.
+func headerLanguages(h textproto.Header) []language.Tag {
+	var tags []language.Tag
+	for _, k := range []string{"Accept-Language", "X-Accept-Language", "Content-Language"} {
+		tags = append(tags, parseLanguages(h.Get(k))...)
+	}
+	return tags
+}
+
+// languages returns the languages the DSN should be written in, in order of
+// preference: Envelope.Language, or those of the failed message if
+// detectLanguage is set.
+func (e *Envelope) languages(detectLanguage bool) []language.Tag {
+	if e.Language != "" {
+		return parseLanguages(e.Language)
+	}
+	if detectLanguage {
+		return e.headerLanguages
+	}
+	return nil
+}
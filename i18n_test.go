@@ -0,0 +1,143 @@
+package dsn_test
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+	"testing"
+	"text/template"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-smtp"
+	dsn "schneider.vip/go-dsn"
+)
+
+var registerGerman sync.Once
+
+func germanTranslation(t *testing.T) {
+	registerGerman.Do(func() {
+		err := dsn.RegisterTranslation("de", dsn.ActionFailed, &dsn.Profile{
+			Subject:       "Unzustellbare Nachricht",
+			Text:          template.Must(template.New("").Parse("Dies ist das Mailsystem von {{.ReportingMTA}}.\n\n")),
+			RecipientText: template.Must(template.New("").Parse("Zustellung an {{.FinalRecipient}} fehlgeschlagen\n")),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestRegisterTranslation(t *testing.T) {
+	germanTranslation(t)
+	if err := dsn.RegisterTranslation("de", dsn.ActionFailed, &dsn.Profile{}); err == nil {
+		t.Error("RegisterTranslation() succeeded for a registered language")
+	}
+	if err := dsn.RegisterTranslation("not a tag", dsn.ActionFailed, &dsn.Profile{}); err == nil {
+		t.Error("RegisterTranslation() succeeded for an invalid tag")
+	}
+}
+
+func TestTranslation(t *testing.T) {
+	germanTranslation(t)
+	failed := dsn.RecipientInfo{FinalRecipient: "rcpt@example.com", Action: dsn.ActionFailed, Status: smtp.EnhancedCode{5, 1, 1}}
+	delayed := dsn.RecipientInfo{FinalRecipient: "rcpt@example.com", Action: dsn.ActionDelayed, Status: smtp.EnhancedCode{4, 4, 1}}
+
+	tests := []struct {
+		name     string
+		detect   bool
+		language string
+		header   map[string][]string
+		rcpt     dsn.RecipientInfo
+		german   bool
+	}{
+		{name: "explicit", language: "de-CH", rcpt: failed, german: true},
+		{name: "explicit list", language: "fr, de;q=0.5", rcpt: failed, german: true},
+		{name: "English preferred", language: "en, de;q=0.5", rcpt: failed},
+		{name: "no translation", language: "fr", rcpt: failed},
+		{name: "other action", language: "de", rcpt: delayed},
+		{name: "detection disabled", header: map[string][]string{"Content-Language": {"de"}}, rcpt: failed},
+		{name: "Content-Language", detect: true, header: map[string][]string{"Content-Language": {"de"}}, rcpt: failed, german: true},
+		{name: "Accept-Language", detect: true, header: map[string][]string{"Accept-Language": {"de-AT;q=0.9, en;q=0.8"}, "Content-Language": {"en"}}, rcpt: failed, german: true},
+		{name: "explicit wins", detect: true, language: "en", header: map[string][]string{"Content-Language": {"de"}}, rcpt: failed},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			g := dsn.Generator{DetectLanguage: test.detect}
+			var body bytes.Buffer
+			h, err := g.Generate(false, dsn.Envelope{Language: test.language}, dsn.ReportingMTAInfo{ReportingMTA: "mx.example.org"}, []dsn.RecipientInfo{test.rcpt}, dsn.HeaderFromMap(test.header), &body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			german := h.Get("Subject") == "Unzustellbare Nachricht"
+			if german != test.german {
+				t.Errorf("Subject = %q, german %v, want %v", h.Get("Subject"), german, test.german)
+			}
+			if german {
+				if h.Get("Content-Language") != "de" {
+					t.Errorf("Content-Language = %q, want de", h.Get("Content-Language"))
+				}
+				if !strings.Contains(body.String(), "Zustellung an rcpt@example.com fehlgeschlagen") {
+					t.Errorf("body is not translated:\n%s", body.String())
+				}
+			}
+		})
+	}
+
+	// An explicit profile is not replaced.
+	g := dsn.Generator{Profile: dsn.PostfixProfile}
+	h, err := g.Generate(false, dsn.Envelope{Language: "de"}, dsn.ReportingMTAInfo{ReportingMTA: "mx.example.org"}, []dsn.RecipientInfo{failed}, textproto.Header{}, &bytes.Buffer{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.Get("Subject") == "Unzustellbare Nachricht" {
+		t.Error("translation replaced Generator.Profile")
+	}
+}
+
+func TestAlternativeLanguages(t *testing.T) {
+	germanTranslation(t)
+	rcpts := []dsn.RecipientInfo{{FinalRecipient: "rcpt@example.com", Action: dsn.ActionFailed, Status: smtp.EnhancedCode{5, 1, 1}}}
+
+	var body bytes.Buffer
+	_, err := dsn.GenerateDSN(false, dsn.Envelope{Language: "de"}, dsn.ReportingMTAInfo{ReportingMTA: "mx.example.org"}, rcpts, textproto.Header{}, &body,
+		dsn.WithAlternativeLanguages("de", "en", "fr"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := body.String()
+	if !strings.Contains(s, "multipart/alternative") {
+		t.Fatalf("human-readable part is not multipart/alternative:\n%s", s)
+	}
+	english := strings.Index(s, "Delivery to rcpt@example.com failed")
+	german := strings.Index(s, "Zustellung an rcpt@example.com fehlgeschlagen")
+	if english < 0 || german < 0 || english > german {
+		t.Errorf("want the English text before the German one:\n%s", s)
+	}
+	if n := strings.Count(s, "Content-Type: text/plain"); n != 2 {
+		t.Errorf("%d text/plain parts, want 2", n)
+	}
+	if n := strings.Count(s, "Content-Type: message/delivery-status"); n != 1 {
+		t.Errorf("%d delivery-status parts, want 1", n)
+	}
+}
+
+func TestProfileAlternatives(t *testing.T) {
+	rcpts := []dsn.RecipientInfo{{FinalRecipient: "rcpt@example.com", Action: dsn.ActionFailed, Status: smtp.EnhancedCode{5, 1, 1}}}
+	p := &dsn.Profile{
+		Alternatives: []*dsn.Profile{{
+			Text:          template.Must(template.New("").Parse("Short version\n")),
+			RecipientText: template.Must(template.New("").Parse("")),
+		}},
+	}
+
+	var body bytes.Buffer
+	if _, err := dsn.GenerateDSN(false, dsn.Envelope{}, dsn.ReportingMTAInfo{ReportingMTA: "mx.example.org"}, rcpts, textproto.Header{}, &body, dsn.WithProfile(p)); err != nil {
+		t.Fatal(err)
+	}
+	s := body.String()
+	short := strings.Index(s, "Short version")
+	full := strings.Index(s, "Delivery to rcpt@example.com failed")
+	if !strings.Contains(s, "multipart/alternative") || short < 0 || full < 0 || short > full {
+		t.Errorf("want a multipart/alternative of the short and the full text:\n%s", s)
+	}
+}
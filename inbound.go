@@ -0,0 +1,195 @@
+package dsn
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-smtp"
+)
+
+// Bounce is a message received by BounceBackend.
+type Bounce struct {
+	// From is the reverse-path, usually empty for bounces.
+	From string
+	// To is the bounce address the message was sent to, e.g. a VERP
+	// address identifying the original message.
+	To string
+	// Data is the complete message.
+	Data []byte
+
+	// Report is the parsed DSN, nil if Err is set.
+	Report *Report
+	// Err is the error returned by Parser, e.g. ErrNotDSN for auto replies.
+	Err error
+}
+
+// BounceHandler processes messages received by BounceBackend.
+type BounceHandler interface {
+	HandleBounce(b *Bounce) error
+}
+
+// BounceHandlerFunc adapts a function to BounceHandler.
+type BounceHandlerFunc func(b *Bounce) error
+
+// HandleBounce implements BounceHandler.
+func (f BounceHandlerFunc) HandleBounce(b *Bounce) error {
+	return f(b)
+}
+
+// DefaultMaxReceived is the default BounceBackend.MaxReceived.
+const DefaultMaxReceived = 50
+
+// BounceBackend is a go-smtp Backend accepting mail for bounce addresses
+// and passing it to Handler once per bounce address, e.g. to close the loop
+// of VERP based bounce handling:
+//
+//	srv := smtp.NewServer(&dsn.BounceBackend{Match: isBounceAddr, Handler: h})
+//
+// Mail for other addresses is rejected. Messages that passed MaxReceived
+// hops are rejected as a mail loop. Bounces of messages sent to a bounce
+// address are accepted but discarded, so that two bounce handlers cannot
+// keep bouncing each other's notifications.
+//
+// If the handler returns an *smtp.SMTPError it is sent to the client, other
+// errors are reported as temporary failures so the message is retried.
+type BounceBackend struct {
+	// Match reports whether rcpt is a bounce address.
+	Match func(rcpt string) bool
+
+	// Parser parses the received messages. Its MaxBytes also limits the
+	// size of accepted messages.
+	Parser Parser
+
+	// MaxReceived is the maximum number of Received fields, it defaults to
+	// DefaultMaxReceived.
+	MaxReceived int
+
+	Handler BounceHandler
+}
+
+// Login implements smtp.Backend, authentication is not supported.
+func (be *BounceBackend) Login(state *smtp.ConnectionState, username, password string) (smtp.Session, error) {
+	return nil, smtp.ErrAuthUnsupported
+}
+
+// AnonymousLogin implements smtp.Backend.
+func (be *BounceBackend) AnonymousLogin(state *smtp.ConnectionState) (smtp.Session, error) {
+	return &bounceSession{be: be}, nil
+}
+
+type bounceSession struct {
+	be   *BounceBackend
+	from string
+	to   []string
+}
+
+func (s *bounceSession) Reset() {
+	s.from = ""
+	s.to = nil
+}
+
+func (s *bounceSession) Logout() error {
+	return nil
+}
+
+func (s *bounceSession) Mail(from string, opts smtp.MailOptions) error {
+	s.from = from
+	return nil
+}
+
+func (s *bounceSession) Rcpt(to string) error {
+	if s.be.Match == nil || !s.be.Match(to) {
+		return &smtp.SMTPError{
+			Code:         550,
+			EnhancedCode: smtp.EnhancedCode{5, 1, 1},
+			Message:      "Not a bounce address",
+		}
+	}
+	s.to = append(s.to, to)
+	return nil
+}
+
+func (s *bounceSession) Data(r io.Reader) error {
+	maxBytes := s.be.Parser.MaxBytes
+	if maxBytes == 0 {
+		maxBytes = DefaultMaxBytes
+	}
+	if maxBytes > 0 {
+		r = io.LimitReader(r, maxBytes+1)
+	}
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if maxBytes > 0 && int64(len(data)) > maxBytes {
+		return &smtp.SMTPError{
+			Code:         552,
+			EnhancedCode: smtp.EnhancedCode{5, 3, 4},
+			Message:      "Message too big",
+		}
+	}
+
+	if s.hops(data) > limit(s.be.MaxReceived, DefaultMaxReceived) {
+		return &smtp.SMTPError{
+			Code:         554,
+			EnhancedCode: smtp.EnhancedCode{5, 4, 6},
+			Message:      "Routing loop detected",
+		}
+	}
+
+	report, err := s.be.Parser.Parse(bytes.NewReader(data))
+	if _, ok := err.(*LimitError); ok {
+		return &smtp.SMTPError{
+			Code:         554,
+			EnhancedCode: smtp.EnhancedCode{5, 6, 0},
+			Message:      err.Error(),
+		}
+	}
+	if err == nil && s.bounceOfBounce(report) {
+		return nil
+	}
+
+	for _, to := range s.to {
+		b := &Bounce{From: s.from, To: to, Data: data, Report: report, Err: err}
+		if err := s.be.Handler.HandleBounce(b); err != nil {
+			if smtpErr, ok := err.(*smtp.SMTPError); ok {
+				return smtpErr
+			}
+			return &smtp.SMTPError{
+				Code:         451,
+				EnhancedCode: smtp.EnhancedCode{4, 3, 0},
+				Message:      "Cannot process bounce",
+			}
+		}
+	}
+	return nil
+}
+
+// hops returns the number of Received fields of the message.
+func (s *bounceSession) hops(data []byte) int {
+	h, err := textproto.ReadHeader(bufio.NewReader(bytes.NewReader(data)))
+	if err != nil {
+		// Parse reports the error.
+		return 0
+	}
+	n := 0
+	for f := h.FieldsByKey("Received"); f.Next(); {
+		n++
+	}
+	return n
+}
+
+// bounceOfBounce reports whether report is about a message sent to a bounce
+// address.
+func (s *bounceSession) bounceOfBounce(report *Report) bool {
+	for _, rcpt := range report.Recipients {
+		if s.be.Match(strings.TrimSpace(rcpt.FinalRecipient)) {
+			return true
+		}
+	}
+	return false
+}
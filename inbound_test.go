@@ -0,0 +1,90 @@
+package dsn_test
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-smtp"
+	dsn "schneider.vip/go-dsn"
+)
+
+func TestBounceBackend(t *testing.T) {
+	var mu sync.Mutex
+	var bounces []*dsn.Bounce
+	be := &dsn.BounceBackend{
+		Match: func(rcpt string) bool { return strings.HasPrefix(rcpt, "bounces+") },
+		Handler: dsn.BounceHandlerFunc(func(b *dsn.Bounce) error {
+			mu.Lock()
+			defer mu.Unlock()
+			bounces = append(bounces, b)
+			return nil
+		}),
+		MaxReceived: 3,
+	}
+	srv := smtp.NewServer(be)
+	srv.Domain = "localhost"
+	srv.AllowInsecureAuth = true
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(l)
+	defer srv.Close()
+	addr := l.Addr().String()
+
+	generate := func(finalRcpt string) []byte {
+		var body bytes.Buffer
+		hdr, err := dsn.GenerateDSN(false, dsn.Envelope{
+			MsgID: "<bounce@example.net>",
+			From:  "MAILER-DAEMON@example.net",
+			To:    "bounces+42@example.org",
+		}, dsn.ReportingMTAInfo{ReportingMTA: "mx.example.net"}, []dsn.RecipientInfo{{
+			FinalRecipient: finalRcpt,
+			Action:         dsn.ActionFailed,
+			Status:         smtp.EnhancedCode{5, 1, 1},
+		}}, textproto.Header{}, &body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var msg bytes.Buffer
+		if err := textproto.WriteHeader(&msg, hdr); err != nil {
+			t.Fatal(err)
+		}
+		msg.Write(body.Bytes())
+		return msg.Bytes()
+	}
+
+	if err := smtp.SendMail(addr, nil, "", []string{"bounces+42@example.org"}, bytes.NewReader(generate("user@example.net"))); err != nil {
+		t.Fatal(err)
+	}
+	if err := smtp.SendMail(addr, nil, "", []string{"postmaster@example.org"}, bytes.NewReader(generate("user@example.net"))); err == nil {
+		t.Error("mail for other addresses accepted")
+	}
+	// A bounce of a bounce is accepted but discarded.
+	if err := smtp.SendMail(addr, nil, "", []string{"bounces+42@example.org"}, bytes.NewReader(generate("bounces+1@example.net"))); err != nil {
+		t.Fatal(err)
+	}
+	looping := "Received: from a\r\nReceived: from b\r\nReceived: from c\r\nReceived: from d\r\n" + string(generate("user@example.net"))
+	if err := smtp.SendMail(addr, nil, "", []string{"bounces+42@example.org"}, strings.NewReader(looping)); err == nil || !strings.Contains(err.Error(), "loop") {
+		t.Errorf("looping message: error %v", err)
+	}
+	if err := smtp.SendMail(addr, nil, "auto@example.net", []string{"bounces+43@example.org"}, strings.NewReader("Subject: Out of office\r\n\r\nAway.\r\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(bounces) != 2 {
+		t.Fatalf("handler called %d times, want 2", len(bounces))
+	}
+	if b := bounces[0]; b.To != "bounces+42@example.org" || b.Err != nil || b.Report.Recipients[0].FinalRecipient != "user@example.net" {
+		t.Errorf("bounce: To %q, Err %v, Report %+v", b.To, b.Err, b.Report)
+	}
+	if b := bounces[1]; b.To != "bounces+43@example.org" || b.Err != dsn.ErrNotDSN || b.From != "auto@example.net" {
+		t.Errorf("auto reply: To %q, From %q, Err %v", b.To, b.From, b.Err)
+	}
+}
@@ -0,0 +1,54 @@
+package dsn
+
+import (
+	"mime"
+	"strings"
+
+	"github.com/emersion/go-message/textproto"
+)
+
+// ShouldGenerateDSN reports whether a DSN may be sent for the failed message
+// with header failedHeader to envelope.To, following RFC 3461 section 6.2
+// and RFC 3834. If not, reason tells why. It refuses to bounce
+//
+//   - messages sent with the null reverse-path, that is envelope.To or the
+//     Return-Path field of failedHeader is "<>" or empty, as go-smtp passes
+//     it to Session.Mail,
+//   - automatically submitted messages, with an Auto-Submitted field other
+//     than "no",
+//   - reports, such as other DSNs, with a multipart/report Content-Type,
+//
+// which would otherwise cause mail loops and backscatter.
+func ShouldGenerateDSN(failedHeader textproto.Header, envelope Envelope) (ok bool, reason string) {
+	if isNullPath(envelope.To) || (failedHeader.Has("Return-Path") && isNullPath(failedHeader.Get("Return-Path"))) {
+		return false, "message was sent with the null reverse-path"
+	}
+	if v := failedHeader.Get("Auto-Submitted"); v != "" {
+		// Parameters may follow, e.g. "auto-replied; owner-email=...".
+		if i := strings.IndexByte(v, ';'); i >= 0 {
+			v = v[:i]
+		}
+		if !strings.EqualFold(strings.TrimSpace(v), "no") {
+			return false, "message was submitted automatically"
+		}
+	}
+	if mediaType, _, err := mime.ParseMediaType(failedHeader.Get("Content-Type")); err == nil && mediaType == "multipart/report" {
+		return false, "message is a report"
+	}
+	return true, ""
+}
+
+func isNullPath(path string) bool {
+	path = strings.TrimSpace(path)
+	return path == "" || path == "<>"
+}
+
+// SuppressedError is returned by Generator.Send if LoopGuard is set and
+// ShouldGenerateDSN refuses the DSN.
+type SuppressedError struct {
+	Reason string
+}
+
+func (err *SuppressedError) Error() string {
+	return "dsn: DSN suppressed: " + err.Reason
+}
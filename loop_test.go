@@ -0,0 +1,90 @@
+package dsn_test
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-smtp"
+	dsn "schneider.vip/go-dsn"
+	"schneider.vip/go-dsn/dsntest"
+)
+
+func TestShouldGenerateDSN(t *testing.T) {
+	header := func(kv ...string) textproto.Header {
+		h := textproto.Header{}
+		for i := 0; i < len(kv); i += 2 {
+			h.Add(kv[i], kv[i+1])
+		}
+		return h
+	}
+	tests := []struct {
+		name     string
+		header   textproto.Header
+		envelope dsn.Envelope
+		want     bool
+	}{
+		{"regular", header("Subject", "Hello"), dsn.Envelope{To: "sender@example.org"}, true},
+		{"null envelope", header(), dsn.Envelope{To: "<>"}, false},
+		{"empty envelope", header(), dsn.Envelope{To: " "}, false},
+		{"null Return-Path", header("Return-Path", "<>"), dsn.Envelope{To: "sender@example.org"}, false},
+		{"empty Return-Path", header("Return-Path", ""), dsn.Envelope{To: "sender@example.org"}, false},
+		{"auto-replied", header("Auto-Submitted", "auto-replied"), dsn.Envelope{To: "sender@example.org"}, false},
+		{"auto-generated", header("Auto-Submitted", "Auto-Generated; owner-email=a@example.org"), dsn.Envelope{To: "sender@example.org"}, false},
+		{"not auto-submitted", header("Auto-Submitted", "no"), dsn.Envelope{To: "sender@example.org"}, true},
+		{"report", header("Content-Type", "multipart/report; report-type=delivery-status; boundary=x"), dsn.Envelope{To: "sender@example.org"}, false},
+		{"mixed", header("Content-Type", "multipart/mixed; boundary=x"), dsn.Envelope{To: "sender@example.org"}, true},
+	}
+	for _, test := range tests {
+		ok, reason := dsn.ShouldGenerateDSN(test.header, test.envelope)
+		if ok != test.want {
+			t.Errorf("%s: ShouldGenerateDSN() = %v, %q, want %v", test.name, ok, reason, test.want)
+		}
+		if !ok && reason == "" {
+			t.Errorf("%s: no reason given", test.name)
+		}
+	}
+}
+
+func TestShouldGenerateDSNNullSender(t *testing.T) {
+	srv := dsntest.NewServer(t)
+	tr := &dsn.NetSMTPTransport{Addr: srv.Addr}
+	err := tr.Send("", []string{"rcpt@example.com"}, func(w io.Writer) error {
+		_, err := io.WriteString(w, "Subject: Hello\r\n\r\nHello\r\n")
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The reverse-path as received by go-smtp.
+	tx := srv.Transactions()[0]
+	failedHeader, err := textproto.ReadHeader(bufio.NewReader(bytes.NewReader(tx.Data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := dsn.ShouldGenerateDSN(failedHeader, dsn.Envelope{To: tx.From}); ok {
+		t.Errorf("ShouldGenerateDSN() allows a DSN to the reverse-path %q", tx.From)
+	}
+}
+
+func TestSendDSNLoopGuard(t *testing.T) {
+	failedHeader := textproto.Header{}
+	failedHeader.Add("Auto-Submitted", "auto-replied")
+	rcpts := []dsn.RecipientInfo{{FinalRecipient: "rcpt@example.com", Action: dsn.ActionFailed, Status: smtp.EnhancedCode{5, 1, 1}}}
+
+	// The guard refuses the DSN before connecting.
+	err := dsn.SendDSN("127.0.0.1:0", false, dsn.Envelope{To: "sender@example.org"}, dsn.ReportingMTAInfo{ReportingMTA: "mx.example.org"}, rcpts, failedHeader)
+	var suppressed *dsn.SuppressedError
+	if !errors.As(err, &suppressed) {
+		t.Fatalf("SendDSN() = %v, want a SuppressedError", err)
+	}
+
+	err = dsn.SendDSN("127.0.0.1:0", false, dsn.Envelope{To: "sender@example.org"}, dsn.ReportingMTAInfo{ReportingMTA: "mx.example.org"}, rcpts, failedHeader, dsn.WithLoopGuard(false))
+	if err == nil || errors.As(err, &suppressed) {
+		t.Errorf("SendDSN(WithLoopGuard(false)) = %v, want a connection error", err)
+	}
+}
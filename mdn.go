@@ -0,0 +1,332 @@
+package dsn
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"text/template"
+
+	"github.com/emersion/go-message/textproto"
+)
+
+// DispositionType is the disposition-type of a message disposition
+// notification as defined by RFC 8098.
+type DispositionType string
+
+const (
+	DispositionDisplayed  DispositionType = "displayed"
+	DispositionDeleted    DispositionType = "deleted"
+	DispositionDispatched DispositionType = "dispatched"
+	DispositionProcessed  DispositionType = "processed"
+)
+
+// MDNInfo holds the fields of the message/disposition-notification part of
+// a message disposition notification (MDN).
+type MDNInfo struct {
+	// ReportingUA is the host name of the user agent, optionally followed
+	// by "; " and the product name, e.g. "mua.example.org; Example Mail".
+	ReportingUA string
+
+	// OriginalRecipient is the address of the ORCPT parameter, if any.
+	OriginalRecipient string
+	// FinalRecipient is the address of the recipient the MDN is sent for.
+	FinalRecipient string
+	// OriginalMessageID is the Message-Id of the message the MDN is sent
+	// for.
+	OriginalMessageID string
+
+	// ManualAction is set if the MDN was sent due to an explicit action of
+	// the user instead of automatically.
+	ManualAction bool
+	// SentManually is set if the user was asked before sending the MDN.
+	SentManually bool
+	Disposition  DispositionType
+}
+
+func (info MDNInfo) WriteTo(utf8 bool, w io.Writer) error {
+	fw := getFieldWriter()
+	defer putFieldWriter(fw)
+
+	if info.FinalRecipient == "" {
+		return errors.New("dsn: Final-Recipient is required")
+	}
+	if info.Disposition == "" {
+		return errors.New("dsn: Disposition is required")
+	}
+
+	// The fields are written in reverse order, see fieldWriter.
+	actionMode, sendingMode := "automatic-action", "MDN-sent-automatically"
+	if info.ManualAction {
+		actionMode = "manual-action"
+	}
+	if info.SentManually {
+		sendingMode = "MDN-sent-manually"
+	}
+	if err := fw.field("Disposition", actionMode+"/"+sendingMode+"; "+string(info.Disposition)); err != nil {
+		return err
+	}
+	if info.OriginalMessageID != "" {
+		if err := fw.field("Original-Message-Id", info.OriginalMessageID); err != nil {
+			return err
+		}
+	}
+
+	typ, finalRcpt, err := addressField(utf8, info.FinalRecipient)
+	if err != nil {
+		return fmt.Errorf("dsn: cannot convert Final-Recipient to a suitable representation: %w", err)
+	}
+	if err := fw.typed("Final-Recipient", typ, finalRcpt); err != nil {
+		return err
+	}
+	if info.OriginalRecipient != "" {
+		typ, origRcpt, err := addressField(utf8, info.OriginalRecipient)
+		if err != nil {
+			return fmt.Errorf("dsn: cannot convert Original-Recipient to a suitable representation: %w", err)
+		}
+		if err := fw.typed("Original-Recipient", typ, origRcpt); err != nil {
+			return err
+		}
+	}
+
+	if info.ReportingUA != "" {
+		if err := fw.field("Reporting-Ua", info.ReportingUA); err != nil {
+			return err
+		}
+	}
+	return fw.flush(w)
+}
+
+// DefaultMDNSubject is the subject of MDNs.
+const DefaultMDNSubject = "Disposition notification"
+
+// MDNAutoSubmitted is the value of the Auto-Submitted field of MDNs, which
+// are sent in response to a message, unlike DSNs, see
+// Profile.AutoSubmitted.
+const MDNAutoSubmitted = "auto-replied"
+
+// MDNTemplateText is the text of the human-readable part of MDNs, it is
+// executed with the MDNInfo.
+var MDNTemplateText = `
+The message{{with .OriginalMessageID}} {{.}}{{end}} sent to {{.FinalRecipient}}
+was {{.Disposition}}.
+
+This is no guarantee that the message has been read or understood.
+`
+
+var mdnText = template.Must(template.New("mdn-text").Parse(MDNTemplateText))
+
+// GenerateMDN generates a message disposition notification as defined by
+// RFC 8098 for the message with header originalHeader, which is returned in
+// the third part.
+//
+// The envelope is used as for DSNs, the subject is DefaultMDNSubject. If
+// info.OriginalMessageID is set, the MDN references it with In-Reply-To and
+// References fields.
+func GenerateMDN(utf8 bool, envelope Envelope, info MDNInfo, originalHeader textproto.Header, outWriter io.Writer) (textproto.Header, error) {
+	return (&Generator{}).GenerateMDN(utf8, envelope, info, originalHeader, outWriter)
+}
+
+// GenerateMDN is like the GenerateMDN function but uses the Clock, Rand,
+// Boundary and MessageID of g. The Profile and the other options only apply to DSNs.
+func (g *Generator) GenerateMDN(utf8 bool, envelope Envelope, info MDNInfo, originalHeader textproto.Header, outWriter io.Writer) (textproto.Header, error) {
+	boundary, err := g.boundary(0)
+	if err != nil {
+		return textproto.Header{}, err
+	}
+	if envelope.MsgID == "" && g.MessageID != nil {
+		envelope.MsgID = g.MessageID()
+	}
+
+	reportHeader := textproto.Header{}
+	reportHeader.Add("Date", clockOrDefault(g.Clock).Now().Format(timeLayout))
+	reportHeader.Add("Message-Id", envelope.MsgID)
+	reportHeader.Add("Content-Transfer-Encoding", "8bit")
+	reportHeader.Add("Content-Type", "multipart/report; report-type=disposition-notification; boundary="+boundary)
+	reportHeader.Add("MIME-Version", "1.0")
+	reportHeader.Add("Auto-Submitted", MDNAutoSubmitted)
+	to, from := envelope.To, envelope.From
+	if err := checkHeaderValue("To", to); err != nil {
+		return textproto.Header{}, err
+	}
+	if err := checkHeaderValue("From", from); err != nil {
+		return textproto.Header{}, err
+	}
+	if !utf8 {
+		to, from = encodeAddressList(to), encodeAddressList(from)
+	}
+	reportHeader.Add("To", to)
+	reportHeader.Add("From", from)
+	reportHeader.Add("Subject", DefaultMDNSubject)
+	if info.OriginalMessageID != "" {
+		reportHeader.Add("In-Reply-To", info.OriginalMessageID)
+		reportHeader.Add("References", info.OriginalMessageID)
+	}
+	if err := checkHeaderValues(reportHeader); err != nil {
+		return textproto.Header{}, err
+	}
+
+	// Check the fields before anything is written.
+	buf := getBuffer()
+	defer putBuffer(buf)
+	if err := info.WriteTo(utf8, buf); err != nil {
+		return textproto.Header{}, err
+	}
+
+	partWriter := textproto.NewMultipartWriter(outWriter)
+	if err := partWriter.SetBoundary(boundary); err != nil {
+		return textproto.Header{}, err
+	}
+
+	humanHeader := textproto.Header{}
+	humanHeader.Add("Content-Transfer-Encoding", "8bit")
+	humanHeader.Add("Content-Type", `text/plain; charset="utf-8"`)
+	humanWriter, err := partWriter.CreatePart(humanHeader)
+	if err != nil {
+		return textproto.Header{}, err
+	}
+	if err := mdnText.Execute(humanWriter, info); err != nil {
+		return textproto.Header{}, err
+	}
+
+	mdnHeader := textproto.Header{}
+	if utf8 {
+		mdnHeader.Add("Content-Type", "message/global-disposition-notification")
+	} else {
+		mdnHeader.Add("Content-Type", "message/disposition-notification")
+	}
+	mdnWriter, err := partWriter.CreatePart(mdnHeader)
+	if err != nil {
+		return textproto.Header{}, err
+	}
+	if _, err := buf.WriteTo(mdnWriter); err != nil {
+		return textproto.Header{}, err
+	}
+
+	returnedHeader := textproto.Header{}
+	if utf8 {
+		returnedHeader.Add("Content-Type", "message/global-headers")
+	} else {
+		returnedHeader.Add("Content-Type", "text/rfc822-headers")
+	}
+	returnedHeader.Add("Content-Transfer-Encoding", "8bit")
+	returnedWriter, err := partWriter.CreatePart(returnedHeader)
+	if err != nil {
+		return textproto.Header{}, err
+	}
+	if err := textproto.WriteHeader(returnedWriter, originalHeader); err != nil {
+		return textproto.Header{}, err
+	}
+
+	if err := partWriter.Close(); err != nil {
+		return textproto.Header{}, err
+	}
+	return reportHeader, nil
+}
+
+// ErrNotMDN is returned by ParseMDN if the message does not contain a
+// disposition-notification part.
+var ErrNotMDN = errors.New("dsn: message is not a message disposition notification")
+
+// MDNReport is a parsed message disposition notification.
+type MDNReport struct {
+	// Header is the top-level header of the message.
+	Header textproto.Header
+	// Envelope is taken from the From, To and Message-Id fields of Header.
+	Envelope Envelope
+
+	// UTF8 is true if the disposition-notification part is a
+	// message/global-disposition-notification (RFC 6533) part.
+	UTF8 bool
+
+	MDN MDNInfo
+
+	// HumanText is the first text/plain part before the
+	// disposition-notification part, see Report.HumanText.
+	HumanText string
+
+	// OriginalHeader is the header of the returned message, if any.
+	OriginalHeader textproto.Header
+}
+
+// ParseMDN reads a multipart/report message and extracts the fields of its
+// disposition-notification part, the human-readable text and the header of
+// the returned message.
+//
+// Disposition modifiers such as "/error" are ignored. The default limits of
+// Parser apply.
+func ParseMDN(r io.Reader) (*MDNReport, error) {
+	return (&Parser{}).ParseMDN(r)
+}
+
+// ParseMDN parses an MDN, see ParseMDN.
+func (p *Parser) ParseMDN(r io.Reader) (*MDNReport, error) {
+	ps := p.newState()
+	ps.mdn = &MDNReport{}
+	rep, err := p.parse(r, ps)
+	if err != nil {
+		return nil, err
+	}
+	mdn := ps.mdn
+	mdn.Header = rep.Header
+	mdn.Envelope = rep.Envelope
+	mdn.UTF8 = rep.UTF8
+	mdn.HumanText = rep.HumanText
+	mdn.OriginalHeader = rep.FailedHeader
+	return mdn, nil
+}
+
+func (info *MDNInfo) readFrom(h textproto.Header) error {
+	fields := h.Fields()
+	for fields.Next() {
+		value := fields.Value()
+
+		switch strings.ToLower(fields.Key()) {
+		case "reporting-ua":
+			info.ReportingUA = strings.TrimSpace(value)
+		case "original-recipient":
+			info.OriginalRecipient = splitAddress(value)
+		case "final-recipient":
+			info.FinalRecipient = splitAddress(value)
+		case "original-message-id":
+			info.OriginalMessageID = strings.TrimSpace(value)
+		case "disposition":
+			if err := info.readDisposition(value); err != nil {
+				return err
+			}
+		}
+	}
+
+	if info.FinalRecipient == "" {
+		return errors.New("dsn: Final-Recipient is required")
+	}
+	if info.Disposition == "" {
+		return errors.New("dsn: Disposition is required")
+	}
+	return nil
+}
+
+// readDisposition parses a Disposition field such as
+// "manual-action/MDN-sent-manually; displayed".
+func (info *MDNInfo) readDisposition(v string) error {
+	i := strings.IndexByte(v, ';')
+	if i == -1 {
+		return fmt.Errorf("dsn: malformed Disposition: %q", v)
+	}
+	modes := strings.Split(strings.ToLower(strings.TrimSpace(v[:i])), "/")
+	if len(modes) != 2 {
+		return fmt.Errorf("dsn: malformed Disposition: %q", v)
+	}
+	typ := strings.ToLower(strings.TrimSpace(v[i+1:]))
+	if j := strings.IndexByte(typ, '/'); j >= 0 {
+		typ = strings.TrimSpace(typ[:j])
+	}
+	if typ == "" {
+		return fmt.Errorf("dsn: malformed Disposition: %q", v)
+	}
+
+	info.ManualAction = strings.TrimSpace(modes[0]) == "manual-action"
+	info.SentManually = strings.TrimSpace(modes[1]) == "mdn-sent-manually"
+	info.Disposition = DispositionType(typ)
+	return nil
+}
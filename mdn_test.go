@@ -0,0 +1,112 @@
+package dsn_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-message/textproto"
+	dsn "schneider.vip/go-dsn"
+)
+
+func TestGenerateMDN(t *testing.T) {
+	original := textproto.Header{}
+	original.Add("Subject", "Meeting")
+	original.Add("Message-Id", "<orig@example.org>")
+
+	var body bytes.Buffer
+	hdr, err := dsn.GenerateMDN(false, dsn.Envelope{
+		MsgID: "<mdn@example.net>",
+		From:  "rcpt@example.net",
+		To:    "sender@example.org",
+	}, dsn.MDNInfo{
+		ReportingUA:       "mua.example.net; Example Mail",
+		OriginalRecipient: "rcpt@example.net",
+		FinalRecipient:    "rcpt@example.net",
+		OriginalMessageID: "<orig@example.org>",
+		ManualAction:      true,
+		SentManually:      true,
+		Disposition:       dsn.DispositionDisplayed,
+	}, original, &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := hdr.Get("Content-Type"); !strings.HasPrefix(got, "multipart/report; report-type=disposition-notification;") {
+		t.Errorf("Content-Type = %q", got)
+	}
+	if got := hdr.Get("In-Reply-To"); got != "<orig@example.org>" {
+		t.Errorf("In-Reply-To = %q", got)
+	}
+	for _, want := range []string{
+		"was displayed.",
+		"Content-Type: message/disposition-notification\r\n\r\n" +
+			"Reporting-Ua: mua.example.net; Example Mail\r\n" +
+			"Original-Recipient: rfc822; rcpt@example.net\r\n" +
+			"Final-Recipient: rfc822; rcpt@example.net\r\n" +
+			"Original-Message-Id: <orig@example.org>\r\n" +
+			"Disposition: manual-action/MDN-sent-manually; displayed\r\n",
+		"Subject: Meeting\r\n",
+	} {
+		if !strings.Contains(body.String(), want) {
+			t.Errorf("body does not contain %q:\n%s", want, body.String())
+		}
+	}
+
+	if _, err := dsn.GenerateMDN(false, dsn.Envelope{}, dsn.MDNInfo{FinalRecipient: "rcpt@example.net"}, original, &body); err == nil {
+		t.Error("GenerateMDN() succeeded without Disposition")
+	}
+}
+
+func TestParseMDN(t *testing.T) {
+	original := textproto.Header{}
+	original.Add("Subject", "Meeting")
+
+	info := dsn.MDNInfo{
+		ReportingUA:       "mua.example.net; Example Mail",
+		FinalRecipient:    "rcpt@example.net",
+		OriginalMessageID: "<orig@example.org>",
+		Disposition:       dsn.DispositionDeleted,
+	}
+	var body bytes.Buffer
+	hdr, err := dsn.GenerateMDN(false, dsn.Envelope{MsgID: "<mdn@example.net>", From: "rcpt@example.net", To: "sender@example.org"}, info, original, &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var msg bytes.Buffer
+	if err := textproto.WriteHeader(&msg, hdr); err != nil {
+		t.Fatal(err)
+	}
+	msg.Write(body.Bytes())
+	raw := msg.Bytes()
+
+	rep, err := dsn.ParseMDN(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rep.MDN != info {
+		t.Errorf("MDN = %+v, want %+v", rep.MDN, info)
+	}
+	if rep.Envelope.MsgID != "<mdn@example.net>" {
+		t.Errorf("Message-Id = %q", rep.Envelope.MsgID)
+	}
+	if got := rep.OriginalHeader.Get("Subject"); got != "Meeting" {
+		t.Errorf("original Subject = %q", got)
+	}
+	if !strings.Contains(rep.HumanText, "was deleted.") {
+		t.Errorf("HumanText = %q", rep.HumanText)
+	}
+
+	if _, err := dsn.ParseDSN(bytes.NewReader(raw)); err != dsn.ErrNotDSN {
+		t.Errorf("ParseDSN() = %v, want ErrNotDSN", err)
+	}
+
+	modified := strings.Replace(string(raw), "automatic-action/MDN-sent-automatically; deleted", "automatic-action/MDN-sent-automatically; processed/error", 1)
+	rep, err = dsn.ParseMDN(strings.NewReader(modified))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rep.MDN.Disposition != dsn.DispositionProcessed {
+		t.Errorf("Disposition = %q, want %q", rep.MDN.Disposition, dsn.DispositionProcessed)
+	}
+}
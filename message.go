@@ -0,0 +1,60 @@
+package dsn
+
+import (
+	"bytes"
+	"io"
+
+	"github.com/emersion/go-message/textproto"
+)
+
+// DSN holds everything needed to generate a delivery status notification.
+// It implements io.WriterTo, writing the complete message, header and body.
+type DSN struct {
+	// Generator is used to generate the DSN, the zero Generator if nil.
+	Generator *Generator
+
+	// UTF8 selects the internationalized format of RFC 6533.
+	UTF8         bool
+	Envelope     Envelope
+	MTAInfo      ReportingMTAInfo
+	Recipients   []RecipientInfo
+	FailedHeader textproto.Header
+	// FailedMessage, if set, is returned instead of FailedHeader, see
+	// Generator.GenerateFull. It is read once.
+	FailedMessage io.Reader
+}
+
+// Generate returns the header of the DSN and writes its body to w, like
+// Generator.Generate.
+func (d *DSN) Generate(w io.Writer) (textproto.Header, error) {
+	g := d.Generator
+	if g == nil {
+		g = &Generator{}
+	}
+	if d.FailedMessage != nil {
+		return g.GenerateFull(d.UTF8, d.Envelope, d.MTAInfo, d.Recipients, d.FailedMessage, w)
+	}
+	return g.Generate(d.UTF8, d.Envelope, d.MTAInfo, d.Recipients, d.FailedHeader, w)
+}
+
+// WriteTo writes the complete message to w. The body is generated before
+// anything is written, so that nothing is written if generating fails.
+func (d *DSN) WriteTo(w io.Writer) (int64, error) {
+	body := getBuffer()
+	defer putBuffer(body)
+	h, err := d.Generate(body)
+	if err != nil {
+		return 0, err
+	}
+
+	var header bytes.Buffer
+	if err := textproto.WriteHeader(&header, h); err != nil {
+		return 0, err
+	}
+	n, err := header.WriteTo(w)
+	if err != nil {
+		return n, err
+	}
+	m, err := body.WriteTo(w)
+	return n + m, err
+}
@@ -0,0 +1,46 @@
+package dsn_test
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-smtp"
+	dsn "schneider.vip/go-dsn"
+)
+
+var _ io.WriterTo = (*dsn.DSN)(nil)
+
+func TestDSNWriteTo(t *testing.T) {
+	d := &dsn.DSN{
+		Envelope:      dsn.Envelope{From: "MAILER-DAEMON@mx.example.org", To: "sender@example.org"},
+		MTAInfo:       dsn.ReportingMTAInfo{ReportingMTA: "mx.example.org"},
+		Recipients:    []dsn.RecipientInfo{{FinalRecipient: "rcpt@example.com", Action: dsn.ActionFailed, Status: smtp.EnhancedCode{5, 1, 1}}},
+		FailedMessage: strings.NewReader("Subject: Hello\r\n\r\nHello\r\n"),
+	}
+	var buf bytes.Buffer
+	n, err := d.WriteTo(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(buf.Len()) {
+		t.Errorf("WriteTo() = %d, wrote %d bytes", n, buf.Len())
+	}
+
+	rep, err := dsn.ParseDSN(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rep.Envelope.To != "sender@example.org" || rep.MTAInfo.ReportingMTA != "mx.example.org" || len(rep.Recipients) != 1 {
+		t.Errorf("ParseDSN() = %+v", rep)
+	}
+}
+
+func TestDSNWriteToError(t *testing.T) {
+	d := &dsn.DSN{MTAInfo: dsn.ReportingMTAInfo{ReportingMTA: "mx.example.org"}, Recipients: []dsn.RecipientInfo{{FinalRecipient: "rcpt@example.com"}}}
+	var buf bytes.Buffer
+	if n, err := d.WriteTo(&buf); err == nil || n != 0 || buf.Len() != 0 {
+		t.Errorf("WriteTo() = %d, %v and wrote %d bytes, want an error and no output", n, err, buf.Len())
+	}
+}
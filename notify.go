@@ -0,0 +1,54 @@
+package dsn
+
+import (
+	"github.com/emersion/go-message/textproto"
+)
+
+// NotifyAction is the verdict of a NotifyPolicy.
+type NotifyAction int
+
+const (
+	// NotifySend sends the DSN as usual.
+	NotifySend NotifyAction = iota
+	// NotifySuppress drops the recipient from the DSN, e.g. for senders such
+	// as noreply@ addresses that never read bounces.
+	NotifySuppress
+	// NotifyRedirect reports the recipient to NotifyDecision.To instead of
+	// the sender, e.g. to summarize failures of mailing list traffic for
+	// the list owner.
+	NotifyRedirect
+	// NotifyDowngrade sends the DSN without the header of the message.
+	NotifyDowngrade
+)
+
+// NotifyRequest is the input of a NotifyPolicy.
+type NotifyRequest struct {
+	// Sender is the address the DSN would be sent to.
+	Sender string
+	// Header is the header of the message.
+	Header textproto.Header
+	// Recipient is the recipient as it would be reported, its Action and
+	// Status give the kind of failure.
+	Recipient RecipientInfo
+}
+
+// NotifyDecision is the result of a NotifyPolicy.
+type NotifyDecision struct {
+	Action NotifyAction
+	// To is the address the DSN is sent to for NotifyRedirect.
+	To string
+}
+
+// NotifyPolicy decides, before a DSN is generated, whether and how a
+// recipient is reported.
+type NotifyPolicy interface {
+	Notify(req NotifyRequest) NotifyDecision
+}
+
+// NotifyPolicyFunc adapts a function to NotifyPolicy.
+type NotifyPolicyFunc func(req NotifyRequest) NotifyDecision
+
+// Notify implements NotifyPolicy.
+func (f NotifyPolicyFunc) Notify(req NotifyRequest) NotifyDecision {
+	return f(req)
+}
@@ -0,0 +1,130 @@
+package dsn
+
+import (
+	"strconv"
+	"text/template"
+	"time"
+)
+
+// Option configures a Generator, see NewGenerator. Options are accepted by
+// GenerateDSN, GenerateFullDSN and SendDSN so that settings can be added
+// without changing their signatures.
+type Option func(g *Generator)
+
+// NewGenerator returns a Generator with opts applied to the zero value.
+func NewGenerator(opts ...Option) *Generator {
+	g := &Generator{}
+	for _, opt := range opts {
+		opt(g)
+	}
+	return g
+}
+
+// WithProfile sets Generator.Profile.
+func WithProfile(p *Profile) Option {
+	return func(g *Generator) {
+		g.Profile = p
+	}
+}
+
+// WithSubject overrides the subject of the profile for all actions, see
+// Profile.Subjects. Unlike a Profile with only the Subject set, it keeps
+// the default profile depending on the recipients.
+func WithSubject(subject string) Option {
+	return withProfileOption(func(p *Profile) {
+		p.Subject = subject
+		p.Subjects = nil
+	})
+}
+
+// WithTemplate overrides the template of the human-readable text of the
+// profile, see Profile.Text.
+func WithTemplate(t *template.Template) Option {
+	return withProfileOption(func(p *Profile) {
+		p.Text = t
+	})
+}
+
+// WithXMTAName overrides the MTA name of the profile, see Profile.XMTAName.
+func WithXMTAName(name string) Option {
+	return withProfileOption(func(p *Profile) {
+		p.XMTAName = name
+	})
+}
+
+func withProfileOption(opt func(p *Profile)) Option {
+	return func(g *Generator) {
+		// Copy on append, g may share the slice with a copied Generator.
+		g.profileOptions = append(g.profileOptions[:len(g.profileOptions):len(g.profileOptions)], opt)
+	}
+}
+
+// WithClock sets Generator.Clock.
+func WithClock(c Clock) Option {
+	return func(g *Generator) {
+		g.Clock = c
+	}
+}
+
+// WithReturnPolicy sets Generator.Return.
+func WithReturnPolicy(r ReturnPolicy) Option {
+	return func(g *Generator) {
+		g.Return = r
+	}
+}
+
+// WithMaxReturnSize sets Generator.MaxReturnSize.
+func WithMaxReturnSize(n int64) Option {
+	return func(g *Generator) {
+		g.MaxReturnSize = n
+	}
+}
+
+// WithDeterministicOutput makes the output depend on the arguments only,
+// e.g. for golden-file tests: the Date field is set to now, the MIME
+// boundaries are fixed and the Message-Id is derived from now if the
+// envelope has none.
+func WithDeterministicOutput(now time.Time) Option {
+	return func(g *Generator) {
+		g.Clock = FixedClock(now)
+		g.Boundary = func(n int) string {
+			return "dsn-boundary-" + strconv.Itoa(n)
+		}
+		g.MessageID = func() string {
+			return "<" + strconv.FormatInt(now.Unix(), 10) + ".dsn@localhost>"
+		}
+	}
+}
+
+// WithLoopGuard sets Generator.LoopGuard.
+func WithLoopGuard(enabled bool) Option {
+	return func(g *Generator) {
+		g.LoopGuard = enabled
+	}
+}
+
+// WithFuncs adds funcs to Generator.Funcs.
+func WithFuncs(funcs template.FuncMap) Option {
+	return func(g *Generator) {
+		if g.Funcs == nil {
+			g.Funcs = template.FuncMap{}
+		}
+		for name, fn := range funcs {
+			g.Funcs[name] = fn
+		}
+	}
+}
+
+// WithLanguageDetection sets Generator.DetectLanguage.
+func WithLanguageDetection(enabled bool) Option {
+	return func(g *Generator) {
+		g.DetectLanguage = enabled
+	}
+}
+
+// WithAlternativeLanguages adds langs to Generator.AlternativeLanguages.
+func WithAlternativeLanguages(langs ...string) Option {
+	return func(g *Generator) {
+		g.AlternativeLanguages = append(g.AlternativeLanguages, langs...)
+	}
+}
@@ -0,0 +1,101 @@
+package dsn_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"text/template"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-smtp"
+	dsn "schneider.vip/go-dsn"
+)
+
+func TestGenerateDSNOptions(t *testing.T) {
+	now := time.Date(2020, 4, 14, 10, 0, 0, 0, time.UTC)
+	rcpts := []dsn.RecipientInfo{{FinalRecipient: "rcpt@example.com", Action: dsn.ActionDelayed, Status: smtp.EnhancedCode{4, 4, 1}}}
+
+	var body bytes.Buffer
+	h, err := dsn.GenerateDSN(false, dsn.Envelope{}, dsn.ReportingMTAInfo{ReportingMTA: "mx.example.org", XMessageID: "q1"}, rcpts, textproto.Header{}, &body,
+		dsn.WithSubject("Still trying"),
+		dsn.WithTemplate(template.Must(template.New("text").Parse("Custom text for {{.ReportingMTA}}.\n"))),
+		dsn.WithXMTAName("Example"),
+		dsn.WithClock(dsn.FixedClock(now)),
+		dsn.WithReturnPolicy(dsn.ReturnNone))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := h.Get("Subject"); got != "Still trying" {
+		t.Errorf("Subject = %q", got)
+	}
+	if got, want := h.Get("Date"), now.Format(time.RFC1123Z); got != want {
+		t.Errorf("Date = %q, want %q", got, want)
+	}
+	for _, want := range []string{"Custom text for mx.example.org.", "X-Example-Msgid: q1", "Delivery to rcpt@example.com delayed"} {
+		if !strings.Contains(body.String(), want) {
+			t.Errorf("body does not contain %q:\n%s", want, body.String())
+		}
+	}
+	if strings.Contains(body.String(), "rfc822-headers") {
+		t.Errorf("body contains the returned header despite ReturnNone:\n%s", body.String())
+	}
+}
+
+func TestDeterministicOutput(t *testing.T) {
+	now := time.Date(2020, 4, 14, 10, 0, 0, 0, time.UTC)
+	rcpts := []dsn.RecipientInfo{{FinalRecipient: "rcpt@example.com", Action: dsn.ActionFailed, Status: smtp.EnhancedCode{5, 1, 1}}}
+
+	generate := func() []byte {
+		d := &dsn.DSN{
+			Generator:  dsn.NewGenerator(dsn.WithProfile(dsn.ConsumerProfile), dsn.WithDeterministicOutput(now)),
+			MTAInfo:    dsn.ReportingMTAInfo{ReportingMTA: "mx.example.org"},
+			Recipients: rcpts,
+		}
+		var buf bytes.Buffer
+		if _, err := d.WriteTo(&buf); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+	first, second := generate(), generate()
+	if !bytes.Equal(first, second) {
+		t.Errorf("outputs differ:\n%s\n\n%s", first, second)
+	}
+	for _, want := range []string{"boundary=dsn-boundary-0", "boundary=dsn-boundary-1", "Message-Id: <1586858400.dsn@localhost>"} {
+		if !bytes.Contains(first, []byte(want)) {
+			t.Errorf("output does not contain %q:\n%s", want, first)
+		}
+	}
+}
+
+func TestWithFuncs(t *testing.T) {
+	rcpts := []dsn.RecipientInfo{{FinalRecipient: "rcpt@example.com", Action: dsn.ActionFailed, Status: smtp.EnhancedCode{5, 1, 1}}}
+	funcs := template.FuncMap{
+		"status": func(action dsn.Action) string { return "Nicht zugestellt" },
+		"upper":  strings.ToUpper,
+	}
+	text := template.Must(template.New("").Funcs(funcs).Parse("Bericht von {{upper .ReportingMTA}}\n"))
+
+	var body bytes.Buffer
+	_, err := dsn.GenerateDSN(false, dsn.Envelope{}, dsn.ReportingMTAInfo{ReportingMTA: "mx.example.org"}, rcpts, textproto.Header{}, &body,
+		dsn.WithProfile(dsn.ConsumerProfile), dsn.WithTemplate(text), dsn.WithFuncs(funcs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"Bericht von MX.EXAMPLE.ORG", "rcpt@example.com: Nicht zugestellt"} {
+		if !strings.Contains(body.String(), want) {
+			t.Errorf("body does not contain %q:\n%s", want, body.String())
+		}
+	}
+
+	// The templates of the profile are not changed.
+	body.Reset()
+	if _, err := dsn.GenerateDSN(false, dsn.Envelope{}, dsn.ReportingMTAInfo{ReportingMTA: "mx.example.org"}, rcpts, textproto.Header{}, &body, dsn.WithProfile(dsn.ConsumerProfile)); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(body.String(), "Nicht zugestellt") {
+		t.Error("WithFuncs changed the templates of ConsumerProfile")
+	}
+}
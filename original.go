@@ -0,0 +1,68 @@
+package dsn
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net/mail"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+)
+
+// GenerateDSNFromMessage is like GenerateDSN but reads the failed message
+// from original, see Generator.GenerateFromMessage.
+func GenerateDSNFromMessage(original io.Reader, utf8 bool, envelope Envelope, mtaInfo ReportingMTAInfo, rcptsInfo []RecipientInfo, outWriter io.Writer, opts ...Option) (textproto.Header, error) {
+	return NewGenerator(opts...).GenerateFromMessage(original, utf8, envelope, mtaInfo, rcptsInfo, outWriter)
+}
+
+// GenerateFromMessage is like Generate but reads the failed message from
+// original. Its header is returned in the DSN, or the complete message if
+// g.Return is ReturnFull, see GenerateFull.
+//
+// Empty fields of mtaInfo are filled from the header: XMessageID is set to
+// the Message-Id and ArrivalDate to the date of the topmost Received field,
+// or of the Date field if there is none.
+func (g *Generator) GenerateFromMessage(original io.Reader, utf8 bool, envelope Envelope, mtaInfo ReportingMTAInfo, rcptsInfo []RecipientInfo, outWriter io.Writer) (textproto.Header, error) {
+	br := bufio.NewReader(original)
+	h, err := textproto.ReadHeader(br)
+	if err != nil {
+		return textproto.Header{}, fmt.Errorf("dsn: cannot read header of the failed message: %w", err)
+	}
+
+	if mtaInfo.XMessageID == "" {
+		mtaInfo.XMessageID = strings.TrimSpace(h.Get("Message-Id"))
+	}
+	if mtaInfo.ArrivalDate.IsZero() {
+		mtaInfo.ArrivalDate = arrivalDate(h)
+	}
+
+	if g.Return != ReturnFull {
+		return g.Generate(utf8, envelope, mtaInfo, rcptsInfo, h, outWriter)
+	}
+	var header bytes.Buffer
+	if err := textproto.WriteHeader(&header, h); err != nil {
+		return textproto.Header{}, err
+	}
+	return g.GenerateFull(utf8, envelope, mtaInfo, rcptsInfo, io.MultiReader(&header, br), outWriter)
+}
+
+// arrivalDate returns the date of the topmost Received field of h, the time
+// the message arrived at the reporting MTA, falling back to the Date field.
+// It returns the zero time if neither can be parsed.
+func arrivalDate(h textproto.Header) time.Time {
+	// The date follows the last semicolon, RFC 5321 section 4.4.
+	if received := h.Get("Received"); received != "" {
+		if i := strings.LastIndexByte(received, ';'); i >= 0 {
+			if t, err := mail.ParseDate(strings.TrimSpace(received[i+1:])); err == nil {
+				return t
+			}
+		}
+	}
+	if t, err := mail.ParseDate(strings.TrimSpace(h.Get("Date"))); err == nil {
+		return t
+	}
+	return time.Time{}
+}
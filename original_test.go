@@ -0,0 +1,47 @@
+package dsn_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	dsn "schneider.vip/go-dsn"
+)
+
+const originalMessage = "Received: from mx.example.org by mx2.example.org; Tue, 14 Apr 2020 10:05:00 +0000\r\n" +
+	"Received: from client.example.org by mx.example.org; Tue, 14 Apr 2020 10:01:00 +0000\r\n" +
+	"Message-Id: <msg@example.org>\r\n" +
+	"Date: Tue, 14 Apr 2020 10:00:00 +0000\r\n" +
+	"Subject: Hello\r\n" +
+	"\r\n" +
+	"Hello world\r\n"
+
+func TestGenerateDSNFromMessage(t *testing.T) {
+	rcpts := []dsn.RecipientInfo{{FinalRecipient: "rcpt@example.com", Action: dsn.ActionFailed, Status: smtp.EnhancedCode{5, 1, 1}}}
+
+	var body bytes.Buffer
+	if _, err := dsn.GenerateDSNFromMessage(strings.NewReader(originalMessage), false, dsn.Envelope{}, dsn.ReportingMTAInfo{ReportingMTA: "mx.example.org"}, rcpts, &body); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"X-Godsn-Msgid: <msg@example.org>", "Arrival-Date: Tue, 14 Apr 2020 10:05:00 +0000", "Subject: Hello"} {
+		if !strings.Contains(body.String(), want) {
+			t.Errorf("body does not contain %q:\n%s", want, body.String())
+		}
+	}
+	if strings.Contains(body.String(), "Hello world") {
+		t.Errorf("body contains the message body:\n%s", body.String())
+	}
+
+	body.Reset()
+	mtaInfo := dsn.ReportingMTAInfo{ReportingMTA: "mx.example.org", XMessageID: "q1", ArrivalDate: time.Date(2020, 4, 14, 9, 0, 0, 0, time.UTC)}
+	if _, err := dsn.GenerateDSNFromMessage(strings.NewReader(originalMessage), false, dsn.Envelope{}, mtaInfo, rcpts, &body, dsn.WithReturnPolicy(dsn.ReturnFull)); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"X-Godsn-Msgid: q1", "Arrival-Date: Tue, 14 Apr 2020 09:00:00 +0000", "message/rfc822", "Hello world"} {
+		if !strings.Contains(body.String(), want) {
+			t.Errorf("ReturnFull: body does not contain %q:\n%s", want, body.String())
+		}
+	}
+}
@@ -0,0 +1,556 @@
+package dsn
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/quotedprintable"
+	"net/mail"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-smtp"
+)
+
+// ErrNotDSN is returned by ParseDSN if the message does not contain a
+// delivery-status part.
+var ErrNotDSN = errors.New("dsn: message is not a delivery status notification")
+
+// Report is a parsed delivery status notification.
+type Report struct {
+	// Header is the top-level header of the message.
+	Header textproto.Header
+	// Envelope is taken from the From, To and Message-Id fields of Header.
+	Envelope Envelope
+
+	// UTF8 is true if the delivery-status part is a
+	// message/global-delivery-status (RFC 6533) part.
+	UTF8 bool
+
+	MTAInfo    ReportingMTAInfo
+	Recipients []RecipientInfo
+
+	// HumanText is the first text/plain part before the delivery-status
+	// part with the Content-Transfer-Encoding removed, e.g. to show the
+	// explanation of the remote MTA. It is empty if there is none.
+	HumanText string
+
+	// FailedHeader is the header of the returned message, if any.
+	FailedHeader textproto.Header
+}
+
+// ParseDSN reads a multipart/report message and extracts the per-message and
+// per-recipient fields of its delivery-status part, the human-readable text
+// and the header of the returned message.
+//
+// Fields that have no equivalent in ReportingMTAInfo or RecipientInfo are
+// returned in their ExtensionFields. Diagnostic codes of type "smtp" are
+// returned as *smtp.SMTPError.
+//
+// The default limits of Parser apply.
+func ParseDSN(r io.Reader) (*Report, error) {
+	return (&Parser{}).Parse(r)
+}
+
+// Default limits of Parser.
+const (
+	DefaultMaxBytes        = 10 << 20
+	DefaultMaxLineLength   = 64 << 10
+	DefaultMaxHeaderFields = 1000
+	DefaultMaxDepth        = 10
+	DefaultMaxParts        = 100
+	DefaultMaxRecipients   = 1000
+)
+
+// Parser parses DSNs with configurable limits, so that hostile bounces
+// cannot exhaust memory. The zero value is ready to use and applies the
+// Default* limits, a negative limit disables the check.
+type Parser struct {
+	// MaxBytes is the maximum size of the message.
+	MaxBytes int64
+	// MaxLineLength is the maximum length of a line. Header lines are
+	// limited to 4000 octets regardless of this setting.
+	MaxLineLength int
+	// MaxHeaderFields is the maximum number of fields of every header and
+	// delivery-status block.
+	MaxHeaderFields int
+	// MaxDepth is the maximum nesting depth of multiparts.
+	MaxDepth int
+	// MaxParts is the maximum number of parts in total.
+	MaxParts int
+	// MaxRecipients is the maximum number of per-recipient blocks.
+	MaxRecipients int
+}
+
+// LimitError is returned by Parser if a message exceeds one of its limits.
+type LimitError struct {
+	// Limit is the name of the exceeded Parser field.
+	Limit string
+}
+
+func (err *LimitError) Error() string {
+	return "dsn: parse limit exceeded: " + err.Limit
+}
+
+func limit(v, def int) int {
+	if v == 0 {
+		return def
+	}
+	return v
+}
+
+// Parse parses a DSN, see ParseDSN.
+func (p *Parser) Parse(r io.Reader) (*Report, error) {
+	return p.parse(r, p.newState())
+}
+
+func (p *Parser) newState() *parseState {
+	return &parseState{
+		maxHeaderFields: limit(p.MaxHeaderFields, DefaultMaxHeaderFields),
+		maxDepth:        limit(p.MaxDepth, DefaultMaxDepth),
+		maxParts:        limit(p.MaxParts, DefaultMaxParts),
+		maxRecipients:   limit(p.MaxRecipients, DefaultMaxRecipients),
+	}
+}
+
+func (p *Parser) parse(r io.Reader, ps *parseState) (*Report, error) {
+	maxBytes := p.MaxBytes
+	if maxBytes == 0 {
+		maxBytes = DefaultMaxBytes
+	}
+	lr := &limitedReader{r: r, remaining: maxBytes, maxLine: limit(p.MaxLineLength, DefaultMaxLineLength)}
+
+	rep, err := ps.parse(lr)
+	if lr.err != nil {
+		// Errors of the underlying reader may be wrapped by the MIME
+		// parser.
+		return nil, lr.err
+	}
+	return rep, err
+}
+
+// parseState holds the limits and counters of a single Parse call.
+type parseState struct {
+	maxHeaderFields int
+	maxDepth        int
+	maxParts        int
+	maxRecipients   int
+
+	parts int
+	rep   *Report
+	// mdn is set when parsing an MDN, the disposition-notification part is
+	// used instead of the delivery-status part then.
+	mdn *MDNReport
+	// found is set once the delivery-status or disposition-notification
+	// part was read.
+	found bool
+}
+
+func (ps *parseState) parse(r io.Reader) (*Report, error) {
+	br := bufio.NewReader(r)
+	h, err := ps.readHeader(br)
+	if err != nil {
+		return nil, fmt.Errorf("dsn: cannot read header: %w", err)
+	}
+
+	ps.rep = &Report{
+		Header: h,
+		Envelope: Envelope{
+			MsgID: h.Get("Message-Id"),
+			From:  h.Get("From"),
+			To:    h.Get("To"),
+		},
+	}
+	if err := ps.readEntity(h, br, 0); err != nil {
+		return nil, err
+	}
+	if !ps.found {
+		if ps.mdn != nil {
+			return nil, ErrNotMDN
+		}
+		return nil, ErrNotDSN
+	}
+	return ps.rep, nil
+}
+
+func (ps *parseState) readHeader(br *bufio.Reader) (textproto.Header, error) {
+	h, err := textproto.ReadHeader(br)
+	if err != nil {
+		return h, err
+	}
+	if ps.maxHeaderFields > 0 && h.Len() > ps.maxHeaderFields {
+		return h, &LimitError{Limit: "MaxHeaderFields"}
+	}
+	return h, nil
+}
+
+// readEntity looks for the delivery-status and returned content parts in the
+// entity with header h and body r, descending into nested multiparts.
+//
+// Only the first delivery-status part and the first returned content part
+// following it are used.
+func (ps *parseState) readEntity(h textproto.Header, r io.Reader, depth int) error {
+	rep := ps.rep
+	mediaType, params, err := mime.ParseMediaType(h.Get("Content-Type"))
+	if err != nil {
+		return nil
+	}
+	found := ps.found
+
+	switch mediaType {
+	case "message/delivery-status", "message/global-delivery-status":
+		if found || ps.mdn != nil {
+			return nil
+		}
+		rep.UTF8 = mediaType == "message/global-delivery-status"
+		blocks, err := ps.readStatusBlocks(decodeBody(h, r))
+		if err != nil {
+			return err
+		}
+		if len(blocks) == 0 {
+			return errors.New("dsn: empty delivery-status part")
+		}
+		if ps.maxRecipients > 0 && len(blocks)-1 > ps.maxRecipients {
+			return &LimitError{Limit: "MaxRecipients"}
+		}
+		if err := rep.MTAInfo.readFrom(blocks[0]); err != nil {
+			return err
+		}
+		for _, b := range blocks[1:] {
+			rcpt := RecipientInfo{}
+			if err := rcpt.readFrom(b); err != nil {
+				return err
+			}
+			rep.Recipients = append(rep.Recipients, rcpt)
+		}
+		ps.found = true
+	case "message/disposition-notification", "message/global-disposition-notification":
+		if found || ps.mdn == nil {
+			return nil
+		}
+		rep.UTF8 = mediaType == "message/global-disposition-notification"
+		blocks, err := ps.readStatusBlocks(decodeBody(h, r))
+		if err != nil {
+			return err
+		}
+		if len(blocks) == 0 {
+			return errors.New("dsn: empty disposition-notification part")
+		}
+		if err := ps.mdn.MDN.readFrom(blocks[0]); err != nil {
+			return err
+		}
+		ps.found = true
+	case "text/plain":
+		if found || rep.HumanText != "" {
+			return nil
+		}
+		text, err := ioutil.ReadAll(decodeBody(h, r))
+		if err != nil {
+			return fmt.Errorf("dsn: cannot read human-readable part: %w", err)
+		}
+		rep.HumanText = string(text)
+	case "message/rfc822-headers", "text/rfc822-headers", "message/global-headers", "message/rfc822", "message/global":
+		if !found || rep.FailedHeader.Len() != 0 {
+			return nil
+		}
+		fh, err := ps.readHeader(bufio.NewReader(r))
+		if err != nil {
+			return fmt.Errorf("dsn: cannot read returned header: %w", err)
+		}
+		rep.FailedHeader = fh
+	default:
+		if !strings.HasPrefix(mediaType, "multipart/") {
+			return nil
+		}
+		if ps.maxDepth > 0 && depth >= ps.maxDepth {
+			return &LimitError{Limit: "MaxDepth"}
+		}
+		mr := textproto.NewMultipartReader(r, params["boundary"])
+		for {
+			p, err := mr.NextPart()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return fmt.Errorf("dsn: cannot read part: %w", err)
+			}
+			ps.parts++
+			if ps.maxParts > 0 && ps.parts > ps.maxParts {
+				return &LimitError{Limit: "MaxParts"}
+			}
+			if ps.maxHeaderFields > 0 && p.Header.Len() > ps.maxHeaderFields {
+				return &LimitError{Limit: "MaxHeaderFields"}
+			}
+			if err := ps.readEntity(p.Header, p, depth+1); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// limitedReader fails with a *LimitError once more than remaining bytes or
+// a line longer than maxLine were read.
+type limitedReader struct {
+	r         io.Reader
+	remaining int64
+	maxLine   int
+	line      int
+	err       error
+}
+
+func (lr *limitedReader) Read(b []byte) (int, error) {
+	if lr.err != nil {
+		return 0, lr.err
+	}
+	if lr.remaining >= 0 && int64(len(b)) > lr.remaining+1 {
+		b = b[:lr.remaining+1]
+	}
+	n, err := lr.r.Read(b)
+	if lr.remaining >= 0 {
+		lr.remaining -= int64(n)
+		if lr.remaining < 0 {
+			lr.err = &LimitError{Limit: "MaxBytes"}
+			return 0, lr.err
+		}
+	}
+	if lr.maxLine > 0 {
+		for _, c := range b[:n] {
+			if c == '\n' {
+				lr.line = 0
+				continue
+			}
+			lr.line++
+			if lr.line > lr.maxLine {
+				lr.err = &LimitError{Limit: "MaxLineLength"}
+				return 0, lr.err
+			}
+		}
+	}
+	return n, err
+}
+
+// decodeBody undoes the Content-Transfer-Encoding some MTAs apply to the
+// delivery-status part.
+func decodeBody(h textproto.Header, r io.Reader) io.Reader {
+	switch strings.ToLower(strings.TrimSpace(h.Get("Content-Transfer-Encoding"))) {
+	case "quoted-printable":
+		return quotedprintable.NewReader(r)
+	case "base64":
+		return base64.NewDecoder(base64.StdEncoding, r)
+	}
+	return r
+}
+
+// readStatusBlocks splits the delivery-status body into its header-like
+// blocks.
+func (ps *parseState) readStatusBlocks(r io.Reader) ([]textproto.Header, error) {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("dsn: cannot read delivery-status part: %w", err)
+	}
+	b = bytes.Replace(b, []byte("\r\n"), []byte("\n"), -1)
+
+	var blocks []textproto.Header
+	for _, chunk := range bytes.Split(b, []byte("\n\n")) {
+		chunk = bytes.Trim(chunk, "\n")
+		if len(bytes.TrimSpace(chunk)) == 0 {
+			continue
+		}
+		chunk = append(chunk, "\n\n"...)
+		h, err := ps.readHeader(bufio.NewReader(bytes.NewReader(chunk)))
+		if err != nil {
+			return nil, fmt.Errorf("dsn: malformed delivery-status block: %w", err)
+		}
+		blocks = append(blocks, h)
+	}
+	return blocks, nil
+}
+
+// splitTyped splits a "type; value" field.
+func splitTyped(v string) (typ, value string) {
+	i := strings.IndexByte(v, ';')
+	if i == -1 {
+		return "", strings.TrimSpace(v)
+	}
+	return strings.ToLower(strings.TrimSpace(v[:i])), strings.TrimSpace(v[i+1:])
+}
+
+// isXMTAField reports whether the lower-case key is an "X-<mta>" field with
+// suffix, such as "x-postfix-sender". Fields without an MTA name, such as
+// "X-Sender", are extension fields.
+func isXMTAField(key, suffix string) bool {
+	return len(key) > len("x-")+len(suffix) && strings.HasPrefix(key, "x-") && strings.HasSuffix(key, suffix)
+}
+
+// xMTAName returns the MTA name of an "X-<mta>" field with suffix, see
+// isXMTAField.
+func xMTAName(key, suffix string) string {
+	return key[len("x-") : len(key)-len(suffix)]
+}
+
+// splitMTAName splits an MTA name field, the type is empty for "dns" names.
+func splitMTAName(v string) (typ, name string) {
+	typ, name = splitTyped(v)
+	if typ == "dns" {
+		typ = ""
+	}
+	return typ, name
+}
+
+func parseDate(v string) (time.Time, error) {
+	return mail.ParseDate(strings.TrimSpace(v))
+}
+
+func (info *ReportingMTAInfo) readFrom(h textproto.Header) error {
+	fields := h.Fields()
+	for fields.Next() {
+		key := strings.ToLower(fields.Key())
+		value := fields.Value()
+
+		switch {
+		case key == "reporting-mta":
+			info.ReportingMTAType, info.ReportingMTA = splitMTAName(value)
+		case key == "received-from-mta":
+			info.ReceivedFromMTAType, info.ReceivedFromMTA = splitMTAName(value)
+		case key == "arrival-date":
+			t, err := parseDate(value)
+			if err != nil {
+				return fmt.Errorf("dsn: malformed Arrival-Date: %w", err)
+			}
+			info.ArrivalDate = t
+		case key == "last-attempt-date":
+			t, err := parseDate(value)
+			if err != nil {
+				return fmt.Errorf("dsn: malformed Last-Attempt-Date: %w", err)
+			}
+			info.LastAttemptDate = t
+		case isXMTAField(key, "-sender"):
+			info.XMTAName = xMTAName(fields.Key(), "-sender")
+			info.XSender = splitAddress(value)
+		case isXMTAField(key, "-msgid"):
+			info.XMTAName = xMTAName(fields.Key(), "-msgid")
+			info.XMessageID = strings.TrimSpace(value)
+		case isXMTAField(key, "-queue-id"):
+			info.XMTAName = xMTAName(fields.Key(), "-queue-id")
+			info.XMessageID = strings.TrimSpace(value)
+		default:
+			info.ExtensionFields.Add(fields.Key(), value)
+		}
+	}
+
+	if info.ReportingMTA == "" {
+		return errors.New("dsn: Reporting-MTA field is mandatory")
+	}
+	return nil
+}
+
+func (info *RecipientInfo) readFrom(h textproto.Header) error {
+	fields := h.Fields()
+	for fields.Next() {
+		value := fields.Value()
+
+		switch strings.ToLower(fields.Key()) {
+		case "final-recipient":
+			info.FinalRecipient = splitAddress(value)
+		case "original-recipient":
+			info.OriginalRecipientType, info.OriginalRecipient = splitTyped(value)
+		case "remote-mta":
+			info.RemoteMTAType, info.RemoteMTA = splitMTAName(value)
+		case "action":
+			info.Action = Action(strings.ToLower(strings.TrimSpace(value)))
+		case "status":
+			code, err := parseEnhancedCode(value)
+			if err != nil {
+				return err
+			}
+			info.Status = code
+		case "diagnostic-code":
+			info.DiagnosticCode = parseDiagnosticCode(value)
+		case "will-retry-until":
+			t, err := parseDate(value)
+			if err != nil {
+				return fmt.Errorf("dsn: malformed Will-Retry-Until: %w", err)
+			}
+			info.WillRetryUntil = t
+		default:
+			info.ExtensionFields.Add(fields.Key(), value)
+		}
+	}
+
+	if info.FinalRecipient == "" {
+		return errors.New("dsn: Final-Recipient is required")
+	}
+	if info.Action == "" {
+		return errors.New("dsn: Action is required")
+	}
+	if info.Status[0] == 0 {
+		return errors.New("dsn: Status is required")
+	}
+	return nil
+}
+
+// parseEnhancedCode parses a status-code such as "5.1.1". Trailing comments,
+// as emitted by some MTAs ("5.1.1 (user unknown)"), are ignored.
+func parseEnhancedCode(v string) (smtp.EnhancedCode, error) {
+	fields := strings.Fields(v)
+	if len(fields) == 0 {
+		return smtp.EnhancedCode{}, errors.New("dsn: empty Status")
+	}
+
+	parts := strings.Split(fields[0], ".")
+	if len(parts) != 3 {
+		return smtp.EnhancedCode{}, fmt.Errorf("dsn: malformed Status: %q", v)
+	}
+
+	code := smtp.EnhancedCode{}
+	for i, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 0 {
+			return smtp.EnhancedCode{}, fmt.Errorf("dsn: malformed Status: %q", v)
+		}
+		code[i] = n
+	}
+	if code[0] != 2 && code[0] != 4 && code[0] != 5 {
+		return smtp.EnhancedCode{}, fmt.Errorf("dsn: malformed Status: %q", v)
+	}
+	return code, nil
+}
+
+// parseDiagnosticCode converts a Diagnostic-Code field back into an error.
+// "smtp" diagnostics are returned as *smtp.SMTPError where possible, other
+// types as *DiagnosticError.
+func parseDiagnosticCode(v string) error {
+	typ, text := splitTyped(v)
+	switch typ {
+	case "smtp":
+	case "":
+		return errors.New(text)
+	default:
+		return &DiagnosticError{Type: typ, Text: text}
+	}
+
+	fields := strings.SplitN(text, " ", 3)
+	code, err := strconv.Atoi(fields[0])
+	if err != nil || code < 200 || code > 599 {
+		return errors.New(text)
+	}
+
+	smtpErr := &smtp.SMTPError{Code: code, EnhancedCode: smtp.NoEnhancedCode}
+	rest := strings.TrimSpace(strings.TrimPrefix(text, fields[0]))
+	if len(fields) > 1 {
+		if enh, err := parseEnhancedCode(fields[1]); err == nil {
+			smtpErr.EnhancedCode = enh
+			rest = strings.TrimSpace(strings.TrimPrefix(rest, fields[1]))
+		}
+	}
+	smtpErr.Message = rest
+	return smtpErr
+}
@@ -0,0 +1,279 @@
+package dsn
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-smtp"
+)
+
+func generateTestDSN(t *testing.T, rcpts int) []byte {
+	t.Helper()
+
+	rcptsInfo := make([]RecipientInfo, rcpts)
+	for i := range rcptsInfo {
+		rcptsInfo[i] = RecipientInfo{FinalRecipient: "rcpt@example.com", Action: ActionFailed, Status: smtp.EnhancedCode{5, 1, 1}}
+	}
+	var body bytes.Buffer
+	h, err := GenerateDSN(false, Envelope{}, ReportingMTAInfo{ReportingMTA: "mx.example.org"}, rcptsInfo, textproto.Header{}, &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var msg bytes.Buffer
+	if err := textproto.WriteHeader(&msg, h); err != nil {
+		t.Fatal(err)
+	}
+	msg.Write(body.Bytes())
+	return msg.Bytes()
+}
+
+func TestParserLimits(t *testing.T) {
+	msg := generateTestDSN(t, 3)
+	if _, err := ParseDSN(bytes.NewReader(msg)); err != nil {
+		t.Fatalf("ParseDSN() = %v", err)
+	}
+
+	// Wraps the report in multipart/mixed n times.
+	nest := func(msg []byte, n int) []byte {
+		for i := 0; i < n; i++ {
+			b := "nest" + strings.Repeat("x", i)
+			msg = []byte("Content-Type: multipart/mixed; boundary=" + b + "\r\n\r\n--" + b + "\r\n" +
+				string(msg) + "\r\n--" + b + "--\r\n")
+		}
+		return msg
+	}
+
+	tests := []struct {
+		name   string
+		parser Parser
+		msg    []byte
+		limit  string
+	}{
+		{"bytes", Parser{MaxBytes: 100}, msg, "MaxBytes"},
+		{"line", Parser{MaxLineLength: 10}, msg, "MaxLineLength"},
+		{"header fields", Parser{MaxHeaderFields: 3}, msg, "MaxHeaderFields"},
+		{"recipients", Parser{MaxRecipients: 2}, msg, "MaxRecipients"},
+		{"parts", Parser{MaxParts: 2}, msg, "MaxParts"},
+		{"depth", Parser{}, nest(msg, DefaultMaxDepth), "MaxDepth"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := tt.parser.Parse(bytes.NewReader(tt.msg))
+			var limitErr *LimitError
+			if !errors.As(err, &limitErr) || limitErr.Limit != tt.limit {
+				t.Errorf("Parse() = %v, want %s exceeded", err, tt.limit)
+			}
+		})
+	}
+
+	// Below the limits and with limits disabled.
+	if _, err := (&Parser{}).Parse(bytes.NewReader(nest(msg, DefaultMaxDepth-1))); err != nil {
+		t.Errorf("Parse() of nested report = %v", err)
+	}
+	if _, err := (&Parser{MaxBytes: -1, MaxRecipients: -1}).Parse(bytes.NewReader(generateTestDSN(t, DefaultMaxRecipients+1))); err != nil {
+		t.Errorf("Parse() without limits = %v", err)
+	}
+}
+
+func TestParseDSNHumanText(t *testing.T) {
+	rep, err := ParseDSN(bytes.NewReader(generateTestDSN(t, 1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"This is the mail delivery system at mx.example.org.",
+		"Delivery to rcpt@example.com failed",
+	} {
+		if !strings.Contains(rep.HumanText, want) {
+			t.Errorf("HumanText does not contain %q:\n%s", want, rep.HumanText)
+		}
+	}
+	if strings.Contains(rep.HumanText, "Reporting-MTA") {
+		t.Errorf("HumanText contains the delivery-status part:\n%s", rep.HumanText)
+	}
+}
+
+func TestRecipientExtensionFields(t *testing.T) {
+	ext := textproto.Header{}
+	ext.Add("X-Site-Queue", "q1")
+	ext.Add("X-Site-Route", "backup")
+	rcpt := RecipientInfo{FinalRecipient: "rcpt@example.com", Action: ActionFailed, Status: smtp.EnhancedCode{5, 1, 1}, ExtensionFields: ext}
+
+	var b bytes.Buffer
+	if err := rcpt.WriteTo(false, &b); err != nil {
+		t.Fatal(err)
+	}
+	if want := "Final-Recipient: rfc822; rcpt@example.com\r\nX-Site-Queue: q1\r\nX-Site-Route: backup\r\n\r\n"; !strings.HasSuffix(b.String(), want) {
+		t.Errorf("recipient block %q does not end with %q", b.String(), want)
+	}
+
+	var body bytes.Buffer
+	h, err := GenerateDSN(false, Envelope{}, ReportingMTAInfo{ReportingMTA: "mx.example.org"}, []RecipientInfo{rcpt}, textproto.Header{}, &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var msg bytes.Buffer
+	if err := textproto.WriteHeader(&msg, h); err != nil {
+		t.Fatal(err)
+	}
+	msg.Write(body.Bytes())
+	rep, err := ParseDSN(&msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := rep.Recipients[0].ExtensionFields
+	if got.Get("X-Site-Queue") != "q1" || got.Get("X-Site-Route") != "backup" || got.Len() != 2 {
+		t.Errorf("parsed extension fields: %v", got)
+	}
+}
+
+func TestMessageExtensionFields(t *testing.T) {
+	ext := textproto.Header{}
+	ext.Add("DSN-Gateway", "dns; gw.example.org")
+	info := ReportingMTAInfo{ReportingMTA: "mx.example.org", ExtensionFields: ext}
+
+	var b bytes.Buffer
+	if err := info.WriteTo(false, &b); err != nil {
+		t.Fatal(err)
+	}
+	if want := "Reporting-Mta: dns; mx.example.org\r\nDsn-Gateway: dns; gw.example.org\r\n\r\n"; b.String() != want {
+		t.Errorf("per-message block %q, want %q", b.String(), want)
+	}
+
+	var body bytes.Buffer
+	h, err := GenerateDSN(false, Envelope{}, info, []RecipientInfo{{FinalRecipient: "rcpt@example.com", Action: ActionFailed, Status: smtp.EnhancedCode{5, 1, 1}}}, textproto.Header{}, &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var msg bytes.Buffer
+	if err := textproto.WriteHeader(&msg, h); err != nil {
+		t.Fatal(err)
+	}
+	msg.Write(body.Bytes())
+	rep, err := ParseDSN(&msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := rep.MTAInfo.ExtensionFields.Get("Dsn-Gateway"); got != "dns; gw.example.org" {
+		t.Errorf("parsed DSN-Gateway %q", got)
+	}
+}
+
+func TestDiagnosticError(t *testing.T) {
+	rcpt := RecipientInfo{
+		FinalRecipient: "rcpt@example.com",
+		Action:         ActionFailed,
+		Status:         smtp.EnhancedCode{5, 2, 2},
+		DiagnosticCode: &DiagnosticError{Type: "X-Unix", Text: "mailbox über quota"},
+	}
+	var b bytes.Buffer
+	if err := rcpt.WriteTo(false, &b); err != nil {
+		t.Fatal(err)
+	}
+	if want := "Diagnostic-Code: X-Unix; mailbox ?ber quota\r\n"; !strings.Contains(b.String(), want) {
+		t.Errorf("recipient block %q does not contain %q", b.String(), want)
+	}
+
+	var parsed RecipientInfo
+	if err := parsed.readFrom(mustReadHeader(t, b.String())); err != nil {
+		t.Fatal(err)
+	}
+	diagErr, ok := parsed.DiagnosticCode.(*DiagnosticError)
+	if !ok || diagErr.Type != "x-unix" || diagErr.Text != "mailbox ?ber quota" {
+		t.Errorf("parsed Diagnostic-Code %#v", parsed.DiagnosticCode)
+	}
+}
+
+func mustReadHeader(t *testing.T, s string) textproto.Header {
+	t.Helper()
+	h, err := textproto.ReadHeader(bufio.NewReader(strings.NewReader(s)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+func TestMTANameTypes(t *testing.T) {
+	info := ReportingMTAInfo{ReportingMTA: "relay-7", ReportingMTAType: "x-local-hostname"}
+	var b bytes.Buffer
+	if err := info.WriteTo(false, &b); err != nil {
+		t.Fatal(err)
+	}
+	rcpt := RecipientInfo{FinalRecipient: "rcpt@example.com", Action: ActionRelayed, Status: smtp.EnhancedCode{2, 0, 0}, RemoteMTA: "büro.example", RemoteMTAType: "dns"}
+	if err := rcpt.WriteTo(false, &b); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"Reporting-Mta: x-local-hostname; relay-7\r\n",
+		"Remote-Mta: dns; xn--bro-hoa.example\r\n",
+	} {
+		if !strings.Contains(b.String(), want) {
+			t.Errorf("blocks %q do not contain %q", b.String(), want)
+		}
+	}
+
+	var parsed ReportingMTAInfo
+	if err := parsed.readFrom(mustReadHeader(t, "Reporting-MTA: x-local-hostname; relay-7\r\n\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	if parsed.ReportingMTAType != "x-local-hostname" || parsed.ReportingMTA != "relay-7" {
+		t.Errorf("parsed Reporting-MTA %q; %q", parsed.ReportingMTAType, parsed.ReportingMTA)
+	}
+}
+
+// parseMTAField parses a report with field in the per-message block.
+func parseMTAField(t *testing.T, field string) *Report {
+	t.Helper()
+	msg := "Content-Type: multipart/report; report-type=delivery-status; boundary=b\r\n" +
+		"\r\n" +
+		"--b\r\n" +
+		"Content-Type: message/delivery-status\r\n" +
+		"\r\n" +
+		"Reporting-MTA: dns; mx.example.org\r\n" +
+		field + "\r\n" +
+		"\r\n" +
+		"Final-Recipient: rfc822; rcpt@example.com\r\n" +
+		"Action: failed\r\n" +
+		"Status: 5.1.1\r\n" +
+		"\r\n" +
+		"--b--\r\n"
+	rep, err := ParseDSN(strings.NewReader(msg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rep
+}
+
+func TestParseShortXFields(t *testing.T) {
+	for _, field := range []string{"X-Sender: rfc822; sender@example.org", "X-Msgid: 123"} {
+		rep := parseMTAField(t, field)
+		key := field[:strings.IndexByte(field, ':')]
+		if rep.MTAInfo.ExtensionFields.Get(key) == "" {
+			t.Errorf("%s: not kept as extension field", key)
+		}
+		if rep.MTAInfo.XMTAName != "" || rep.MTAInfo.XSender != "" || rep.MTAInfo.XMessageID != "" {
+			t.Errorf("%s: parsed as X-<mta> field: %+v", key, rep.MTAInfo)
+		}
+	}
+
+	rep := parseMTAField(t, "X-Postfix-Sender: rfc822; sender@example.org")
+	if rep.MTAInfo.XMTAName != "Postfix" || rep.MTAInfo.XSender != "sender@example.org" {
+		t.Errorf("X-Postfix-Sender parsed as XMTAName %q, XSender %q", rep.MTAInfo.XMTAName, rep.MTAInfo.XSender)
+	}
+}
+
+func TestParseShortQueueIDField(t *testing.T) {
+	rep := parseMTAField(t, "X-Queue-Id: 4ABC123")
+	if rep.MTAInfo.ExtensionFields.Get("X-Queue-Id") != "4ABC123" || rep.MTAInfo.XMessageID != "" {
+		t.Errorf("X-Queue-Id parsed as XMTAName %q, XMessageID %q", rep.MTAInfo.XMTAName, rep.MTAInfo.XMessageID)
+	}
+
+	rep = parseMTAField(t, "X-Postfix-Queue-ID: 4ABC123")
+	if rep.MTAInfo.XMTAName != "Postfix" || rep.MTAInfo.XMessageID != "4ABC123" {
+		t.Errorf("X-Postfix-Queue-ID parsed as XMTAName %q, XMessageID %q", rep.MTAInfo.XMTAName, rep.MTAInfo.XMessageID)
+	}
+}
@@ -0,0 +1,131 @@
+package dsn
+
+import (
+	"context"
+	"io"
+	"sync"
+)
+
+// ParseJob is a raw bounce to be parsed by Parser.ParseAll.
+type ParseJob struct {
+	// ID is copied to the result, it is not used otherwise.
+	ID string
+	// Message is read until EOF, it is not closed.
+	Message io.Reader
+}
+
+// ParseResult is the outcome of a ParseJob.
+type ParseResult struct {
+	Job    ParseJob
+	Report *Report
+	Err    error
+}
+
+// ParseAll parses the bounces received from jobs using the given number of
+// workers and sends the results to results, e.g. when ingesting a burst of
+// bounces from a mailbox. If ordered is set, results are sent in the order
+// of jobs, otherwise as soon as they are available.
+//
+// At most 2*workers jobs are in progress or waiting to be sent at a time.
+// ParseAll returns when jobs is closed and all results were sent or when
+// ctx is done, in which case ctx.Err() is returned. results is not closed.
+func (p *Parser) ParseAll(ctx context.Context, jobs <-chan ParseJob, results chan<- ParseResult, workers int, ordered bool) error {
+	if workers < 1 {
+		workers = 1
+	}
+
+	type item struct {
+		seq int
+		job ParseJob
+		res ParseResult
+	}
+	tokens := make(chan struct{}, 2*workers)
+	work := make(chan item)
+	done := make(chan item)
+
+	// Dispatcher.
+	go func() {
+		defer close(work)
+		for seq := 0; ; seq++ {
+			select {
+			case <-ctx.Done():
+				return
+			case tokens <- struct{}{}:
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case job, ok := <-jobs:
+				if !ok {
+					return
+				}
+				select {
+				case <-ctx.Done():
+					return
+				case work <- item{seq: seq, job: job}:
+				}
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for it := range work {
+				it.res.Job = it.job
+				it.res.Report, it.res.Err = p.Parse(it.job.Message)
+				select {
+				case <-ctx.Done():
+					return
+				case done <- it:
+				}
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	send := func(res ParseResult) bool {
+		select {
+		case <-ctx.Done():
+			return false
+		case results <- res:
+			<-tokens
+			return true
+		}
+	}
+
+	next := 0
+	pending := map[int]ParseResult{}
+	for it := range done {
+		if !ordered {
+			if !send(it.res) {
+				break
+			}
+			continue
+		}
+		pending[it.seq] = it.res
+		for {
+			res, ok := pending[next]
+			if !ok {
+				break
+			}
+			delete(pending, next)
+			next++
+			if !send(res) {
+				break
+			}
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		// Let the workers exit.
+		for range done {
+		}
+		return err
+	}
+	return nil
+}
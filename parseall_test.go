@@ -0,0 +1,71 @@
+package dsn
+
+import (
+	"bytes"
+	"context"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestParseAll(t *testing.T) {
+	valid := generateTestDSN(t, 1)
+
+	for _, ordered := range []bool{false, true} {
+		t.Run("ordered="+strconv.FormatBool(ordered), func(t *testing.T) {
+			jobs := make(chan ParseJob)
+			results := make(chan ParseResult)
+			done := make(chan error, 1)
+			go func() {
+				done <- (&Parser{}).ParseAll(context.Background(), jobs, results, 4, ordered)
+				close(results)
+			}()
+
+			const n = 100
+			go func() {
+				for i := 0; i < n; i++ {
+					job := ParseJob{ID: strconv.Itoa(i), Message: bytes.NewReader(valid)}
+					if i%10 == 0 {
+						job.Message = strings.NewReader("Subject: not a bounce\r\n\r\nhello\r\n")
+					}
+					jobs <- job
+				}
+				close(jobs)
+			}()
+
+			i := 0
+			failed := 0
+			for res := range results {
+				if ordered && res.Job.ID != strconv.Itoa(i) {
+					t.Errorf("result %d is for job %s", i, res.Job.ID)
+				}
+				if res.Err != nil {
+					failed++
+				} else if res.Report.MTAInfo.ReportingMTA != "mx.example.org" {
+					t.Errorf("job %s: Reporting-MTA %q", res.Job.ID, res.Report.MTAInfo.ReportingMTA)
+				}
+				i++
+			}
+			if err := <-done; err != nil {
+				t.Errorf("ParseAll() = %v", err)
+			}
+			if i != n || failed != n/10 {
+				t.Errorf("got %d results with %d errors, want %d with %d", i, failed, n, n/10)
+			}
+		})
+	}
+}
+
+func TestParseAllCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	jobs := make(chan ParseJob, 1)
+	jobs <- ParseJob{Message: strings.NewReader("")}
+
+	results := make(chan ParseResult)
+	done := make(chan error, 1)
+	go func() { done <- (&Parser{}).ParseAll(ctx, jobs, results, 2, true) }()
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Errorf("ParseAll() = %v, want %v", err, context.Canceled)
+	}
+}
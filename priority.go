@@ -0,0 +1,159 @@
+package dsn
+
+import (
+	"context"
+	"sync"
+)
+
+// Priority is the priority of a Job in a PriorityQueue.
+type Priority int
+
+const (
+	// PriorityLow is meant for e.g. success notifications.
+	PriorityLow Priority = -1
+	// PriorityNormal is the zero value.
+	PriorityNormal Priority = 0
+	// PriorityHigh is meant for e.g. hard failures.
+	PriorityHigh Priority = 1
+)
+
+// lane returns the index of the lane of p, priorities outside of the
+// defined ones are clamped.
+func (p Priority) lane() int {
+	switch {
+	case p < PriorityNormal:
+		return 0
+	case p > PriorityNormal:
+		return 2
+	}
+	return 1
+}
+
+// PriorityQueue is an in-memory queue of jobs that hands out jobs of higher
+// priority first, e.g. to feed Sender.SendDSNs. A lane that was passed over
+// MaxSkips times is served next, so that low priority jobs are not starved.
+// The zero value is ready to use.
+type PriorityQueue struct {
+	// MaxSkips defaults to 8.
+	MaxSkips int
+
+	mu     sync.Mutex
+	lanes  [3][]Job
+	skips  [3]int
+	closed bool
+	notify chan struct{}
+}
+
+func (q *PriorityQueue) notifyChan() chan struct{} {
+	if q.notify == nil {
+		q.notify = make(chan struct{}, 1)
+	}
+	return q.notify
+}
+
+// Push adds job to the lane of job.Priority. It must not be called after
+// Close.
+func (q *PriorityQueue) Push(job Job) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		panic("dsn: Push on closed PriorityQueue")
+	}
+	lane := job.Priority.lane()
+	q.lanes[lane] = append(q.lanes[lane], job)
+	select {
+	case q.notifyChan() <- struct{}{}:
+	default:
+	}
+}
+
+// Close makes Run return once all queued jobs were handed out.
+func (q *PriorityQueue) Close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.closed = true
+	select {
+	case q.notifyChan() <- struct{}{}:
+	default:
+	}
+}
+
+// Len returns the number of queued jobs.
+func (q *PriorityQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.lanes[0]) + len(q.lanes[1]) + len(q.lanes[2])
+}
+
+// pop removes the next job, ok is false if the queue is empty.
+func (q *PriorityQueue) pop() (job Job, ok, closed bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	maxSkips := q.MaxSkips
+	if maxSkips <= 0 {
+		maxSkips = 8
+	}
+
+	next := -1
+	for i := range q.lanes {
+		if len(q.lanes[i]) != 0 && q.skips[i] >= maxSkips {
+			next = i
+			break
+		}
+	}
+	if next < 0 {
+		for i := len(q.lanes) - 1; i >= 0; i-- {
+			if len(q.lanes[i]) != 0 {
+				next = i
+				break
+			}
+		}
+	}
+	if next < 0 {
+		return Job{}, false, q.closed
+	}
+
+	for i := range q.lanes {
+		if i != next && len(q.lanes[i]) != 0 {
+			q.skips[i]++
+		}
+	}
+	q.skips[next] = 0
+
+	job = q.lanes[next][0]
+	q.lanes[next][0] = Job{}
+	q.lanes[next] = q.lanes[next][1:]
+	return job, true, q.closed
+}
+
+// Run sends the queued jobs to out as they are pushed. It returns when the
+// queue was closed and is empty, in which case out is closed, or when ctx
+// is done, in which case ctx.Err() is returned.
+func (q *PriorityQueue) Run(ctx context.Context, out chan<- Job) error {
+	q.mu.Lock()
+	notify := q.notifyChan()
+	q.mu.Unlock()
+
+	for {
+		job, ok, closed := q.pop()
+		if !ok {
+			if closed {
+				close(out)
+				return nil
+			}
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-notify:
+			}
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case out <- job:
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package dsn
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestPriorityQueue(t *testing.T) {
+	q := &PriorityQueue{MaxSkips: 2}
+	for _, j := range []Job{
+		{ID: "l1", Priority: PriorityLow},
+		{ID: "n1"},
+		{ID: "h1", Priority: PriorityHigh},
+		{ID: "h2", Priority: PriorityHigh},
+		{ID: "h3", Priority: 5},
+		{ID: "h4", Priority: PriorityHigh},
+		{ID: "n2"},
+	} {
+		q.Push(j)
+	}
+	q.Close()
+	if q.Len() != 7 {
+		t.Errorf("Len() = %d, want 7", q.Len())
+	}
+
+	out := make(chan Job)
+	errCh := make(chan error, 1)
+	go func() { errCh <- q.Run(context.Background(), out) }()
+	var ids []string
+	for j := range out {
+		ids = append(ids, j.ID)
+	}
+	if err := <-errCh; err != nil {
+		t.Fatal(err)
+	}
+
+	// After two skips the lowest starved lane is served.
+	if got, want := strings.Join(ids, " "), "h1 h2 l1 n1 h3 h4 n2"; got != want {
+		t.Errorf("order %q, want %q", got, want)
+	}
+}
+
+func TestPriorityQueueCancel(t *testing.T) {
+	q := &PriorityQueue{}
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error, 1)
+	go func() { errCh <- q.Run(ctx, make(chan Job)) }()
+	cancel()
+	if err := <-errCh; err != context.Canceled {
+		t.Errorf("Run() = %v, want context.Canceled", err)
+	}
+}
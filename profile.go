@@ -0,0 +1,772 @@
+package dsn
+
+import (
+	"fmt"
+	htmltemplate "html/template"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-smtp"
+)
+
+// Profile controls the wording and layout of generated DSNs, e.g. to mimic
+// the bounces of another MTA so that existing parsers and people used to
+// them keep working, or to apply the branding of a vendor. The
+// machine-readable fields are generated as defined by RFC 3464 regardless
+// of the profile.
+//
+// Empty fields take their value from DefaultProfile.
+type Profile struct {
+	// Name identifies the profile, see RegisterProfile.
+	Name string
+
+	// Subject of the report.
+	Subject string
+	// Subjects, if set, selects the subject by the Action of the report:
+	// the Action of all recipients, or the most severe one of a mix, failed
+	// before delayed before the others, which count as delivered. The
+	// templates are executed with a TemplateData. Subject is used for
+	// actions without an entry.
+	Subjects map[Action]*template.Template
+	// Header lists extra fields added to the message header, e.g. a
+	// vendor-specific X- field.
+	Header textproto.Header
+	// AutoSubmitted is the value of the Auto-Submitted field (RFC 3834).
+	// DefaultProfile uses "auto-generated", the profiles mimicking an MTA
+	// use its value.
+	AutoSubmitted string
+	// SuppressAutoResponses adds "Precedence: bulk" and
+	// "X-Auto-Response-Suppress: All" fields, so that vacation responders
+	// and Exchange do not reply to the report.
+	SuppressAutoResponses bool
+
+	// XMTAName is used when ReportingMTAInfo.XMTAName is empty.
+	XMTAName string
+	// MessageIDField is the name of the per-message field holding
+	// ReportingMTAInfo.XMessageID, following the "X-<XMTAName>-" prefix.
+	MessageIDField string
+
+	// DiagnosticType, if set, is the type of the Diagnostic-Code field of
+	// errors other than *smtp.SMTPError when not generating an
+	// internationalized (utf8) DSN, e.g. "X-Postfix". Non-ASCII characters
+	// are replaced with '?'. If empty, such diagnostics are left out.
+	DiagnosticType string
+
+	// Preamble is written before the first part, for clients that do not
+	// understand MIME.
+	Preamble string
+
+	// Text renders the beginning of the human-readable part, it is executed
+	// with a TemplateData. The fields of the ReportingMTAInfo are promoted,
+	// so templates written for it keep working.
+	Text *template.Template
+	// RecipientText is executed with every RecipientInfo after Text. A Text
+	// that lists the Recipients itself controls the whole layout if
+	// RecipientText is an empty template.
+	RecipientText *template.Template
+	// HTML, if set, adds an HTML alternative to the human-readable part. It
+	// is executed with a TemplateData.
+	HTML *htmltemplate.Template
+	// Trailer, if set, is executed with the []RecipientInfo after
+	// RecipientText, e.g. to list the recipients grouped by Action.
+	Trailer *template.Template
+
+	// Language, if set, is the language tag of Text, RecipientText, HTML
+	// and Trailer, e.g. "de" for templates from a TemplateSet. It is written
+	// as Content-Language field of the message and the human-readable part.
+	Language string
+
+	// GroupRecipients, if set, lists the recipients grouped by Action with
+	// a heading and count per group, e.g. "Permanently failed (3):", once a
+	// DSN has at least that many recipients. RecipientText is still used
+	// for every recipient.
+	GroupRecipients int
+
+	// Alternatives, if set, are further renderings of the human-readable
+	// part, e.g. translations or a shorter plain text. The part is written
+	// as multipart/alternative of the text of every alternative, followed by
+	// the text and HTML of the profile, which mail clients prefer as the
+	// last part. Only Text, RecipientText, Trailer, GroupRecipients and
+	// Language of the alternatives are used, the delivery-status part is
+	// not affected.
+	Alternatives []*Profile
+
+	// Content-Description of the human-readable, the delivery-status and the
+	// returned header part. Non-ASCII descriptions are encoded as defined
+	// by RFC 2047, so they can be localized.
+	HumanDescription    string
+	StatusDescription   string
+	ReturnedDescription string
+	// ReturnedMessageDescription is the Content-Description of the complete
+	// message returned by Generator.GenerateFull, "Undelivered message" if
+	// empty.
+	ReturnedMessageDescription string
+
+	// ReturnedFilename, if set, marks the returned header part as an
+	// attachment with this file name. Non-ASCII names are encoded as defined
+	// by RFC 2231.
+	ReturnedFilename string
+
+	// StatusFilename, if set, marks the delivery-status part as an
+	// attachment with this file name.
+	StatusFilename string
+
+	// Dispositions adds a Content-Disposition field to every part: the
+	// human-readable part is inline, the delivery-status and returned header
+	// parts are attachments named StatusFilename and ReturnedFilename, which
+	// default to "delivery-status.txt" and "original-headers.txt".
+	Dispositions bool
+
+	// ReturnedHeadersType is the media type of the returned header part
+	// when not generating an internationalized (utf8) DSN.
+	ReturnedHeadersType string
+
+	// QSBMF generates a plain text bounce in the qmail-send bounce message
+	// format (QSBMF) instead of a multipart/report: the human-readable text
+	// followed by "--- Below this line is a copy of the message." and the
+	// returned header. The delivery-status part is omitted in this mode.
+	QSBMF bool
+
+	// FailedRecipientsField adds an X-Failed-Recipients field listing the
+	// recipients with ActionFailed to the message header.
+	FailedRecipientsField bool
+
+	// OmitTransferEncoding leaves out the "Content-Transfer-Encoding: 8bit"
+	// fields of the message and its text parts.
+	OmitTransferEncoding bool
+
+	// inlineText marks the human-readable parts as inline.
+	inlineText bool
+	// machineOnly, location and dateLayout are set from the Generator.
+	machineOnly bool
+	location    *time.Location
+	dateLayout  string
+	// returnFull is set by GenerateFull, returnTruncated if only the header
+	// is returned since the message exceeds this size.
+	returnFull      bool
+	returnTruncated int64
+	// returnNone is set for ReturnNone.
+	returnNone bool
+	// sevenBit is set from Generator.SevenBit.
+	sevenBit bool
+}
+
+// TemplateData is passed to the Text, HTML and Subjects templates of a
+// Profile. Recipients hold every per-recipient field, such as Action,
+// Status, RemoteMTA and DiagnosticCode.
+type TemplateData struct {
+	ReportingMTAInfo
+	Recipients []RecipientInfo
+}
+
+// defaultRecipientText is written by writeDefaultRecipientText without
+// executing the template.
+var defaultRecipientText = template.Must(template.New("dsn-rcpt").Parse(`Delivery to {{.FinalRecipient}} failed with error: {{printf "%v" .DiagnosticCode}}` + "\n"))
+
+// DefaultProfile is used by Generator if no profile is set.
+var DefaultProfile = &Profile{
+	Name:                "default",
+	Subject:             "Undelivered Mail Returned to Sender",
+	AutoSubmitted:       "auto-generated",
+	XMTAName:            xMTADefaultName,
+	MessageIDField:      "MsgID",
+	Text:                failedText,
+	RecipientText:       defaultRecipientText,
+	HumanDescription:    "Notification",
+	StatusDescription:   "Delivery report",
+	ReturnedDescription: "Undelivered message header",
+	ReturnedHeadersType: "message/rfc822-headers",
+	Subjects: map[Action]*template.Template{
+		ActionDelayed:   subjectTemplate(DefaultDelayedSubject),
+		ActionDelivered: subjectTemplate("Successful Mail Delivery Report"),
+		ActionRelayed:   subjectTemplate("Relayed Mail Delivery Report"),
+		ActionExpanded:  subjectTemplate("Mail Delivery Report: Alias Expanded"),
+	},
+}
+
+// PostfixTemplateText is the text of the human-readable part of
+// PostfixProfile.
+var PostfixTemplateText = `This is the mail system at host {{.ReportingMTA}}.
+
+I'm sorry to have to inform you that your message could not
+be delivered to one or more recipients. It's attached below.
+
+For further assistance, please send mail to postmaster.
+
+If you do so, please include this problem report. You can
+delete your own text from the attached returned message.
+
+                   The mail system
+
+`
+
+// PostfixProfile mimics the bounces generated by Postfix: its wording, one
+// "<rcpt>: host X said: ..." line per recipient, an X-Postfix-Queue-ID field
+// holding XMessageID and a text/rfc822-headers returned header part.
+var PostfixProfile = &Profile{
+	Name:                 "postfix",
+	Subject:              "Undelivered Mail Returned to Sender",
+	AutoSubmitted:        "auto-replied",
+	XMTAName:             "Postfix",
+	MessageIDField:       "Queue-ID",
+	DiagnosticType:       "X-Postfix",
+	Preamble:             "This is a MIME-encapsulated message.\r\n",
+	Text:                 template.Must(template.New("postfix-text").Parse(PostfixTemplateText)),
+	RecipientText:        template.Must(template.New("postfix-rcpt").Funcs(templateFuncs).Parse(`<{{.FinalRecipient}}>: {{with .RemoteMTA}}host {{.}} said: {{end}}{{diagnostic .DiagnosticCode}}` + "\n")),
+	HumanDescription:     "Notification",
+	StatusDescription:    "Delivery report",
+	ReturnedDescription:  "Undelivered Message Headers",
+	ReturnedHeadersType:  "text/rfc822-headers",
+	OmitTransferEncoding: true,
+}
+
+// EximTemplateText is the text of the human-readable part of EximProfile.
+var EximTemplateText = `This message was created automatically by mail delivery software.
+
+A message that you sent could not be delivered to one or more of its
+recipients. This is a permanent error. The following address(es) failed:
+
+`
+
+// EximProfile mimics the bounces generated by Exim: its subject and wording,
+// an indented block per recipient and an X-Failed-Recipients field.
+var EximProfile = &Profile{
+	Name:                  "exim",
+	Subject:               "Mail delivery failed: returning message to sender",
+	AutoSubmitted:         "auto-replied",
+	XMTAName:              "Exim",
+	Text:                  template.Must(template.New("exim-text").Parse(EximTemplateText)),
+	RecipientText:         template.Must(template.New("exim-rcpt").Funcs(templateFuncs).Parse(`  {{.FinalRecipient}}` + "\n" + `{{with .RemoteMTA}}    host {{.}}` + "\n" + `{{end}}{{with .DiagnosticCode}}    {{diagnostic .}}` + "\n" + `{{end}}`)),
+	HumanDescription:      "Notification",
+	StatusDescription:     "Delivery report",
+	ReturnedDescription:   "Undelivered Message Headers",
+	ReturnedHeadersType:   "text/rfc822-headers",
+	FailedRecipientsField: true,
+}
+
+// SendmailTemplateText is the text of the human-readable part of
+// SendmailProfile.
+var SendmailTemplateText = `The original message was received at {{.ArrivalDate.Format "Mon, 2 Jan 2006 15:04:05 -0700"}}
+{{with .ReceivedFromMTA}}from {{.}}
+{{end}}
+`
+
+// SendmailTrailerText lists the recipients of SendmailProfile grouped by
+// Action, followed by the transcript of the remote replies.
+var SendmailTrailerText = `{{with byAction . "failed"}}   ----- The following addresses had permanent fatal errors -----
+{{range .}}<{{.FinalRecipient}}>
+{{with .DiagnosticCode}}    (reason: {{diagnostic .}})
+{{end}}{{end}}
+{{end}}{{with byAction . "delayed"}}   ----- The following addresses had transient non-fatal errors -----
+{{range .}}<{{.FinalRecipient}}>
+{{with .DiagnosticCode}}    (reason: {{diagnostic .}})
+{{end}}{{end}}
+{{end}}   ----- Transcript of session follows -----
+{{range .}}{{with .RemoteMTA}}... while talking to {{.}}.:
+{{end}}{{with .DiagnosticCode}}<<< {{diagnostic .}}
+{{end}}{{end}}`
+
+// SendmailProfile mimics the bounces generated by sendmail: the recipients
+// are listed in "----- The following addresses had ... -----" sections
+// followed by the classic session transcript.
+var SendmailProfile = &Profile{
+	Name:                "sendmail",
+	Subject:             "Returned mail: see transcript for details",
+	XMTAName:            "Sendmail",
+	Preamble:            "This is a MIME-encapsulated message\r\n",
+	Text:                template.Must(template.New("sendmail-text").Parse(SendmailTemplateText)),
+	RecipientText:       template.Must(template.New("sendmail-rcpt").Parse("")),
+	Trailer:             template.Must(template.New("sendmail-trailer").Funcs(templateFuncs).Parse(SendmailTrailerText)),
+	HumanDescription:    "Notification",
+	StatusDescription:   "Delivery report",
+	ReturnedDescription: "Undelivered Message Headers",
+	ReturnedHeadersType: "text/rfc822-headers",
+}
+
+// QmailTemplateText is the text of the human-readable part of QmailProfile.
+var QmailTemplateText = `Hi. This is the qmail-send program at {{.ReportingMTA}}.
+I'm afraid I wasn't able to deliver your message to the following addresses.
+This is a permanent error; I've given up. Sorry it didn't work out.
+
+`
+
+// QmailRecipientText is the paragraph QmailProfile writes for every
+// recipient.
+var QmailRecipientText = `<{{.FinalRecipient}}>:
+{{with .RemoteMTA}}{{.}} does not like recipient.
+Remote host said: {{end}}{{diagnostic .DiagnosticCode}}
+{{with .RemoteMTA}}Giving up on {{.}}.
+{{end}}
+`
+
+// QmailProfile generates plain qmail-style bounces (QSBMF). Set QSBMF to
+// false on a copy to use the same wording in a multipart/report with the
+// standard machine-readable part:
+//
+//	p := *dsn.QmailProfile
+//	p.QSBMF = false
+//	g := dsn.Generator{Profile: &p}
+var QmailProfile = &Profile{
+	Name:                "qmail",
+	Subject:             "failure notice",
+	XMTAName:            "Qmail",
+	Text:                template.Must(template.New("qmail-text").Parse(QmailTemplateText)),
+	RecipientText:       template.Must(template.New("qmail-rcpt").Funcs(templateFuncs).Parse(QmailRecipientText)),
+	HumanDescription:    "Notification",
+	StatusDescription:   "Delivery report",
+	ReturnedDescription: "Undelivered Message Headers",
+	ReturnedHeadersType: "text/rfc822-headers",
+	QSBMF:               true,
+}
+
+// ConsumerTemplateText is the text of the human-readable part of
+// ConsumerProfile.
+var ConsumerTemplateText = `Your message couldn't be delivered.
+
+`
+
+// ConsumerRecipientText is the line ConsumerProfile writes for every
+// recipient.
+var ConsumerRecipientText = `  {{.FinalRecipient}}: {{status .Action}}
+`
+
+// ConsumerTrailerText is appended to the text of ConsumerProfile.
+var ConsumerTrailerText = `
+Check the addresses for typos and try again. If the problem persists,
+forward this message to your mail administrator.
+`
+
+// ConsumerHTMLText is the HTML alternative of ConsumerProfile. The
+// technical details are collapsed into a <details> element.
+var ConsumerHTMLText = `<!DOCTYPE html>
+<html>
+<body style="font-family: sans-serif;">
+<h2>Your message couldn't be delivered</h2>
+<table>
+{{- range .Recipients}}
+<tr><td>{{.FinalRecipient}}</td><td><span style="padding: 2px 6px; border-radius: 4px; color: #fff; background: {{badgeColor .Action}};">{{status .Action}}</span></td></tr>
+{{- end}}
+</table>
+<p>Check the addresses for typos and try again. If the problem persists,
+forward this message to your mail administrator.</p>
+<details>
+<summary>Technical details</summary>
+<pre>
+Reporting MTA: {{.ReportingMTA}}
+{{- range .Recipients}}
+{{.FinalRecipient}}: {{statusCode .Status}}{{with .RemoteMTA}} ({{.}}){{end}}{{with .DiagnosticCode}} {{diagnostic .}}{{end}}
+{{- end}}
+</pre>
+</details>
+</body>
+</html>
+`
+
+// ConsumerProfile is tuned for consumer mail clients and non-technical
+// senders: a short headline, one status badge per recipient in an HTML
+// alternative with the technical details collapsed, and the returned
+// headers attached as a file.
+var ConsumerProfile = &Profile{
+	Name:                "consumer",
+	Subject:             "Your message couldn't be delivered",
+	XMTAName:            xMTADefaultName,
+	Text:                template.Must(template.New("consumer-text").Parse(ConsumerTemplateText)),
+	RecipientText:       template.Must(template.New("consumer-rcpt").Funcs(templateFuncs).Parse(ConsumerRecipientText)),
+	Trailer:             template.Must(template.New("consumer-trailer").Parse(ConsumerTrailerText)),
+	HTML:                htmltemplate.Must(htmltemplate.New("consumer-html").Funcs(htmltemplate.FuncMap(templateFuncs)).Parse(ConsumerHTMLText)),
+	HumanDescription:    "Notification",
+	StatusDescription:   "Delivery report",
+	ReturnedDescription: "Undelivered message header",
+	ReturnedFilename:    "headers.txt",
+	ReturnedHeadersType: "text/rfc822-headers",
+}
+
+// templateFuncs are available to the templates of the built-in profiles and
+// TemplateSet. humanize formats a time.Duration for people, e.g. the
+// QueuedFor of a ReportingMTAInfo or the RetryingFor of a RecipientInfo.
+var templateFuncs = template.FuncMap{
+	"diagnostic": diagnosticText,
+	"byAction":   byAction,
+	"status":     actionStatus,
+	"badgeColor": badgeColor,
+	"statusCode": statusCode,
+	"humanize":   humanDuration,
+}
+
+// withFuncs returns a copy of p with funcs added to clones of its text
+// templates.
+func (p *Profile) withFuncs(funcs template.FuncMap) *Profile {
+	out := *p
+	clone := func(t *template.Template) *template.Template {
+		if t == nil {
+			return nil
+		}
+		// Clone of a text/template never fails.
+		c, _ := t.Clone()
+		return c.Funcs(funcs)
+	}
+	out.Text = clone(p.Text)
+	out.RecipientText = clone(p.RecipientText)
+	out.Trailer = clone(p.Trailer)
+	if p.Subjects != nil {
+		out.Subjects = make(map[Action]*template.Template, len(p.Subjects))
+		for action, t := range p.Subjects {
+			out.Subjects[action] = clone(t)
+		}
+	}
+	if p.Alternatives != nil {
+		out.Alternatives = make([]*Profile, len(p.Alternatives))
+		for i, alt := range p.Alternatives {
+			out.Alternatives[i] = alt.withFuncs(funcs)
+		}
+	}
+	return &out
+}
+
+// statusCode formats an enhanced status code such as "5.1.1".
+func statusCode(code smtp.EnhancedCode) string {
+	return fmt.Sprintf("%d.%d.%d", code[0], code[1], code[2])
+}
+
+// actionStatus returns a short description of action for people.
+func actionStatus(action Action) string {
+	switch action {
+	case ActionFailed:
+		return "Not delivered"
+	case ActionDelayed:
+		return "Delayed"
+	case ActionDelivered:
+		return "Delivered"
+	case ActionRelayed:
+		return "Relayed"
+	case ActionExpanded:
+		return "Expanded"
+	}
+	return string(action)
+}
+
+// badgeColor returns the CSS color of the status badge of action.
+func badgeColor(action Action) string {
+	switch action {
+	case ActionFailed:
+		return "#c5221f"
+	case ActionDelayed:
+		return "#e37400"
+	}
+	return "#188038"
+}
+
+// byAction returns the recipients with the given action.
+func byAction(rcptsInfo []RecipientInfo, action Action) []RecipientInfo {
+	var out []RecipientInfo
+	for _, rcpt := range rcptsInfo {
+		if rcpt.Action == action {
+			out = append(out, rcpt)
+		}
+	}
+	return out
+}
+
+// diagnosticText formats err like the value of a Diagnostic-Code field,
+// without the type.
+func diagnosticText(err error) string {
+	if err == nil {
+		return ""
+	}
+	if smtpErr, ok := err.(*smtp.SMTPError); ok {
+		if smtpErr.EnhancedCode[0] > 0 {
+			return fmt.Sprintf("%d %d.%d.%d %s", smtpErr.Code,
+				smtpErr.EnhancedCode[0], smtpErr.EnhancedCode[1], smtpErr.EnhancedCode[2],
+				newLineReplacer.Replace(smtpErr.Message))
+		}
+		return fmt.Sprintf("%d %s", smtpErr.Code, newLineReplacer.Replace(smtpErr.Message))
+	}
+	return newLineReplacer.Replace(err.Error())
+}
+
+// outlookPreamble is shown by clients that do not understand MIME.
+const outlookPreamble = "This is a multi-part message in MIME format.\r\n"
+
+// outlook returns a copy of p adjusted for Outlook and OWA: the human-readable
+// part is inline and comes first, the other parts are named attachments in
+// formats Outlook can open and non-MIME readers get a plain-text preamble.
+func (p *Profile) outlook() *Profile {
+	out := *p
+	out.inlineText = true
+	if out.Preamble == "" {
+		out.Preamble = outlookPreamble
+	}
+	if out.StatusFilename == "" {
+		out.StatusFilename = "details.txt"
+	}
+	if out.ReturnedFilename == "" {
+		out.ReturnedFilename = "headers.txt"
+	}
+	// Outlook shows message/rfc822-headers as an unnamed .dat file.
+	out.ReturnedHeadersType = "text/rfc822-headers"
+	return &out
+}
+
+// dispositions returns a copy of p with all parts marked inline or as
+// attachment, see Profile.Dispositions.
+func (p *Profile) dispositions() *Profile {
+	out := *p
+	out.inlineText = true
+	if out.StatusFilename == "" {
+		out.StatusFilename = "delivery-status.txt"
+	}
+	if out.ReturnedFilename == "" {
+		out.ReturnedFilename = "original-headers.txt"
+	}
+	return &out
+}
+
+// legacy returns a copy of p restricted to RFC 1894 era output.
+func (p *Profile) legacy() *Profile {
+	out := *p
+	out.HTML = nil
+	out.ReturnedHeadersType = "message/rfc822-headers"
+	// 7bit is the default.
+	out.OmitTransferEncoding = true
+	return &out
+}
+
+func subjectTemplate(subject string) *template.Template {
+	return template.Must(template.New("subject").Parse(subject))
+}
+
+// subject returns the subject of a report of rcptsInfo, see Subjects.
+func (p *Profile) subject(mtaInfo ReportingMTAInfo, rcptsInfo []RecipientInfo) (string, error) {
+	t := p.Subjects[reportAction(rcptsInfo)]
+	if t == nil {
+		return p.Subject, nil
+	}
+	var b strings.Builder
+	if err := t.Execute(&b, TemplateData{ReportingMTAInfo: mtaInfo, Recipients: rcptsInfo}); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// reportAction returns the Action of a report of rcptsInfo, see Subjects.
+func reportAction(rcptsInfo []RecipientInfo) Action {
+	var action Action
+	for i, rcpt := range rcptsInfo {
+		switch {
+		case rcpt.Action == ActionFailed:
+			return ActionFailed
+		case i == 0 || action == rcpt.Action:
+			action = rcpt.Action
+		case action == ActionDelayed || rcpt.Action == ActionDelayed:
+			action = ActionDelayed
+		default:
+			action = ActionDelivered
+		}
+	}
+	return action
+}
+
+// alternative returns a copy of p rendering the human-readable text of alt.
+func (p *Profile) alternative(alt *Profile) *Profile {
+	alt = alt.withDefaults()
+	out := *p
+	out.Text = alt.Text
+	out.RecipientText = alt.RecipientText
+	out.Trailer = alt.Trailer
+	out.GroupRecipients = alt.GroupRecipients
+	out.Language = alt.Language
+	return &out
+}
+
+// withDefaults returns a copy of p with empty fields taken from
+// DefaultProfile.
+func (p *Profile) withDefaults() *Profile {
+	if p == nil {
+		return DefaultProfile
+	}
+
+	out := *p
+	def := DefaultProfile
+	if out.Subject == "" {
+		out.Subject = def.Subject
+	}
+	if out.Subjects == nil {
+		out.Subjects = def.Subjects
+	}
+	if out.AutoSubmitted == "" {
+		out.AutoSubmitted = def.AutoSubmitted
+	}
+	if out.XMTAName == "" {
+		out.XMTAName = def.XMTAName
+	}
+	if out.MessageIDField == "" {
+		out.MessageIDField = def.MessageIDField
+	}
+	if out.Text == nil {
+		out.Text = def.Text
+	}
+	if out.RecipientText == nil {
+		out.RecipientText = def.RecipientText
+	}
+	if out.HumanDescription == "" {
+		out.HumanDescription = def.HumanDescription
+	}
+	if out.StatusDescription == "" {
+		out.StatusDescription = def.StatusDescription
+	}
+	if out.ReturnedDescription == "" {
+		out.ReturnedDescription = def.ReturnedDescription
+	}
+	if out.ReturnedHeadersType == "" {
+		out.ReturnedHeadersType = def.ReturnedHeadersType
+	}
+	return &out
+}
+
+// DelayedTemplateText is the text of the human-readable part of
+// DelayedProfile.
+var DelayedTemplateText = `
+This is the mail delivery system at {{.ReportingMTA}}.
+
+####################################################################
+# THIS IS A WARNING ONLY.  YOU DO NOT NEED TO RESEND YOUR MESSAGE. #
+####################################################################
+
+Your message could not be delivered to one or more recipients yet.
+Delivery will be retried, you will be notified if it finally fails.
+{{with humanize .QueuedFor}}
+Your message has been queued for {{.}}.
+{{end}}
+Message ID: {{.XMessageID}}
+Arrival: {{.FormatDate .ArrivalDate}}
+Last delivery attempt: {{.FormatDate .LastAttemptDate}}
+
+`
+
+// DelayedRecipientText is the line DelayedProfile writes for every
+// recipient.
+var DelayedRecipientText = `Delivery to {{.FinalRecipient}} delayed{{with .DiagnosticCode}} with error: {{diagnostic .}}{{end}}
+{{- with humanize .RetryingFor}}, will keep trying for another {{.}}
+{{- else}}{{if not .WillRetryUntil.IsZero}}, will retry until {{.WillRetryUntil}}{{end}}{{end}}
+`
+
+// DelayedProfile is the wording of delay warnings, see GenerateDelayWarning.
+var DelayedProfile = &Profile{
+	Name:                "delayed",
+	Subject:             DefaultDelayedSubject,
+	XMTAName:            xMTADefaultName,
+	MessageIDField:      "MsgID",
+	Text:                template.Must(template.New("delayed-text").Funcs(templateFuncs).Parse(DelayedTemplateText)),
+	RecipientText:       template.Must(template.New("delayed-rcpt").Funcs(templateFuncs).Parse(DelayedRecipientText)),
+	HumanDescription:    "Notification",
+	StatusDescription:   "Delivery report",
+	ReturnedDescription: "Delayed message header",
+	ReturnedHeadersType: "message/rfc822-headers",
+}
+
+// DeliveredTemplateText is the text of the human-readable part of
+// DeliveredProfile.
+var DeliveredTemplateText = `
+This is the mail delivery system at {{.ReportingMTA}}.
+
+Your message was successfully delivered to the destination(s) listed
+below. If the message was delivered to a mailbox you will receive no
+further notifications, otherwise you may still receive notifications
+of mail delivery errors from other systems.
+
+Message ID: {{.XMessageID}}
+Arrival: {{.FormatDate .ArrivalDate}}
+Delivery: {{.FormatDate .LastAttemptDate}}
+
+`
+
+// DeliveredRecipientText is the line DeliveredProfile writes for every
+// recipient.
+var DeliveredRecipientText = `{{if eq .Action "relayed"}}Relayed{{else}}Delivered{{end}} to {{.FinalRecipient}}{{with .RemoteMTA}} via {{.}}{{end}}
+`
+
+// DeliveredProfile is the wording of success notifications, see
+// GenerateSuccessDSN.
+var DeliveredProfile = &Profile{
+	Name:                "delivered",
+	Subject:             "Successful Mail Delivery Report",
+	XMTAName:            xMTADefaultName,
+	MessageIDField:      "MsgID",
+	Text:                template.Must(template.New("delivered-text").Parse(DeliveredTemplateText)),
+	RecipientText:       template.Must(template.New("delivered-rcpt").Parse(DeliveredRecipientText)),
+	HumanDescription:    "Notification",
+	StatusDescription:   "Delivery report",
+	ReturnedDescription: "Delivered message header",
+	ReturnedHeadersType: "message/rfc822-headers",
+}
+
+// RelayedTemplateText is the text of the human-readable part of
+// RelayedProfile.
+var RelayedTemplateText = `
+This is the mail delivery system at {{.ReportingMTA}}.
+
+Your message was successfully relayed to the destination(s) listed
+below. The receiving system does not support delivery status
+notifications, so you will receive no further notifications about the
+delivery of the message.
+
+Message ID: {{.XMessageID}}
+Arrival: {{.FormatDate .ArrivalDate}}
+Relayed: {{.FormatDate .LastAttemptDate}}
+
+`
+
+// RelayedProfile is the wording of relay notifications, see
+// GenerateRelayedDSN.
+var RelayedProfile = &Profile{
+	Name:                "relayed",
+	Subject:             "Relayed Mail Delivery Report",
+	XMTAName:            xMTADefaultName,
+	MessageIDField:      "MsgID",
+	Text:                template.Must(template.New("relayed-text").Parse(RelayedTemplateText)),
+	RecipientText:       template.Must(template.New("relayed-rcpt").Parse(DeliveredRecipientText)),
+	HumanDescription:    "Notification",
+	StatusDescription:   "Delivery report",
+	ReturnedDescription: "Relayed message header",
+	ReturnedHeadersType: "message/rfc822-headers",
+}
+
+// ExpandedTemplateText is the text of the human-readable part of
+// ExpandedProfile.
+var ExpandedTemplateText = `
+This is the mail delivery system at {{.ReportingMTA}}.
+
+Your message was delivered to the alias or mailing list address(es)
+listed below and was forwarded to their members. The members may not
+support delivery status notifications, so you will receive no further
+notifications about the delivery of the message.
+
+Message ID: {{.XMessageID}}
+Arrival: {{.FormatDate .ArrivalDate}}
+
+`
+
+// ExpandedRecipientText is the paragraph ExpandedProfile writes for every
+// recipient.
+var ExpandedRecipientText = `{{.FinalRecipient}} was expanded to {{len .ExpandedTo}} address(es){{if .ExpandedTo}}:{{end}}
+{{- range .ExpandedTo}}
+    {{.}}
+{{- end}}
+`
+
+// ExpandedProfile is the wording of expansion notifications, see
+// GenerateExpandedDSN.
+var ExpandedProfile = &Profile{
+	Name:                "expanded",
+	Subject:             "Mail Delivery Report: Alias Expanded",
+	XMTAName:            xMTADefaultName,
+	MessageIDField:      "MsgID",
+	Text:                template.Must(template.New("expanded-text").Parse(ExpandedTemplateText)),
+	RecipientText:       template.Must(template.New("expanded-rcpt").Parse(ExpandedRecipientText)),
+	HumanDescription:    "Notification",
+	StatusDescription:   "Delivery report",
+	ReturnedDescription: "Expanded message header",
+	ReturnedHeadersType: "message/rfc822-headers",
+}
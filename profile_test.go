@@ -0,0 +1,657 @@
+package dsn_test
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"text/template"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-smtp"
+	"schneider.vip/go-dsn"
+	"schneider.vip/go-dsn/dsntest"
+)
+
+func TestPostfixProfile(t *testing.T) {
+	ref, err := ioutil.ReadFile("dsntest/testdata/corpus/postfix.eml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	failedHeader := textproto.Header{}
+	failedHeader.Add("Subject", "test")
+	failedHeader.Add("To", "nobody@example.net")
+	failedHeader.Add("From", "sender@example.org")
+
+	g := dsn.Generator{Profile: dsn.PostfixProfile}
+	var body bytes.Buffer
+	h, err := g.Generate(false,
+		dsn.Envelope{MsgID: "<20200414082107.C19A91A0312@mail.example.com>", From: "MAILER-DAEMON@mail.example.com", To: "sender@example.org"},
+		dsn.ReportingMTAInfo{
+			ReportingMTA: "mail.example.com",
+			XSender:      "sender@example.org",
+			XMessageID:   "8B2E41A0311",
+			ArrivalDate:  time.Date(2020, 4, 14, 10, 21, 6, 0, time.UTC),
+		},
+		[]dsn.RecipientInfo{{
+			FinalRecipient:    "nobody@example.net",
+			OriginalRecipient: "nobody@example.net",
+			RemoteMTA:         "mx.example.net",
+			Action:            dsn.ActionFailed,
+			Status:            smtp.EnhancedCode{5, 1, 1},
+			DiagnosticCode:    &smtp.SMTPError{Code: 550, EnhancedCode: smtp.EnhancedCode{5, 1, 1}, Message: "User unknown"},
+		}},
+		failedHeader, &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := dsntest.Message(h, body.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := dsntest.SameStructure(bytes.NewReader(ref), bytes.NewReader(msg)); err != nil {
+		t.Error(err)
+	}
+	for _, want := range []string{
+		"This is a MIME-encapsulated message.\r\n",
+		"X-Postfix-Queue-Id: 8B2E41A0311\r\n",
+		"<nobody@example.net>: host mx.example.net said: 550 5.1.1 User unknown\n",
+	} {
+		if !strings.Contains(string(msg), want) {
+			t.Errorf("generated message does not contain %q", want)
+		}
+	}
+
+	rep, err := dsn.ParseDSN(bytes.NewReader(msg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rep.MTAInfo.XMTAName != "Postfix" || rep.MTAInfo.XMessageID != "8B2E41A0311" {
+		t.Errorf("parsed X-MTA name %q, queue ID %q", rep.MTAInfo.XMTAName, rep.MTAInfo.XMessageID)
+	}
+	if rcpt := rep.Recipients[0]; rcpt.OriginalRecipientType != "rfc822" || rcpt.OriginalRecipient != "nobody@example.net" {
+		t.Errorf("parsed Original-Recipient %q; %q", rcpt.OriginalRecipientType, rcpt.OriginalRecipient)
+	}
+}
+
+func TestEximProfile(t *testing.T) {
+	g := dsn.Generator{Profile: dsn.EximProfile}
+	var body bytes.Buffer
+	h, err := g.Generate(false, dsn.Envelope{From: "Mail Delivery System <Mailer-Daemon@mail.example.com>", To: "sender@example.org"},
+		dsn.ReportingMTAInfo{ReportingMTA: "mail.example.com"},
+		[]dsn.RecipientInfo{
+			{
+				FinalRecipient: "nobody@example.net",
+				RemoteMTA:      "mx.example.net",
+				Action:         dsn.ActionFailed,
+				Status:         smtp.EnhancedCode{5, 1, 1},
+				DiagnosticCode: &smtp.SMTPError{Code: 550, EnhancedCode: smtp.EnhancedCode{5, 1, 1}, Message: "User unknown"},
+			},
+			{
+				FinalRecipient: "slow@example.net",
+				Action:         dsn.ActionDelayed,
+				Status:         smtp.EnhancedCode{4, 4, 1},
+			},
+			{
+				FinalRecipient: "full@example.com",
+				Action:         dsn.ActionFailed,
+				Status:         smtp.EnhancedCode{5, 2, 2},
+			},
+		},
+		textproto.Header{}, &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := h.Get("Subject"), "Mail delivery failed: returning message to sender"; got != want {
+		t.Errorf("Subject = %q, want %q", got, want)
+	}
+	if got, want := h.Get("X-Failed-Recipients"), "nobody@example.net, full@example.com"; got != want {
+		t.Errorf("X-Failed-Recipients = %q, want %q", got, want)
+	}
+	want := "  nobody@example.net\n    host mx.example.net\n    550 5.1.1 User unknown\n"
+	if !strings.Contains(body.String(), want) {
+		t.Errorf("human-readable part does not contain %q:\n%s", want, body.String())
+	}
+}
+
+func TestSendmailProfile(t *testing.T) {
+	g := dsn.Generator{Profile: dsn.SendmailProfile}
+	var body bytes.Buffer
+	_, err := g.Generate(false, dsn.Envelope{From: "Mail Delivery Subsystem <MAILER-DAEMON@mail.example.com>", To: "sender@example.org"},
+		dsn.ReportingMTAInfo{
+			ReportingMTA:    "mail.example.com",
+			ReceivedFromMTA: "client.example.org",
+			ArrivalDate:     time.Date(2020, 4, 14, 10, 21, 6, 0, time.UTC),
+		},
+		[]dsn.RecipientInfo{
+			{
+				FinalRecipient: "nobody@example.net",
+				RemoteMTA:      "mx.example.net",
+				Action:         dsn.ActionFailed,
+				Status:         smtp.EnhancedCode{5, 1, 1},
+				DiagnosticCode: &smtp.SMTPError{Code: 550, EnhancedCode: smtp.EnhancedCode{5, 1, 1}, Message: "User unknown"},
+			},
+			{
+				FinalRecipient: "slow@example.net",
+				Action:         dsn.ActionDelayed,
+				Status:         smtp.EnhancedCode{4, 4, 1},
+			},
+		},
+		textproto.Header{}, &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := `The original message was received at Tue, 14 Apr 2020 10:21:06 +0000
+from client.example.org
+
+   ----- The following addresses had permanent fatal errors -----
+<nobody@example.net>
+    (reason: 550 5.1.1 User unknown)
+
+   ----- The following addresses had transient non-fatal errors -----
+<slow@example.net>
+
+   ----- Transcript of session follows -----
+... while talking to mx.example.net.:
+<<< 550 5.1.1 User unknown
+`
+	if !strings.Contains(body.String(), want) {
+		t.Errorf("human-readable part does not contain\n%s\ngot:\n%s", want, body.String())
+	}
+}
+
+func TestQmailProfile(t *testing.T) {
+	rcpts := []dsn.RecipientInfo{{
+		FinalRecipient: "nobody@example.net",
+		RemoteMTA:      "192.0.2.25",
+		Action:         dsn.ActionFailed,
+		Status:         smtp.EnhancedCode{5, 1, 1},
+		DiagnosticCode: &smtp.SMTPError{Code: 550, EnhancedCode: smtp.EnhancedCode{5, 1, 1}, Message: "User unknown"},
+	}}
+	failedHeader := textproto.Header{}
+	failedHeader.Add("Subject", "test")
+
+	g := dsn.Generator{Profile: dsn.QmailProfile}
+	var body bytes.Buffer
+	h, err := g.Generate(false, dsn.Envelope{From: "MAILER-DAEMON@mail.example.com", To: "sender@example.org"},
+		dsn.ReportingMTAInfo{ReportingMTA: "mail.example.com"}, rcpts, failedHeader, &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := h.Get("Content-Type"); !strings.HasPrefix(got, "text/plain") {
+		t.Errorf("Content-Type = %q, want text/plain", got)
+	}
+	want := `Hi. This is the qmail-send program at mail.example.com.
+I'm afraid I wasn't able to deliver your message to the following addresses.
+This is a permanent error; I've given up. Sorry it didn't work out.
+
+<nobody@example.net>:
+192.0.2.25 does not like recipient.
+Remote host said: 550 5.1.1 User unknown
+Giving up on 192.0.2.25.
+
+--- Below this line is a copy of the message.
+
+` + "Subject: test\r\n\r\n"
+	if got := body.String(); got != want {
+		t.Errorf("body =\n%q\nwant\n%q", got, want)
+	}
+
+	// With the machine-readable part.
+	p := *dsn.QmailProfile
+	p.QSBMF = false
+	g.Profile = &p
+	body.Reset()
+	h, err = g.Generate(false, dsn.Envelope{From: "MAILER-DAEMON@mail.example.com", To: "sender@example.org"},
+		dsn.ReportingMTAInfo{ReportingMTA: "mail.example.com"}, rcpts, failedHeader, &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := dsntest.Message(h, body.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	rep, err := dsn.ParseDSN(bytes.NewReader(msg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rep.Recipients) != 1 || rep.Recipients[0].FinalRecipient != "nobody@example.net" {
+		t.Errorf("parsed recipients %+v", rep.Recipients)
+	}
+}
+
+func TestConsumerProfile(t *testing.T) {
+	g := dsn.Generator{Profile: dsn.ConsumerProfile}
+	var body bytes.Buffer
+	h, err := g.Generate(false, dsn.Envelope{From: "mailer-daemon@example.org", To: "sender@example.org"},
+		dsn.ReportingMTAInfo{ReportingMTA: "mx.example.org"},
+		[]dsn.RecipientInfo{{
+			FinalRecipient: "nobody@example.net",
+			Action:         dsn.ActionFailed,
+			Status:         smtp.EnhancedCode{5, 1, 1},
+			DiagnosticCode: &smtp.SMTPError{Code: 550, EnhancedCode: smtp.EnhancedCode{5, 1, 1}, Message: "<nobody@example.net> unknown"},
+		}},
+		textproto.Header{}, &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := dsntest.Message(h, body.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := dsntest.Validate(msg, dsntest.Checks...); err != nil {
+		t.Error(err)
+	}
+
+	for _, want := range []string{
+		"Content-Type: multipart/alternative;",
+		"Content-Type: text/html; charset=\"utf-8\"",
+		"background: #c5221f;\">Not delivered</span>",
+		"nobody@example.net: 5.1.1 550 5.1.1 &lt;nobody@example.net&gt; unknown",
+		"  nobody@example.net: Not delivered\n",
+		"Content-Disposition: attachment; filename=headers.txt",
+	} {
+		if !strings.Contains(body.String(), want) {
+			t.Errorf("body does not contain %q:\n%s", want, body.String())
+		}
+	}
+}
+
+func TestOutlookCompat(t *testing.T) {
+	g := dsn.Generator{OutlookCompat: true}
+	var body bytes.Buffer
+	h, err := g.Generate(false, dsn.Envelope{From: "mailer-daemon@example.org", To: "sender@example.org"},
+		dsn.ReportingMTAInfo{ReportingMTA: "mx.example.org"},
+		[]dsn.RecipientInfo{{
+			FinalRecipient: "nobody@example.net",
+			Action:         dsn.ActionFailed,
+			Status:         smtp.EnhancedCode{5, 1, 1},
+		}},
+		textproto.Header{}, &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := dsntest.Message(h, body.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := dsntest.Parse(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(body.String(), "This is a multi-part message in MIME format.\r\n") {
+		t.Error("preamble is missing")
+	}
+
+	want := []struct {
+		mediaType, disposition string
+	}{
+		{"text/plain", "inline"},
+		{"message/delivery-status", "attachment; filename=details.txt"},
+		{"text/rfc822-headers", "attachment; filename=headers.txt"},
+	}
+	if len(parsed.Parts) != len(want) {
+		t.Fatalf("got %d parts, want %d", len(parsed.Parts), len(want))
+	}
+	for i, w := range want {
+		part := parsed.Parts[i]
+		if part.MediaType != w.mediaType {
+			t.Errorf("part %d: media type %q, want %q", i, part.MediaType, w.mediaType)
+		}
+		if got := part.Header.Get("Content-Disposition"); got != w.disposition {
+			t.Errorf("part %d: Content-Disposition %q, want %q", i, got, w.disposition)
+		}
+	}
+
+	// The profile itself is not modified.
+	if dsn.DefaultProfile.StatusFilename != "" {
+		t.Error("DefaultProfile was modified")
+	}
+}
+
+func TestLegacyRFC1894(t *testing.T) {
+	failedHeader := textproto.Header{}
+	failedHeader.Add("Subject", "Grüße")
+
+	g := dsn.Generator{LegacyRFC1894: true, Profile: dsn.ConsumerProfile}
+	var body bytes.Buffer
+	h, err := g.Generate(true, dsn.Envelope{From: "mailer-daemon@example.org", To: "Jörg <sender@example.org>"},
+		dsn.ReportingMTAInfo{ReportingMTA: "mx.example.org"},
+		[]dsn.RecipientInfo{{
+			FinalRecipient: "nobody@example.net",
+			Action:         dsn.ActionFailed,
+			Status:         smtp.EnhancedCode{5, 1, 1},
+			DiagnosticCode: &smtp.SMTPError{Code: 550, EnhancedCode: smtp.EnhancedCode{5, 1, 1}, Message: "Empfänger unbekannt"},
+		}},
+		failedHeader, &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := dsntest.Message(h, body.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, c := range msg {
+		if c >= 0x80 {
+			t.Fatalf("non-ASCII byte at offset %d:\n%s", i, msg)
+		}
+	}
+	for _, unwanted := range []string{"message/global", "utf8;", "text/html", "Content-Transfer-Encoding: 8bit"} {
+		if bytes.Contains(msg, []byte(unwanted)) {
+			t.Errorf("output contains %q", unwanted)
+		}
+	}
+	for _, want := range []string{"To: =?utf-8?q?J=C3=B6rg?= <sender@example.org>", "Subject: Gr??e", "Empf?nger unbekannt", "message/rfc822-headers"} {
+		if !bytes.Contains(msg, []byte(want)) {
+			t.Errorf("output does not contain %q", want)
+		}
+	}
+}
+
+func TestLocalizedDescriptions(t *testing.T) {
+	g := dsn.Generator{Profile: &dsn.Profile{
+		HumanDescription:    "Benachrichtigung",
+		StatusDescription:   "Zustellbericht",
+		ReturnedDescription: "Kopfzeilen der unzustellbaren Nachricht",
+		ReturnedFilename:    "Kopfzeilen-unzustellbar-ä.txt",
+		StatusFilename:      "zustellbericht.txt",
+		Language:            "de",
+	}}
+	var body bytes.Buffer
+	h, err := g.Generate(false, dsn.Envelope{From: "mailer-daemon@example.org", To: "sender@example.org"},
+		dsn.ReportingMTAInfo{ReportingMTA: "mx.example.org"},
+		[]dsn.RecipientInfo{{
+			FinalRecipient: "nobody@example.net",
+			Action:         dsn.ActionFailed,
+			Status:         smtp.EnhancedCode{5, 1, 1},
+		}},
+		textproto.Header{}, &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := dsntest.Message(h, body.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := dsntest.Parse(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := h.Get("Content-Language"); got != "de" {
+		t.Errorf("Content-Language %q, want %q", got, "de")
+	}
+
+	want := []struct {
+		description, disposition, language string
+	}{
+		{"Benachrichtigung", "", "de"},
+		{"Zustellbericht", "attachment; filename=zustellbericht.txt", ""},
+		{"Kopfzeilen der unzustellbaren Nachricht", "attachment; filename*=utf-8''Kopfzeilen-unzustellbar-%C3%A4.txt", ""},
+	}
+	for i, w := range want {
+		part := parsed.Parts[i]
+		if got := part.Header.Get("Content-Description"); got != w.description {
+			t.Errorf("part %d: Content-Description %q, want %q", i, got, w.description)
+		}
+		if got := part.Header.Get("Content-Language"); got != w.language {
+			t.Errorf("part %d: Content-Language %q, want %q", i, got, w.language)
+		}
+		if got := part.Header.Get("Content-Disposition"); got != w.disposition {
+			t.Errorf("part %d: Content-Disposition %q, want %q", i, got, w.disposition)
+		}
+	}
+
+	g.Profile.HumanDescription = "通知"
+	body.Reset()
+	if _, err := g.Generate(false, dsn.Envelope{}, dsn.ReportingMTAInfo{ReportingMTA: "mx.example.org"}, nil, textproto.Header{}, &body); err != nil {
+		t.Fatal(err)
+	}
+	if want := "Content-Description: =?utf-8?q?=E9=80=9A=E7=9F=A5?="; !strings.Contains(body.String(), want) {
+		t.Errorf("body does not contain %q:\n%s", want, body.String())
+	}
+}
+
+func TestDiagnosticType(t *testing.T) {
+	rcpts := []dsn.RecipientInfo{{
+		FinalRecipient: "nobody@example.net",
+		Action:         dsn.ActionFailed,
+		Status:         smtp.EnhancedCode{5, 4, 4},
+		DiagnosticCode: errors.New("lookup of example.net failed:\nno MX – giving up"),
+	}}
+	generate := func(p *dsn.Profile) string {
+		var body bytes.Buffer
+		if _, err := (&dsn.Generator{Profile: p}).Generate(false, dsn.Envelope{}, dsn.ReportingMTAInfo{ReportingMTA: "mx.example.org"}, rcpts, textproto.Header{}, &body); err != nil {
+			t.Fatal(err)
+		}
+		return body.String()
+	}
+
+	if got := generate(nil); strings.Contains(got, "Diagnostic-Code") {
+		t.Errorf("default profile emits a non-SMTP Diagnostic-Code in ASCII mode:\n%s", got)
+	}
+	want := "Diagnostic-Code: X-Postfix; lookup of example.net failed: no MX ? giving up\r\n"
+	if got := generate(dsn.PostfixProfile); !strings.Contains(got, want) {
+		t.Errorf("body does not contain %q:\n%s", want, got)
+	}
+	want = "Diagnostic-Code: X-Legacy; lookup"
+	if got := generate(&dsn.Profile{DiagnosticType: "X-Legacy"}); !strings.Contains(got, want) {
+		t.Errorf("body does not contain %q:\n%s", want, got)
+	}
+}
+
+func TestProfileDefaults(t *testing.T) {
+	g := dsn.Generator{Profile: &dsn.Profile{Subject: "Delivery failure"}}
+	var body bytes.Buffer
+	h, err := g.Generate(false, dsn.Envelope{From: "mailer-daemon@example.org", To: "sender@example.org"},
+		dsn.ReportingMTAInfo{ReportingMTA: "mx.example.org"},
+		[]dsn.RecipientInfo{{
+			FinalRecipient: "rcpt@example.com",
+			Action:         dsn.ActionFailed,
+			Status:         smtp.EnhancedCode{5, 0, 0},
+			DiagnosticCode: errors.New("failed"),
+		}},
+		textproto.Header{}, &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := h.Get("Subject"); got != "Delivery failure" {
+		t.Errorf("Subject = %q", got)
+	}
+	if !strings.Contains(body.String(), "Content-Description: Delivery report") {
+		t.Error("default Content-Description is not used")
+	}
+}
+
+func TestGeneratorMachineOnly(t *testing.T) {
+	for _, p := range []*dsn.Profile{dsn.DefaultProfile, dsn.ConsumerProfile, dsn.QmailProfile} {
+		g := &dsn.Generator{Profile: p, MachineOnly: true}
+		var body bytes.Buffer
+		hdr, err := g.Generate(false, dsn.Envelope{MsgID: "<msgid@example.org>"}, dsn.ReportingMTAInfo{ReportingMTA: "mx.example.org"}, []dsn.RecipientInfo{{
+			FinalRecipient: "a@example.net",
+			Action:         dsn.ActionFailed,
+			Status:         smtp.EnhancedCode{5, 1, 1},
+		}}, textproto.Header{}, &body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ct := hdr.Get("Content-Type"); !strings.HasPrefix(ct, "multipart/report") {
+			t.Errorf("%s: Content-Type = %q", p.Name, ct)
+		}
+		if strings.Contains(body.String(), "text/plain") || strings.Contains(body.String(), "text/html") {
+			t.Errorf("%s: body contains a human-readable part:\n%s", p.Name, body.String())
+		}
+
+		var msg bytes.Buffer
+		textproto.WriteHeader(&msg, hdr)
+		msg.Write(body.Bytes())
+		report, err := dsn.ParseDSN(&msg)
+		if err != nil {
+			t.Fatalf("%s: %v", p.Name, err)
+		}
+		if len(report.Recipients) != 1 {
+			t.Errorf("%s: parsed %d recipients", p.Name, len(report.Recipients))
+		}
+	}
+}
+
+func TestProfileDispositions(t *testing.T) {
+	p := *dsn.ConsumerProfile
+	p.Dispositions = true
+	p.ReturnedFilename = "returned.txt"
+	g := dsn.Generator{Profile: &p}
+	var body bytes.Buffer
+	h, err := g.Generate(false, dsn.Envelope{From: "mailer-daemon@example.org", To: "sender@example.org"},
+		dsn.ReportingMTAInfo{ReportingMTA: "mx.example.org"},
+		[]dsn.RecipientInfo{{
+			FinalRecipient: "nobody@example.net",
+			Action:         dsn.ActionFailed,
+			Status:         smtp.EnhancedCode{5, 1, 1},
+		}},
+		textproto.Header{}, &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := dsntest.Message(h, body.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := dsntest.Parse(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		"inline",
+		"attachment; filename=delivery-status.txt",
+		"attachment; filename=returned.txt",
+	}
+	if len(parsed.Parts) != len(want) {
+		t.Fatalf("got %d parts, want %d", len(parsed.Parts), len(want))
+	}
+	for i, w := range want {
+		if got := parsed.Parts[i].Header.Get("Content-Disposition"); got != w {
+			t.Errorf("part %d: Content-Disposition %q, want %q", i, got, w)
+		}
+	}
+	if strings.HasPrefix(body.String(), "This is a multi-part message") {
+		t.Error("unexpected preamble")
+	}
+}
+
+func TestRecipientMetadata(t *testing.T) {
+	p := *dsn.DefaultProfile
+	p.RecipientText = template.Must(template.New("rcpt").Parse(`{{.FinalRecipient}} (campaign {{index .Metadata "campaign"}})` + "\n"))
+	g := dsn.Generator{Profile: &p}
+	var body bytes.Buffer
+	_, err := g.Generate(false, dsn.Envelope{From: "mailer-daemon@example.org", To: "sender@example.org"},
+		dsn.ReportingMTAInfo{ReportingMTA: "mx.example.org"},
+		[]dsn.RecipientInfo{{
+			FinalRecipient: "nobody@example.net",
+			Action:         dsn.ActionFailed,
+			Status:         smtp.EnhancedCode{5, 1, 1},
+			Metadata:       map[string]string{"campaign": "spring-sale"},
+		}},
+		textproto.Header{}, &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(body.String(), "nobody@example.net (campaign spring-sale)\n") {
+		t.Errorf("metadata not rendered:\n%s", body.String())
+	}
+	if strings.Count(body.String(), "spring-sale") != 1 {
+		t.Errorf("metadata written outside the template:\n%s", body.String())
+	}
+}
+
+func TestProfileSubjects(t *testing.T) {
+	failed := dsn.RecipientInfo{FinalRecipient: "a@example.com", Action: dsn.ActionFailed, Status: smtp.EnhancedCode{5, 1, 1}}
+	delayed := dsn.RecipientInfo{FinalRecipient: "b@example.com", Action: dsn.ActionDelayed, Status: smtp.EnhancedCode{4, 4, 1}}
+	delivered := dsn.RecipientInfo{FinalRecipient: "c@example.com", Action: dsn.ActionDelivered, Status: smtp.EnhancedCode{2, 0, 0}}
+	custom := &dsn.Profile{
+		Subject: "Failed",
+		Subjects: map[dsn.Action]*template.Template{
+			dsn.ActionDelayed: template.Must(template.New("").Parse("{{len .Recipients}} recipient(s) delayed at {{.ReportingMTA}}")),
+		},
+	}
+
+	tests := []struct {
+		profile *dsn.Profile
+		rcpts   []dsn.RecipientInfo
+		want    string
+	}{
+		{nil, []dsn.RecipientInfo{delayed, delivered}, dsn.DefaultDelayedSubject},
+		{nil, []dsn.RecipientInfo{delivered, failed, delayed}, "Undelivered Mail Returned to Sender"},
+		{dsn.PostfixProfile, []dsn.RecipientInfo{delayed}, dsn.DefaultDelayedSubject},
+		{dsn.PostfixProfile, []dsn.RecipientInfo{failed}, "Undelivered Mail Returned to Sender"},
+		{custom, []dsn.RecipientInfo{delayed, delayed}, "2 recipient(s) delayed at mx.example.org"},
+		{custom, []dsn.RecipientInfo{delivered}, "Failed"},
+	}
+	for i, test := range tests {
+		g := dsn.Generator{Profile: test.profile}
+		h, err := g.Generate(false, dsn.Envelope{}, dsn.ReportingMTAInfo{ReportingMTA: "mx.example.org"}, test.rcpts, textproto.Header{}, &bytes.Buffer{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := h.Get("Subject"); got != test.want {
+			t.Errorf("%d: Subject = %q, want %q", i, got, test.want)
+		}
+	}
+}
+
+func TestProfileAutoResponseSuppression(t *testing.T) {
+	rcpts := []dsn.RecipientInfo{{FinalRecipient: "rcpt@example.com", Action: dsn.ActionFailed, Status: smtp.EnhancedCode{5, 1, 1}}}
+	generate := func(p *dsn.Profile) textproto.Header {
+		g := dsn.Generator{Profile: p}
+		h, err := g.Generate(false, dsn.Envelope{}, dsn.ReportingMTAInfo{ReportingMTA: "mx.example.org"}, rcpts, textproto.Header{}, &bytes.Buffer{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return h
+	}
+
+	h := generate(nil)
+	if h.Get("Auto-Submitted") != "auto-generated" || h.Get("Precedence") != "" || h.Get("X-Auto-Response-Suppress") != "" {
+		t.Errorf("default: Auto-Submitted = %q, Precedence = %q, X-Auto-Response-Suppress = %q", h.Get("Auto-Submitted"), h.Get("Precedence"), h.Get("X-Auto-Response-Suppress"))
+	}
+
+	if h := generate(dsn.PostfixProfile); h.Get("Auto-Submitted") != "auto-replied" {
+		t.Errorf("postfix: Auto-Submitted = %q, want auto-replied", h.Get("Auto-Submitted"))
+	}
+
+	h = generate(&dsn.Profile{AutoSubmitted: "auto-generated (failure)", SuppressAutoResponses: true})
+	if h.Get("Auto-Submitted") != "auto-generated (failure)" || h.Get("Precedence") != "bulk" || h.Get("X-Auto-Response-Suppress") != "All" {
+		t.Errorf("suppressed: Auto-Submitted = %q, Precedence = %q, X-Auto-Response-Suppress = %q", h.Get("Auto-Submitted"), h.Get("Precedence"), h.Get("X-Auto-Response-Suppress"))
+	}
+}
+
+func TestProfileTextRecipients(t *testing.T) {
+	p := &dsn.Profile{
+		Text: template.Must(template.New("").Parse(`Report from {{.ReportingMTA}}:
+{{range .Recipients}}{{.FinalRecipient}}: {{.Action}} {{index .Status 0}}.{{index .Status 1}}.{{index .Status 2}}{{with .RemoteMTA}} via {{.}}{{end}}
+{{end}}`)),
+		RecipientText: template.Must(template.New("").Parse("")),
+	}
+	rcpts := []dsn.RecipientInfo{
+		{FinalRecipient: "a@example.com", Action: dsn.ActionFailed, Status: smtp.EnhancedCode{5, 1, 1}, RemoteMTA: "mx.example.com"},
+		{FinalRecipient: "b@example.com", Action: dsn.ActionDelayed, Status: smtp.EnhancedCode{4, 4, 1}},
+	}
+
+	var b bytes.Buffer
+	g := dsn.Generator{Profile: p}
+	if _, err := g.Generate(false, dsn.Envelope{}, dsn.ReportingMTAInfo{ReportingMTA: "mx.example.org"}, rcpts, textproto.Header{}, &b); err != nil {
+		t.Fatal(err)
+	}
+	want := "Report from mx.example.org:\n" +
+		"a@example.com: failed 5.1.1 via mx.example.com\n" +
+		"b@example.com: delayed 4.4.1\n"
+	if !strings.Contains(b.String(), want) {
+		t.Errorf("human-readable part does not contain %q:\n%s", want, b.String())
+	}
+}
@@ -0,0 +1,99 @@
+package dsn
+
+import (
+	"sync"
+	"time"
+)
+
+// SenderQuota limits the number of DSNs triggered by each original sender,
+// or any other key such as a tenant, per time window, to protect shared
+// relays from misbehaving senders. DSNs exceeding the quota can be deferred
+// until the window ends or counted and summarized later.
+//
+// The zero value is not usable, Limit must be set. A SenderQuota is safe for
+// concurrent use.
+type SenderQuota struct {
+	// Limit is the number of DSNs allowed per key and window.
+	Limit int
+	// Window defaults to 1 hour.
+	Window time.Duration
+	// Clock defaults to SystemClock.
+	Clock Clock
+
+	mu        sync.Mutex
+	windows   map[string]*quotaWindow
+	lastPrune time.Time
+}
+
+type quotaWindow struct {
+	start  time.Time
+	used   int
+	denied int
+}
+
+func (q *SenderQuota) window() time.Duration {
+	if q.Window <= 0 {
+		return time.Hour
+	}
+	return q.Window
+}
+
+// Reserve counts a DSN for key and reports whether it is within the quota.
+// If it is not, the DSN is counted as denied and next is the time the
+// current window ends.
+func (q *SenderQuota) Reserve(key string) (ok bool, next time.Time) {
+	now := clockOrDefault(q.Clock).Now()
+	window := q.window()
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.prune(now, window)
+
+	w := q.windows[key]
+	if w == nil {
+		w = &quotaWindow{start: now}
+		q.windows[key] = w
+	} else if !now.Before(w.start.Add(window)) {
+		w.start = now
+		w.used = 0
+	}
+
+	if w.used >= q.Limit {
+		w.denied++
+		return false, w.start.Add(window)
+	}
+	w.used++
+	return true, time.Time{}
+}
+
+// TakeDenied returns the number of DSNs denied for key since the last call,
+// e.g. to send a single summary for them.
+func (q *SenderQuota) TakeDenied(key string) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	w := q.windows[key]
+	if w == nil {
+		return 0
+	}
+	n := w.denied
+	w.denied = 0
+	return n
+}
+
+// prune drops expired windows without denied DSNs, at most once per
+// window.
+func (q *SenderQuota) prune(now time.Time, window time.Duration) {
+	if q.windows == nil {
+		q.windows = make(map[string]*quotaWindow)
+	}
+	if now.Sub(q.lastPrune) < window {
+		return
+	}
+	q.lastPrune = now
+	for key, w := range q.windows {
+		if w.denied == 0 && !now.Before(w.start.Add(window)) {
+			delete(q.windows, key)
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package dsn
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSenderQuota(t *testing.T) {
+	start := time.Date(2020, 4, 14, 10, 0, 0, 0, time.UTC)
+	clock := &stepClock{now: start}
+	q := &SenderQuota{Limit: 2, Window: time.Hour, Clock: clock}
+
+	for i := 0; i < 2; i++ {
+		if ok, _ := q.Reserve("spammer@example.org"); !ok {
+			t.Fatalf("DSN %d denied", i)
+		}
+	}
+	clock.now = start.Add(10 * time.Minute)
+	for i := 0; i < 3; i++ {
+		ok, next := q.Reserve("spammer@example.org")
+		if ok {
+			t.Fatal("DSN over the limit allowed")
+		}
+		if want := start.Add(time.Hour); !next.Equal(want) {
+			t.Errorf("next = %v, want %v", next, want)
+		}
+	}
+	if ok, _ := q.Reserve("other@example.org"); !ok {
+		t.Error("other sender denied")
+	}
+
+	if n := q.TakeDenied("spammer@example.org"); n != 3 {
+		t.Errorf("TakeDenied() = %d, want 3", n)
+	}
+	if n := q.TakeDenied("spammer@example.org"); n != 0 {
+		t.Errorf("second TakeDenied() = %d, want 0", n)
+	}
+
+	clock.now = start.Add(2 * time.Hour)
+	if ok, _ := q.Reserve("spammer@example.org"); !ok {
+		t.Error("DSN denied in the next window")
+	}
+	if _, ok := q.windows["other@example.org"]; ok {
+		t.Error("expired window was not pruned")
+	}
+}
@@ -0,0 +1,59 @@
+package dsn
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+var (
+	profilesMu sync.RWMutex
+	profiles   = map[string]*Profile{}
+)
+
+func init() {
+	for _, p := range []*Profile{DefaultProfile, PostfixProfile, EximProfile, SendmailProfile, QmailProfile, ConsumerProfile, DelayedProfile, DeliveredProfile, RelayedProfile, ExpandedProfile} {
+		if err := RegisterProfile(p); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// RegisterProfile makes p available by its Name to LookupProfile, e.g. so
+// that users can select a vendor profile in their configuration.
+//
+// It returns an error if the name is empty or already registered.
+func RegisterProfile(p *Profile) error {
+	if p == nil || p.Name == "" {
+		return errors.New("dsn: profile name is required")
+	}
+
+	profilesMu.Lock()
+	defer profilesMu.Unlock()
+	if _, ok := profiles[p.Name]; ok {
+		return fmt.Errorf("dsn: profile %q is already registered", p.Name)
+	}
+	profiles[p.Name] = p
+	return nil
+}
+
+// LookupProfile returns the profile registered with name.
+func LookupProfile(name string) (*Profile, bool) {
+	profilesMu.RLock()
+	defer profilesMu.RUnlock()
+	p, ok := profiles[name]
+	return p, ok
+}
+
+// ProfileNames returns the sorted names of all registered profiles.
+func ProfileNames() []string {
+	profilesMu.RLock()
+	defer profilesMu.RUnlock()
+	names := make([]string, 0, len(profiles))
+	for name := range profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
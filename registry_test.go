@@ -0,0 +1,66 @@
+package dsn
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"text/template"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-smtp"
+)
+
+func TestRegisterProfile(t *testing.T) {
+	want := []string{"consumer", "default", "delayed", "delivered", "exim", "expanded", "postfix", "qmail", "relayed", "sendmail"}
+	if got := ProfileNames(); !reflect.DeepEqual(got, want) {
+		t.Errorf("ProfileNames() = %v, want %v", got, want)
+	}
+
+	hdr := textproto.Header{}
+	hdr.Add("X-Vendor-Brand", "ACME Mail")
+	vendor := &Profile{
+		Name:    "acme",
+		Subject: "ACME: delivery failed",
+		Header:  hdr,
+		Text:    template.Must(template.New("acme").Parse("ACME Mail at {{.ReportingMTA}}\n")),
+	}
+	if err := RegisterProfile(vendor); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		profilesMu.Lock()
+		delete(profiles, "acme")
+		profilesMu.Unlock()
+	}()
+	if err := RegisterProfile(vendor); err == nil {
+		t.Error("RegisterProfile() registered a duplicate name")
+	}
+	if err := RegisterProfile(&Profile{}); err == nil {
+		t.Error("RegisterProfile() registered an empty name")
+	}
+
+	p, ok := LookupProfile("acme")
+	if !ok || p != vendor {
+		t.Fatalf("LookupProfile() = %v, %v", p, ok)
+	}
+	if _, ok := LookupProfile("nonexistent"); ok {
+		t.Error("LookupProfile() found a nonexistent profile")
+	}
+
+	var body bytes.Buffer
+	h, err := (&Generator{Profile: p}).Generate(false, Envelope{}, ReportingMTAInfo{ReportingMTA: "mx.example.org"},
+		[]RecipientInfo{{FinalRecipient: "nobody@example.net", Action: ActionFailed, Status: smtp.EnhancedCode{5, 1, 1}}},
+		textproto.Header{}, &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := h.Get("X-Vendor-Brand"); got != "ACME Mail" {
+		t.Errorf("X-Vendor-Brand = %q", got)
+	}
+	if got := h.Get("Subject"); got != "ACME: delivery failed" {
+		t.Errorf("Subject = %q", got)
+	}
+	if !bytes.Contains(body.Bytes(), []byte("ACME Mail at mx.example.org\n")) {
+		t.Errorf("body does not contain the profile text:\n%s", body.String())
+	}
+}
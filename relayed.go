@@ -0,0 +1,45 @@
+package dsn
+
+import (
+	"errors"
+	"io"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-smtp"
+)
+
+// GenerateRelayedDSN generates a DSN reporting that the message was relayed
+// at relayedAt to rcptsInfo through a gateway or MTA that does not support
+// DSNs, so no further notifications will follow (RFC 3464 section 2.3.3),
+// with RelayedProfile.
+//
+// RemoteMTA must be set to the host the message was relayed to for all
+// recipients. Action is set to ActionRelayed and Status to 2.0.0 unless it
+// already is a 2.x.x code. mtaInfo.LastAttemptDate is set to relayedAt
+// unless it is already set.
+func GenerateRelayedDSN(utf8 bool, envelope Envelope, mtaInfo ReportingMTAInfo, rcptsInfo []RecipientInfo, relayedAt time.Time, failedHeader textproto.Header, outWriter io.Writer) (textproto.Header, error) {
+	return (&Generator{}).GenerateRelayedDSN(utf8, envelope, mtaInfo, rcptsInfo, relayedAt, failedHeader, outWriter)
+}
+
+// GenerateRelayedDSN is like the GenerateRelayedDSN function but uses the
+// configuration of g. g.Profile is used instead of RelayedProfile if it is
+// set.
+func (g *Generator) GenerateRelayedDSN(utf8 bool, envelope Envelope, mtaInfo ReportingMTAInfo, rcptsInfo []RecipientInfo, relayedAt time.Time, failedHeader textproto.Header, outWriter io.Writer) (textproto.Header, error) {
+	relayed := make([]RecipientInfo, len(rcptsInfo))
+	for i, rcpt := range rcptsInfo {
+		if rcpt.RemoteMTA == "" {
+			return textproto.Header{}, errors.New("dsn: Remote-MTA is required for relayed recipients")
+		}
+		rcpt.Action = ActionRelayed
+		if rcpt.Status[0] != 2 {
+			rcpt.Status = smtp.EnhancedCode{2, 0, 0}
+		}
+		relayed[i] = rcpt
+	}
+	if mtaInfo.LastAttemptDate.IsZero() {
+		mtaInfo.LastAttemptDate = relayedAt
+	}
+
+	return g.withDefaultProfile(RelayedProfile).Generate(utf8, envelope, mtaInfo, relayed, failedHeader, outWriter)
+}
@@ -0,0 +1,44 @@
+package dsn_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	dsn "schneider.vip/go-dsn"
+)
+
+func TestGenerateRelayedDSN(t *testing.T) {
+	relayedAt := time.Date(2020, 4, 14, 10, 0, 0, 0, time.UTC)
+
+	var body bytes.Buffer
+	hdr, err := dsn.GenerateRelayedDSN(false, dsn.Envelope{MsgID: "<relayed@example.org>"}, dsn.ReportingMTAInfo{ReportingMTA: "mx.example.org"}, []dsn.RecipientInfo{
+		{FinalRecipient: "a@example.net", RemoteMTA: "gw.example.net"},
+	}, relayedAt, textproto.Header{}, &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := hdr.Get("Subject"); got != dsn.RelayedProfile.Subject {
+		t.Errorf("Subject = %q", got)
+	}
+	for _, want := range []string{
+		"does not support delivery status\nnotifications",
+		"Relayed to a@example.net via gw.example.net\n",
+		"Action: relayed\r\n",
+		"Status: 2.0.0\r\n",
+		"Remote-Mta: dns; gw.example.net\r\n",
+	} {
+		if !strings.Contains(body.String(), want) {
+			t.Errorf("body does not contain %q:\n%s", want, body.String())
+		}
+	}
+
+	_, err = dsn.GenerateRelayedDSN(false, dsn.Envelope{}, dsn.ReportingMTAInfo{ReportingMTA: "mx.example.org"}, []dsn.RecipientInfo{
+		{FinalRecipient: "a@example.net"},
+	}, relayedAt, textproto.Header{}, &body)
+	if err == nil {
+		t.Error("GenerateRelayedDSN() succeeded without Remote-MTA")
+	}
+}
@@ -0,0 +1,232 @@
+package dsn
+
+import (
+	"encoding/binary"
+	"io"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+// Backoff computes exponentially growing retry intervals with jitter. The
+// zero value uses the defaults documented on the fields.
+type Backoff struct {
+	// Initial is the delay after the first attempt, 5 minutes by default.
+	Initial time.Duration
+	// Max caps the delay, 4 hours by default.
+	Max time.Duration
+	// Factor the delay is multiplied with after each attempt, 2 by default.
+	Factor float64
+	// Jitter is the fraction of the delay that is randomized, e.g. 0.2
+	// means ±10%. 0.2 by default, a negative value disables it.
+	Jitter float64
+	// Rand is the source of the jitter, like Generator.Rand, so that a
+	// single seeded reader can drive both in tests. It defaults to
+	// crypto/rand.Reader. If it fails, the jitter is left out.
+	Rand io.Reader
+}
+
+// Delay returns the delay after the given attempt, counting from 1.
+func (b Backoff) Delay(attempt int) time.Duration {
+	initial, max, factor, jitter := b.Initial, b.Max, b.Factor, b.Jitter
+	if initial <= 0 {
+		initial = 5 * time.Minute
+	}
+	if max <= 0 {
+		max = 4 * time.Hour
+	}
+	if factor < 1 {
+		factor = 2
+	}
+	if jitter == 0 {
+		jitter = 0.2
+	}
+	if attempt < 1 {
+		attempt = 1
+	}
+
+	d := float64(initial) * math.Pow(factor, float64(attempt-1))
+	if d > float64(max) {
+		d = float64(max)
+	}
+	if jitter > 0 {
+		if f, err := randomFloat(b.Rand); err == nil {
+			d += d * jitter * (f - 0.5)
+		}
+	}
+	return time.Duration(d)
+}
+
+// randomFloat reads a number in [0, 1) from r, see randOrDefault.
+func randomFloat(r io.Reader) (float64, error) {
+	var b [8]byte
+	if _, err := io.ReadFull(randOrDefault(r), b[:]); err != nil {
+		return 0, err
+	}
+	return float64(binary.BigEndian.Uint64(b[:])>>11) / (1 << 53), nil
+}
+
+// Decision is the outcome of a delivery attempt as decided by Scheduler.
+type Decision int
+
+const (
+	// DecisionRetry means the recipient should be retried at NextAttempt.
+	DecisionRetry Decision = iota
+	// DecisionWarn is like DecisionRetry, but a delayed DSN should be sent.
+	DecisionWarn
+	// DecisionFail means delivery was given up and a failed DSN should be
+	// sent.
+	DecisionFail
+	// DecisionDelivered means the recipient was delivered.
+	DecisionDelivered
+)
+
+// RetryState is the delivery state of a single recipient. It is updated by
+// Scheduler.Record and persisted by the caller between attempts.
+type RetryState struct {
+	Recipient string
+	// Class is the sender class of the message, e.g. "transactional" or
+	// "bulk", as used by RetryPolicy. It is optional.
+	Class string
+	// Metadata is copied to the RecipientInfo of the DSNs of Workflow.
+	Metadata map[string]string
+
+	FirstAttempt time.Time
+	LastAttempt  time.Time
+	NextAttempt  time.Time
+	Attempts     int
+
+	// LastError is the error of the last attempt.
+	LastError error
+
+	// Warned is set once a delayed DSN was requested.
+	Warned bool
+	// Done is set once delivery succeeded or was given up.
+	Done bool
+}
+
+// Scheduler decides when recipients are retried and when a delayed or a
+// failed DSN is due. The zero value is ready to use.
+type Scheduler struct {
+	Backoff Backoff
+
+	// WarnAfter is the time after the first attempt after which a delayed
+	// DSN is sent, 4 hours by default. A negative value disables warnings.
+	WarnAfter time.Duration
+	// Lifetime is the time after the first attempt after which delivery is
+	// given up, 5 days by default.
+	Lifetime time.Duration
+
+	// Policy, if set, overrides WarnAfter and Lifetime per recipient.
+	Policy RetryPolicy
+
+	// Clock defaults to SystemClock.
+	Clock Clock
+}
+
+// Thresholds are the warning and expiry times of a recipient. Zero fields
+// fall back to the Scheduler fields.
+type Thresholds struct {
+	WarnAfter time.Duration
+	Lifetime  time.Duration
+}
+
+// RetryPolicy returns the thresholds of a recipient, e.g. depending on its
+// domain or the sender class.
+type RetryPolicy interface {
+	Thresholds(st *RetryState) Thresholds
+}
+
+// StaticPolicy is a RetryPolicy using fixed thresholds per recipient domain
+// and per sender class. Domain thresholds take precedence over class
+// thresholds, field by field.
+type StaticPolicy struct {
+	// Domains maps lower-case recipient domains to thresholds.
+	Domains map[string]Thresholds
+	// Classes maps RetryState.Class to thresholds.
+	Classes map[string]Thresholds
+}
+
+// Thresholds implements RetryPolicy.
+func (p StaticPolicy) Thresholds(st *RetryState) Thresholds {
+	t := p.Classes[st.Class]
+	if i := strings.LastIndexByte(st.Recipient, '@'); i >= 0 {
+		d := p.Domains[strings.ToLower(st.Recipient[i+1:])]
+		if d.WarnAfter != 0 {
+			t.WarnAfter = d.WarnAfter
+		}
+		if d.Lifetime != 0 {
+			t.Lifetime = d.Lifetime
+		}
+	}
+	return t
+}
+
+// thresholds returns the thresholds of st with the defaults applied.
+func (s *Scheduler) thresholds(st *RetryState) Thresholds {
+	var t Thresholds
+	if s.Policy != nil {
+		t = s.Policy.Thresholds(st)
+	}
+	if t.WarnAfter == 0 {
+		t.WarnAfter = s.WarnAfter
+	}
+	if t.WarnAfter == 0 {
+		t.WarnAfter = 4 * time.Hour
+	}
+	if t.Lifetime <= 0 {
+		t.Lifetime = s.Lifetime
+	}
+	if t.Lifetime <= 0 {
+		t.Lifetime = 5 * 24 * time.Hour
+	}
+	return t
+}
+
+// RetryUntil returns the time delivery to the recipient of st is given up,
+// as used for the Will-Retry-Until field.
+func (s *Scheduler) RetryUntil(st *RetryState) time.Time {
+	return st.FirstAttempt.Add(s.thresholds(st).Lifetime)
+}
+
+// Record updates st with the result of a delivery attempt, err is nil if
+// the attempt succeeded. SMTP errors with a 5xx code are permanent and fail
+// the recipient at once.
+func (s *Scheduler) Record(st *RetryState, err error) Decision {
+	now := clockOrDefault(s.Clock).Now()
+	if st.FirstAttempt.IsZero() {
+		st.FirstAttempt = now
+	}
+	st.Attempts++
+	st.LastAttempt = now
+	st.LastError = err
+
+	if err == nil {
+		st.Done = true
+		return DecisionDelivered
+	}
+	if isPermanent(err) || !now.Before(s.RetryUntil(st)) {
+		st.Done = true
+		return DecisionFail
+	}
+
+	st.NextAttempt = now.Add(s.Backoff.Delay(st.Attempts))
+	if until := s.RetryUntil(st); st.NextAttempt.After(until) {
+		// Make a last attempt when the lifetime expires.
+		st.NextAttempt = until
+	}
+
+	if warnAfter := s.thresholds(st).WarnAfter; !st.Warned && warnAfter > 0 && now.Sub(st.FirstAttempt) >= warnAfter {
+		st.Warned = true
+		return DecisionWarn
+	}
+	return DecisionRetry
+}
+
+// isPermanent reports whether err is an SMTP error with a 5xx code.
+func isPermanent(err error) bool {
+	smtpErr, ok := err.(*smtp.SMTPError)
+	return ok && smtpErr.Code >= 500
+}
@@ -0,0 +1,126 @@
+package dsn
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+func TestBackoff(t *testing.T) {
+	b := Backoff{Initial: time.Minute, Max: 10 * time.Minute, Jitter: -1}
+	for attempt, want := range []time.Duration{time.Minute, time.Minute, 2 * time.Minute, 4 * time.Minute, 8 * time.Minute, 10 * time.Minute, 10 * time.Minute} {
+		if got := b.Delay(attempt); got != want {
+			t.Errorf("Delay(%d) = %v, want %v", attempt, got, want)
+		}
+	}
+
+	b.Jitter = 0.5
+	b.Rand = bytes.NewReader(make([]byte, 8))
+	if got, want := b.Delay(1), 45*time.Second; got != want {
+		t.Errorf("Delay(1) with jitter = %v, want %v", got, want)
+	}
+	// The reader is exhausted, the jitter is left out.
+	if got, want := b.Delay(1), time.Minute; got != want {
+		t.Errorf("Delay(1) with failing Rand = %v, want %v", got, want)
+	}
+}
+
+type stepClock struct{ now time.Time }
+
+func (c *stepClock) Now() time.Time { return c.now }
+
+func TestScheduler(t *testing.T) {
+	start := time.Date(2020, 4, 14, 10, 0, 0, 0, time.UTC)
+	clock := &stepClock{now: start}
+	s := &Scheduler{
+		Backoff:   Backoff{Initial: time.Hour, Max: time.Hour, Jitter: -1},
+		WarnAfter: 3 * time.Hour,
+		Lifetime:  6 * time.Hour,
+		Clock:     clock,
+	}
+	tempErr := &smtp.SMTPError{Code: 451, EnhancedCode: smtp.EnhancedCode{4, 4, 1}, Message: "Try again later"}
+
+	st := &RetryState{Recipient: "rcpt@example.com"}
+	var decisions []Decision
+	for !st.Done {
+		decisions = append(decisions, s.Record(st, tempErr))
+		if st.Done {
+			break
+		}
+		if !st.NextAttempt.After(clock.now) {
+			t.Fatalf("NextAttempt %v is not after %v", st.NextAttempt, clock.now)
+		}
+		clock.now = st.NextAttempt
+	}
+	want := []Decision{DecisionRetry, DecisionRetry, DecisionRetry, DecisionWarn, DecisionRetry, DecisionRetry, DecisionFail}
+	if len(decisions) != len(want) {
+		t.Fatalf("decisions %v, want %v", decisions, want)
+	}
+	for i := range want {
+		if decisions[i] != want[i] {
+			t.Errorf("decisions %v, want %v", decisions, want)
+			break
+		}
+	}
+	if got, want := s.RetryUntil(st), start.Add(6*time.Hour); !got.Equal(want) {
+		t.Errorf("RetryUntil() = %v, want %v", got, want)
+	}
+
+	st = &RetryState{}
+	if d := s.Record(st, &smtp.SMTPError{Code: 550, Message: "No such user"}); d != DecisionFail || !st.Done {
+		t.Errorf("permanent error: decision %v, done %v", d, st.Done)
+	}
+	st = &RetryState{}
+	if d := s.Record(st, errors.New("connection refused")); d != DecisionRetry {
+		t.Errorf("network error: decision %v", d)
+	}
+	if d := s.Record(st, nil); d != DecisionDelivered || !st.Done {
+		t.Errorf("success: decision %v, done %v", d, st.Done)
+	}
+}
+
+func TestSchedulerPolicy(t *testing.T) {
+	start := time.Date(2020, 4, 14, 10, 0, 0, 0, time.UTC)
+	s := &Scheduler{
+		WarnAfter: time.Hour,
+		Lifetime:  24 * time.Hour,
+		Policy: StaticPolicy{
+			Domains: map[string]Thresholds{
+				"slow.example": {Lifetime: 72 * time.Hour},
+			},
+			Classes: map[string]Thresholds{
+				"bulk":          {WarnAfter: -1, Lifetime: 12 * time.Hour},
+				"transactional": {WarnAfter: 15 * time.Minute},
+			},
+		},
+		Clock: &stepClock{now: start},
+	}
+
+	tests := []struct {
+		rcpt, class string
+		want        Thresholds
+	}{
+		{"a@example.com", "", Thresholds{time.Hour, 24 * time.Hour}},
+		{"a@Slow.Example", "", Thresholds{time.Hour, 72 * time.Hour}},
+		{"a@example.com", "bulk", Thresholds{-1, 12 * time.Hour}},
+		{"a@slow.example", "bulk", Thresholds{-1, 72 * time.Hour}},
+		{"a@example.com", "transactional", Thresholds{15 * time.Minute, 24 * time.Hour}},
+	}
+	for _, tt := range tests {
+		st := &RetryState{Recipient: tt.rcpt, Class: tt.class, FirstAttempt: start}
+		if got := s.thresholds(st); got != tt.want {
+			t.Errorf("thresholds(%q, %q) = %v, want %v", tt.rcpt, tt.class, got, tt.want)
+		}
+		if got, want := s.RetryUntil(st), start.Add(tt.want.Lifetime); !got.Equal(want) {
+			t.Errorf("RetryUntil(%q, %q) = %v, want %v", tt.rcpt, tt.class, got, want)
+		}
+	}
+
+	st := &RetryState{Recipient: "a@example.com", Class: "bulk", FirstAttempt: start.Add(-2 * time.Hour)}
+	if d := s.Record(st, errors.New("timeout")); d != DecisionRetry {
+		t.Errorf("bulk recipient: decision %v, want no warning", d)
+	}
+}
@@ -0,0 +1,104 @@
+package dsn
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/emersion/go-message/textproto"
+)
+
+// ReturnPolicy selects the content of the failed message returned in a DSN.
+type ReturnPolicy int
+
+const (
+	// ReturnDefault returns what was passed: the header to Generate and
+	// GenerateRawHeader, the complete message to GenerateFull.
+	ReturnDefault ReturnPolicy = iota
+	// ReturnNone leaves out the returned content part.
+	ReturnNone
+	// ReturnHeaders only returns the header, RET=HDRS. GenerateFull reads
+	// the header from the message.
+	ReturnHeaders
+	// ReturnFull returns the complete message, RET=FULL. It is the same as
+	// ReturnDefault, Generate can only return the header.
+	ReturnFull
+)
+
+// ParseReturnPolicy parses the value of the RET parameter of RFC 3461,
+// "FULL" or "HDRS". The empty value yields ReturnDefault.
+func ParseReturnPolicy(ret string) (ReturnPolicy, error) {
+	switch strings.ToUpper(ret) {
+	case "":
+		return ReturnDefault, nil
+	case "FULL":
+		return ReturnFull, nil
+	case "HDRS":
+		return ReturnHeaders, nil
+	}
+	return ReturnDefault, fmt.Errorf("dsn: unknown RET value %q", ret)
+}
+
+// returnedContent writes the returned part of the failed message.
+type returnedContent func(w io.Writer) error
+
+func headerContent(h textproto.Header) returnedContent {
+	return func(w io.Writer) error {
+		return textproto.WriteHeader(w, h)
+	}
+}
+
+func rawHeaderContent(b []byte) returnedContent {
+	return func(w io.Writer) error {
+		_, err := io.Copy(w, bytes.NewReader(b))
+		return err
+	}
+}
+
+func messageContent(r io.Reader) returnedContent {
+	return func(w io.Writer) error {
+		_, err := io.Copy(w, r)
+		return err
+	}
+}
+
+// maxRawLineLength is the line length limit of RFC 5322 without CRLF.
+const maxRawLineLength = 998
+
+// checkRawHeader checks that b starts with a header and returns its length
+// including the empty line ending it. b must end with the empty line if it
+// only contains the header.
+func checkRawHeader(b []byte) (int, error) {
+	n := 0
+	for n < len(b) {
+		i := bytes.IndexByte(b[n:], '\n')
+		if i == -1 {
+			return 0, errors.New("dsn: raw header is not terminated by an empty line")
+		}
+		line := b[n : n+i+1]
+		if len(line) < 2 || line[len(line)-2] != '\r' {
+			return 0, errors.New("dsn: raw header must use CRLF line endings")
+		}
+		if len(line)-2 > maxRawLineLength {
+			return 0, errors.New("dsn: raw header line too long")
+		}
+		n += len(line)
+
+		switch {
+		case len(line) == 2:
+			return n, nil
+		case line[0] == ' ' || line[0] == '\t':
+			if n == len(line) {
+				return 0, errors.New("dsn: raw header starts with a continuation line")
+			}
+		default:
+			colon := bytes.IndexByte(line, ':')
+			if colon <= 0 || !validFieldKey(string(line[:colon])) {
+				return 0, errors.New("dsn: malformed raw header field")
+			}
+		}
+	}
+	return 0, errors.New("dsn: raw header is not terminated by an empty line")
+}
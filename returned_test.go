@@ -0,0 +1,203 @@
+package dsn
+
+import (
+	"bytes"
+	"math/rand"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-smtp"
+)
+
+func TestGenerateRawHeader(t *testing.T) {
+	failedHeader := textproto.Header{}
+	failedHeader.Add("Subject", "test")
+	failedHeader.Add("Received", "from a.example.org by b.example.org with ESMTP id 8B2E41A0311 for <rcpt@example.com>; Tue, 14 Apr 2020 10:21:06 +0200")
+	failedHeader.Add("From", "sender@example.org")
+	var raw bytes.Buffer
+	if err := textproto.WriteHeader(&raw, failedHeader); err != nil {
+		t.Fatal(err)
+	}
+
+	generate := func(rawHeader []byte) ([]byte, error) {
+		g := &Generator{
+			Clock: FixedClock(time.Date(2020, 4, 14, 10, 21, 7, 0, time.UTC)),
+			Rand:  rand.New(rand.NewSource(1)),
+		}
+		mtaInfo := ReportingMTAInfo{ReportingMTA: "mx.example.org"}
+		rcpts := []RecipientInfo{{FinalRecipient: "rcpt@example.com", Action: ActionFailed, Status: smtp.EnhancedCode{5, 1, 1}}}
+		var out bytes.Buffer
+		var err error
+		if rawHeader == nil {
+			_, err = g.Generate(false, Envelope{}, mtaInfo, rcpts, failedHeader, &out)
+		} else {
+			_, err = g.GenerateRawHeader(false, Envelope{}, mtaInfo, rcpts, rawHeader, &out)
+		}
+		return out.Bytes(), err
+	}
+
+	want, err := generate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The body of the failed message is left out.
+	got, err := generate(append(raw.Bytes(), "body\r\n"...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("GenerateRawHeader() output\n%s\nwant\n%s", got, want)
+	}
+
+	for _, invalid := range []string{
+		"Subject: test\r\n",
+		"Subject: test\n\n",
+		" folded: test\r\n\r\n",
+		"no colon\r\n\r\n",
+		"Subject: " + string(bytes.Repeat([]byte("x"), 1000)) + "\r\n\r\n",
+	} {
+		if _, err := generate([]byte(invalid)); err == nil {
+			t.Errorf("GenerateRawHeader(%q) succeeded", invalid)
+		}
+	}
+}
+
+func TestGenerateFull(t *testing.T) {
+	original := "Subject: test\r\nFrom: sender@example.org\r\n\r\nHello,\r\nthe complete message.\r\n"
+	rcpts := []RecipientInfo{{FinalRecipient: "rcpt@example.com", Action: ActionFailed, Status: smtp.EnhancedCode{5, 1, 1}}}
+
+	for _, test := range []struct {
+		utf8      bool
+		mediaType string
+	}{
+		{false, "message/rfc822"},
+		{true, "message/global"},
+	} {
+		var body bytes.Buffer
+		h, err := GenerateFullDSN(test.utf8, Envelope{}, ReportingMTAInfo{ReportingMTA: "mx.example.org"}, rcpts, strings.NewReader(original), &body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, want := range []string{
+			"Content-Type: " + test.mediaType + "\r\n",
+			"Content-Description: Undelivered message\r\n\r\n" + original,
+		} {
+			if !strings.Contains(body.String(), want) {
+				t.Errorf("body does not contain %q:\n%s", want, body.String())
+			}
+		}
+
+		var msg bytes.Buffer
+		if err := textproto.WriteHeader(&msg, h); err != nil {
+			t.Fatal(err)
+		}
+		msg.Write(body.Bytes())
+		rep, err := ParseDSN(&msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := rep.FailedHeader.Get("Subject"); got != "test" {
+			t.Errorf("returned Subject = %q", got)
+		}
+	}
+}
+
+func TestGenerateFullMaxReturnSize(t *testing.T) {
+	original := "Subject: test\r\n\r\n" + strings.Repeat("large body\r\n", 100)
+	rcpts := []RecipientInfo{{FinalRecipient: "rcpt@example.com", Action: ActionFailed, Status: smtp.EnhancedCode{5, 1, 1}}}
+
+	g := Generator{MaxReturnSize: 512}
+	var body bytes.Buffer
+	if _, err := g.GenerateFull(false, Envelope{}, ReportingMTAInfo{ReportingMTA: "mx.example.org"}, rcpts, strings.NewReader(original), &body); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"The message is larger than 512 bytes, only its header is returned.\n",
+		"Content-Type: message/rfc822-headers\r\n",
+		"Subject: test\r\n",
+	} {
+		if !strings.Contains(body.String(), want) {
+			t.Errorf("body does not contain %q:\n%s", want, body.String())
+		}
+	}
+	if strings.Contains(body.String(), "large body") {
+		t.Error("body contains the returned message body")
+	}
+
+	g.MaxReturnSize = int64(len(original))
+	body.Reset()
+	if _, err := g.GenerateFull(false, Envelope{}, ReportingMTAInfo{ReportingMTA: "mx.example.org"}, rcpts, strings.NewReader(original), &body); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(body.String(), original) || strings.Contains(body.String(), "only its header") {
+		t.Errorf("message within the limit not returned:\n%s", body.String())
+	}
+}
+
+func TestReturnPolicy(t *testing.T) {
+	original := "Subject: test\r\n\r\nbody text\r\n"
+	rcpts := []RecipientInfo{{FinalRecipient: "rcpt@example.com", Action: ActionFailed, Status: smtp.EnhancedCode{5, 1, 1}}}
+	failedHeader := textproto.Header{}
+	failedHeader.Add("Subject", "test")
+
+	generate := func(g *Generator, full bool) string {
+		var body bytes.Buffer
+		var err error
+		if full {
+			_, err = g.GenerateFull(false, Envelope{}, ReportingMTAInfo{ReportingMTA: "mx.example.org"}, rcpts, strings.NewReader(original), &body)
+		} else {
+			_, err = g.Generate(false, Envelope{}, ReportingMTAInfo{ReportingMTA: "mx.example.org"}, rcpts, failedHeader, &body)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		return body.String()
+	}
+
+	for _, full := range []bool{false, true} {
+		body := generate(&Generator{Return: ReturnNone}, full)
+		if strings.Contains(body, "Subject: test") || strings.Contains(body, "message/rfc822") {
+			t.Errorf("full=%v: returned content with ReturnNone:\n%s", full, body)
+		}
+	}
+	body := generate(&Generator{Return: ReturnNone, Profile: QmailProfile}, false)
+	if strings.Contains(body, "Below this line") {
+		t.Errorf("QSBMF returned content with ReturnNone:\n%s", body)
+	}
+
+	body = generate(&Generator{Return: ReturnHeaders}, true)
+	if !strings.Contains(body, "Content-Type: message/rfc822-headers\r\n") || strings.Contains(body, "body text") {
+		t.Errorf("GenerateFull with ReturnHeaders:\n%s", body)
+	}
+
+	for ret, want := range map[string]ReturnPolicy{"": ReturnDefault, "FULL": ReturnFull, "hdrs": ReturnHeaders} {
+		if got, err := ParseReturnPolicy(ret); err != nil || got != want {
+			t.Errorf("ParseReturnPolicy(%q) = %v, %v", ret, got, err)
+		}
+	}
+	if _, err := ParseReturnPolicy("NONE"); err == nil {
+		t.Error("ParseReturnPolicy(NONE) succeeded")
+	}
+}
+
+func TestGenerateFullTransferEncoding(t *testing.T) {
+	original := "Subject: =?utf-8?q?Gr=C3=BC=C3=9Fe?=\r\nTo: jörg@example.com\r\n\r\nGrüße\r\n"
+	rcpts := []RecipientInfo{{FinalRecipient: "jörg@example.com", Action: ActionFailed, Status: smtp.EnhancedCode{5, 1, 1}}}
+
+	for _, g := range []*Generator{{}, {Profile: &Profile{OmitTransferEncoding: true}}} {
+		var body bytes.Buffer
+		if _, err := g.GenerateFull(true, Envelope{}, ReportingMTAInfo{ReportingMTA: "mx.example.org"}, rcpts, strings.NewReader(original), &body); err != nil {
+			t.Fatal(err)
+		}
+		for _, want := range []string{
+			"Content-Transfer-Encoding: 8bit\r\nContent-Type: message/global\r\n",
+			original,
+		} {
+			if !strings.Contains(body.String(), want) {
+				t.Errorf("body does not contain %q:\n%s", want, body.String())
+			}
+		}
+	}
+}
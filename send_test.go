@@ -0,0 +1,150 @@
+package dsn_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-smtp"
+	dsn "schneider.vip/go-dsn"
+	"schneider.vip/go-dsn/dsntest"
+)
+
+func TestSendDSN(t *testing.T) {
+	type args struct {
+		utf8         bool
+		envelope     dsn.Envelope
+		mtaInfo      dsn.ReportingMTAInfo
+		rcptsInfo    []dsn.RecipientInfo
+		failedHeader textproto.Header
+	}
+	tests := []struct {
+		name       string
+		args       args
+		rejectRcpt map[string]error
+		wantErr    bool
+		// wantConns is the number of connections expected on error.
+		wantConns int
+	}{
+		{
+			name: "t",
+			args: args{
+				utf8: false,
+				envelope: dsn.Envelope{
+					MsgID: "<msgid1@example.com>",
+					From:  "from@example.com",
+					To:    "to@example.com",
+				},
+				mtaInfo: dsn.ReportingMTAInfo{
+					ReportingMTA:    "reportingmta.example.com",
+					ReceivedFromMTA: "receivedmta.example.com",
+					XSender:         "XSender@example.com",
+					XMessageID:      "XMessageID@example.com",
+					ArrivalDate:     time.Date(2020, 01, 02, 15, 04, 05, 06, time.UTC),
+					LastAttemptDate: time.Date(2020, 01, 02, 15, 04, 05, 07, time.UTC),
+				},
+				rcptsInfo: []dsn.RecipientInfo{{
+					FinalRecipient: "test@example.com",
+					RemoteMTA:      "remotemta.example.com",
+					Action:         dsn.ActionFailed,
+					Status:         smtp.EnhancedCode{5, 0, 0},
+					DiagnosticCode: nil,
+				}},
+				failedHeader: textproto.Header{},
+			},
+			wantErr: false,
+		},
+		{
+			name: "rejected recipient",
+			args: args{
+				envelope: dsn.Envelope{MsgID: "<msgid2@example.com>", To: "sender@example.com"},
+				mtaInfo:  dsn.ReportingMTAInfo{ReportingMTA: "reportingmta.example.com"},
+				rcptsInfo: []dsn.RecipientInfo{{
+					FinalRecipient: "unknown@example.com",
+					Action:         dsn.ActionFailed,
+					Status:         smtp.EnhancedCode{5, 0, 0},
+				}},
+			},
+			rejectRcpt: map[string]error{
+				"unknown@example.com": &smtp.SMTPError{
+					Code:         550,
+					EnhancedCode: smtp.EnhancedCode{5, 1, 1},
+					Message:      "No such user",
+				},
+			},
+			wantErr:   true,
+			wantConns: 1,
+		},
+		{
+			name: "invalid recipient info",
+			args: args{
+				envelope: dsn.Envelope{MsgID: "<msgid3@example.com>", To: "sender@example.com"},
+				mtaInfo:  dsn.ReportingMTAInfo{ReportingMTA: "reportingmta.example.com"},
+				rcptsInfo: []dsn.RecipientInfo{{
+					FinalRecipient: "nostatus@example.com",
+					Action:         dsn.ActionFailed,
+				}},
+			},
+			wantErr:   true,
+			wantConns: 0,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := &dsntest.Server{RejectRcpt: tt.rejectRcpt}
+			if err := srv.Start(); err != nil {
+				t.Fatal(err)
+			}
+			defer srv.Close()
+
+			if err := dsn.SendDSN(srv.Addr, tt.args.utf8, tt.args.envelope, tt.args.mtaInfo, tt.args.rcptsInfo, tt.args.failedHeader); (err != nil) != tt.wantErr {
+				t.Errorf("SendDSN() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				if got := srv.Connections(); got != tt.wantConns {
+					t.Errorf("server accepted %d connections, want %d", got, tt.wantConns)
+				}
+				return
+			}
+
+			msgs := srv.Transactions()
+			if len(msgs) != 1 {
+				t.Fatalf("server received %d messages, want 1", len(msgs))
+			}
+			if msgs[0].From != "" {
+				t.Errorf("reverse-path is %q, want null", msgs[0].From)
+			}
+			if !strings.Contains(string(msgs[0].Data), "Message-Id: "+tt.args.envelope.MsgID) {
+				t.Errorf("message does not contain the Message-Id:\n%s", msgs[0].Data)
+			}
+		})
+	}
+}
+
+func TestSendDSNError(t *testing.T) {
+	srv := &dsntest.Server{RejectRcpt: map[string]error{
+		"unknown@example.com": &smtp.SMTPError{
+			Code:         550,
+			EnhancedCode: smtp.EnhancedCode{5, 1, 1},
+			Message:      "No such user",
+		},
+	}}
+	if err := srv.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	err := dsn.SendDSN(srv.Addr, false, dsn.Envelope{MsgID: "<msgid@example.com>", To: "sender@example.com"}, dsn.ReportingMTAInfo{ReportingMTA: "reportingmta.example.com"}, []dsn.RecipientInfo{{
+		FinalRecipient: "unknown@example.com",
+		Action:         dsn.ActionFailed,
+		Status:         smtp.EnhancedCode{5, 0, 0},
+	}}, textproto.Header{})
+	smtpErr, ok := err.(*smtp.SMTPError)
+	if !ok {
+		t.Fatalf("SendDSN() error = %#v, want *smtp.SMTPError", err)
+	}
+	if smtpErr.Code != 550 || smtpErr.EnhancedCode != (smtp.EnhancedCode{5, 1, 1}) || smtpErr.Message != "No such user" {
+		t.Errorf("SendDSN() error = %+v", smtpErr)
+	}
+}
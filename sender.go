@@ -0,0 +1,316 @@
+package dsn
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Sender sends DSNs through an SMTP relay like SendDSN. Unlike SendDSN, it
+// buffers every DSN so that it can be sent again unchanged.
+type Sender struct {
+	// Addr is the address of the relay.
+	Addr string
+	// Transport, if set, is used instead of Addr.
+	Transport Transport
+
+	// Generator generates the DSNs, e.g. to set a Profile or Clock. If nil,
+	// a Generator with LoopGuard enabled is used, like SendDSN does. Its
+	// Rand must be safe for concurrent use if Workers is larger than 1.
+	Generator *Generator
+
+	// Workers is the number of DSNs sent concurrently, 1 by default.
+	Workers int
+
+	// MaxPerDomain limits the number of DSNs sent concurrently to the same
+	// destination domain, so that a domain dominating a bounce run does not
+	// get the relay throttled. The DSN of a Job is sent to the
+	// FinalRecipient of each of its Recipients, it counts against all their
+	// domains. 0 means no limit.
+	MaxPerDomain int
+
+	// Attempts is the number of times a DSN is sent before it is given up,
+	// 1 by default. SMTP errors with a 5xx code are not retried.
+	Attempts int
+	// Backoff is the delay between attempts.
+	Backoff Backoff
+
+	// DeadLetter, if set, receives the DSNs that were given up instead of
+	// them being dropped, except those that failed with an ArchiveError or
+	// were suppressed by Generator.LoopGuard. Retries send the message of
+	// the first attempt again, which is the one passed to DeadLetter. If it
+	// fails, the Err of the Result reports both errors.
+	DeadLetter DeadLetterSink
+
+	// send is replaced in tests.
+	send sendFunc
+}
+
+// sendFunc sends the DSN of job. prev is the message handed to the
+// Transport by the previous attempt, it is sent again unchanged instead of
+// generating a new DSN. The message of this attempt is returned, nil if
+// none was generated.
+type sendFunc func(job Job, prev *sentMessage) (*sentMessage, error)
+
+// sentMessage is a message handed to a Transport.
+type sentMessage struct {
+	from string
+	to   []string
+	data []byte
+}
+
+func (m *sentMessage) sendTo(t Transport) error {
+	return t.Send(m.from, m.to, func(w io.Writer) error {
+		_, err := w.Write(m.data)
+		return err
+	})
+}
+
+// recordingTransport keeps the message it sends through Transport.
+type recordingTransport struct {
+	Transport
+	msg *sentMessage
+}
+
+func (t *recordingTransport) Send(from string, to []string, write func(w io.Writer) error) error {
+	var buf bytes.Buffer
+	if err := write(&buf); err != nil {
+		return err
+	}
+	t.msg = &sentMessage{from: from, to: to, data: buf.Bytes()}
+	return t.msg.sendTo(t.Transport)
+}
+
+// sendJob returns the function sending a Job with the Generator and
+// Transport of s. The DSN is generated once, retries send the same message.
+func (s *Sender) sendJob() sendFunc {
+	g := s.Generator
+	if g == nil {
+		g = &Generator{LoopGuard: true}
+	}
+	t := s.Transport
+	if t == nil {
+		t = &NetSMTPTransport{Addr: s.Addr}
+	}
+	return func(job Job, prev *sentMessage) (*sentMessage, error) {
+		if prev != nil {
+			return prev, prev.sendTo(t)
+		}
+		rt := &recordingTransport{Transport: t}
+		err := g.Send(rt, job.UTF8, job.Envelope, job.MTAInfo, job.Recipients, job.FailedHeader)
+		return rt.msg, err
+	}
+}
+
+// SendDSNs sends the DSNs for all jobs received from jobs and sends a Result
+// for each of them to results, only Job and Err are set. Results are sent in
+// no particular order.
+//
+// A worker waiting for a domain at its MaxPerDomain limit does not pick up
+// other jobs, so Workers should be larger than MaxPerDomain.
+//
+// It returns when jobs is closed and all results were sent or when ctx is
+// done, in which case ctx.Err() is returned. results is not closed.
+func (s *Sender) SendDSNs(ctx context.Context, jobs <-chan Job, results chan<- Result) error {
+	workers := s.Workers
+	if workers < 1 {
+		workers = 1
+	}
+	send := s.send
+	if send == nil {
+		send = s.sendJob()
+	}
+	limiter := newDomainLimiter(s.MaxPerDomain)
+
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for {
+				var job Job
+				var ok bool
+				select {
+				case <-ctx.Done():
+					return
+				case job, ok = <-jobs:
+					if !ok {
+						return
+					}
+				}
+
+				domains := recipientDomains(job.Recipients)
+				if err := limiter.acquireAll(ctx, domains); err != nil {
+					return
+				}
+				msg, err := s.sendAttempts(ctx, send, job)
+				limiter.releaseAll(domains)
+				if ctx.Err() != nil {
+					return
+				}
+
+				res := Result{Job: job, Err: err}
+				if err != nil && !isFinal(err) && s.DeadLetter != nil {
+					var data []byte
+					if msg != nil {
+						data = msg.data
+					}
+					if dlErr := s.DeadLetter.DeadLetter(job, data, err); dlErr != nil {
+						res.Err = fmt.Errorf("dsn: dead letter failed: %v (send error: %v)", dlErr, err)
+					}
+				}
+
+				select {
+				case <-ctx.Done():
+					return
+				case results <- res:
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	return ctx.Err()
+}
+
+// sendAttempts sends job until it succeeds, fails permanently or
+// s.Attempts is reached, and returns the message that was attempted. DSNs
+// that were sent but not archived or were suppressed are not retried.
+func (s *Sender) sendAttempts(ctx context.Context, send sendFunc, job Job) (*sentMessage, error) {
+	var msg *sentMessage
+	for attempt := 1; ; attempt++ {
+		sent, err := send(job, msg)
+		if sent != nil {
+			msg = sent
+		}
+		if err == nil || isFinal(err) || isPermanent(err) || attempt >= s.Attempts {
+			return msg, err
+		}
+
+		t := time.NewTimer(s.Backoff.Delay(attempt))
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return msg, ctx.Err()
+		case <-t.C:
+		}
+	}
+}
+
+// isFinal reports whether err ends a job without a DSN to retry or keep:
+// it was sent but not archived, or suppressed.
+func isFinal(err error) bool {
+	switch err.(type) {
+	case *ArchiveError, *SuppressedError:
+		return true
+	}
+	return false
+}
+
+// addressDomain returns the lower-case domain of addr, empty if it has none.
+func addressDomain(addr string) string {
+	i := strings.LastIndexByte(addr, '@')
+	if i < 0 {
+		return ""
+	}
+	return strings.ToLower(strings.TrimSuffix(addr[i+1:], ">"))
+}
+
+// recipientDomains returns the sorted, distinct domains of the
+// FinalRecipients of rcpts, the domains Generator.Send delivers to.
+func recipientDomains(rcpts []RecipientInfo) []string {
+	var domains []string
+	seen := make(map[string]bool)
+	for _, rcpt := range rcpts {
+		domain := addressDomain(rcpt.FinalRecipient)
+		if !seen[domain] {
+			seen[domain] = true
+			domains = append(domains, domain)
+		}
+	}
+	sort.Strings(domains)
+	return domains
+}
+
+// domainLimiter limits the number of concurrent operations per domain.
+type domainLimiter struct {
+	max int
+
+	mu   sync.Mutex
+	sems map[string]*domainSem
+}
+
+type domainSem struct {
+	c    chan struct{}
+	refs int
+}
+
+func newDomainLimiter(max int) *domainLimiter {
+	return &domainLimiter{max: max, sems: make(map[string]*domainSem)}
+}
+
+func (l *domainLimiter) acquire(ctx context.Context, domain string) error {
+	if l.max <= 0 {
+		return nil
+	}
+
+	l.mu.Lock()
+	sem := l.sems[domain]
+	if sem == nil {
+		sem = &domainSem{c: make(chan struct{}, l.max)}
+		l.sems[domain] = sem
+	}
+	sem.refs++
+	l.mu.Unlock()
+
+	select {
+	case sem.c <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		l.unref(domain, sem)
+		return ctx.Err()
+	}
+}
+
+func (l *domainLimiter) release(domain string) {
+	if l.max <= 0 {
+		return
+	}
+
+	l.mu.Lock()
+	sem := l.sems[domain]
+	l.mu.Unlock()
+	<-sem.c
+	l.unref(domain, sem)
+}
+
+// acquireAll acquires all domains. They must be sorted so that two callers
+// sharing several domains cannot block each other.
+func (l *domainLimiter) acquireAll(ctx context.Context, domains []string) error {
+	for i, domain := range domains {
+		if err := l.acquire(ctx, domain); err != nil {
+			l.releaseAll(domains[:i])
+			return err
+		}
+	}
+	return nil
+}
+
+func (l *domainLimiter) releaseAll(domains []string) {
+	for _, domain := range domains {
+		l.release(domain)
+	}
+}
+
+// unref drops the semaphore of domain once it is unused.
+func (l *domainLimiter) unref(domain string, sem *domainSem) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if sem.refs--; sem.refs == 0 {
+		delete(l.sems, domain)
+	}
+}
@@ -0,0 +1,251 @@
+package dsn
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-smtp"
+)
+
+func TestSenderMaxPerDomain(t *testing.T) {
+	var mu sync.Mutex
+	active := make(map[string]int)
+	peak := make(map[string]int)
+	var running, peakRunning int
+
+	s := &Sender{
+		Workers:      8,
+		MaxPerDomain: 2,
+		send: func(job Job, prev *sentMessage) (*sentMessage, error) {
+			domains := recipientDomains(job.Recipients)
+			mu.Lock()
+			for _, domain := range domains {
+				active[domain]++
+				if active[domain] > peak[domain] {
+					peak[domain] = active[domain]
+				}
+			}
+			if running++; running > peakRunning {
+				peakRunning = running
+			}
+			mu.Unlock()
+
+			time.Sleep(10 * time.Millisecond)
+
+			mu.Lock()
+			for _, domain := range domains {
+				active[domain]--
+			}
+			running--
+			mu.Unlock()
+			return nil, nil
+		},
+	}
+
+	jobs := make(chan Job)
+	results := make(chan Result)
+	go func() {
+		for i := 0; i < 20; i++ {
+			rcpts := []RecipientInfo{{FinalRecipient: "rcpt@big.example"}}
+			switch i % 4 {
+			case 0:
+				rcpts = []RecipientInfo{{FinalRecipient: "rcpt@Small.Example"}}
+			case 1:
+				rcpts = append(rcpts, RecipientInfo{FinalRecipient: "other@small.example"})
+			}
+			// The DSN is delivered to the recipients, not to Envelope.To.
+			jobs <- Job{Envelope: Envelope{To: "sender@example.org"}, Recipients: rcpts}
+		}
+		close(jobs)
+	}()
+
+	done := make(chan error, 1)
+	go func() { done <- s.SendDSNs(context.Background(), jobs, results) }()
+	for i := 0; i < 20; i++ {
+		if res := <-results; res.Err != nil {
+			t.Fatal(res.Err)
+		}
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	if peak["big.example"] != 2 {
+		t.Errorf("peak concurrency for big.example = %d, want 2", peak["big.example"])
+	}
+	if peak["small.example"] > 2 {
+		t.Errorf("peak concurrency for small.example = %d, want at most 2", peak["small.example"])
+	}
+	if peakRunning < 3 {
+		t.Errorf("peak concurrency = %d, want more than MaxPerDomain for distinct recipient domains", peakRunning)
+	}
+}
+
+func TestSenderDeadLetter(t *testing.T) {
+	tempErr := &smtp.SMTPError{Code: 451, Message: "Try again\nlater"}
+	permErr := &smtp.SMTPError{Code: 554, Message: "Rejected"}
+
+	var mu sync.Mutex
+	attempts := make(map[string]int)
+	sent := make(map[string][]byte)
+	dir := t.TempDir()
+	s := &Sender{
+		Attempts:   3,
+		Backoff:    Backoff{Initial: time.Millisecond, Jitter: -1},
+		DeadLetter: DeadLetterDir{Dir: dir},
+		Transport: TransportFunc(func(from string, to []string, msg io.Reader) error {
+			b, err := ioutil.ReadAll(msg)
+			if err != nil {
+				return err
+			}
+			h, err := textproto.ReadHeader(bufio.NewReader(bytes.NewReader(b)))
+			if err != nil {
+				return err
+			}
+			id := strings.TrimSuffix(strings.TrimPrefix(h.Get("Message-Id"), "<"), "@example.org>")
+
+			mu.Lock()
+			defer mu.Unlock()
+			if prev, ok := sent[id]; ok && !bytes.Equal(prev, b) {
+				t.Errorf("job %q: retry sent a different message", id)
+			}
+			attempts[id]++
+			sent[id] = b
+			switch id {
+			case "temp":
+				return tempErr
+			case "perm/../1":
+				return permErr
+			case "flaky":
+				if attempts[id] < 2 {
+					return tempErr
+				}
+			}
+			return nil
+		}),
+	}
+
+	jobs := make(chan Job, 3)
+	for _, id := range []string{"temp", "perm/../1", "flaky"} {
+		jobs <- Job{
+			ID:       id,
+			Envelope: Envelope{MsgID: "<" + id + "@example.org>", To: "sender@example.org"},
+			MTAInfo:  ReportingMTAInfo{ReportingMTA: "mx.example.org"},
+			Recipients: []RecipientInfo{{
+				FinalRecipient: "rcpt@example.net",
+				Action:         ActionFailed,
+				Status:         smtp.EnhancedCode{5, 1, 1},
+			}},
+		}
+	}
+	close(jobs)
+	results := make(chan Result, 3)
+	if err := s.SendDSNs(context.Background(), jobs, results); err != nil {
+		t.Fatal(err)
+	}
+	close(results)
+	for res := range results {
+		if (res.Err != nil) != (res.Job.ID != "flaky") {
+			t.Errorf("job %q: error %v", res.Job.ID, res.Err)
+		}
+	}
+
+	wantAttempts := map[string]int{"temp": 3, "perm/../1": 1, "flaky": 2}
+	for id, want := range wantAttempts {
+		if attempts[id] != want {
+			t.Errorf("job %q: %d attempts, want %d", id, attempts[id], want)
+		}
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, fi := range files {
+		names = append(names, fi.Name())
+	}
+	sort.Strings(names)
+	if want := []string{"perm_.._1.eml", "temp.eml"}; !reflect.DeepEqual(names, want) {
+		t.Fatalf("dead letter files %v, want %v", names, want)
+	}
+	b, err := ioutil.ReadFile(filepath.Join(dir, "temp.eml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "X-Dead-Letter-Reason: Try again later\r\n" + string(sent["temp"]); string(b) != want {
+		t.Errorf("dead letter is not the attempted DSN:\n%s\nwant:\n%s", b, want)
+	}
+}
+
+func TestSenderGenerator(t *testing.T) {
+	var mu sync.Mutex
+	var subjects []string
+	transport := TransportFunc(func(from string, to []string, msg io.Reader) error {
+		h, err := textproto.ReadHeader(bufio.NewReader(msg))
+		if err != nil {
+			return err
+		}
+		mu.Lock()
+		subjects = append(subjects, h.Get("Subject"))
+		mu.Unlock()
+		return nil
+	})
+	job := func(id string, failedHeader textproto.Header) Job {
+		return Job{
+			ID:           id,
+			Envelope:     Envelope{To: "sender@example.org"},
+			MTAInfo:      ReportingMTAInfo{ReportingMTA: "mx.example.org"},
+			Recipients:   []RecipientInfo{{FinalRecipient: "rcpt@example.net", Action: ActionFailed, Status: smtp.EnhancedCode{5, 1, 1}}},
+			FailedHeader: failedHeader,
+		}
+	}
+	bounce := textproto.Header{}
+	bounce.Add("Auto-Submitted", "auto-replied")
+
+	run := func(s *Sender) map[string]error {
+		jobs := make(chan Job, 2)
+		jobs <- job("message", textproto.Header{})
+		jobs <- job("bounce", bounce)
+		close(jobs)
+		results := make(chan Result, 2)
+		if err := s.SendDSNs(context.Background(), jobs, results); err != nil {
+			t.Fatal(err)
+		}
+		close(results)
+		errs := make(map[string]error)
+		for res := range results {
+			errs[res.Job.ID] = res.Err
+		}
+		return errs
+	}
+
+	// The default Generator has LoopGuard enabled.
+	errs := run(&Sender{Transport: transport})
+	if errs["message"] != nil {
+		t.Errorf("message: %v", errs["message"])
+	}
+	if _, ok := errs["bounce"].(*SuppressedError); !ok {
+		t.Errorf("bounce: error %v, want SuppressedError", errs["bounce"])
+	}
+
+	subjects = nil
+	errs = run(&Sender{Transport: transport, Generator: NewGenerator(WithSubject("Custom"))})
+	if errs["message"] != nil || errs["bounce"] != nil {
+		t.Errorf("errors %v", errs)
+	}
+	if len(subjects) != 2 || subjects[0] != "Custom" || subjects[1] != "Custom" {
+		t.Errorf("subjects %q, want the subject of the Generator", subjects)
+	}
+}
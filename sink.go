@@ -0,0 +1,98 @@
+package dsn
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/emersion/go-message/textproto"
+)
+
+// DeliveryResult is the outcome of a delivery attempt of a queued message
+// as reported by an MTA.
+type DeliveryResult struct {
+	// QueueID identifies the message across attempts.
+	QueueID string
+	// Sender is the reverse-path of the message, DSNs are sent to it.
+	Sender string
+	// Header is the header of the message, it is returned in DSNs.
+	Header textproto.Header
+	// Recipients maps the attempted recipients to the error of the attempt,
+	// nil if they were delivered.
+	Recipients map[string]error
+}
+
+// DeliverySink lets MTAs mount DSN handling as a module of their delivery
+// pipeline: it is passed the result of every delivery attempt and decides
+// which DSNs are due.
+type DeliverySink interface {
+	Deliver(res DeliveryResult) error
+}
+
+// WorkflowSink is a DeliverySink driving a Workflow. The MessageStates are
+// kept in memory and dropped once all recipients of a message are done, MTAs
+// that need them to survive a restart use Workflow directly.
+type WorkflowSink struct {
+	Workflow *Workflow
+	// Emit is called for every DSN, e.g. to queue it for sending.
+	Emit func(n Notification) error
+
+	mu     sync.Mutex
+	states map[string]*MessageState
+}
+
+// Deliver implements DeliverySink.
+func (s *WorkflowSink) Deliver(res DeliveryResult) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.states == nil {
+		s.states = make(map[string]*MessageState)
+	}
+	st := s.states[res.QueueID]
+	if st == nil {
+		st = &MessageState{Sender: res.Sender}
+		s.states[res.QueueID] = st
+	}
+	addRecipients(st, res.Recipients)
+
+	notes, err := s.Workflow.Record(st, res.Recipients, res.Header)
+	if err != nil {
+		return err
+	}
+	if allDone(st) {
+		delete(s.states, res.QueueID)
+	}
+	for _, n := range notes {
+		if err := s.Emit(n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addRecipients adds the recipients of results that are not in st yet.
+func addRecipients(st *MessageState, results map[string]error) {
+	known := make(map[string]bool, len(st.Recipients))
+	for _, rs := range st.Recipients {
+		known[rs.Recipient] = true
+	}
+	var added []string
+	for rcpt := range results {
+		if !known[rcpt] {
+			added = append(added, rcpt)
+		}
+	}
+	sort.Strings(added)
+	for _, rcpt := range added {
+		st.Recipients = append(st.Recipients, RetryState{Recipient: rcpt})
+	}
+}
+
+func allDone(st *MessageState) bool {
+	for _, rs := range st.Recipients {
+		if !rs.Done {
+			return false
+		}
+	}
+	return true
+}
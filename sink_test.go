@@ -0,0 +1,57 @@
+package dsn_test
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-smtp"
+	dsn "schneider.vip/go-dsn"
+)
+
+// mta is a stand-in for the delivery pipeline of an MTA.
+type mta struct {
+	dsn dsn.DeliverySink
+}
+
+func (m *mta) deliver(queueID string, results map[string]error) {
+	hdr := textproto.Header{}
+	hdr.Add("Subject", "Hello")
+	err := m.dsn.Deliver(dsn.DeliveryResult{
+		QueueID:    queueID,
+		Sender:     "sender@example.org",
+		Header:     hdr,
+		Recipients: results,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func ExampleWorkflowSink() {
+	sink := &dsn.WorkflowSink{
+		Workflow: &dsn.Workflow{
+			MTAInfo: dsn.ReportingMTAInfo{ReportingMTA: "mx.example.org"},
+			Generator: dsn.Generator{
+				Clock: dsn.FixedClock(time.Date(2020, 4, 14, 10, 0, 0, 0, time.UTC)),
+			},
+		},
+		Emit: func(n dsn.Notification) error {
+			// Queue the DSN for sending here.
+			fmt.Println(n.Action, n.Header.Get("To"))
+			return nil
+		},
+	}
+	m := &mta{dsn: sink}
+
+	m.deliver("4AB12", map[string]error{
+		"ok@example.net": nil,
+		"unknown@example.net": &smtp.SMTPError{
+			Code:         550,
+			EnhancedCode: smtp.EnhancedCode{5, 1, 1},
+			Message:      "No such user",
+		},
+	})
+	// Output: failed sender@example.org
+}
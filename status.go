@@ -0,0 +1,85 @@
+package dsn
+
+import (
+	"errors"
+
+	"github.com/emersion/go-smtp"
+)
+
+// NewStatus returns the enhanced status code class.subject.detail as defined
+// by RFC 3463, e.g. NewStatus(5, 1, 1) for a bad destination mailbox.
+func NewStatus(class, subject, detail int) smtp.EnhancedCode {
+	return smtp.EnhancedCode{class, subject, detail}
+}
+
+// StatusFromSMTPError returns the enhanced status code of err if it is or
+// wraps an *smtp.SMTPError. If the error has no enhanced code, the class is
+// derived from the reply code, e.g. 4.0.0 for 451. The zero value is
+// returned for other errors.
+func StatusFromSMTPError(err error) smtp.EnhancedCode {
+	var smtpErr *smtp.SMTPError
+	if !errors.As(err, &smtpErr) {
+		return smtp.EnhancedCode{}
+	}
+	if smtpErr.EnhancedCode[0] > 0 {
+		return smtpErr.EnhancedCode
+	}
+	switch class := smtpErr.Code / 100; class {
+	case 2, 4, 5:
+		return smtp.EnhancedCode{class, 0, 0}
+	}
+	return smtp.EnhancedCode{}
+}
+
+// Status adds the RFC 3463 classification to an enhanced status code, e.g.
+// Status(rcpt.Status).IsPermanent().
+type Status smtp.EnhancedCode
+
+// IsSuccess reports whether s is a 2.X.X code.
+func (s Status) IsSuccess() bool { return s[0] == 2 }
+
+// IsTemporary reports whether s is a 4.X.X code.
+func (s Status) IsTemporary() bool { return s[0] == 4 }
+
+// IsPermanent reports whether s is a 5.X.X code.
+func (s Status) IsPermanent() bool { return s[0] == 5 }
+
+// Subject returns the subject category of s.
+func (s Status) Subject() StatusSubject { return StatusSubject(s[1]) }
+
+// String formats s such as "5.1.1".
+func (s Status) String() string { return statusCode(smtp.EnhancedCode(s)) }
+
+// StatusSubject is the subject category of an enhanced status code as
+// defined by RFC 3463 section 3.
+type StatusSubject int
+
+const (
+	SubjectOther      StatusSubject = 0 // X.0.X Other or Undefined Status
+	SubjectAddressing StatusSubject = 1 // X.1.X Addressing Status
+	SubjectMailbox    StatusSubject = 2 // X.2.X Mailbox Status
+	SubjectMailSystem StatusSubject = 3 // X.3.X Mail System Status
+	SubjectNetwork    StatusSubject = 4 // X.4.X Network and Routing Status
+	SubjectDelivery   StatusSubject = 5 // X.5.X Mail Delivery Protocol Status
+	SubjectContent    StatusSubject = 6 // X.6.X Message Content or Media Status
+	SubjectSecurity   StatusSubject = 7 // X.7.X Security or Policy Status
+)
+
+var subjectNames = [...]string{
+	SubjectOther:      "Other or Undefined Status",
+	SubjectAddressing: "Addressing Status",
+	SubjectMailbox:    "Mailbox Status",
+	SubjectMailSystem: "Mail System Status",
+	SubjectNetwork:    "Network and Routing Status",
+	SubjectDelivery:   "Mail Delivery Protocol Status",
+	SubjectContent:    "Message Content or Media Status",
+	SubjectSecurity:   "Security or Policy Status",
+}
+
+// String returns the RFC 3463 name of s.
+func (s StatusSubject) String() string {
+	if s < 0 || int(s) >= len(subjectNames) {
+		return subjectNames[SubjectOther]
+	}
+	return subjectNames[s]
+}
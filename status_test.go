@@ -0,0 +1,47 @@
+package dsn
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/emersion/go-smtp"
+)
+
+func TestStatusFromSMTPError(t *testing.T) {
+	for _, test := range []struct {
+		err  error
+		want smtp.EnhancedCode
+	}{
+		{&smtp.SMTPError{Code: 550, EnhancedCode: smtp.EnhancedCode{5, 1, 1}}, NewStatus(5, 1, 1)},
+		{fmt.Errorf("rcpt: %w", &smtp.SMTPError{Code: 452, EnhancedCode: smtp.EnhancedCode{4, 2, 2}}), NewStatus(4, 2, 2)},
+		{&smtp.SMTPError{Code: 451, EnhancedCode: smtp.NoEnhancedCode}, NewStatus(4, 0, 0)},
+		{&smtp.SMTPError{Code: 554}, NewStatus(5, 0, 0)},
+		{&smtp.SMTPError{Code: 354}, smtp.EnhancedCode{}},
+		{errors.New("connection refused"), smtp.EnhancedCode{}},
+		{nil, smtp.EnhancedCode{}},
+	} {
+		if got := StatusFromSMTPError(test.err); got != test.want {
+			t.Errorf("StatusFromSMTPError(%v) = %v, want %v", test.err, got, test.want)
+		}
+	}
+}
+
+func TestStatus(t *testing.T) {
+	s := Status(NewStatus(5, 7, 1))
+	if !s.IsPermanent() || s.IsTemporary() || s.IsSuccess() {
+		t.Errorf("%v: wrong class", s)
+	}
+	if s.Subject() != SubjectSecurity {
+		t.Errorf("%v: subject %v, want %v", s, s.Subject(), SubjectSecurity)
+	}
+	if got := s.String(); got != "5.7.1" {
+		t.Errorf("String() = %q", got)
+	}
+	if got := Status(NewStatus(4, 4, 7)).Subject().String(); got != "Network and Routing Status" {
+		t.Errorf("subject name %q", got)
+	}
+	if got := StatusSubject(9).String(); got != "Other or Undefined Status" {
+		t.Errorf("unknown subject name %q", got)
+	}
+}
@@ -0,0 +1,40 @@
+package dsn
+
+import (
+	"io"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-smtp"
+)
+
+// GenerateSuccessDSN generates a DSN confirming the delivery of the message
+// to rcptsInfo at deliveredAt, as requested with NOTIFY=SUCCESS, with
+// DeliveredProfile. RemoteMTA of the recipients should be set to the host
+// that accepted the message.
+//
+// Action is set to ActionDelivered for all recipients and Status to 2.0.0
+// if it is not set. Other statuses than 2.x.x are rejected.
+// mtaInfo.LastAttemptDate is set to deliveredAt unless it is already set.
+func GenerateSuccessDSN(utf8 bool, envelope Envelope, mtaInfo ReportingMTAInfo, rcptsInfo []RecipientInfo, deliveredAt time.Time, failedHeader textproto.Header, outWriter io.Writer) (textproto.Header, error) {
+	return (&Generator{}).GenerateSuccessDSN(utf8, envelope, mtaInfo, rcptsInfo, deliveredAt, failedHeader, outWriter)
+}
+
+// GenerateSuccessDSN is like the GenerateSuccessDSN function but uses the
+// configuration of g. g.Profile is used instead of DeliveredProfile if it is
+// set.
+func (g *Generator) GenerateSuccessDSN(utf8 bool, envelope Envelope, mtaInfo ReportingMTAInfo, rcptsInfo []RecipientInfo, deliveredAt time.Time, failedHeader textproto.Header, outWriter io.Writer) (textproto.Header, error) {
+	delivered := make([]RecipientInfo, len(rcptsInfo))
+	for i, rcpt := range rcptsInfo {
+		rcpt.Action = ActionDelivered
+		if rcpt.Status[0] == 0 {
+			rcpt.Status = smtp.EnhancedCode{2, 0, 0}
+		}
+		delivered[i] = rcpt
+	}
+	if mtaInfo.LastAttemptDate.IsZero() {
+		mtaInfo.LastAttemptDate = deliveredAt
+	}
+
+	return g.withDefaultProfile(DeliveredProfile).Generate(utf8, envelope, mtaInfo, delivered, failedHeader, outWriter)
+}
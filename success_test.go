@@ -0,0 +1,83 @@
+package dsn_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-smtp"
+	dsn "schneider.vip/go-dsn"
+)
+
+func TestGenerateSuccessDSN(t *testing.T) {
+	deliveredAt := time.Date(2020, 4, 14, 10, 0, 0, 0, time.UTC)
+
+	var body bytes.Buffer
+	hdr, err := dsn.GenerateSuccessDSN(false, dsn.Envelope{
+		MsgID: "<success@example.org>",
+		From:  "MAILER-DAEMON@example.org",
+		To:    "sender@example.org",
+	}, dsn.ReportingMTAInfo{ReportingMTA: "mx.example.org"}, []dsn.RecipientInfo{
+		{FinalRecipient: "a@example.net", RemoteMTA: "mx.example.net"},
+	}, deliveredAt, textproto.Header{}, &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := hdr.Get("Subject"); got != dsn.DeliveredProfile.Subject {
+		t.Errorf("Subject = %q", got)
+	}
+	if !strings.Contains(body.String(), "Delivered to a@example.net via mx.example.net") {
+		t.Errorf("body does not contain the recipient line:\n%s", body.String())
+	}
+
+	var msg bytes.Buffer
+	if err := textproto.WriteHeader(&msg, hdr); err != nil {
+		t.Fatal(err)
+	}
+	msg.Write(body.Bytes())
+	report, err := dsn.ParseDSN(&msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rcpt := report.Recipients[0]
+	if rcpt.Action != dsn.ActionDelivered || rcpt.Status != (smtp.EnhancedCode{2, 0, 0}) || rcpt.RemoteMTA != "mx.example.net" {
+		t.Errorf("recipient: Action %v, Status %v, Remote-MTA %q", rcpt.Action, rcpt.Status, rcpt.RemoteMTA)
+	}
+	if !report.MTAInfo.LastAttemptDate.Equal(deliveredAt) {
+		t.Errorf("Last-Attempt-Date = %v, want %v", report.MTAInfo.LastAttemptDate, deliveredAt)
+	}
+
+	_, err = dsn.GenerateSuccessDSN(false, dsn.Envelope{}, dsn.ReportingMTAInfo{ReportingMTA: "mx.example.org"}, []dsn.RecipientInfo{
+		{FinalRecipient: "a@example.net", Status: smtp.EnhancedCode{5, 1, 1}},
+	}, deliveredAt, textproto.Header{}, &body)
+	if err == nil {
+		t.Error("GenerateSuccessDSN() succeeded with a 5.x.x status")
+	}
+}
+
+func TestGenerateDSNDelivered(t *testing.T) {
+	var body bytes.Buffer
+	hdr, err := dsn.GenerateDSN(false, dsn.Envelope{}, dsn.ReportingMTAInfo{ReportingMTA: "mx.example.org"}, []dsn.RecipientInfo{
+		{FinalRecipient: "a@example.net", Action: dsn.ActionDelivered, Status: smtp.EnhancedCode{2, 0, 0}},
+		{FinalRecipient: "b@example.net", Action: dsn.ActionRelayed, Status: smtp.EnhancedCode{2, 0, 0}, RemoteMTA: "gw.example.net"},
+	}, textproto.Header{}, &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := hdr.Get("Subject"); got != dsn.DeliveredProfile.Subject {
+		t.Errorf("Subject = %q, want %q", got, dsn.DeliveredProfile.Subject)
+	}
+	for _, want := range []string{
+		"Delivered to a@example.net\n",
+		"Relayed to b@example.net via gw.example.net\n",
+	} {
+		if !strings.Contains(body.String(), want) {
+			t.Errorf("body does not contain %q:\n%s", want, body.String())
+		}
+	}
+	if strings.Contains(body.String(), "could not be delivered") {
+		t.Errorf("body uses the failure text:\n%s", body.String())
+	}
+}
@@ -0,0 +1,97 @@
+package dsn
+
+import (
+	"fmt"
+	"sync"
+	"text/template"
+)
+
+// TemplateSet compiles the templates for the human-readable part on first
+// use and caches them per language and Action, so that per-instance or
+// localized templates are not parsed for every DSN. Set it as
+// Generator.Templates to use them as RecipientText, they are executed with
+// a RecipientInfo.
+//
+// It is safe for concurrent use. Fields must not be changed after first use,
+// call Invalidate instead when the sources change, e.g. on reload.
+type TemplateSet struct {
+	// Load returns the source of the template for lang and action. lang is
+	// a language tag such as "de" or "" for the default language.
+	Load func(lang string, action Action) (string, error)
+
+	// Funcs are added to every template before parsing.
+	Funcs template.FuncMap
+
+	mu    sync.RWMutex
+	cache map[templateKey]*template.Template
+}
+
+type templateKey struct {
+	lang   string
+	action Action
+}
+
+// Get returns the compiled template for lang and action.
+func (s *TemplateSet) Get(lang string, action Action) (*template.Template, error) {
+	key := templateKey{lang, action}
+
+	s.mu.RLock()
+	t, ok := s.cache[key]
+	s.mu.RUnlock()
+	if ok {
+		return t, nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if t, ok := s.cache[key]; ok {
+		return t, nil
+	}
+
+	text, err := s.Load(lang, action)
+	if err != nil {
+		return nil, fmt.Errorf("dsn: cannot load template for %q/%s: %w", lang, action, err)
+	}
+	t, err = template.New(fmt.Sprintf("%s/%s", lang, action)).Funcs(templateFuncs).Funcs(s.Funcs).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("dsn: cannot parse template for %q/%s: %w", lang, action, err)
+	}
+	if s.cache == nil {
+		s.cache = make(map[templateKey]*template.Template)
+	}
+	s.cache[key] = t
+	return t, nil
+}
+
+// Invalidate drops all compiled templates, they are loaded again on next
+// use.
+func (s *TemplateSet) Invalidate() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cache = nil
+}
+
+// apply returns a copy of p whose RecipientText, and that of its
+// Alternatives, is the template for their Language and action.
+func (s *TemplateSet) apply(p *Profile, action Action) (*Profile, error) {
+	out := *p
+	t, err := s.Get(p.Language, action)
+	if err != nil {
+		return nil, err
+	}
+	out.RecipientText = t
+
+	if len(p.Alternatives) != 0 {
+		out.Alternatives = make([]*Profile, len(p.Alternatives))
+		for i, alt := range p.Alternatives {
+			t, err := s.Get(alt.Language, action)
+			if err != nil {
+				return nil, err
+			}
+			withText := *alt
+			withText.RecipientText = t
+			out.Alternatives[i] = &withText
+		}
+	}
+	return &out, nil
+}
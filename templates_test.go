@@ -0,0 +1,117 @@
+package dsn
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-smtp"
+)
+
+func TestTemplateSet(t *testing.T) {
+	var mu sync.Mutex
+	loads := 0
+	texts := map[string]string{
+		"":   "Delivery to {{.FinalRecipient}} failed",
+		"de": "Zustellung an {{.FinalRecipient}} fehlgeschlagen",
+	}
+	s := &TemplateSet{
+		Load: func(lang string, action Action) (string, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			loads++
+			text, ok := texts[lang]
+			if !ok {
+				return "", errors.New("no such language")
+			}
+			return text, nil
+		},
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := s.Get("de", ActionFailed); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if loads != 1 {
+		t.Errorf("template loaded %d times, want 1", loads)
+	}
+
+	tmpl, err := s.Get("de", ActionFailed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	if err := tmpl.Execute(&b, RecipientInfo{FinalRecipient: "rcpt@example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	if want := "Zustellung an rcpt@example.com fehlgeschlagen"; b.String() != want {
+		t.Errorf("template output %q, want %q", b.String(), want)
+	}
+
+	if _, err := s.Get("fr", ActionFailed); err == nil {
+		t.Error("Get() succeeded for a language without template")
+	}
+
+	texts["de"] = "Neu: {{.FinalRecipient}}"
+	s.Invalidate()
+	tmpl, err = s.Get("de", ActionFailed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Reset()
+	if err := tmpl.Execute(&b, RecipientInfo{FinalRecipient: "rcpt@example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	if want := "Neu: rcpt@example.com"; b.String() != want {
+		t.Errorf("template output after Invalidate %q, want %q", b.String(), want)
+	}
+}
+
+func TestGeneratorTemplates(t *testing.T) {
+	loads := 0
+	text := "Zustellung an {{.FinalRecipient}} fehlgeschlagen\n"
+	s := &TemplateSet{
+		Load: func(lang string, action Action) (string, error) {
+			loads++
+			if lang != "de" || action != ActionFailed {
+				return "", errors.New("no such template")
+			}
+			return text, nil
+		},
+	}
+	g := &Generator{Profile: &Profile{Language: "de"}, Templates: s}
+	rcpts := []RecipientInfo{{FinalRecipient: "rcpt@example.com", Action: ActionFailed, Status: smtp.EnhancedCode{5, 1, 1}}}
+	generate := func() string {
+		t.Helper()
+		var body bytes.Buffer
+		if _, err := g.Generate(false, Envelope{}, ReportingMTAInfo{ReportingMTA: "mx.example.org"}, rcpts, textproto.Header{}, &body); err != nil {
+			t.Fatal(err)
+		}
+		return body.String()
+	}
+
+	for i := 0; i < 2; i++ {
+		if body := generate(); !strings.Contains(body, "Zustellung an rcpt@example.com fehlgeschlagen") {
+			t.Errorf("DSN does not use the template:\n%s", body)
+		}
+	}
+	if loads != 1 {
+		t.Errorf("template loaded %d times, want 1", loads)
+	}
+
+	text = "Neu: {{.FinalRecipient}}\n"
+	s.Invalidate()
+	if body := generate(); !strings.Contains(body, "Neu: rcpt@example.com") {
+		t.Errorf("DSN does not use the reloaded template:\n%s", body)
+	}
+}
@@ -0,0 +1,238 @@
+package dsn
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+
+	"github.com/emersion/go-sasl"
+	gosmtp "github.com/emersion/go-smtp"
+)
+
+// Transport submits messages to a relay.
+type Transport interface {
+	// Send submits a message with the given reverse-path, empty for the
+	// null reverse-path, to the given recipients. write is called once to
+	// write the message. If it fails, the transaction must not be
+	// completed.
+	//
+	// Errors returned by the relay should be *smtp.SMTPError from
+	// github.com/emersion/go-smtp.
+	Send(from string, to []string, write func(w io.Writer) error) error
+}
+
+// NetSMTPTransport is a Transport using the client of the net/smtp package.
+type NetSMTPTransport struct {
+	// Addr is the address of the relay, including the port.
+	Addr string
+	// LocalName is sent in EHLO, it defaults to "localhost".
+	LocalName string
+	// TLSConfig, if set, makes the transport use STARTTLS. Relays that do
+	// not support it are refused then.
+	TLSConfig *tls.Config
+	// Auth, if set, is used to authenticate.
+	Auth smtp.Auth
+}
+
+// Send implements Transport.
+func (t *NetSMTPTransport) Send(from string, to []string, write func(w io.Writer) error) error {
+	c, err := smtp.Dial(t.Addr)
+	if err != nil {
+		return err
+	}
+	// Closing without QUIT aborts an unfinished transaction.
+	defer c.Close()
+
+	if t.LocalName != "" {
+		if err := c.Hello(t.LocalName); err != nil {
+			return toSMTPError(err)
+		}
+	}
+	if t.TLSConfig != nil {
+		if ok, _ := c.Extension("STARTTLS"); !ok {
+			return errors.New("dsn: relay does not support STARTTLS")
+		}
+		if err := c.StartTLS(t.TLSConfig); err != nil {
+			return toSMTPError(err)
+		}
+	}
+	if t.Auth != nil {
+		if err := c.Auth(t.Auth); err != nil {
+			return toSMTPError(err)
+		}
+	}
+
+	if err := c.Mail(from); err != nil {
+		return toSMTPError(err)
+	}
+	for _, rcpt := range to {
+		if err := c.Rcpt(rcpt); err != nil {
+			return toSMTPError(err)
+		}
+	}
+	wr, err := c.Data()
+	if err != nil {
+		return toSMTPError(err)
+	}
+	if err := write(wr); err != nil {
+		return err
+	}
+	if err := wr.Close(); err != nil {
+		return toSMTPError(err)
+	}
+	return toSMTPError(c.Quit())
+}
+
+// toSMTPError converts replies returned by net/smtp to *smtp.SMTPError,
+// with the enhanced status code taken from the text if present.
+func toSMTPError(err error) error {
+	protoErr, ok := err.(*textproto.Error)
+	if !ok {
+		return err
+	}
+
+	smtpErr := &gosmtp.SMTPError{
+		Code:         protoErr.Code,
+		EnhancedCode: gosmtp.NoEnhancedCode,
+		Message:      protoErr.Msg,
+	}
+	if fields := strings.SplitN(protoErr.Msg, " ", 2); len(fields) == 2 {
+		if code, err := parseEnhancedCode(fields[0]); err == nil && code[0] == protoErr.Code/100 {
+			smtpErr.EnhancedCode = code
+			smtpErr.Message = fields[1]
+		}
+	}
+	return smtpErr
+}
+
+// GoSMTPTransport is a Transport using the client of
+// github.com/emersion/go-smtp.
+type GoSMTPTransport struct {
+	// Addr is the address of the relay, including the port.
+	Addr string
+	// LocalName is sent in EHLO or LHLO, it defaults to "localhost".
+	LocalName string
+
+	// LMTP makes the transport speak LMTP (RFC 2033). If a recipient
+	// rejects the message, the error of the first one is returned, even
+	// though other recipients may have accepted it.
+	LMTP bool
+
+	// TLSConfig, if set, makes the transport use STARTTLS. Relays that do
+	// not support it are refused then.
+	TLSConfig *tls.Config
+	// Auth, if set, is used to authenticate.
+	Auth sasl.Client
+
+	// MailOptions are passed to the MAIL command, e.g. UTF8 for SMTPUTF8 or
+	// RequireTLS. DSN parameters (RFC 3461) are never sent: a DSN has the
+	// null reverse-path, so no notification could be returned for it.
+	MailOptions gosmtp.MailOptions
+}
+
+// Send implements Transport.
+func (t *GoSMTPTransport) Send(from string, to []string, write func(w io.Writer) error) error {
+	host, _, err := net.SplitHostPort(t.Addr)
+	if err != nil {
+		return err
+	}
+	conn, err := net.Dial("tcp", t.Addr)
+	if err != nil {
+		return err
+	}
+	var c *gosmtp.Client
+	if t.LMTP {
+		c, err = gosmtp.NewClientLMTP(conn, host)
+	} else {
+		c, err = gosmtp.NewClient(conn, host)
+	}
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	// Closing without QUIT aborts an unfinished transaction.
+	defer c.Close()
+
+	if t.LocalName != "" {
+		if err := c.Hello(t.LocalName); err != nil {
+			return err
+		}
+	}
+	if t.TLSConfig != nil {
+		if ok, _ := c.Extension("STARTTLS"); !ok {
+			return errors.New("dsn: relay does not support STARTTLS")
+		}
+		if err := c.StartTLS(t.TLSConfig); err != nil {
+			return err
+		}
+	}
+	if t.Auth != nil {
+		if err := c.Auth(t.Auth); err != nil {
+			return err
+		}
+	}
+
+	opts := t.MailOptions
+	if err := c.Mail(from, &opts); err != nil {
+		return err
+	}
+	for _, rcpt := range to {
+		if err := c.Rcpt(rcpt); err != nil {
+			return err
+		}
+	}
+
+	var rcptErr error
+	var wr io.WriteCloser
+	if t.LMTP {
+		wr, err = c.LMTPData(func(rcpt string, status *gosmtp.SMTPError) {
+			if status != nil && rcptErr == nil {
+				rcptErr = status
+			}
+		})
+	} else {
+		wr, err = c.Data()
+	}
+	if err != nil {
+		return err
+	}
+	if err := write(wr); err != nil {
+		return err
+	}
+	if err := wr.Close(); err != nil {
+		return err
+	}
+	if rcptErr != nil {
+		return rcptErr
+	}
+	return c.Quit()
+}
+
+// TransportFunc adapts a function sending complete messages to Transport,
+// e.g. to dispatch DSNs through the sender of another mail library:
+//
+//	dsn.TransportFunc(func(from string, to []string, msg io.Reader) error {
+//		m, err := mail.EMLToMsgFromReader(msg) // github.com/wneessen/go-mail
+//		if err != nil {
+//			return err
+//		}
+//		...
+//		return client.DialAndSend(m)
+//	})
+//
+// The message is generated into memory before the function is called.
+type TransportFunc func(from string, to []string, msg io.Reader) error
+
+// Send implements Transport.
+func (f TransportFunc) Send(from string, to []string, write func(w io.Writer) error) error {
+	var buf bytes.Buffer
+	if err := write(&buf); err != nil {
+		return err
+	}
+	return f(from, to, &buf)
+}
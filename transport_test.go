@@ -0,0 +1,136 @@
+package dsn_test
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-smtp"
+	dsn "schneider.vip/go-dsn"
+	"schneider.vip/go-dsn/dsntest"
+)
+
+func sendTestDSN(t dsn.Transport, utf8 bool, rcpts ...string) error {
+	var infos []dsn.RecipientInfo
+	for _, rcpt := range rcpts {
+		infos = append(infos, dsn.RecipientInfo{
+			FinalRecipient: rcpt,
+			Action:         dsn.ActionFailed,
+			Status:         smtp.EnhancedCode{5, 1, 1},
+		})
+	}
+	g := &dsn.Generator{}
+	return g.Send(t, utf8, dsn.Envelope{MsgID: "<msgid@example.com>", To: "sender@example.com"}, dsn.ReportingMTAInfo{ReportingMTA: "mx.example.com"}, infos, textproto.Header{})
+}
+
+func TestGoSMTPTransport(t *testing.T) {
+	t.Run("SMTPUTF8 and STARTTLS", func(t *testing.T) {
+		srv := &dsntest.Server{StartTLS: true}
+		if err := srv.Start(); err != nil {
+			t.Fatal(err)
+		}
+		defer srv.Close()
+
+		tr := &dsn.GoSMTPTransport{
+			Addr:        srv.Addr,
+			TLSConfig:   srv.ClientTLSConfig(),
+			MailOptions: smtp.MailOptions{UTF8: true},
+		}
+		if err := sendTestDSN(tr, true, "пользователь@example.com"); err != nil {
+			t.Fatal(err)
+		}
+		msgs := srv.Transactions()
+		if len(msgs) != 1 {
+			t.Fatalf("server received %d messages, want 1", len(msgs))
+		}
+		if !msgs[0].MailOpts.UTF8 || msgs[0].From != "" {
+			t.Errorf("MAIL from %q with options %+v", msgs[0].From, msgs[0].MailOpts)
+		}
+		if !strings.Contains(string(msgs[0].Data), "message/global-delivery-status") {
+			t.Errorf("message is not a utf8 DSN:\n%s", msgs[0].Data)
+		}
+	})
+
+	t.Run("LMTP", func(t *testing.T) {
+		rejected := &smtp.SMTPError{Code: 552, EnhancedCode: smtp.EnhancedCode{5, 2, 2}, Message: "Mailbox full"}
+		srv := &dsntest.Server{
+			LMTP:   true,
+			Script: []dsntest.Rule{{Command: "DATA", Rcpt: "full@example.com", Err: rejected}},
+		}
+		if err := srv.Start(); err != nil {
+			t.Fatal(err)
+		}
+		defer srv.Close()
+
+		tr := &dsn.GoSMTPTransport{Addr: srv.Addr, LMTP: true}
+		if err := sendTestDSN(tr, false, "ok@example.com"); err != nil {
+			t.Fatal(err)
+		}
+		err := sendTestDSN(tr, false, "ok@example.com", "full@example.com")
+		if smtpErr, ok := err.(*smtp.SMTPError); !ok || smtpErr.Code != 552 {
+			t.Errorf("Send() error = %v, want the LMTP status of full@example.com", err)
+		}
+		if got := len(srv.Transactions()); got != 2 {
+			t.Errorf("server delivered %d messages, want 2", got)
+		}
+	})
+}
+
+func TestTransportFunc(t *testing.T) {
+	var gotFrom string
+	var gotTo []string
+	var report *dsn.Report
+	tr := dsn.TransportFunc(func(from string, to []string, msg io.Reader) error {
+		gotFrom, gotTo = from, to
+		var err error
+		report, err = dsn.ParseDSN(msg)
+		return err
+	})
+	if err := sendTestDSN(tr, false, "rcpt@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if gotFrom != "" || len(gotTo) != 1 || gotTo[0] != "rcpt@example.com" {
+		t.Errorf("envelope from %q to %q", gotFrom, gotTo)
+	}
+	if report.Envelope.MsgID != "<msgid@example.com>" || len(report.Recipients) != 1 {
+		t.Errorf("parsed report %+v", report)
+	}
+}
+
+func TestArchiveTransport(t *testing.T) {
+	srv := dsntest.NewServer(t)
+	var archived [][]byte
+	tr := &dsn.ArchiveTransport{
+		Transport: &dsn.NetSMTPTransport{Addr: srv.Addr},
+		Archive: func(msg []byte) error {
+			archived = append(archived, append([]byte(nil), msg...))
+			return nil
+		},
+	}
+	if err := sendTestDSN(tr, false, "rcpt@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	msgs := srv.Transactions()
+	if len(msgs) != 1 || len(archived) != 1 || string(archived[0]) != string(msgs[0].Data) {
+		t.Fatalf("sent %d and archived %d messages, want the same one", len(msgs), len(archived))
+	}
+
+	tr.Archive = func(msg []byte) error { return errors.New("folder does not exist") }
+	if _, ok := sendTestDSN(tr, false, "rcpt@example.com").(*dsn.ArchiveError); !ok {
+		t.Error("archive failure is not reported as ArchiveError")
+	}
+
+	tr.Transport = nil
+	tr.Archive = func(msg []byte) error {
+		archived = append(archived, msg)
+		return nil
+	}
+	if err := sendTestDSN(tr, false, "rcpt@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if len(archived) != 2 || len(srv.Transactions()) != 2 {
+		t.Errorf("archive only: archived %d, sent %d messages", len(archived), len(srv.Transactions()))
+	}
+}
@@ -0,0 +1,244 @@
+package dsn
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-smtp"
+)
+
+// DefaultDelayedSubject is the subject of delayed DSNs, see DelayedProfile
+// and Workflow.
+const DefaultDelayedSubject = "Delayed Mail (still being retried)"
+
+// Workflow implements the usual delay-then-fail handling of a queued
+// message: once delivery to a recipient was retried for Scheduler.WarnAfter
+// a delayed DSN with Will-Retry-Until is generated, once delivery was given
+// up a failed DSN referencing the earlier warning is generated.
+//
+// All state is kept in MessageState, which the caller persists between
+// attempts.
+type Workflow struct {
+	Scheduler Scheduler
+	Generator Generator
+
+	// MTAInfo is used for all DSNs.
+	MTAInfo ReportingMTAInfo
+
+	// From is the From field of the DSNs, it defaults to
+	// MAILER-DAEMON@<MTAInfo.ReportingMTA>.
+	From string
+	// DelayedSubject, if set, overrides the subject of delayed DSNs, see
+	// WithSubject. The profile selects DefaultDelayedSubject otherwise.
+	DelayedSubject string
+
+	// Policy, if set, decides for every recipient whether and how it is
+	// reported.
+	Policy NotifyPolicy
+}
+
+// MessageState is the delivery state of a queued message.
+type MessageState struct {
+	// Sender is the address DSNs are sent to.
+	Sender     string
+	Recipients []RetryState
+
+	// WarningMessageID is the Message-Id of the delayed DSN, if one was
+	// generated.
+	WarningMessageID string
+}
+
+// Notification is a DSN generated by Workflow.
+type Notification struct {
+	// Action is ActionDelayed or ActionFailed.
+	Action Action
+	Header textproto.Header
+	Body   []byte
+}
+
+// WriteTo writes the complete message, e.g. to hand it to a mail library
+// that imports messages from a reader.
+func (n Notification) WriteTo(w io.Writer) (int64, error) {
+	cw := &countWriter{w: w}
+	if err := textproto.WriteHeader(cw, n.Header); err != nil {
+		return cw.n, err
+	}
+	_, err := cw.Write(n.Body)
+	return cw.n, err
+}
+
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countWriter) Write(b []byte) (int, error) {
+	n, err := cw.w.Write(b)
+	cw.n += int64(n)
+	return n, err
+}
+
+// Record records the results of a delivery attempt and returns the DSNs to
+// send, if any. results maps the attempted recipients to the error of the
+// attempt, nil if they were delivered.
+func (w *Workflow) Record(st *MessageState, results map[string]error, failedHeader textproto.Header) ([]Notification, error) {
+	var delayed, failed []RecipientInfo
+	for i := range st.Recipients {
+		rs := &st.Recipients[i]
+		err, ok := results[rs.Recipient]
+		if rs.Done || !ok {
+			continue
+		}
+
+		switch w.Scheduler.Record(rs, err) {
+		case DecisionWarn:
+			delayed = append(delayed, RecipientInfo{
+				FinalRecipient: rs.Recipient,
+				Action:         ActionDelayed,
+				Status:         attemptStatus(err, ActionDelayed),
+				DiagnosticCode: err,
+				WillRetryUntil: w.Scheduler.RetryUntil(rs),
+				Metadata:       rs.Metadata,
+			})
+		case DecisionFail:
+			failed = append(failed, RecipientInfo{
+				FinalRecipient: rs.Recipient,
+				Action:         ActionFailed,
+				Status:         attemptStatus(err, ActionFailed),
+				DiagnosticCode: err,
+				Metadata:       rs.Metadata,
+			})
+		}
+	}
+
+	var notes []Notification
+	for _, g := range w.group(st, append(delayed, failed...), failedHeader) {
+		header := failedHeader
+		if g.downgrade {
+			header = textproto.Header{}
+		}
+		n, err := w.generate(st, g.action, g.to, g.rcpts, header)
+		if err != nil {
+			return nil, err
+		}
+		if g.action == ActionDelayed && g.to == st.Sender {
+			st.WarningMessageID = n.Header.Get("Message-Id")
+		}
+		notes = append(notes, n)
+	}
+	return notes, nil
+}
+
+// notifyGroup is a set of recipients reported in the same DSN.
+type notifyGroup struct {
+	action    Action
+	to        string
+	downgrade bool
+	rcpts     []RecipientInfo
+}
+
+// group applies the policy to rcpts and groups them by DSN, in the order of
+// rcpts.
+func (w *Workflow) group(st *MessageState, rcpts []RecipientInfo, failedHeader textproto.Header) []*notifyGroup {
+	var groups []*notifyGroup
+	for _, rcpt := range rcpts {
+		key := notifyGroup{action: rcpt.Action, to: st.Sender}
+		if w.Policy != nil {
+			d := w.Policy.Notify(NotifyRequest{Sender: st.Sender, Header: failedHeader, Recipient: rcpt})
+			switch d.Action {
+			case NotifySuppress:
+				continue
+			case NotifyRedirect:
+				key.to = d.To
+			case NotifyDowngrade:
+				key.downgrade = true
+			}
+		}
+
+		var g *notifyGroup
+		for _, other := range groups {
+			if other.action == key.action && other.to == key.to && other.downgrade == key.downgrade {
+				g = other
+				break
+			}
+		}
+		if g == nil {
+			g = &key
+			groups = append(groups, g)
+		}
+		g.rcpts = append(g.rcpts, rcpt)
+	}
+	return groups
+}
+
+func (w *Workflow) generate(st *MessageState, action Action, to string, rcpts []RecipientInfo, failedHeader textproto.Header) (Notification, error) {
+	from := w.From
+	if from == "" {
+		from = "MAILER-DAEMON@" + w.MTAInfo.ReportingMTA
+	}
+	envelope := Envelope{
+		From: from,
+		To:   to,
+	}
+	if w.Generator.MessageID == nil {
+		id, err := randomHex(w.Generator.Rand, 16)
+		if err != nil {
+			return Notification{}, err
+		}
+		envelope.MsgID = "<" + id + "@" + w.MTAInfo.ReportingMTA + ">"
+	}
+
+	if action != ActionDelayed && st.WarningMessageID != "" {
+		envelope.Header = threadWarning(failedHeader, st.WarningMessageID)
+	}
+
+	g := w.Generator
+	if action == ActionDelayed && w.DelayedSubject != "" {
+		WithSubject(w.DelayedSubject)(&g)
+	}
+
+	var body bytes.Buffer
+	var h textproto.Header
+	var err error
+	if action == ActionDelayed {
+		h, err = g.GenerateDelayWarning(false, envelope, w.MTAInfo, rcpts, time.Time{}, failedHeader, &body)
+	} else {
+		h, err = g.Generate(false, envelope, w.MTAInfo, rcpts, failedHeader, &body)
+	}
+	if err != nil {
+		return Notification{}, err
+	}
+	return Notification{Action: action, Header: h, Body: body.Bytes()}, nil
+}
+
+// threadWarning returns the In-Reply-To and References fields of a failed
+// DSN replying to the delayed DSN warningID: the References of the failed
+// message are kept and extended with its Message-Id and warningID.
+func threadWarning(failedHeader textproto.Header, warningID string) textproto.Header {
+	references := strings.Fields(failedHeader.Get("References"))
+	if msgID := strings.TrimSpace(failedHeader.Get("Message-Id")); msgID != "" {
+		references = append(references, msgID)
+	}
+	references = append(references, warningID)
+
+	h := textproto.Header{}
+	h.Add("References", strings.Join(references, " "))
+	h.Add("In-Reply-To", warningID)
+	return h
+}
+
+// attemptStatus returns the status for a recipient whose last attempt
+// failed with err.
+func attemptStatus(err error, action Action) smtp.EnhancedCode {
+	if code := StatusFromSMTPError(err); code[0] != 0 {
+		return code
+	}
+	if action == ActionFailed {
+		// Other errors are temporary, so delivery time expired.
+		return smtp.EnhancedCode{4, 4, 7}
+	}
+	return smtp.EnhancedCode{4, 0, 0}
+}
@@ -0,0 +1,184 @@
+package dsn
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"text/template"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-smtp"
+)
+
+func TestWorkflow(t *testing.T) {
+	start := time.Date(2020, 4, 14, 10, 0, 0, 0, time.UTC)
+	clock := &stepClock{now: start}
+	w := &Workflow{
+		Scheduler: Scheduler{
+			Backoff:   Backoff{Initial: time.Hour, Max: time.Hour, Jitter: -1},
+			WarnAfter: 2 * time.Hour,
+			Lifetime:  4 * time.Hour,
+			Clock:     clock,
+		},
+		Generator: Generator{Clock: clock},
+		MTAInfo:   ReportingMTAInfo{ReportingMTA: "mx.example.org"},
+	}
+	st := &MessageState{
+		Sender:     "sender@example.org",
+		Recipients: []RetryState{{Recipient: "slow@example.net"}, {Recipient: "ok@example.net"}},
+	}
+	failedHeader := textproto.Header{}
+	failedHeader.Add("Subject", "test")
+	failedHeader.Add("Message-Id", "<msg@example.org>")
+	failedHeader.Add("References", "<parent@example.org>")
+
+	tempErr := errors.New("connection timed out")
+	var notes []Notification
+	for hour := 0; hour <= 4; hour++ {
+		clock.now = start.Add(time.Duration(hour) * time.Hour)
+		results := map[string]error{"slow@example.net": tempErr}
+		if hour == 0 {
+			results["ok@example.net"] = &smtp.SMTPError{Code: 451, Message: "Greylisted"}
+		}
+		if hour == 1 {
+			results["ok@example.net"] = nil
+		}
+		n, err := w.Record(st, results, failedHeader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		notes = append(notes, n...)
+	}
+
+	if len(notes) != 2 || notes[0].Action != ActionDelayed || notes[1].Action != ActionFailed {
+		t.Fatalf("got %d notifications: %+v", len(notes), notes)
+	}
+	delayed, failed := notes[0], notes[1]
+	if got := delayed.Header.Get("Subject"); got != DefaultDelayedSubject {
+		t.Errorf("delayed Subject = %q", got)
+	}
+	wantUntil := "Will-Retry-Until: " + start.Add(4*time.Hour).Format(timeLayout)
+	if !bytes.Contains(delayed.Body, []byte(wantUntil)) {
+		t.Errorf("delayed DSN does not contain %q:\n%s", wantUntil, delayed.Body)
+	}
+	if bytes.Contains(delayed.Body, []byte("ok@example.net")) {
+		t.Error("delayed DSN lists a delivered recipient")
+	}
+
+	warningID := delayed.Header.Get("Message-Id")
+	if warningID == "" || st.WarningMessageID != warningID {
+		t.Errorf("WarningMessageID = %q, Message-Id of warning %q", st.WarningMessageID, warningID)
+	}
+	if got := failed.Header.Get("In-Reply-To"); got != warningID {
+		t.Errorf("failed DSN In-Reply-To = %q, want %q", got, warningID)
+	}
+	if got, want := failed.Header.Get("References"), "<parent@example.org> <msg@example.org> "+warningID; got != want {
+		t.Errorf("failed DSN References = %q, want %q", got, want)
+	}
+	if !bytes.Contains(failed.Body, []byte("Status: 4.4.7")) {
+		t.Errorf("failed DSN does not contain Status 4.4.7:\n%s", failed.Body)
+	}
+	if got := failed.Header.Get("To"); got != "sender@example.org" {
+		t.Errorf("failed DSN To = %q", got)
+	}
+}
+
+func TestNotificationWriteTo(t *testing.T) {
+	h := textproto.Header{}
+	h.Add("Subject", "Delivery Status Notification")
+	n := Notification{Action: ActionFailed, Header: h, Body: []byte("body\r\n")}
+
+	var buf bytes.Buffer
+	written, err := n.WriteTo(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "Subject: Delivery Status Notification\r\n\r\nbody\r\n"
+	if buf.String() != want || written != int64(len(want)) {
+		t.Errorf("WriteTo() wrote %d bytes %q, want %q", written, buf.String(), want)
+	}
+}
+
+func TestWorkflowPolicy(t *testing.T) {
+	w := &Workflow{
+		MTAInfo: ReportingMTAInfo{ReportingMTA: "mx.example.org"},
+		Policy: NotifyPolicyFunc(func(req NotifyRequest) NotifyDecision {
+			if req.Header.Get("List-Id") == "" || req.Recipient.Status[0] != 5 {
+				return NotifyDecision{}
+			}
+			switch req.Recipient.FinalRecipient {
+			case "gone@example.net":
+				return NotifyDecision{Action: NotifySuppress}
+			case "private@example.net":
+				return NotifyDecision{Action: NotifyDowngrade}
+			}
+			return NotifyDecision{Action: NotifyRedirect, To: "list-owner@example.org"}
+		}),
+	}
+	st := &MessageState{Sender: "list@example.org"}
+	results := make(map[string]error)
+	for _, rcpt := range []string{"a@example.net", "gone@example.net", "private@example.net", "b@example.net"} {
+		st.Recipients = append(st.Recipients, RetryState{Recipient: rcpt})
+		results[rcpt] = &smtp.SMTPError{Code: 550, EnhancedCode: smtp.EnhancedCode{5, 1, 1}, Message: "No such user"}
+	}
+	failedHeader := textproto.Header{}
+	failedHeader.Add("List-Id", "<list.example.org>")
+
+	notes, err := w.Record(st, results, failedHeader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(notes) != 2 {
+		t.Fatalf("got %d notifications, want 2", len(notes))
+	}
+	redirected, downgraded := notes[0], notes[1]
+	if got := redirected.Header.Get("To"); got != "list-owner@example.org" {
+		t.Errorf("redirected DSN To = %q", got)
+	}
+	if !bytes.Contains(redirected.Body, []byte("b@example.net")) || bytes.Contains(redirected.Body, []byte("gone@example.net")) {
+		t.Errorf("redirected DSN does not list the expected recipients:\n%s", redirected.Body)
+	}
+	if got := downgraded.Header.Get("To"); got != "list@example.org" {
+		t.Errorf("downgraded DSN To = %q", got)
+	}
+	if bytes.Contains(downgraded.Body, []byte("List-Id")) || !bytes.Contains(redirected.Body, []byte("List-Id")) {
+		t.Errorf("downgraded DSN contains the message header:\n%s", downgraded.Body)
+	}
+}
+
+func TestWorkflowDelayedSubject(t *testing.T) {
+	delayed := func(w *Workflow) Notification {
+		t.Helper()
+		clock := &stepClock{now: time.Date(2020, 4, 14, 10, 0, 0, 0, time.UTC)}
+		w.Scheduler = Scheduler{WarnAfter: time.Hour, Clock: clock}
+		w.MTAInfo = ReportingMTAInfo{ReportingMTA: "mx.example.org"}
+		st := &MessageState{Sender: "sender@example.org", Recipients: []RetryState{{Recipient: "rcpt@example.net"}}}
+		results := map[string]error{"rcpt@example.net": errors.New("connection timed out")}
+		for i := 0; i < 3; i++ {
+			clock.now = clock.now.Add(time.Hour)
+			notes, err := w.Record(st, results, textproto.Header{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(notes) == 1 {
+				return notes[0]
+			}
+		}
+		t.Fatal("no delayed DSN generated")
+		return Notification{}
+	}
+
+	n := delayed(&Workflow{DelayedSubject: "Zustellung verzögert"})
+	if got, want := n.Header.Get("Subject"), "=?utf-8?q?Zustellung_verz=C3=B6gert?="; got != want {
+		t.Errorf("Subject = %q, want %q", got, want)
+	}
+
+	p := &Profile{Subjects: map[Action]*template.Template{
+		ActionDelayed: template.Must(template.New("").Parse("Delayed at {{.ReportingMTA}}")),
+	}}
+	n = delayed(&Workflow{Generator: Generator{Profile: p}})
+	if got, want := n.Header.Get("Subject"), "Delayed at mx.example.org"; got != want {
+		t.Errorf("Subject = %q, want %q", got, want)
+	}
+}